@@ -0,0 +1,47 @@
+package common
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+)
+
+// StartOpenTelemetry registers an OTLP/HTTP trace exporter when OTEL_EXPORTER_OTLP_ENDPOINT is set.
+// The exporter itself reads the standard OTEL_EXPORTER_OTLP_* variables (headers, protocol, timeout).
+// The returned shutdown flushes the batched spans, it is nil when no exporter was registered.
+func StartOpenTelemetry() (shutdown func(context.Context) error, err error) {
+	otlpEndpoint := GetEnvOrDefaultString("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	if otlpEndpoint == "" {
+		otlpEndpoint = GetEnvOrDefaultString("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	}
+	if otlpEndpoint == "" {
+		return nil, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	serviceName := GetEnvOrDefaultString("OTEL_SERVICE_NAME", "new-api")
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(Version),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
@@ -19,6 +19,7 @@ const (
 	ContextKeyTokenModelLimitEnabled ContextKey = "token_model_limit_enabled"
 	ContextKeyTokenModelLimit        ContextKey = "token_model_limit"
 	ContextKeyTokenCrossGroupRetry   ContextKey = "token_cross_group_retry"
+	ContextKeyTokenProviderKey       ContextKey = "token_provider_key_enabled"
 
 	/* channel related keys */
 	ContextKeyChannelId                ContextKey = "channel_id"
@@ -63,6 +64,94 @@ const (
 	// It is not returned to end users, but can be persisted into consume/error logs for debugging.
 	ContextKeyAdminRejectReason ContextKey = "admin_reject_reason"
 
+	// ContextKeyGeminiThinkingSummary stores the requested thought summary verbosity (concise/none) for Gemini responses
+	ContextKeyGeminiThinkingSummary ContextKey = "gemini_thinking_summary"
+
+	// ContextKeyGeminiStreamResponseSchema stores the translated response schema checked against the assembled stream output
+	ContextKeyGeminiStreamResponseSchema ContextKey = "gemini_stream_response_schema"
+
+	// ContextKeyGeminiMixedModalities marks that the client asked for several response modalities, content is returned as ordered blocks
+	ContextKeyGeminiMixedModalities ContextKey = "gemini_mixed_modalities"
+
+	// ContextKeyGeminiIncludeSafetyRatings marks that the client asked for candidates' safety ratings in the response
+	ContextKeyGeminiIncludeSafetyRatings ContextKey = "gemini_include_safety_ratings"
+
+	// ContextKeyGeminiEmbeddingInputTokens stores the locally counted prompt tokens of each batch embedding input
+	ContextKeyGeminiEmbeddingInputTokens ContextKey = "gemini_embedding_input_tokens"
+
+	// ContextKeyGeminiEmbeddingDimensions stores the requested embedding dimensions used to truncate and re-normalize vectors
+	ContextKeyGeminiEmbeddingDimensions ContextKey = "gemini_embedding_dimensions"
+
+	// ContextKeyGeminiEmbeddingFailures stores the per-index error messages of batch embedding inputs that failed individually
+	ContextKeyGeminiEmbeddingFailures ContextKey = "gemini_embedding_failures"
+
+	// ContextKeyGeminiImageIdempotencyHit marks an image request served from the idempotency cache
+	ContextKeyGeminiImageIdempotencyHit ContextKey = "gemini_image_idempotency_hit"
+
+	// ContextKeyGeminiImageIdempotencyKey stores the idempotency cache key of an image request, scoped by the request body
+	ContextKeyGeminiImageIdempotencyKey ContextKey = "gemini_image_idempotency_key"
+
+	// ContextKeyGeminiSeed stores the effective generationConfig.seed so it can be echoed in system_fingerprint
+	ContextKeyGeminiSeed ContextKey = "gemini_seed"
+
+	// ContextKeyGeminiStreamFanOutN stores n when a streamed n>1 request is fanned out into n non-stream requests
+	ContextKeyGeminiStreamFanOutN ContextKey = "gemini_stream_fan_out_n"
+
+	// ContextKeyGeminiStreamFanOutBodies stores the upstream bodies collected by the stream fan-out
+	ContextKeyGeminiStreamFanOutBodies ContextKey = "gemini_stream_fan_out_bodies"
+
+	// ContextKeyGeminiInFlightDedupHit marks a request served by an identical in-flight Gemini request
+	ContextKeyGeminiInFlightDedupHit ContextKey = "gemini_in_flight_dedup_hit"
+
+	// ContextKeyGeminiStreamFirstTokenMs stores the latency in milliseconds between request start and the first emitted Gemini stream chunk
+	ContextKeyGeminiStreamFirstTokenMs ContextKey = "gemini_stream_first_token_ms"
+
+	// ContextKeyGeminiStreamDurationMs stores the total duration in milliseconds of a Gemini stream
+	ContextKeyGeminiStreamDurationMs ContextKey = "gemini_stream_duration_ms"
+
+	// ContextKeyGeminiContextOverflowFrom stores the original upstream model when a request was upgraded to a larger context model
+	ContextKeyGeminiContextOverflowFrom ContextKey = "gemini_context_overflow_from"
+
+	// ContextKeyGeminiTraceContext stores the context carrying the gemini.request span, the stage spans are its children
+	ContextKeyGeminiTraceContext ContextKey = "gemini_trace_context"
+
+	// ContextKeyGeminiUpstreamTraceContext stores the context carrying the current upstream span, injected into the upstream headers
+	ContextKeyGeminiUpstreamTraceContext ContextKey = "gemini_upstream_trace_context"
+
+	// ContextKeyGeminiFinishReasons stores the distinct upstream finish reasons recorded on the response span
+	ContextKeyGeminiFinishReasons ContextKey = "gemini_finish_reasons"
+
+	// ContextKeyGeminiRequestCompressed marks that the current upstream request body is gzip compressed
+	ContextKeyGeminiRequestCompressed ContextKey = "gemini_request_compressed"
+
+	// ContextKeyGeminiRerankRequest holds the original rerank request while it is emulated with generateContent
+	ContextKeyGeminiRerankRequest ContextKey = "gemini_rerank_request"
+
+	// ContextKeyGeminiUploadedFiles maps the channel, key and content hash of media uploaded to the Gemini File API during the request to its file URI
+	ContextKeyGeminiUploadedFiles ContextKey = "gemini_uploaded_files"
+
+	// ContextKeyGeminiSpeechFormat holds the response_format of an audio/speech request served by Gemini TTS
+	ContextKeyGeminiSpeechFormat ContextKey = "gemini_speech_format"
+
+	// ContextKeyGeminiAudioOutputFormat holds the format of message.audio when a chat request asked for audio output
+	ContextKeyGeminiAudioOutputFormat ContextKey = "gemini_audio_output_format"
+
+	// ContextKeyGeminiTranscriptionRequest holds the response_format and language of an audio/transcriptions request
+	ContextKeyGeminiTranscriptionRequest ContextKey = "gemini_transcription_request"
+
+	// ContextKeyGeminiFinalTurnParts holds how many parts of the last Gemini content come from the final chat message,
+	// the rest were merged into it from earlier messages of the same role
+	ContextKeyGeminiFinalTurnParts ContextKey = "gemini_final_turn_parts"
+
+	// ContextKeyGeminiPromptCache holds what a cachedContent replaced in the request, used to recreate an expired cache
+	ContextKeyGeminiPromptCache ContextKey = "gemini_prompt_cache"
+
+	// ContextKeySafetyIdentifier stores the end-user identifier (safety_identifier or user) of the request for the admin log
+	ContextKeySafetyIdentifier ContextKey = "safety_identifier"
+
+	// ContextKeyProviderKeyUsed marks that the current attempt used the client supplied upstream key (BYOK)
+	ContextKeyProviderKeyUsed ContextKey = "provider_key_used"
+
 	// ContextKeyLanguage stores the user's language preference for i18n
 	ContextKeyLanguage ContextKey = "language"
 	ContextKeyIsStream ContextKey = "is_stream"
@@ -13,6 +13,7 @@ import (
 	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/dto"
 	"github.com/QuantumNous/new-api/model"
+	"github.com/QuantumNous/new-api/pkg/jqtransform"
 	relaychannel "github.com/QuantumNous/new-api/relay/channel"
 	"github.com/QuantumNous/new-api/relay/channel/gemini"
 	"github.com/QuantumNous/new-api/relay/channel/ollama"
@@ -460,6 +461,21 @@ func validateChannel(channel *model.Channel, isAdd bool) error {
 		return fmt.Errorf("渠道额外设置[channel setting] 格式错误：%s", err.Error())
 	}
 
+	// 校验 jq 请求/响应体转换表达式
+	if channel.OtherSettings != "" {
+		var otherSettings dto.ChannelOtherSettings
+		if err := common.UnmarshalJsonStr(channel.OtherSettings, &otherSettings); err == nil {
+			for _, expression := range []string{otherSettings.GeminiRequestJq, otherSettings.GeminiResponseJq} {
+				if expression == "" {
+					continue
+				}
+				if _, err := jqtransform.Compile(expression); err != nil {
+					return fmt.Errorf("渠道额外设置[jq 表达式] 格式错误：%s", err.Error())
+				}
+			}
+		}
+	}
+
 	// 如果是添加操作，检查 channel 和 key 是否为空
 	if isAdd {
 		if channel == nil || channel.Key == "" {
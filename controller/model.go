@@ -18,6 +18,7 @@ import (
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
 	"github.com/QuantumNous/new-api/relay/helper"
 	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
 	"github.com/QuantumNous/new-api/setting/operation_setting"
 	"github.com/QuantumNous/new-api/types"
 	"github.com/gin-gonic/gin"
@@ -166,6 +167,17 @@ func buildOpenAIModel(modelName string, ownerByModel map[string]string) dto.Open
 		oaiModel.OwnedBy = owner
 	}
 	oaiModel.SupportedEndpointTypes = model.GetModelSupportEndpointTypes(modelName)
+	if capabilities, ok := model_setting.GetGeminiModelCapabilities(modelName); ok {
+		limits, _ := model_setting.GetGeminiModelLimits(modelName)
+		oaiModel.Capabilities = &dto.ModelCapabilities{
+			Vision:          capabilities.Vision,
+			Tools:           capabilities.Tools,
+			Json:            capabilities.Json,
+			Thinking:        capabilities.Thinking,
+			ContextLength:   limits.ContextLength,
+			MaxOutputTokens: limits.MaxOutputTokens,
+		}
+	}
 	return oaiModel
 }
 
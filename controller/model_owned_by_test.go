@@ -55,6 +55,21 @@ func TestBuildOpenAIModelFallsBackToCustomForUnknownModels(t *testing.T) {
 	modelItem := buildOpenAIModel("custom-test-model", nil)
 	require.Equal(t, "custom-test-model", modelItem.Id)
 	require.Equal(t, "custom", modelItem.OwnedBy)
+	require.Nil(t, modelItem.Capabilities)
+}
+
+func TestBuildOpenAIModelAttachesGeminiCapabilities(t *testing.T) {
+	modelItem := buildOpenAIModel("gemini-2.5-flash", nil)
+	require.NotNil(t, modelItem.Capabilities)
+	require.True(t, modelItem.Capabilities.Vision)
+	require.True(t, modelItem.Capabilities.Thinking)
+	require.Equal(t, 1048576, modelItem.Capabilities.ContextLength)
+	require.Equal(t, 65536, modelItem.Capabilities.MaxOutputTokens)
+
+	modelItem = buildOpenAIModel("gemini-2.0-flash", nil)
+	require.NotNil(t, modelItem.Capabilities)
+	require.False(t, modelItem.Capabilities.Thinking)
+	require.Equal(t, 8192, modelItem.Capabilities.MaxOutputTokens)
 }
 
 func TestGetModelListGroupsUsesUserGroupWhenTokenGroupIsEmpty(t *testing.T) {
@@ -221,6 +221,8 @@ func AddToken(c *gin.Context) {
 		AllowIps:           token.AllowIps,
 		Group:              token.Group,
 		CrossGroupRetry:    token.CrossGroupRetry,
+		// 自带 key 的请求不计费，只允许管理员开启
+		ProviderKeyEnabled: token.ProviderKeyEnabled && c.GetInt("role") >= common.RoleAdminUser,
 	}
 	err = cleanToken.Insert()
 	if err != nil {
@@ -299,6 +301,9 @@ func UpdateToken(c *gin.Context) {
 		cleanToken.AllowIps = token.AllowIps
 		cleanToken.Group = token.Group
 		cleanToken.CrossGroupRetry = token.CrossGroupRetry
+		if c.GetInt("role") >= common.RoleAdminUser {
+			cleanToken.ProviderKeyEnabled = token.ProviderKeyEnabled
+		}
 	}
 	err = cleanToken.Update()
 	if err != nil {
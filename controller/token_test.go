@@ -506,6 +506,42 @@ func TestUpdateTokenMasksKeyInResponse(t *testing.T) {
 	}
 }
 
+func TestUpdateTokenProviderKeyRequiresAdmin(t *testing.T) {
+	db := setupTokenControllerTestDB(t)
+	token := seedToken(t, db, 1, "byok-token", "byok1234cdef5678")
+
+	body := map[string]any{
+		"id":                   token.Id,
+		"name":                 "byok-token",
+		"expired_time":         -1,
+		"remain_quota":         100,
+		"unlimited_quota":      true,
+		"group":                "default",
+		"provider_key_enabled": true,
+	}
+	for _, tc := range []struct {
+		role    int
+		enabled bool
+	}{
+		{common.RoleCommonUser, false},
+		{common.RoleAdminUser, true},
+	} {
+		ctx, recorder := newAuthenticatedContext(t, http.MethodPut, "/api/token/", body, 1)
+		ctx.Set("role", tc.role)
+		UpdateToken(ctx)
+		if response := decodeAPIResponse(t, recorder); !response.Success {
+			t.Fatalf("expected success response, got message: %s", response.Message)
+		}
+		updated, err := model.GetTokenByIds(token.Id, 1)
+		if err != nil {
+			t.Fatalf("failed to load token: %v", err)
+		}
+		if updated.ProviderKeyEnabled != tc.enabled {
+			t.Fatalf("role %d: expected provider_key_enabled=%v, got %v", tc.role, tc.enabled, updated.ProviderKeyEnabled)
+		}
+	}
+}
+
 func TestGetTokenKeyRequiresOwnershipAndReturnsFullKey(t *testing.T) {
 	db := setupTokenControllerTestDB(t)
 	token := seedToken(t, db, 1, "owned-token", "owner1234token5678")
@@ -7,6 +7,16 @@ type ChannelSettings struct {
 	PassThroughBodyEnabled bool   `json:"pass_through_body_enabled,omitempty"`
 	SystemPrompt           string `json:"system_prompt,omitempty"`
 	SystemPromptOverride   bool   `json:"system_prompt_override,omitempty"`
+	SystemPromptAppend     bool   `json:"system_prompt_append,omitempty"` // 覆盖模式下将渠道系统提示追加到客户端系统提示之后（默认前置）
+}
+
+// MergeSystemPrompt joins the channel system prompt with an existing client system prompt,
+// the channel prompt goes first unless SystemPromptAppend is enabled.
+func (s *ChannelSettings) MergeSystemPrompt(existing string) string {
+	if s.SystemPromptAppend {
+		return existing + "\n" + s.SystemPrompt
+	}
+	return s.SystemPrompt + "\n" + existing
 }
 
 type VertexKeyType string
@@ -16,6 +26,14 @@ const (
 	VertexKeyTypeAPIKey VertexKeyType = "api_key"
 )
 
+type GeminiThinkingPolicy string
+
+const (
+	GeminiThinkingPolicyClient   GeminiThinkingPolicy = "client" // 默认
+	GeminiThinkingPolicyForceOn  GeminiThinkingPolicy = "force_on"
+	GeminiThinkingPolicyForceOff GeminiThinkingPolicy = "force_off"
+)
+
 type AwsKeyType string
 
 const (
@@ -24,23 +42,37 @@ const (
 )
 
 type ChannelOtherSettings struct {
-	AzureResponsesVersion                 string        `json:"azure_responses_version,omitempty"`
-	VertexKeyType                         VertexKeyType `json:"vertex_key_type,omitempty"` // "json" or "api_key"
-	OpenRouterEnterprise                  *bool         `json:"openrouter_enterprise,omitempty"`
-	ClaudeBetaQuery                       bool          `json:"claude_beta_query,omitempty"`         // Claude 渠道是否强制追加 ?beta=true
-	AllowServiceTier                      bool          `json:"allow_service_tier,omitempty"`        // 是否允许 service_tier 透传（默认过滤以避免额外计费）
-	AllowInferenceGeo                     bool          `json:"allow_inference_geo,omitempty"`       // 是否允许 inference_geo 透传（仅 Claude，默认过滤以满足数据驻留合规
-	AllowSpeed                            bool          `json:"allow_speed,omitempty"`               // 是否允许 speed 透传（仅 Claude，默认过滤以避免意外切换推理速度模式）
-	AllowSafetyIdentifier                 bool          `json:"allow_safety_identifier,omitempty"`   // 是否允许 safety_identifier 透传（默认过滤以保护用户隐私）
-	DisableStore                          bool          `json:"disable_store,omitempty"`             // 是否禁用 store 透传（默认允许透传，禁用后可能导致 Codex 无法使用）
-	AllowIncludeObfuscation               bool          `json:"allow_include_obfuscation,omitempty"` // 是否允许 stream_options.include_obfuscation 透传（默认过滤以避免关闭流混淆保护）
-	AwsKeyType                            AwsKeyType    `json:"aws_key_type,omitempty"`
-	UpstreamModelUpdateCheckEnabled       bool          `json:"upstream_model_update_check_enabled,omitempty"`        // 是否检测上游模型更新
-	UpstreamModelUpdateAutoSyncEnabled    bool          `json:"upstream_model_update_auto_sync_enabled,omitempty"`    // 是否自动同步上游模型更新
-	UpstreamModelUpdateLastCheckTime      int64         `json:"upstream_model_update_last_check_time,omitempty"`      // 上次检测时间
-	UpstreamModelUpdateLastDetectedModels []string      `json:"upstream_model_update_last_detected_models,omitempty"` // 上次检测到的可加入模型
-	UpstreamModelUpdateLastRemovedModels  []string      `json:"upstream_model_update_last_removed_models,omitempty"`  // 上次检测到的可删除模型
-	UpstreamModelUpdateIgnoredModels      []string      `json:"upstream_model_update_ignored_models,omitempty"`       // 手动忽略的模型
+	AzureResponsesVersion                 string               `json:"azure_responses_version,omitempty"`
+	VertexKeyType                         VertexKeyType        `json:"vertex_key_type,omitempty"` // "json" or "api_key"
+	OpenRouterEnterprise                  *bool                `json:"openrouter_enterprise,omitempty"`
+	ClaudeBetaQuery                       bool                 `json:"claude_beta_query,omitempty"`         // Claude 渠道是否强制追加 ?beta=true
+	AllowServiceTier                      bool                 `json:"allow_service_tier,omitempty"`        // 是否允许 service_tier 透传（默认过滤以避免额外计费）
+	AllowInferenceGeo                     bool                 `json:"allow_inference_geo,omitempty"`       // 是否允许 inference_geo 透传（仅 Claude，默认过滤以满足数据驻留合规
+	AllowSpeed                            bool                 `json:"allow_speed,omitempty"`               // 是否允许 speed 透传（仅 Claude，默认过滤以避免意外切换推理速度模式）
+	AllowSafetyIdentifier                 bool                 `json:"allow_safety_identifier,omitempty"`   // 是否允许 safety_identifier 透传（默认过滤以保护用户隐私）
+	DisableStore                          bool                 `json:"disable_store,omitempty"`             // 是否禁用 store 透传（默认允许透传，禁用后可能导致 Codex 无法使用）
+	AllowIncludeObfuscation               bool                 `json:"allow_include_obfuscation,omitempty"` // 是否允许 stream_options.include_obfuscation 透传（默认过滤以避免关闭流混淆保护）
+	AwsKeyType                            AwsKeyType           `json:"aws_key_type,omitempty"`
+	UpstreamModelUpdateCheckEnabled       bool                 `json:"upstream_model_update_check_enabled,omitempty"`        // 是否检测上游模型更新
+	UpstreamModelUpdateAutoSyncEnabled    bool                 `json:"upstream_model_update_auto_sync_enabled,omitempty"`    // 是否自动同步上游模型更新
+	UpstreamModelUpdateLastCheckTime      int64                `json:"upstream_model_update_last_check_time,omitempty"`      // 上次检测时间
+	UpstreamModelUpdateLastDetectedModels []string             `json:"upstream_model_update_last_detected_models,omitempty"` // 上次检测到的可加入模型
+	UpstreamModelUpdateLastRemovedModels  []string             `json:"upstream_model_update_last_removed_models,omitempty"`  // 上次检测到的可删除模型
+	UpstreamModelUpdateIgnoredModels      []string             `json:"upstream_model_update_ignored_models,omitempty"`       // 手动忽略的模型
+	GeminiDefaultMaxOutputTokens          uint                 `json:"gemini_default_max_output_tokens,omitempty"`           // Gemini 渠道在客户端未指定时使用的默认 maxOutputTokens
+	GeminiThinkingPolicy                  GeminiThinkingPolicy `json:"gemini_thinking_policy,omitempty"`                     // Gemini 渠道思考策略，强制开启/关闭时忽略客户端的模型后缀与参数
+	GeminiMaxRequestBodyMB                int                  `json:"gemini_max_request_body_mb,omitempty"`                 // Gemini 渠道请求体大小上限（MB，base64 解码前），0 表示使用全局配置
+	GeminiAlwaysIncludeUsage              bool                 `json:"gemini_always_include_usage,omitempty"`                // Gemini 渠道流式响应始终追加最终 usage 分片，忽略 stream_options.include_usage
+	GeminiMaxThinkingBudget               int                  `json:"gemini_max_thinking_budget,omitempty"`                 // Gemini 渠道允许的最大思考预算，超过（或动态思考）时截断到该值，0 表示不限制
+	GeminiRegionBaseUrls                  map[string]string    `json:"gemini_region_base_urls,omitempty"`                    // Gemini 渠道允许通过请求头 X-Gemini-Region 选择的区域 base URL，key 为区域名
+	GeminiRequestJq                       string               `json:"gemini_request_jq,omitempty"`                          // Gemini 渠道发送前对上游请求体执行的 jq 表达式
+	GeminiResponseJq                      string               `json:"gemini_response_jq,omitempty"`                         // Gemini 渠道转换前对上游响应体（流式时为每个分片）执行的 jq 表达式
+	GeminiSafetyFallbackMessage           string               `json:"gemini_safety_fallback_message,omitempty"`             // Gemini 渠道内容被安全策略拦截时返回的兜底回复，作为正常补全（finish_reason=stop）返回，流式响应只替换被拦截的分块，已发送的内容不会撤回，为空时保持 content_filter 错误
+	GeminiContextCacheEnabled             bool                 `json:"gemini_context_cache_enabled,omitempty"`               // Gemini 渠道未传 prompt_cache_key 时按系统指令、工具与首条消息自动创建并复用 cachedContent
+	GeminiRateLimitRetryMaxAttempts       int                  `json:"gemini_rate_limit_retry_max_attempts,omitempty"`       // Gemini 渠道上游返回 429/503 时的渠道内重试次数，0 表示使用全局配置，小于 0 表示不重试
+	GeminiImagenPersonGeneration          string               `json:"gemini_imagen_person_generation,omitempty"`            // Gemini 渠道 Imagen 的 personGeneration：dont_allow/allow_adult/allow_all，为空时使用 allow_adult
+	GeminiRequestTimeoutSeconds           int                  `json:"gemini_request_timeout_seconds,omitempty"`             // Gemini 渠道非流式请求的整体超时（秒），超过时返回 504，0 表示不限制
+	GeminiStreamIdleTimeoutSeconds        int                  `json:"gemini_stream_idle_timeout_seconds,omitempty"`         // Gemini 渠道流式响应两次收到数据之间的最长间隔（秒），超过时断开上游，0 表示不限制
 }
 
 func (s *ChannelOtherSettings) IsOpenRouterEnterprise() bool {
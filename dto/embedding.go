@@ -1,6 +1,7 @@
 package dto
 
 import (
+	"encoding/json"
 	"strings"
 
 	"github.com/QuantumNous/new-api/types"
@@ -30,6 +31,10 @@ type EmbeddingRequest struct {
 	TopP             *float64 `json:"top_p,omitempty"`
 	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
 	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	// TaskType 为单个任务类型或与 input 一一对应的任务类型数组（Gemini embedding）
+	TaskType json.RawMessage `json:"task_type,omitempty"`
+	// Title 为 RETRIEVAL_DOCUMENT 任务的文档标题，单个字符串或与 input 一一对应的数组（Gemini embedding）
+	Title json.RawMessage `json:"title,omitempty"`
 }
 
 func (r *EmbeddingRequest) GetTokenCountMeta() *types.TokenCountMeta {
@@ -20,6 +20,7 @@ type GeminiChatRequest struct {
 	ToolConfig         *ToolConfig                `json:"toolConfig,omitempty"`
 	SystemInstructions *GeminiChatContent         `json:"systemInstruction,omitempty"`
 	CachedContent      string                     `json:"cachedContent,omitempty"`
+	Labels             map[string]string          `json:"labels,omitempty"` // Vertex AI only
 }
 
 // UnmarshalJSON allows GeminiChatRequest to accept both snake_case and camelCase fields.
@@ -347,6 +348,8 @@ type GeminiChatGenerationConfig struct {
 	ThinkingConfig             *GeminiThinkingConfig `json:"thinkingConfig,omitempty"`
 	SpeechConfig               json.RawMessage       `json:"speechConfig,omitempty"` // RawMessage to allow flexible speech config
 	ImageConfig                json.RawMessage       `json:"imageConfig,omitempty"`  // RawMessage to allow flexible image config
+	// Passthrough 为客户端透传的原始 generationConfig 字段，序列化时深度合并，已映射的字段优先
+	Passthrough map[string]any `json:"-"`
 }
 
 // UnmarshalJSON allows GeminiChatGenerationConfig to accept both snake_case and camelCase fields.
@@ -435,18 +438,120 @@ func (c *GeminiChatGenerationConfig) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// MarshalJSON merges Passthrough beneath the mapped fields, so fields the adaptor does not know yet still reach
+// Gemini while explicitly mapped values win on conflicts.
+func (c GeminiChatGenerationConfig) MarshalJSON() ([]byte, error) {
+	type Alias GeminiChatGenerationConfig
+	data, err := common.Marshal(Alias(c))
+	if err != nil || len(c.Passthrough) == 0 {
+		return data, err
+	}
+	var mapped map[string]any
+	if err := common.Unmarshal(data, &mapped); err != nil {
+		return nil, err
+	}
+	mergeMissingFields(mapped, c.Passthrough)
+	return common.Marshal(mapped)
+}
+
+// mergeMissingFields copies src fields absent from dst into dst, recursing into objects present in both
+func mergeMissingFields(dst map[string]any, src map[string]any) {
+	for key, value := range src {
+		existing, ok := dst[key]
+		if !ok {
+			dst[key] = value
+			continue
+		}
+		existingMap, ok := existing.(map[string]any)
+		valueMap, isMap := value.(map[string]any)
+		if ok && isMap {
+			mergeMissingFields(existingMap, valueMap)
+		}
+	}
+}
+
 type MediaResolution string
 
 type GeminiChatCandidate struct {
-	Content       GeminiChatContent        `json:"content"`
-	FinishReason  *string                  `json:"finishReason"`
-	Index         int64                    `json:"index"`
-	SafetyRatings []GeminiChatSafetyRating `json:"safetyRatings"`
+	Content            GeminiChatContent         `json:"content"`
+	FinishReason       *string                   `json:"finishReason"`
+	Index              int64                     `json:"index"`
+	SafetyRatings      []GeminiChatSafetyRating  `json:"safetyRatings"`
+	AvgLogprobs        *float64                  `json:"avgLogprobs,omitempty"`
+	LogprobsResult     *GeminiLogprobsResult     `json:"logprobsResult,omitempty"`
+	GroundingMetadata  *GeminiGroundingMetadata  `json:"groundingMetadata,omitempty"`
+	UrlContextMetadata *GeminiUrlContextMetadata `json:"urlContextMetadata,omitempty"`
+}
+
+// GeminiUrlContextMetadata is returned when the urlContext tool fetched the URLs in the prompt
+type GeminiUrlContextMetadata struct {
+	UrlMetadata []GeminiUrlMetadata `json:"urlMetadata,omitempty"`
+}
+
+type GeminiUrlMetadata struct {
+	RetrievedUrl       string `json:"retrievedUrl,omitempty"`
+	UrlRetrievalStatus string `json:"urlRetrievalStatus,omitempty"`
+}
+
+// GeminiGroundingMetadata is returned when the google_search tool grounded the answer
+type GeminiGroundingMetadata struct {
+	SearchEntryPoint  *GeminiSearchEntryPoint  `json:"searchEntryPoint,omitempty"`
+	WebSearchQueries  []string                 `json:"webSearchQueries,omitempty"`
+	GroundingChunks   []GeminiGroundingChunk   `json:"groundingChunks,omitempty"`
+	GroundingSupports []GeminiGroundingSupport `json:"groundingSupports,omitempty"`
+}
+
+// GeminiGroundingSupport links a segment of the answer to the grounding chunks it is based on
+type GeminiGroundingSupport struct {
+	Segment               *GeminiGroundingSegment `json:"segment,omitempty"`
+	GroundingChunkIndices []int                   `json:"groundingChunkIndices,omitempty"`
+	ConfidenceScores      []float64               `json:"confidenceScores,omitempty"`
+}
+
+type GeminiGroundingSegment struct {
+	PartIndex  int    `json:"partIndex,omitempty"`
+	StartIndex int    `json:"startIndex,omitempty"`
+	EndIndex   int    `json:"endIndex,omitempty"`
+	Text       string `json:"text,omitempty"`
+}
+
+// GeminiSearchEntryPoint holds the Google Search suggestions that must be displayed with grounded results
+type GeminiSearchEntryPoint struct {
+	RenderedContent string `json:"renderedContent,omitempty"`
+	SdkBlob         string `json:"sdkBlob,omitempty"`
+}
+
+type GeminiGroundingChunk struct {
+	Web *GeminiGroundingChunkWeb `json:"web,omitempty"`
+}
+
+type GeminiGroundingChunkWeb struct {
+	Uri   string `json:"uri,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+type GeminiLogprobsResult struct {
+	TopCandidates    []GeminiTopLogprobsCandidates `json:"topCandidates,omitempty"`
+	ChosenCandidates []GeminiLogprobsCandidate     `json:"chosenCandidates,omitempty"`
+}
+
+type GeminiTopLogprobsCandidates struct {
+	Candidates []GeminiLogprobsCandidate `json:"candidates,omitempty"`
+}
+
+type GeminiLogprobsCandidate struct {
+	Token          string  `json:"token"`
+	TokenId        int     `json:"tokenId"`
+	LogProbability float64 `json:"logProbability"`
 }
 
 type GeminiChatSafetyRating struct {
-	Category    string `json:"category"`
-	Probability string `json:"probability"`
+	Category         string   `json:"category"`
+	Probability      string   `json:"probability"`
+	ProbabilityScore *float64 `json:"probabilityScore,omitempty"`
+	Severity         string   `json:"severity,omitempty"`
+	SeverityScore    *float64 `json:"severityScore,omitempty"`
+	Blocked          bool     `json:"blocked,omitempty"`
 }
 
 type GeminiChatPromptFeedback struct {
@@ -477,6 +582,23 @@ type GeminiPromptTokensDetails struct {
 	TokenCount int    `json:"tokenCount"`
 }
 
+// GeminiCountTokensRequest counts the tokens of a full generateContent request, including system instruction and tools
+type GeminiCountTokensRequest struct {
+	GenerateContentRequest GeminiCountTokensContentRequest `json:"generateContentRequest"`
+}
+
+// GeminiCountTokensContentRequest is only marshaled, the model is required inside generateContentRequest
+type GeminiCountTokensContentRequest struct {
+	Model string `json:"model"`
+	GeminiChatRequest
+}
+
+type GeminiCountTokensResponse struct {
+	TotalTokens             int                         `json:"totalTokens"`
+	CachedContentTokenCount int                         `json:"cachedContentTokenCount"`
+	PromptTokensDetails     []GeminiPromptTokensDetails `json:"promptTokensDetails"`
+}
+
 // Imagen related structs
 type GeminiImageRequest struct {
 	Instances  []GeminiImageInstance `json:"instances"`
@@ -496,6 +618,9 @@ type GeminiImageParameters struct {
 
 type GeminiImageResponse struct {
 	Predictions []GeminiImagePrediction `json:"predictions"`
+	// CreateTime/UpdateTime are RFC3339 timestamps returned by some upstreams (e.g. Vertex AI)
+	CreateTime string `json:"createTime,omitempty"`
+	UpdateTime string `json:"updateTime,omitempty"`
 }
 
 type GeminiImagePrediction struct {
@@ -293,6 +293,8 @@ type Message struct {
 	Reasoning        *string         `json:"reasoning,omitempty"`
 	ToolCalls        json.RawMessage `json:"tool_calls,omitempty"`
 	ToolCallId       string          `json:"tool_call_id,omitempty"`
+	Refusal          *string         `json:"refusal,omitempty"`
+	Audio            *MessageAudio   `json:"audio,omitempty"`
 	parsedContent    []MediaContent
 	//parsedStringContent *string
 }
@@ -304,6 +306,7 @@ type MediaContent struct {
 	InputAudio any    `json:"input_audio,omitempty"`
 	File       any    `json:"file,omitempty"`
 	VideoUrl   any    `json:"video_url,omitempty"`
+	Audio      any    `json:"audio,omitempty"`
 	// OpenRouter Params
 	CacheControl json.RawMessage `json:"cache_control,omitempty"`
 }
@@ -335,6 +338,9 @@ func (m *MediaContent) GetInputAudio() *MessageInputAudio {
 				Data:   common.Interface2String(itemMap["data"]),
 				Format: common.Interface2String(itemMap["format"]),
 			}
+			if sampleRate, ok := itemMap["sample_rate"].(float64); ok {
+				out.SampleRate = int(sampleRate)
+			}
 			return out
 		}
 	}
@@ -417,9 +423,20 @@ func (m *MessageImageUrl) IsRemoteImage() bool {
 	return strings.HasPrefix(m.Url, "http")
 }
 
+// MessageAudio is the assistant audio output of a chat completion, transcript holds the spoken text
+type MessageAudio struct {
+	Id         string `json:"id"`
+	Data       string `json:"data,omitempty"`
+	Format     string `json:"format,omitempty"`
+	Transcript string `json:"transcript,omitempty"`
+	ExpiresAt  int64  `json:"expires_at,omitempty"`
+}
+
 type MessageInputAudio struct {
 	Data   string `json:"data"` //base64
 	Format string `json:"format"`
+	// SampleRate 原始 PCM 音频的采样率（Hz），其它格式忽略
+	SampleRate int `json:"sample_rate,omitempty"`
 }
 
 type MessageFile struct {
@@ -438,6 +455,7 @@ const (
 	ContentTypeInputAudio = "input_audio"
 	ContentTypeFile       = "file"
 	ContentTypeVideoUrl   = "video_url" // 阿里百炼视频识别
+	ContentTypeAudio      = "audio"     // 助手输出的音频（Gemini 混合模态响应）
 	//ContentTypeAudioUrl   = "audio_url"
 )
 
@@ -609,6 +627,9 @@ func (m *Message) ParseContent() []MediaContent {
 						Data:   data,
 						Format: format,
 					}
+					if sampleRate, ok := audioData["sample_rate"].(float64); ok {
+						temp.SampleRate = int(sampleRate)
+					}
 					contentList = append(contentList, MediaContent{
 						Type:       ContentTypeInputAudio,
 						InputAudio: temp,
@@ -782,6 +803,9 @@ func (m *Message) ParseContent() []MediaContent {
 							Data:   data,
 							Format: format,
 						}
+						if sampleRate, ok := audioData["sample_rate"].(float64); ok {
+							temp.SampleRate = int(sampleRate)
+						}
 						contentList = append(contentList, MediaContent{
 							Type:       ContentTypeInputAudio,
 							InputAudio: temp,
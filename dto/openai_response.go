@@ -32,19 +32,70 @@ type TextResponse struct {
 }
 
 type OpenAITextResponseChoice struct {
-	Index        int `json:"index"`
-	Message      `json:"message"`
-	FinishReason string `json:"finish_reason"`
+	Index         int `json:"index"`
+	Message       `json:"message"`
+	FinishReason  string          `json:"finish_reason"`
+	Grounding     *GroundingInfo  `json:"grounding,omitempty"`
+	UrlContext    *UrlContextInfo `json:"url_context,omitempty"`
+	SafetyRatings []SafetyRating  `json:"safety_ratings,omitempty"`
+	Logprobs      *OpenAILogprobs `json:"logprobs,omitempty"`
+}
+
+// GroundingInfo carries search grounding results of a choice.
+// RenderedContent is the search suggestions HTML that Google requires to be displayed with grounded answers.
+type GroundingInfo struct {
+	RenderedContent  string              `json:"rendered_content,omitempty"`
+	WebSearchQueries []string            `json:"web_search_queries,omitempty"`
+	Sources          []GroundingSource   `json:"sources,omitempty"`
+	Citations        []GroundingCitation `json:"citations,omitempty"`
+}
+
+type GroundingSource struct {
+	Url   string `json:"url"`
+	Title string `json:"title,omitempty"`
+}
+
+// GroundingCitation marks a span of the answer text, SourceIndexes point into GroundingInfo.Sources.
+// StartIndex and EndIndex are byte offsets as reported by Gemini.
+type GroundingCitation struct {
+	Text          string `json:"text,omitempty"`
+	StartIndex    int    `json:"start_index"`
+	EndIndex      int    `json:"end_index"`
+	SourceIndexes []int  `json:"source_indexes"`
+}
+
+// UrlContextInfo reports which URLs the url context tool actually retrieved.
+// Warning is set when none of the URLs could be retrieved, so the answer is not grounded on them.
+type UrlContextInfo struct {
+	Urls    []UrlContextSource `json:"urls"`
+	Warning string             `json:"warning,omitempty"`
+}
+
+// UrlContextSource is one URL with its retrieval status: success, failed, unsafe or paywall
+type UrlContextSource struct {
+	Url    string `json:"url"`
+	Status string `json:"status"`
+}
+
+// SafetyRating is a per-category safety score of a choice, returned on request for moderation use
+type SafetyRating struct {
+	Category         string   `json:"category"`
+	Probability      string   `json:"probability"`
+	ProbabilityScore *float64 `json:"probability_score,omitempty"`
+	Severity         string   `json:"severity,omitempty"`
+	SeverityScore    *float64 `json:"severity_score,omitempty"`
+	Blocked          bool     `json:"blocked,omitempty"`
 }
 
 type OpenAITextResponse struct {
-	Id      string                     `json:"id"`
-	Model   string                     `json:"model"`
-	Object  string                     `json:"object"`
-	Created any                        `json:"created"`
-	Choices []OpenAITextResponseChoice `json:"choices"`
-	Error   any                        `json:"error,omitempty"`
-	Usage   `json:"usage"`
+	Id                string                     `json:"id"`
+	Model             string                     `json:"model"`
+	Object            string                     `json:"object"`
+	Created           any                        `json:"created"`
+	SystemFingerprint string                     `json:"system_fingerprint,omitempty"`
+	Choices           []OpenAITextResponseChoice `json:"choices"`
+	Error             any                        `json:"error,omitempty"`
+	Usage             `json:"usage"`
 }
 
 // GetOpenAIError 从动态错误类型中提取OpenAIError结构
@@ -56,6 +107,10 @@ type OpenAIEmbeddingResponseItem struct {
 	Object    string    `json:"object"`
 	Index     int       `json:"index"`
 	Embedding []float64 `json:"embedding"`
+	// PromptTokens is the per-input token count, only reported by channels that can provide it
+	PromptTokens int `json:"prompt_tokens,omitempty"`
+	// Error marks an input that failed when partial embedding results are enabled, Embedding is null then
+	Error *types.OpenAIError `json:"error,omitempty"`
 }
 
 type OpenAIEmbeddingResponse struct {
@@ -78,11 +133,31 @@ type FlexibleEmbeddingResponse struct {
 	Usage  `json:"usage"`
 }
 
+type OpenAILogprobs struct {
+	Content []OpenAILogprobsContent `json:"content"`
+}
+
+type OpenAILogprobsContent struct {
+	Token       string              `json:"token"`
+	Logprob     float64             `json:"logprob"`
+	Bytes       []int               `json:"bytes"`
+	TopLogprobs []OpenAITopLogprobs `json:"top_logprobs"`
+}
+
+type OpenAITopLogprobs struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
 type ChatCompletionsStreamResponseChoice struct {
-	Delta        ChatCompletionsStreamResponseChoiceDelta `json:"delta,omitempty"`
-	Logprobs     *any                                     `json:"logprobs"`
-	FinishReason *string                                  `json:"finish_reason"`
-	Index        int                                      `json:"index"`
+	Delta         ChatCompletionsStreamResponseChoiceDelta `json:"delta,omitempty"`
+	Logprobs      *any                                     `json:"logprobs"`
+	FinishReason  *string                                  `json:"finish_reason"`
+	Index         int                                      `json:"index"`
+	Grounding     *GroundingInfo                           `json:"grounding,omitempty"`
+	UrlContext    *UrlContextInfo                          `json:"url_context,omitempty"`
+	SafetyRatings []SafetyRating                           `json:"safety_ratings,omitempty"`
 }
 
 type ChatCompletionsStreamResponseChoiceDelta struct {
@@ -91,6 +166,16 @@ type ChatCompletionsStreamResponseChoiceDelta struct {
 	Reasoning        *string            `json:"reasoning,omitempty"`
 	Role             string             `json:"role,omitempty"`
 	ToolCalls        []ToolCallResponse `json:"tool_calls,omitempty"`
+	Refusal          *string            `json:"refusal,omitempty"`
+	Audio            *StreamAudioDelta  `json:"audio,omitempty"`
+}
+
+// StreamAudioDelta is an incremental chunk of assistant audio output, the final chunk carries only id and expires_at
+type StreamAudioDelta struct {
+	Id         string `json:"id"`
+	Data       string `json:"data,omitempty"`
+	Transcript string `json:"transcript,omitempty"`
+	ExpiresAt  int64  `json:"expires_at,omitempty"`
 }
 
 func (c *ChatCompletionsStreamResponseChoiceDelta) SetContentString(s string) {
@@ -242,6 +327,16 @@ type Usage struct {
 	Cost any `json:"cost,omitempty"`
 }
 
+// CountTokensResponse is returned by /v1/chat/completions/count_tokens.
+// PromptTokensDetails breaks the total down by input modality, e.g. text, image, audio, video.
+type CountTokensResponse struct {
+	Object              string         `json:"object"`
+	Model               string         `json:"model"`
+	TotalTokens         int            `json:"total_tokens"`
+	CachedTokens        int            `json:"cached_tokens,omitempty"`
+	PromptTokensDetails map[string]int `json:"prompt_tokens_details,omitempty"`
+}
+
 type OpenAIVideoResponse struct {
 	Id        string `json:"id" example:"file-abc123"`
 	Object    string `json:"object" example:"file"`
@@ -9,6 +9,17 @@ type OpenAIModels struct {
 	Created                int                     `json:"created"`
 	OwnedBy                string                  `json:"owned_by"`
 	SupportedEndpointTypes []constant.EndpointType `json:"supported_endpoint_types"`
+	Capabilities           *ModelCapabilities      `json:"capabilities,omitempty"`
+}
+
+// ModelCapabilities lets clients introspect which features a model supports
+type ModelCapabilities struct {
+	Vision          bool `json:"vision"`
+	Tools           bool `json:"tools"`
+	Json            bool `json:"json"`
+	Thinking        bool `json:"thinking"`
+	ContextLength   int  `json:"context_length,omitempty"`
+	MaxOutputTokens int  `json:"max_output_tokens,omitempty"`
 }
 
 type AnthropicModel struct {
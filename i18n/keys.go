@@ -320,6 +320,67 @@ const (
 	MsgDistributorInvalidParseModel       = "distributor.invalid_request_parse_model"
 )
 
+// Gemini adaptor messages
+const (
+	MsgGeminiInputRequired                   = "gemini.input_required"
+	MsgGeminiInputEmpty                      = "gemini.input_empty"
+	MsgGeminiOperationUnsupported            = "gemini.operation_unsupported"
+	MsgGeminiToolChoiceRequiresTools         = "gemini.tool_choice_requires_tools"
+	MsgGeminiPromptBlocked                   = "gemini.prompt_blocked"
+	MsgGeminiEmptyResponse                   = "gemini.empty_response"
+	MsgGeminiEmptyContents                   = "gemini.empty_contents"
+	MsgGeminiRequestBodyTooLarge             = "gemini.request_body_too_large"
+	MsgGeminiCorruptMediaData                = "gemini.corrupt_media_data"
+	MsgGeminiStreamSchemaMismatch            = "gemini.stream_schema_mismatch"
+	MsgGeminiRegionNotAllowed                = "gemini.region_not_allowed"
+	MsgGeminiImagenPromptTooLong             = "gemini.imagen_prompt_too_long"
+	MsgGeminiImagenSizeInvalid               = "gemini.imagen_size_invalid"
+	MsgGeminiImagenCountOutOfRange           = "gemini.imagen_count_out_of_range"
+	MsgGeminiRequestDeadlineExceeded         = "gemini.request_deadline_exceeded"
+	MsgGeminiEmbeddingTaskTypeInvalid        = "gemini.embedding_task_type_invalid"
+	MsgGeminiEmbeddingTaskTypeUnsupported    = "gemini.embedding_task_type_unsupported"
+	MsgGeminiEmbeddingTitleInvalid           = "gemini.embedding_title_invalid"
+	MsgGeminiEmbeddingTitleRequiresDocument  = "gemini.embedding_title_requires_document"
+	MsgGeminiEmbeddingDimensionsNotSupported = "gemini.embedding_dimensions_not_supported"
+	MsgGeminiRerankTopNExceeded              = "gemini.rerank_top_n_exceeded"
+	MsgGeminiCandidateCountStream            = "gemini.candidate_count_stream"
+	MsgGeminiCandidateCountTooLarge          = "gemini.candidate_count_too_large"
+	MsgGeminiUnsupportedContentPart          = "gemini.unsupported_content_part"
+	MsgGeminiContentPartMissingData          = "gemini.content_part_missing_data"
+	MsgGeminiFileUploadFailed                = "gemini.file_upload_failed"
+	MsgGeminiFileNotActive                   = "gemini.file_not_active"
+	MsgGeminiSpeechModelUnsupported          = "gemini.speech_model_unsupported"
+	MsgGeminiSpeechFormatUnsupported         = "gemini.speech_format_unsupported"
+	MsgGeminiAudioFormatUnsupported          = "gemini.audio_format_unsupported"
+	MsgGeminiSpeechInputRequired             = "gemini.speech_input_required"
+	MsgGeminiTranscriptionFileRequired       = "gemini.transcription_file_required"
+	MsgGeminiTranscriptionFormatUnsupported  = "gemini.transcription_format_unsupported"
+	MsgGeminiTranscriptionAudioUnsupported   = "gemini.transcription_audio_unsupported"
+	MsgGeminiToolResultUnmatched             = "gemini.tool_result_unmatched"
+	MsgGeminiImagesFiltered                  = "gemini.images_filtered"
+	MsgGeminiExtraBodyNotString              = "gemini.extra_body_not_string"
+	MsgGeminiExtraBodyNotBoolean             = "gemini.extra_body_not_boolean"
+	MsgGeminiExtraBodyNotInteger             = "gemini.extra_body_not_integer"
+	MsgGeminiExtraBodyNotObject              = "gemini.extra_body_not_object"
+	MsgGeminiExtraBodyNotStringArray         = "gemini.extra_body_not_string_array"
+	MsgGeminiExtraBodyFieldRenamed           = "gemini.extra_body_field_renamed"
+	MsgGeminiThinkingSummaryInvalid          = "gemini.thinking_summary_invalid"
+	MsgGeminiResponseModalitiesInvalid       = "gemini.response_modalities_invalid"
+	MsgGeminiSafetySettingsInvalid           = "gemini.safety_settings_invalid"
+	MsgGeminiSafetyCategoryUnknown           = "gemini.safety_category_unknown"
+	MsgGeminiAllowedFunctionsRequireTools    = "gemini.allowed_functions_require_tools"
+	MsgGeminiAllowedFunctionUndeclared       = "gemini.allowed_function_undeclared"
+	MsgGeminiAllowedFunctionsConflict        = "gemini.allowed_functions_conflict"
+	MsgGeminiAudioOutputUnsupported          = "gemini.audio_output_unsupported"
+	MsgGeminiStreamFanOutTooLarge            = "gemini.stream_fan_out_too_large"
+	MsgGeminiFunctionArgumentsInvalid        = "gemini.function_arguments_invalid"
+	MsgGeminiMarkdownImageDecodeFailed       = "gemini.markdown_image_decode_failed"
+	MsgGeminiMimeTypeUnsupported             = "gemini.mime_type_unsupported"
+	MsgGeminiNoImagesGenerated               = "gemini.no_images_generated"
+	MsgGeminiCountTokensUnsupported          = "gemini.count_tokens_unsupported"
+	MsgGeminiEmbeddingAllFailed              = "gemini.embedding_all_failed"
+)
+
 // Custom OAuth provider related messages
 const (
 	MsgCustomOAuthNotFound          = "custom_oauth.not_found"
@@ -2,13 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/QuantumNous/new-api/common"
@@ -158,6 +161,25 @@ func main() {
 		common.SysError(fmt.Sprintf("start pyroscope error : %v", err))
 	}
 
+	shutdownOpenTelemetry, err := common.StartOpenTelemetry()
+	if err != nil {
+		common.SysError(fmt.Sprintf("start opentelemetry error : %v", err))
+	}
+	if shutdownOpenTelemetry != nil {
+		// 退出前导出批处理中尚未上报的 span
+		go func() {
+			quit := make(chan os.Signal, 1)
+			signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+			<-quit
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := shutdownOpenTelemetry(ctx); err != nil {
+				common.SysError(fmt.Sprintf("shutdown opentelemetry error : %v", err))
+			}
+			cancel()
+			os.Exit(0)
+		}()
+	}
+
 	// Initialize HTTP server
 	server := gin.New()
 	server.Use(gin.CustomRecovery(func(c *gin.Context, err any) {
@@ -27,7 +27,8 @@ type Token struct {
 	AllowIps           *string        `json:"allow_ips" gorm:"default:''"`
 	UsedQuota          int            `json:"used_quota" gorm:"default:0"` // used quota
 	Group              string         `json:"group" gorm:"default:''"`
-	CrossGroupRetry    bool           `json:"cross_group_retry"` // 跨分组重试，仅auto分组有效
+	CrossGroupRetry    bool           `json:"cross_group_retry"`    // 跨分组重试，仅auto分组有效
+	ProviderKeyEnabled bool           `json:"provider_key_enabled"` // 允许通过 X-Provider-Api-Key 使用自带的上游 key
 	DeletedAt          gorm.DeletedAt `gorm:"index"`
 }
 
@@ -295,7 +296,7 @@ func (token *Token) Update() (err error) {
 		}
 	}()
 	err = DB.Model(token).Select("name", "status", "expired_time", "remain_quota", "unlimited_quota",
-		"model_limits_enabled", "model_limits", "allow_ips", "group", "cross_group_retry").Updates(token).Error
+		"model_limits_enabled", "model_limits", "allow_ips", "group", "cross_group_retry", "provider_key_enabled").Updates(token).Error
 	return err
 }
 
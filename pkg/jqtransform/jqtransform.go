@@ -0,0 +1,81 @@
+// Package jqtransform applies jq expressions to JSON bodies, it backs the channel level
+// request/response body transformations configured by operators.
+package jqtransform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+
+	"github.com/itchyny/gojq"
+)
+
+const (
+	maxCacheSize = 256
+	// runTimeout bounds a single transformation, expressions like `repeat(.)` never terminate
+	runTimeout = time.Second
+)
+
+var (
+	cacheMu sync.RWMutex
+	cache   = make(map[string]*gojq.Code, 16)
+)
+
+// Compile parses and compiles a jq expression, used to validate channel settings.
+func Compile(expression string) (*gojq.Code, error) {
+	cacheMu.RLock()
+	code, ok := cache[expression]
+	cacheMu.RUnlock()
+	if ok {
+		return code, nil
+	}
+
+	query, err := gojq.Parse(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jq expression: %w", err)
+	}
+	code, err = gojq.Compile(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jq expression: %w", err)
+	}
+
+	cacheMu.Lock()
+	if len(cache) >= maxCacheSize {
+		cache = make(map[string]*gojq.Code, 16)
+	}
+	cache[expression] = code
+	cacheMu.Unlock()
+	return code, nil
+}
+
+// Apply runs the expression on a JSON body and returns the transformed JSON body.
+// The expression must produce exactly one value.
+func Apply(ctx context.Context, expression string, body []byte) ([]byte, error) {
+	code, err := Compile(expression)
+	if err != nil {
+		return nil, err
+	}
+	var input any
+	if err := common.Unmarshal(body, &input); err != nil {
+		return nil, fmt.Errorf("jq input is not valid JSON: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, runTimeout)
+	defer cancel()
+	iter := code.RunWithContext(ctx, input)
+	output, ok := iter.Next()
+	if !ok {
+		return nil, errors.New("jq expression produced no output")
+	}
+	if err, isErr := output.(error); isErr {
+		return nil, fmt.Errorf("jq expression failed: %w", err)
+	}
+	if _, more := iter.Next(); more {
+		return nil, errors.New("jq expression produced more than one output")
+	}
+	return common.Marshal(output)
+}
@@ -0,0 +1,25 @@
+package jqtransform
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApply(t *testing.T) {
+	t.Parallel()
+
+	out, err := Apply(context.Background(), `.generationConfig.seed = 7 | del(.safetySettings)`, []byte(`{"contents":[],"safetySettings":[{}]}`))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"contents":[],"generationConfig":{"seed":7}}`, string(out))
+
+	_, err = Compile(`.a |`)
+	require.Error(t, err)
+	_, err = Apply(context.Background(), `.[]`, []byte(`[1,2]`))
+	require.EqualError(t, err, "jq expression produced more than one output")
+	_, err = Apply(context.Background(), `empty`, []byte(`{}`))
+	require.EqualError(t, err, "jq expression produced no output")
+	_, err = Apply(context.Background(), `error("boom")`, []byte(`{}`))
+	require.ErrorContains(t, err, "boom")
+}
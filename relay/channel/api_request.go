@@ -83,9 +83,13 @@ var passthroughSkipHeaderNamesLower = map[string]struct{}{
 	"accept-encoding": {},
 
 	// Do not passthrough credentials by wildcard/regex.
-	"authorization":  {},
-	"x-api-key":      {},
-	"x-goog-api-key": {},
+	"authorization":      {},
+	"x-api-key":          {},
+	"x-goog-api-key":     {},
+	"x-provider-api-key": {},
+	"x-gemini-region":    {},
+	"x-request-deadline": {},
+	"x-gemini-debug":     {},
 
 	// WebSocket handshake headers are generated by the client/dialer.
 	"sec-websocket-key":        {},
@@ -310,30 +314,59 @@ func DoApiRequest(a Adaptor, c *gin.Context, info *common.RelayInfo, requestBody
 		return nil, fmt.Errorf("get request url failed: %w", err)
 	}
 	logger.LogDebug(c, "fullRequestURL: %s", fullRequestURL)
-	req, err := http.NewRequest(c.Request.Method, fullRequestURL, requestBody)
+	ctx, cancel := upstreamRequestContext(info)
+	req, err := http.NewRequestWithContext(ctx, c.Request.Method, fullRequestURL, requestBody)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("new request failed: %w", err)
 	}
 	applyUpstreamContentLength(req, info)
 	headers := req.Header
 	err = a.SetupRequestHeader(c, &headers, info)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("setup request header failed: %w", err)
 	}
 	// 在 SetupRequestHeader 之后应用 Header Override，确保用户设置优先级最高
 	// 这样可以覆盖默认的 Authorization header 设置
 	headerOverride, err := processHeaderOverride(info, c)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 	applyHeaderOverrideToRequest(req, headerOverride)
 	resp, err := doRequest(c, req, info)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("do request failed: %w", err)
 	}
+	if !info.UpstreamDeadline.IsZero() {
+		resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	}
 	return resp, nil
 }
 
+// upstreamRequestContext applies info.UpstreamDeadline to the upstream request, the deadline also covers
+// reading the response body, so the returned cancel must only run once the body is closed.
+func upstreamRequestContext(info *common.RelayInfo) (context.Context, context.CancelFunc) {
+	if info.UpstreamDeadline.IsZero() {
+		return context.Background(), func() {}
+	}
+	return context.WithDeadline(context.Background(), info.UpstreamDeadline)
+}
+
+// cancelOnCloseBody releases the deadline context of the upstream request when its body is closed
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
 func DoFormRequest(a Adaptor, c *gin.Context, info *common.RelayInfo, requestBody io.Reader) (*http.Response, error) {
 	fullRequestURL, err := a.GetRequestURL(info)
 	if err != nil {
@@ -1,17 +1,28 @@
 package gemini
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/i18n"
+	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/relay/channel"
 	"github.com/QuantumNous/new-api/relay/channel/openai"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
-	"github.com/QuantumNous/new-api/relay/constant"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
 	"github.com/QuantumNous/new-api/setting/model_setting"
 	"github.com/QuantumNous/new-api/setting/reasoning"
 	"github.com/QuantumNous/new-api/types"
@@ -23,7 +34,49 @@ import (
 type Adaptor struct {
 }
 
-func (a *Adaptor) ConvertGeminiRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeminiChatRequest) (any, error) {
+// checkRequestBodySize rejects oversized requests with 413 before the expensive base64 decode and re-marshal
+func checkRequestBodySize(c *gin.Context, info *relaycommon.RelayInfo) error {
+	channelLimitMB := 0
+	if info != nil && info.ChannelMeta != nil {
+		channelLimitMB = info.ChannelOtherSettings.GeminiMaxRequestBodyMB
+	}
+	return helper.CheckGeminiRequestBodySize(c, channelLimitMB)
+}
+
+// applyRegionBaseUrl switches the upstream base URL to the region requested by the X-Gemini-Region header.
+// The header may name a region or repeat one of the allowed base URLs, anything else is rejected so the
+// data is never sent to a region the channel does not list.
+func applyRegionBaseUrl(c *gin.Context, info *relaycommon.RelayInfo) error {
+	region := strings.TrimSpace(c.Request.Header.Get("X-Gemini-Region"))
+	if region == "" || info.ChannelMeta == nil {
+		return nil
+	}
+	for name, baseUrl := range info.ChannelOtherSettings.GeminiRegionBaseUrls {
+		baseUrl = strings.TrimSuffix(baseUrl, "/")
+		if baseUrl != "" && (strings.EqualFold(name, region) || baseUrl == strings.TrimSuffix(region, "/")) {
+			info.ChannelBaseUrl = baseUrl
+			return nil
+		}
+	}
+	return types.NewErrorWithStatusCode(
+		errors.New(i18n.T(c, i18n.MsgGeminiRegionNotAllowed, map[string]any{"Region": region})),
+		types.ErrorCodeInvalidRequest,
+		http.StatusBadRequest,
+		types.ErrOptionWithSkipRetry(),
+	)
+}
+
+func (a *Adaptor) ConvertGeminiRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeminiChatRequest) (converted any, err error) {
+	span := startGeminiSpan(c, info, "gemini.convert_request")
+	defer func() { endGeminiSpan(span, err) }()
+	resetGeminiFinishReasons(c)
+	if err := checkRequestBodySize(c, info); err != nil {
+		return nil, err
+	}
+	if err := applyRegionBaseUrl(c, info); err != nil {
+		return nil, err
+	}
+	applyContextOverflowUpgrade(c, info)
 	if len(request.Contents) > 0 {
 		for i, content := range request.Contents {
 			if i == 0 {
@@ -40,10 +93,21 @@ func (a *Adaptor) ConvertGeminiRequest(c *gin.Context, info *relaycommon.RelayIn
 			}
 		}
 	}
+	if info.ChannelType != constant.ChannelTypeVertexAi {
+		// labels 仅 Vertex AI 支持，Gemini API 会拒绝该字段
+		request.Labels = nil
+	}
+	applyDefaultMaxOutputTokens(request, info)
+	applyChannelThinkingPolicy(request, info)
+	adaptGenerationConfigForModelVersion(request, info.UpstreamModelName)
+	applyChannelThinkingBudgetCap(c, request, info)
 	return request, nil
 }
 
 func (a *Adaptor) ConvertClaudeRequest(c *gin.Context, info *relaycommon.RelayInfo, req *dto.ClaudeRequest) (any, error) {
+	if err := checkRequestBodySize(c, info); err != nil {
+		return nil, err
+	}
 	adaptor := openai.Adaptor{}
 	oaiReq, err := adaptor.ConvertClaudeRequest(c, info, req)
 	if err != nil {
@@ -53,48 +117,192 @@ func (a *Adaptor) ConvertClaudeRequest(c *gin.Context, info *relaycommon.RelayIn
 }
 
 func (a *Adaptor) ConvertAudioRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.AudioRequest) (io.Reader, error) {
-	//TODO implement me
-	return nil, errors.New("not implemented")
+	if info.RelayMode != relayconstant.RelayModeAudioSpeech && info.RelayMode != relayconstant.RelayModeAudioTranscription {
+		return nil, errors.New("not implemented")
+	}
+	if err := checkRequestBodySize(c, info); err != nil {
+		return nil, err
+	}
+	if err := checkOperationSupported(c, info); err != nil {
+		return nil, err
+	}
+	if err := applyRegionBaseUrl(c, info); err != nil {
+		return nil, err
+	}
+	var geminiRequest *dto.GeminiChatRequest
+	var err error
+	if info.RelayMode == relayconstant.RelayModeAudioSpeech {
+		geminiRequest, err = convertSpeechRequest(c, info, request)
+	} else {
+		geminiRequest, err = convertTranscriptionRequest(c, info, request)
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := common.Marshal(geminiRequest)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// checkImagenPromptLength rejects prompts longer than the model limit with a clear error instead of the vague
+// upstream one, or cuts them to the limit (with a Warning header) when prompt trimming is enabled.
+// The check is opt-in, models without a configured ImagenPromptMaxChars entry are not limited.
+func checkImagenPromptLength(c *gin.Context, modelName string, prompt string) (string, error) {
+	maxChars, ok := model_setting.GetImagenPromptMaxChars(modelName)
+	if !ok {
+		return prompt, nil
+	}
+	length := utf8.RuneCountInString(prompt)
+	if length <= maxChars {
+		return prompt, nil
+	}
+	if model_setting.GetGeminiSettings().ImagenPromptTrimEnabled {
+		c.Header("Warning", fmt.Sprintf(`199 new-api "prompt truncated from %d to %d chars"`, length, maxChars))
+		return string([]rune(prompt)[:maxChars]), nil
+	}
+	return "", types.NewErrorWithStatusCode(
+		errors.New(i18n.T(c, i18n.MsgGeminiImagenPromptTooLong, map[string]any{"Length": length, "Max": maxChars, "Model": modelName})),
+		types.ErrorCodeInvalidRequest,
+		http.StatusBadRequest,
+		types.ErrOptionWithSkipRetry(),
+	)
+}
+
+// imagenMaxSampleCounts is the largest sampleCount each Imagen model accepts per request, matched by longest prefix
+var imagenMaxSampleCounts = map[string]int{
+	"imagen":           4,
+	"imagen-4.0-ultra": 1,
+}
+
+// imagenMaxSampleCount returns the largest n the Imagen model generates in one request
+func imagenMaxSampleCount(modelName string) int {
+	maxCount, matched := 0, ""
+	for prefix, count := range imagenMaxSampleCounts {
+		if strings.HasPrefix(modelName, prefix) && len(prefix) > len(matched) {
+			maxCount, matched = count, prefix
+		}
+	}
+	return maxCount
+}
+
+const defaultImagenPersonGeneration = "allow_adult"
+
+var imagenPersonGenerations = map[string]bool{
+	"dont_allow":  true,
+	"allow_adult": true,
+	"allow_all":   true,
+}
+
+// imagenPersonGeneration returns the channel personGeneration, unset or unknown values use allow_adult
+func imagenPersonGeneration(c *gin.Context, info *relaycommon.RelayInfo) string {
+	if info.ChannelMeta == nil || info.ChannelOtherSettings.GeminiImagenPersonGeneration == "" {
+		return defaultImagenPersonGeneration
+	}
+	personGeneration := info.ChannelOtherSettings.GeminiImagenPersonGeneration
+	if !imagenPersonGenerations[personGeneration] {
+		logger.LogWarn(c, fmt.Sprintf("gemini channel #%d has invalid imagen person generation %q, using %s", info.ChannelId, personGeneration, defaultImagenPersonGeneration))
+		return defaultImagenPersonGeneration
+	}
+	return personGeneration
+}
+
+// imagenAspectRatios are the aspect ratios supported by Imagen
+var imagenAspectRatios = []struct {
+	name  string
+	ratio float64
+}{
+	{"1:1", 1},
+	{"3:4", 3.0 / 4},
+	{"4:3", 4.0 / 3},
+	{"9:16", 9.0 / 16},
+	{"16:9", 16.0 / 9},
+}
+
+// imagenAspectRatio maps an OpenAI size ("1536x1024") or an aspect ratio ("3:2") to the closest
+// Imagen aspect ratio, ratios are compared on a log scale so 2:1 and 1:2 are equally far from 1:1.
+func imagenAspectRatio(size string) (string, bool) {
+	width, height, found := strings.Cut(strings.ToLower(size), "x")
+	if !found {
+		width, height, found = strings.Cut(size, ":")
+	}
+	if !found {
+		return "", false
+	}
+	w, okWidth := parseImagenDimension(width)
+	h, okHeight := parseImagenDimension(height)
+	if !okWidth || !okHeight {
+		return "", false
+	}
+	target := math.Log(w / h)
+	closest := imagenAspectRatios[0]
+	for _, candidate := range imagenAspectRatios[1:] {
+		if math.Abs(math.Log(candidate.ratio)-target) < math.Abs(math.Log(closest.ratio)-target) {
+			closest = candidate
+		}
+	}
+	return closest.name, true
+}
+
+func parseImagenDimension(value string) (float64, bool) {
+	dimension, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || math.IsNaN(dimension) || math.IsInf(dimension, 0) || dimension <= 0 {
+		return 0, false
+	}
+	return dimension, true
 }
 
 func (a *Adaptor) ConvertImageRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.ImageRequest) (any, error) {
-	if !strings.HasPrefix(info.UpstreamModelName, "imagen") {
-		return nil, errors.New("not supported model for image generation, only imagen models are supported")
+	if err := checkRequestBodySize(c, info); err != nil {
+		return nil, err
+	}
+	if err := applyRegionBaseUrl(c, info); err != nil {
+		return nil, err
+	}
+	if err := checkOperationSupported(c, info); err != nil {
+		return nil, err
+	}
+	prompt, err := checkImagenPromptLength(c, info.UpstreamModelName, request.Prompt)
+	if err != nil {
+		return nil, err
 	}
 
 	// convert size to aspect ratio but allow user to specify aspect ratio
 	aspectRatio := "1:1" // default aspect ratio
-	size := strings.TrimSpace(request.Size)
-	if size != "" {
-		if strings.Contains(size, ":") {
-			aspectRatio = size
-		} else {
-			switch size {
-			case "256x256", "512x512", "1024x1024":
-				aspectRatio = "1:1"
-			case "1536x1024":
-				aspectRatio = "3:2"
-			case "1024x1536":
-				aspectRatio = "2:3"
-			case "1024x1792":
-				aspectRatio = "9:16"
-			case "1792x1024":
-				aspectRatio = "16:9"
-			}
+	if size := strings.TrimSpace(request.Size); size != "" {
+		var ok bool
+		if aspectRatio, ok = imagenAspectRatio(size); !ok {
+			return nil, types.NewErrorWithStatusCode(
+				errors.New(i18n.T(c, i18n.MsgGeminiImagenSizeInvalid, map[string]any{"Size": size})),
+				types.ErrorCodeInvalidRequest,
+				http.StatusBadRequest,
+				types.ErrOptionWithSkipRetry(),
+			)
 		}
 	}
+	// n 未传或为 0 时按 OpenAI 的默认值生成 1 张
+	sampleCount := max(lo.FromPtr(request.N), 1)
+	if maxCount := imagenMaxSampleCount(info.UpstreamModelName); sampleCount > uint(maxCount) {
+		return nil, types.NewErrorWithStatusCode(
+			errors.New(i18n.T(c, i18n.MsgGeminiImagenCountOutOfRange, map[string]any{"N": sampleCount, "Max": maxCount, "Model": info.UpstreamModelName})),
+			types.ErrorCodeInvalidRequest,
+			http.StatusBadRequest,
+			types.ErrOptionWithSkipRetry(),
+		)
+	}
 
 	// build gemini imagen request
 	geminiRequest := dto.GeminiImageRequest{
 		Instances: []dto.GeminiImageInstance{
 			{
-				Prompt: request.Prompt,
+				Prompt: prompt,
 			},
 		},
 		Parameters: dto.GeminiImageParameters{
-			SampleCount:      int(lo.FromPtrOr(request.N, uint(1))),
+			SampleCount:      int(sampleCount),
 			AspectRatio:      aspectRatio,
-			PersonGeneration: "allow_adult", // default allow adult
+			PersonGeneration: imagenPersonGeneration(c, info),
 		},
 	}
 
@@ -124,35 +332,75 @@ func (a *Adaptor) ConvertImageRequest(c *gin.Context, info *relaycommon.RelayInf
 }
 
 func (a *Adaptor) Init(info *relaycommon.RelayInfo) {
-
+	// 转换前规范化，后续的 thinking 后缀、模型族等判断都基于规范化后的模型名，OriginModelName 保留原名用于计费
+	if info.ChannelMeta != nil {
+		info.UpstreamModelName = normalizeGeminiModelName(info.UpstreamModelName)
+	}
 }
 
-func (a *Adaptor) GetRequestURL(info *relaycommon.RelayInfo) (string, error) {
+// normalizeGeminiModelName strips a configured provider prefix (e.g. "google/") and an OpenRouter style tag
+// (e.g. ":free"), neither of which Gemini accepts in the model path. With model suffix pass-through enabled
+// the name is sent verbatim so a chained new-api deployment can resolve it itself.
+func normalizeGeminiModelName(modelName string) string {
+	if model_setting.GetGlobalSettings().ModelSuffixPassThroughEnabled {
+		return modelName
+	}
+	for _, prefix := range model_setting.GetGeminiSettings().ModelProviderPrefixes {
+		if prefix != "" && strings.HasPrefix(modelName, prefix) {
+			modelName = strings.TrimPrefix(modelName, prefix)
+			break
+		}
+	}
+	if baseModel, _, ok := strings.Cut(modelName, ":"); ok {
+		modelName = baseModel
+	}
+	return modelName
+}
 
+// geminiUpstreamBaseModel returns the normalized upstream model without the thinking adapter suffixes
+func geminiUpstreamBaseModel(info *relaycommon.RelayInfo) string {
+	modelName := normalizeGeminiModelName(info.UpstreamModelName)
 	if model_setting.GetGeminiSettings().ThinkingAdapterEnabled &&
 		!model_setting.ShouldPreserveThinkingSuffix(info.OriginModelName) {
 		// 新增逻辑：处理 -thinking-<budget> 格式
-		if strings.Contains(info.UpstreamModelName, "-thinking-") {
-			parts := strings.Split(info.UpstreamModelName, "-thinking-")
-			info.UpstreamModelName = parts[0]
-		} else if strings.HasSuffix(info.UpstreamModelName, "-thinking") { // 旧的适配
-			info.UpstreamModelName = strings.TrimSuffix(info.UpstreamModelName, "-thinking")
-		} else if strings.HasSuffix(info.UpstreamModelName, "-nothinking") {
-			info.UpstreamModelName = strings.TrimSuffix(info.UpstreamModelName, "-nothinking")
-		} else if baseModel, level, ok := reasoning.TrimEffortSuffix(info.UpstreamModelName); ok && level != "" {
-			info.UpstreamModelName = baseModel
+		if strings.Contains(modelName, "-thinking-") {
+			parts := strings.Split(modelName, "-thinking-")
+			modelName = parts[0]
+		} else if strings.HasSuffix(modelName, "-thinking") { // 旧的适配
+			modelName = strings.TrimSuffix(modelName, "-thinking")
+		} else if strings.HasSuffix(modelName, "-nothinking") {
+			modelName = strings.TrimSuffix(modelName, "-nothinking")
+		} else if baseModel, level, ok := reasoning.TrimEffortSuffix(modelName); ok && level != "" {
+			modelName = baseModel
 		}
 	}
+	return modelName
+}
+
+func (a *Adaptor) GetRequestURL(info *relaycommon.RelayInfo) (string, error) {
+
+	info.UpstreamModelName = geminiUpstreamBaseModel(info)
 
 	version := model_setting.GetGeminiVersionSetting(info.UpstreamModelName)
 
-	if strings.HasPrefix(info.UpstreamModelName, "imagen") {
-		return fmt.Sprintf("%s/%s/models/%s:predict", info.ChannelBaseUrl, version, info.UpstreamModelName), nil
+	if info.RelayMode == relayconstant.RelayModeChatCompletionsCountTokens {
+		return fmt.Sprintf("%s/%s/models/%s:countTokens", info.ChannelBaseUrl, version, info.UpstreamModelName), nil
+	}
+
+	// rerank 通过 generateContent 结构化输出模拟，TTS 通过 generateContent 的 AUDIO 输出实现，转写同样走 generateContent
+	if info.RelayMode == relayconstant.RelayModeRerank || info.RelayMode == relayconstant.RelayModeAudioSpeech ||
+		info.RelayMode == relayconstant.RelayModeAudioTranscription {
+		return fmt.Sprintf("%s/%s/models/%s:generateContent", info.ChannelBaseUrl, version, info.UpstreamModelName), nil
 	}
 
-	if strings.HasPrefix(info.UpstreamModelName, "text-embedding") ||
-		strings.HasPrefix(info.UpstreamModelName, "embedding") ||
-		strings.HasPrefix(info.UpstreamModelName, "gemini-embedding") {
+	switch getGeminiModelFamily(info.UpstreamModelName) {
+	case geminiModelFamilyImagen:
+		action := "predict"
+		if info.IsStream && isImagenStreamModel(info.UpstreamModelName) {
+			action = "streamPredict?alt=sse"
+		}
+		return fmt.Sprintf("%s/%s/models/%s:%s", info.ChannelBaseUrl, version, info.UpstreamModelName, action), nil
+	case geminiModelFamilyEmbedding:
 		action := "embedContent"
 		if info.IsGeminiBatchEmbedding {
 			action = "batchEmbedContents"
@@ -163,7 +411,7 @@ func (a *Adaptor) GetRequestURL(info *relaycommon.RelayInfo) (string, error) {
 	action := "generateContent"
 	if info.IsStream {
 		action = "streamGenerateContent?alt=sse"
-		if info.RelayMode == constant.RelayModeGemini {
+		if info.RelayMode == relayconstant.RelayModeGemini {
 			info.DisablePing = true
 		}
 	}
@@ -172,42 +420,183 @@ func (a *Adaptor) GetRequestURL(info *relaycommon.RelayInfo) (string, error) {
 
 func (a *Adaptor) SetupRequestHeader(c *gin.Context, req *http.Header, info *relaycommon.RelayInfo) error {
 	channel.SetupApiRequestHeader(info, c, req)
-	req.Set("x-goog-api-key", info.ApiKey)
+	req.Set("x-goog-api-key", geminiRequestApiKey(c, info))
+	injectGeminiTraceHeaders(c, *req)
+	// 转写请求的客户端是 multipart 表单，转换后发往上游的是 JSON
+	if info.RelayMode == relayconstant.RelayModeAudioTranscription {
+		req.Set("Content-Type", "application/json")
+	}
+	if common.GetContextKeyBool(c, constant.ContextKeyGeminiRequestCompressed) {
+		req.Set("Content-Encoding", "gzip")
+	}
 	return nil
 }
 
-func (a *Adaptor) ConvertOpenAIRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeneralOpenAIRequest) (any, error) {
+// geminiRequestApiKey returns the key upstream requests are sent with, the client key for BYOK requests
+// and the channel key otherwise
+func geminiRequestApiKey(c *gin.Context, info *relaycommon.RelayInfo) string {
+	if providerKey, ok := geminiProviderApiKey(c); ok {
+		return providerKey
+	}
+	return info.ApiKey
+}
+
+// geminiProviderApiKey returns the client supplied Gemini key (BYOK), only tokens with the permission may use it
+func geminiProviderApiKey(c *gin.Context) (string, bool) {
+	if !common.GetContextKeyBool(c, constant.ContextKeyTokenProviderKey) {
+		return "", false
+	}
+	providerKey := strings.TrimSpace(c.Request.Header.Get("X-Provider-Api-Key"))
+	return providerKey, providerKey != ""
+}
+
+// ApplyChannelSystemPrompt injects the channel system prompt into systemInstruction, for native requests
+// and for OpenAI-format requests converted to Gemini alike.
+// In override mode it is merged before the client instructions, or after them when SystemPromptAppend is set.
+// Requests that reference a cachedContent are left alone, Gemini rejects systemInstruction next to a cache.
+func ApplyChannelSystemPrompt(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeminiChatRequest) {
+	if request.CachedContent != "" {
+		return
+	}
+	if request.SystemInstructions == nil {
+		request.SystemInstructions = &dto.GeminiChatContent{
+			Parts: []dto.GeminiPart{
+				{Text: info.ChannelSetting.SystemPrompt},
+			},
+		}
+		return
+	}
+	if len(request.SystemInstructions.Parts) == 0 {
+		request.SystemInstructions.Parts = []dto.GeminiPart{{Text: info.ChannelSetting.SystemPrompt}}
+		return
+	}
+	if !info.ChannelSetting.SystemPromptOverride {
+		return
+	}
+	common.SetContextKey(c, constant.ContextKeySystemPromptOverride, true)
+	parts := request.SystemInstructions.Parts
+	if info.ChannelSetting.SystemPromptAppend {
+		for i := len(parts) - 1; i >= 0; i-- {
+			if parts[i].Text == "" {
+				continue
+			}
+			parts[i].Text = info.ChannelSetting.MergeSystemPrompt(parts[i].Text)
+			return
+		}
+		request.SystemInstructions.Parts = append(parts, dto.GeminiPart{Text: info.ChannelSetting.SystemPrompt})
+		return
+	}
+	for i := range parts {
+		if parts[i].Text == "" {
+			continue
+		}
+		parts[i].Text = info.ChannelSetting.MergeSystemPrompt(parts[i].Text)
+		return
+	}
+	request.SystemInstructions.Parts = append([]dto.GeminiPart{{Text: info.ChannelSetting.SystemPrompt}}, parts...)
+}
+
+// markProviderKeyUsed records whether the request sent upstream actually carried the client key, a channel header
+// override may replace it after SetupRequestHeader, so the price is only waived when the sent header matches
+func markProviderKeyUsed(c *gin.Context, resp any) {
+	providerKey, ok := geminiProviderApiKey(c)
+	httpResp, isHTTP := resp.(*http.Response)
+	used := ok && isHTTP && httpResp != nil && httpResp.Request != nil && httpResp.Request.Header.Get("x-goog-api-key") == providerKey
+	common.SetContextKey(c, constant.ContextKeyProviderKeyUsed, used)
+}
+
+func (a *Adaptor) ConvertOpenAIRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeneralOpenAIRequest) (converted any, err error) {
+	span := startGeminiSpan(c, info, "gemini.convert_request")
+	defer func() { endGeminiSpan(span, err) }()
+	resetGeminiFinishReasons(c)
 	if request == nil {
 		return nil, errors.New("request is nil")
 	}
+	if err := checkOperationSupported(c, info); err != nil {
+		return nil, err
+	}
+	if err := checkRequestBodySize(c, info); err != nil {
+		return nil, err
+	}
+	if err := applyRegionBaseUrl(c, info); err != nil {
+		return nil, err
+	}
+	applyContextOverflowUpgrade(c, info)
+	isCountTokens := info.RelayMode == relayconstant.RelayModeChatCompletionsCountTokens
+	if isCountTokens {
+		// :countTokens 没有流式版本，stream 参数被忽略
+		info.IsStream = false
+	}
+	// ShouldIncludeUsage 由 compatible_handler 按客户端原始 stream_options 设置，此处的 StreamOptions 可能已被强制改写，
+	// 因此不再读取 request.StreamOptions；渠道可配置始终追加 choices 为空的最终 usage 分片
+	if info.IsStream && info.RelayFormat == types.RelayFormatOpenAI && info.ChannelMeta != nil && info.ChannelOtherSettings.GeminiAlwaysIncludeUsage {
+		info.ShouldIncludeUsage = true
+	}
 
 	geminiRequest, err := CovertOpenAI2Gemini(c, *request, info)
 	if err != nil {
 		return nil, err
 	}
+	// 渠道系统提示需在缓存前注入，随 systemInstruction 一起进入 cachedContent
+	if info.ChannelMeta != nil && info.ChannelSetting.SystemPrompt != "" {
+		ApplyChannelSystemPrompt(c, info, geminiRequest)
+	}
+	if isCountTokens {
+		return convertCountTokensRequest(info, geminiRequest), nil
+	}
+	applyPromptCacheKey(c, info, geminiRequest, request.PromptCacheKey)
 
 	return geminiRequest, nil
 }
 
 func (a *Adaptor) ConvertRerankRequest(c *gin.Context, relayMode int, request dto.RerankRequest) (any, error) {
-	return nil, nil
+	return convertRerankRequest(c, request)
 }
 
 func (a *Adaptor) ConvertEmbeddingRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.EmbeddingRequest) (any, error) {
+	if err := checkRequestBodySize(c, info); err != nil {
+		return nil, err
+	}
+	if err := checkOperationSupported(c, info); err != nil {
+		return nil, err
+	}
+	if err := applyRegionBaseUrl(c, info); err != nil {
+		return nil, err
+	}
 	if request.Input == nil {
-		return nil, errors.New("input is required")
+		return nil, errors.New(i18n.T(c, i18n.MsgGeminiInputRequired))
 	}
 
 	inputs := request.ParseInput()
 	if len(inputs) == 0 {
-		return nil, errors.New("input is empty")
+		return nil, errors.New(i18n.T(c, i18n.MsgGeminiInputEmpty))
+	}
+	// 多个输入使用 batchEmbedContents，单个输入直接走 embedContent，payload 与 endpoint 需保持一致
+	info.IsGeminiBatchEmbedding = len(inputs) > 1
+	taskTypes, err := parseEmbeddingTaskTypes(c, request.TaskType, len(inputs))
+	if err != nil {
+		return nil, err
+	}
+	titles, err := parseEmbeddingTitles(c, request.Title, taskTypes)
+	if err != nil {
+		return nil, err
+	}
+	dimensions := lo.FromPtrOr(request.Dimensions, 0)
+	supportsOutputDimensionality := embeddingSupportsOutputDimensionality(info.UpstreamModelName)
+	// 开启 Matryoshka 归一化时由本地截断，不支持的模型也可以处理 dimensions
+	if dimensions > 0 && !supportsOutputDimensionality && !model_setting.GetGeminiSettings().EmbeddingMatryoshkaNormalizeEnabled {
+		return nil, types.NewErrorWithStatusCode(
+			errors.New(i18n.T(c, i18n.MsgGeminiEmbeddingDimensionsNotSupported, map[string]any{"Model": info.UpstreamModelName})),
+			types.ErrorCodeInvalidRequest,
+			http.StatusBadRequest,
+			types.ErrOptionWithSkipRetry(),
+		)
 	}
-	// We always build a batch-style payload with `requests`, so ensure we call the
-	// batch endpoint upstream to avoid payload/endpoint mismatches.
-	info.IsGeminiBatchEmbedding = true
 	// process all inputs
 	geminiRequests := make([]map[string]interface{}, 0, len(inputs))
-	for _, input := range inputs {
+	inputTokens := make([]int, 0, len(inputs))
+	for i, input := range inputs {
+		inputTokens = append(inputTokens, service.CountTextToken(input, info.UpstreamModelName))
 		geminiRequest := map[string]interface{}{
 			"model": fmt.Sprintf("models/%s", info.UpstreamModelName),
 			"content": dto.GeminiChatContent{
@@ -218,36 +607,243 @@ func (a *Adaptor) ConvertEmbeddingRequest(c *gin.Context, info *relaycommon.Rela
 				},
 			},
 		}
+		if taskTypes[i] != "" {
+			geminiRequest["taskType"] = taskTypes[i]
+		}
+		if titles[i] != "" {
+			geminiRequest["title"] = titles[i]
+		}
 
-		// set specific parameters for different models
 		// https://ai.google.dev/api/embeddings?hl=zh-cn#method:-models.embedcontent
-		switch info.UpstreamModelName {
-		case "text-embedding-004", "gemini-embedding-exp-03-07", "gemini-embedding-001":
-			// Only newer models introduced after 2024 support OutputDimensionality
-			dimensions := lo.FromPtrOr(request.Dimensions, 0)
-			if dimensions > 0 {
-				geminiRequest["outputDimensionality"] = dimensions
-			}
+		if dimensions > 0 && supportsOutputDimensionality {
+			geminiRequest["outputDimensionality"] = dimensions
 		}
 		geminiRequests = append(geminiRequests, geminiRequest)
 	}
+	// batchEmbedContents does not report usage, keep local per-item counts for the response
+	common.SetContextKey(c, constant.ContextKeyGeminiEmbeddingInputTokens, inputTokens)
+	if model_setting.GetGeminiSettings().EmbeddingMatryoshkaNormalizeEnabled {
+		common.SetContextKey(c, constant.ContextKeyGeminiEmbeddingDimensions, dimensions)
+	}
 
+	if !info.IsGeminiBatchEmbedding {
+		return geminiRequests[0], nil
+	}
 	return map[string]interface{}{
 		"requests": geminiRequests,
 	}, nil
 }
 
+// outputDimensionalityModels are the embedding model prefixes that support Matryoshka outputDimensionality,
+// the legacy embedding-001 and embedding-gecko models always return full size vectors
+var outputDimensionalityModels = []string{
+	"gemini-embedding",
+	"text-embedding-004",
+	"text-embedding-005",
+	"text-multilingual-embedding-002",
+}
+
+func embeddingSupportsOutputDimensionality(modelName string) bool {
+	return lo.SomeBy(outputDimensionalityModels, func(prefix string) bool {
+		return strings.HasPrefix(modelName, prefix)
+	})
+}
+
+// embeddingTaskTypes are the task types accepted by Gemini embedding models
+var embeddingTaskTypes = []string{
+	"TASK_TYPE_UNSPECIFIED",
+	"RETRIEVAL_QUERY",
+	"RETRIEVAL_DOCUMENT",
+	"SEMANTIC_SIMILARITY",
+	"CLASSIFICATION",
+	"CLUSTERING",
+	"QUESTION_ANSWERING",
+	"FACT_VERIFICATION",
+	"CODE_RETRIEVAL_QUERY",
+}
+
+// parseEmbeddingStrings reads a field that is either a single string applied to every input or an array
+// with one value per input. It returns the number of values found when the array length does not match.
+func parseEmbeddingStrings(raw json.RawMessage, inputCount int) ([]string, int, bool) {
+	var perItem []string
+	switch common.GetJsonType(raw) {
+	case "unknown", "null":
+		return make([]string, inputCount), inputCount, true
+	case "string":
+		var single string
+		if err := common.Unmarshal(raw, &single); err != nil {
+			return nil, 0, false
+		}
+		perItem = lo.Times(inputCount, func(int) string { return single })
+	case "array":
+		if err := common.Unmarshal(raw, &perItem); err != nil {
+			perItem = nil
+		}
+	}
+	return perItem, len(perItem), len(perItem) == inputCount
+}
+
+// parseEmbeddingTaskTypes expands task_type to one Gemini taskType per input, a single string applies to
+// every input while an array must be aligned with the inputs.
+func parseEmbeddingTaskTypes(c *gin.Context, raw json.RawMessage, inputCount int) ([]string, error) {
+	perItem, count, ok := parseEmbeddingStrings(raw, inputCount)
+	if !ok {
+		return nil, types.NewErrorWithStatusCode(
+			errors.New(i18n.T(c, i18n.MsgGeminiEmbeddingTaskTypeInvalid, map[string]any{"Inputs": inputCount, "TaskTypes": count})),
+			types.ErrorCodeInvalidRequest,
+			http.StatusBadRequest,
+			types.ErrOptionWithSkipRetry(),
+		)
+	}
+	taskTypes := make([]string, inputCount)
+	for i, taskType := range perItem {
+		taskTypes[i] = strings.ToUpper(strings.TrimSpace(taskType))
+		if taskTypes[i] != "" && !lo.Contains(embeddingTaskTypes, taskTypes[i]) {
+			return nil, types.NewErrorWithStatusCode(
+				errors.New(i18n.T(c, i18n.MsgGeminiEmbeddingTaskTypeUnsupported, map[string]any{"TaskType": taskType, "Allowed": strings.Join(embeddingTaskTypes, ", ")})),
+				types.ErrorCodeInvalidRequest,
+				http.StatusBadRequest,
+				types.ErrOptionWithSkipRetry(),
+			)
+		}
+	}
+	return taskTypes, nil
+}
+
+// parseEmbeddingTitles reads the per input document titles, Gemini only uses a title for RETRIEVAL_DOCUMENT
+func parseEmbeddingTitles(c *gin.Context, raw json.RawMessage, taskTypes []string) ([]string, error) {
+	titles, count, ok := parseEmbeddingStrings(raw, len(taskTypes))
+	if !ok {
+		return nil, types.NewErrorWithStatusCode(
+			errors.New(i18n.T(c, i18n.MsgGeminiEmbeddingTitleInvalid, map[string]any{"Inputs": len(taskTypes), "Titles": count})),
+			types.ErrorCodeInvalidRequest,
+			http.StatusBadRequest,
+			types.ErrOptionWithSkipRetry(),
+		)
+	}
+	for i, title := range titles {
+		if title != "" && taskTypes[i] != "RETRIEVAL_DOCUMENT" {
+			return nil, types.NewErrorWithStatusCode(
+				errors.New(i18n.T(c, i18n.MsgGeminiEmbeddingTitleRequiresDocument)),
+				types.ErrorCodeInvalidRequest,
+				http.StatusBadRequest,
+				types.ErrOptionWithSkipRetry(),
+			)
+		}
+	}
+	return titles, nil
+}
+
 func (a *Adaptor) ConvertOpenAIResponsesRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.OpenAIResponsesRequest) (any, error) {
 	// TODO implement me
 	return nil, errors.New("not implemented")
 }
 
-func (a *Adaptor) DoRequest(c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader) (any, error) {
-	return channel.DoApiRequest(a, c, info, requestBody)
+func (a *Adaptor) DoRequest(c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader) (resp any, err error) {
+	span := startGeminiUpstreamSpan(c, info)
+	defer func() {
+		setGeminiUpstreamSpanAttributes(span, resp)
+		endGeminiSpan(span, err)
+	}()
+	// 兜底校验，未经本适配器转换的请求（如透传）同样在发往上游前拦截
+	if err := checkOperationSupported(c, info); err != nil {
+		return nil, err
+	}
+	applyChannelRequestTimeout(info)
+	if err := applyRequestDeadline(c, info); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil && isRequestDeadlineExceeded(info) {
+			err = requestDeadlineExceededError(c, info)
+		}
+		if err == nil {
+			markProviderKeyUsed(c, resp)
+			applyStreamIdleTimeout(info, resp)
+			normalizeGeminiErrorResponse(info, resp)
+		}
+	}()
+	if requestBody, err = applyRequestJq(c, info, requestBody); err != nil {
+		return nil, err
+	}
+	if requestBody, err = echoGenerationConfig(c, requestBody); err != nil {
+		return nil, err
+	}
+	if info.RelayMode == relayconstant.RelayModeImagesGenerations && isImagenModel(info.UpstreamModelName) && imageIdempotencyTTL() > 0 {
+		body, err := io.ReadAll(requestBody)
+		if err != nil {
+			return nil, err
+		}
+		if resp := getCachedImageResponse(c, info, body); resp != nil {
+			return resp, nil
+		}
+		requestBody = bytes.NewReader(body)
+	}
+	if isStreamFanOut(c, info) {
+		return doStreamFanOutRequest(a, c, info, requestBody)
+	}
+	if isEmbeddingPartialResults(info) {
+		return doEmbeddingPartialRequest(a, c, info, requestBody)
+	}
+	if isInFlightDedup(info) {
+		return doInFlightDedupRequest(a, c, info, requestBody)
+	}
+	if restore, ok := common.GetContextKeyType[*promptCacheRestore](c, constant.ContextKeyGeminiPromptCache); ok {
+		return doPromptCacheRequest(a, c, info, restore, requestBody)
+	}
+	return doGeminiUpstreamRequest(a, c, info, requestBody)
+}
+
+func doGeminiUpstreamRequest(a *Adaptor, c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader) (any, error) {
+	send := func(body io.Reader) (any, error) {
+		if isRequestCompression(info) {
+			return doCompressedRequest(a, c, info, body)
+		}
+		return channel.DoApiRequest(a, c, info, body)
+	}
+	if maxAttempts := rateLimitRetryMaxAttempts(info); maxAttempts > 0 {
+		return doRateLimitRetryRequest(c, info, requestBody, maxAttempts, send)
+	}
+	return send(requestBody)
 }
 
 func (a *Adaptor) DoResponse(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo) (usage any, err *types.NewAPIError) {
-	if info.RelayMode == constant.RelayModeGemini {
+	span := startGeminiSpan(c, info, "gemini.handle_response")
+	defer func() {
+		setGeminiResponseSpanAttributes(c, span, usage)
+		var spanErr error
+		if err != nil {
+			spanErr = err
+		}
+		endGeminiSpan(span, spanErr)
+	}()
+	if decodeErr := decodeResponseBody(resp); decodeErr != nil {
+		return nil, types.NewOpenAIError(decodeErr, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+	applyResponseJq(c, info, resp)
+	usage, err = a.doResponse(c, resp, info)
+	if err == nil {
+		applyPromptCacheCreationUsage(c, usage)
+	}
+	if err == nil && common.GetContextKeyBool(c, constant.ContextKeyGeminiInFlightDedupHit) {
+		// 复用了相同的进行中请求，上游只执行了一次，由首个请求计费
+		if info.PriceData.OtherRatios == nil {
+			info.PriceData.OtherRatios = make(map[string]float64)
+		}
+		info.PriceData.OtherRatios["in_flight_dedup"] = 0
+	}
+	if err == nil && common.GetContextKeyBool(c, constant.ContextKeyProviderKeyUsed) {
+		// 使用客户自带的 key，上游费用由客户承担
+		if info.PriceData.OtherRatios == nil {
+			info.PriceData.OtherRatios = make(map[string]float64)
+		}
+		info.PriceData.OtherRatios["provider_key"] = 0
+	}
+	return usage, err
+}
+
+func (a *Adaptor) doResponse(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo) (usage any, err *types.NewAPIError) {
+	if info.RelayMode == relayconstant.RelayModeGemini {
 		if strings.Contains(info.RequestURLPath, ":embedContent") ||
 			strings.Contains(info.RequestURLPath, ":batchEmbedContents") {
 			return NativeGeminiEmbeddingHandler(c, resp, info)
@@ -259,17 +855,35 @@ func (a *Adaptor) DoResponse(c *gin.Context, resp *http.Response, info *relaycom
 		}
 	}
 
-	if strings.HasPrefix(info.UpstreamModelName, "imagen") {
-		return GeminiImageHandler(c, info, resp)
+	if info.RelayMode == relayconstant.RelayModeRerank {
+		return GeminiRerankHandler(c, info, resp)
+	}
+
+	if info.RelayMode == relayconstant.RelayModeChatCompletionsCountTokens {
+		return GeminiCountTokensHandler(c, info, resp)
+	}
+
+	if info.RelayMode == relayconstant.RelayModeAudioSpeech {
+		return GeminiSpeechHandler(c, info, resp)
 	}
 
-	// check if the model is an embedding model
-	if strings.HasPrefix(info.UpstreamModelName, "text-embedding") ||
-		strings.HasPrefix(info.UpstreamModelName, "embedding") ||
-		strings.HasPrefix(info.UpstreamModelName, "gemini-embedding") {
+	if info.RelayMode == relayconstant.RelayModeAudioTranscription {
+		return GeminiTranscriptionHandler(c, info, resp)
+	}
+
+	switch getGeminiModelFamily(info.UpstreamModelName) {
+	case geminiModelFamilyImagen:
+		if info.IsStream {
+			return GeminiImageStreamHandler(c, info, resp)
+		}
+		return GeminiImageHandler(c, info, resp)
+	case geminiModelFamilyEmbedding:
 		return GeminiEmbeddingHandler(c, info, resp)
 	}
 
+	if isStreamFanOut(c, info) {
+		return GeminiChatFanOutStreamHandler(c, info, resp)
+	}
 	if info.IsStream {
 		return GeminiChatStreamHandler(c, info, resp)
 	} else {
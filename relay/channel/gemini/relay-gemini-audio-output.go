@@ -0,0 +1,129 @@
+package gemini
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/i18n"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// geminiAudioOutputFormats maps the supported audio.format values to the message.audio format,
+// Gemini only returns PCM so formats that need an encoder (mp3, opus, flac) are rejected
+var geminiAudioOutputFormats = map[string]string{
+	"pcm16": "pcm16",
+	"pcm":   "pcm16",
+	"wav":   "wav",
+}
+
+// Gemini 音频输出按每秒 25 token 计费
+const geminiAudioTokensPerSecond = 25
+
+// setGeminiAudioOutputFormat records the message.audio format of a chat request asking for audio output.
+// An empty audio.format, or the passthrough setting, keeps the PCM returned by Gemini.
+func setGeminiAudioOutputFormat(c *gin.Context, textRequest dto.GeneralOpenAIRequest) error {
+	format := "pcm16"
+	if !model_setting.GetGeminiSettings().AudioOutputPassthroughEnabled && len(textRequest.Audio) > 0 {
+		var audio struct {
+			Format string `json:"format"`
+		}
+		if err := common.Unmarshal(textRequest.Audio, &audio); err != nil {
+			return fmt.Errorf("invalid audio: %w", err)
+		}
+		if requested := strings.ToLower(strings.TrimSpace(audio.Format)); requested != "" {
+			mapped, ok := geminiAudioOutputFormats[requested]
+			if !ok {
+				return types.NewErrorWithStatusCode(
+					errors.New(i18n.T(c, i18n.MsgGeminiAudioFormatUnsupported, map[string]any{"Format": audio.Format})),
+					types.ErrorCodeInvalidRequest,
+					http.StatusBadRequest,
+					types.ErrOptionWithSkipRetry(),
+				)
+			}
+			format = mapped
+		}
+	}
+	common.SetContextKey(c, constant.ContextKeyGeminiAudioOutputFormat, format)
+	return nil
+}
+
+func isGeminiAudioOutputRequested(c *gin.Context) bool {
+	return common.GetContextKeyString(c, constant.ContextKeyGeminiAudioOutputFormat) != ""
+}
+
+// buildGeminiMessageAudio joins the audio parts of a candidate into message.audio. PCM is wrapped in a WAV
+// container when the client asked for wav, any other upstream format is returned as is.
+func buildGeminiMessageAudio(c *gin.Context, parts []dto.GeminiInlineData, id string, expiresAt int64) *dto.MessageAudio {
+	sourceFormat, sampleRate := geminiOutputAudioFormat(parts[0].MimeType)
+	chunks := make([]string, 0, len(parts))
+	for _, part := range parts {
+		chunks = append(chunks, part.Data)
+	}
+	audio := &dto.MessageAudio{
+		Id:        id,
+		Data:      joinBase64Chunks(chunks),
+		Format:    sourceFormat,
+		ExpiresAt: expiresAt,
+	}
+	if sourceFormat != "pcm16" || common.GetContextKeyString(c, constant.ContextKeyGeminiAudioOutputFormat) != "wav" {
+		return audio
+	}
+	pcm, err := base64.StdEncoding.DecodeString(audio.Data)
+	if err != nil {
+		return audio
+	}
+	if sampleRate <= 0 {
+		sampleRate = defaultSpeechSampleRate
+	}
+	audio.Data = base64.StdEncoding.EncodeToString(pcmToWav(pcm, sampleRate))
+	audio.Format = "wav"
+	return audio
+}
+
+// geminiOutputAudioSeconds sums the duration of the PCM audio parts in a response from their byte size
+func geminiOutputAudioSeconds(response *dto.GeminiChatResponse) float64 {
+	var seconds float64
+	for _, candidate := range response.Candidates {
+		for _, part := range candidate.Content.Parts {
+			if part.InlineData == nil || !strings.HasPrefix(part.InlineData.MimeType, "audio") {
+				continue
+			}
+			format, sampleRate := geminiOutputAudioFormat(part.InlineData.MimeType)
+			if format != "pcm16" {
+				continue
+			}
+			if sampleRate <= 0 {
+				sampleRate = defaultSpeechSampleRate
+			}
+			data := part.InlineData.Data
+			size := base64.StdEncoding.DecodedLen(len(data)) - strings.Count(data[max(len(data)-2, 0):], "=")
+			seconds += float64(size) / float64(sampleRate*2)
+		}
+	}
+	return seconds
+}
+
+// applyGeminiAudioOutputUsage splits the candidate tokens into audio and text tokens by the audio duration
+// when usageMetadata has no AUDIO entry in candidatesTokensDetails, so audio output is billed at the audio ratio
+func applyGeminiAudioOutputUsage(usage *dto.Usage, audioSeconds float64) {
+	if audioSeconds <= 0 || usage.CompletionTokenDetails.AudioTokens > 0 {
+		return
+	}
+	candidateTokens := usage.CompletionTokens - usage.CompletionTokenDetails.ReasoningTokens
+	audioTokens := min(int(math.Ceil(audioSeconds*geminiAudioTokensPerSecond)), candidateTokens)
+	if audioTokens <= 0 {
+		return
+	}
+	usage.CompletionTokenDetails.AudioTokens = audioTokens
+	usage.CompletionTokenDetails.TextTokens = candidateTokens - audioTokens
+}
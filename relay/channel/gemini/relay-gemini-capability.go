@@ -0,0 +1,110 @@
+package gemini
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/i18n"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+type geminiModelFamily string
+
+const (
+	geminiModelFamilyChat      geminiModelFamily = "chat"
+	geminiModelFamilyImagen    geminiModelFamily = "imagen"
+	geminiModelFamilyEmbedding geminiModelFamily = "embedding"
+)
+
+// geminiModelFamilyPrefixes maps model name prefixes to their family, models matching none are chat models
+var geminiModelFamilyPrefixes = []struct {
+	prefix string
+	family geminiModelFamily
+}{
+	{"imagen", geminiModelFamilyImagen},
+	{"text-embedding", geminiModelFamilyEmbedding},
+	{"embedding", geminiModelFamilyEmbedding},
+	{"gemini-embedding", geminiModelFamilyEmbedding},
+}
+
+// geminiFamilyOperations lists the relay modes each family serves. Chat models serve every mode except the
+// ones in geminiChatUnsupportedOperations, so modes routed to generateContent need no entry here.
+var geminiFamilyOperations = map[geminiModelFamily]map[int]bool{
+	geminiModelFamilyImagen:    {relayconstant.RelayModeImagesGenerations: true},
+	geminiModelFamilyEmbedding: {relayconstant.RelayModeEmbeddings: true},
+}
+
+// 图像编辑没有对应的 Gemini 接口，任何模型都不支持
+var geminiChatUnsupportedOperations = map[int]bool{
+	relayconstant.RelayModeEmbeddings:        true,
+	relayconstant.RelayModeImagesGenerations: true,
+	relayconstant.RelayModeImagesEdits:       true,
+}
+
+// geminiOperationNames names relay modes in capability errors
+var geminiOperationNames = map[int]string{
+	relayconstant.RelayModeChatCompletions:            "chat completions",
+	relayconstant.RelayModeCompletions:                "completions",
+	relayconstant.RelayModeEmbeddings:                 "embeddings",
+	relayconstant.RelayModeImagesGenerations:          "image generation",
+	relayconstant.RelayModeImagesEdits:                "image edits",
+	relayconstant.RelayModeAudioSpeech:                "speech",
+	relayconstant.RelayModeAudioTranscription:         "transcription",
+	relayconstant.RelayModeAudioTranslation:           "translation",
+	relayconstant.RelayModeRerank:                     "rerank",
+	relayconstant.RelayModeResponses:                  "responses",
+	relayconstant.RelayModeChatCompletionsCountTokens: "token counting",
+}
+
+func getGeminiModelFamily(modelName string) geminiModelFamily {
+	for _, entry := range geminiModelFamilyPrefixes {
+		if strings.HasPrefix(modelName, entry.prefix) {
+			return entry.family
+		}
+	}
+	return geminiModelFamilyChat
+}
+
+func isImagenModel(modelName string) bool {
+	return getGeminiModelFamily(modelName) == geminiModelFamilyImagen
+}
+
+func isEmbeddingModel(modelName string) bool {
+	return getGeminiModelFamily(modelName) == geminiModelFamilyEmbedding
+}
+
+// supportsOperation reports whether the model can serve the relay mode. Native Gemini requests pick the
+// action from the request path and unknown modes (e.g. Claude messages) are left to the upstream.
+func supportsOperation(modelName string, relayMode int) bool {
+	if relayMode == relayconstant.RelayModeUnknown || relayMode == relayconstant.RelayModeGemini {
+		return true
+	}
+	family := getGeminiModelFamily(modelName)
+	if family == geminiModelFamilyChat {
+		return !geminiChatUnsupportedOperations[relayMode]
+	}
+	return geminiFamilyOperations[family][relayMode]
+}
+
+// checkOperationSupported fails before any upstream call when the model cannot serve the requested operation,
+// e.g. chat completions on an embedding model, instead of surfacing a confusing upstream error
+func checkOperationSupported(c *gin.Context, info *relaycommon.RelayInfo) error {
+	if supportsOperation(info.UpstreamModelName, info.RelayMode) {
+		return nil
+	}
+	operation, ok := geminiOperationNames[info.RelayMode]
+	if !ok {
+		operation = "this operation"
+	}
+	return types.NewErrorWithStatusCode(
+		errors.New(i18n.T(c, i18n.MsgGeminiOperationUnsupported, map[string]any{"Model": info.UpstreamModelName, "Operation": operation})),
+		types.ErrorCodeInvalidRequest,
+		http.StatusBadRequest,
+		types.ErrOptionWithSkipRetry(),
+	)
+}
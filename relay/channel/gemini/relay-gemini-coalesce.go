@@ -0,0 +1,105 @@
+package gemini
+
+import (
+	"time"
+
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+)
+
+// geminiStreamCoalescer merges consecutive text-only stream chunks that arrive within a time window into one delta.
+// The first chunk of a window is emitted right away, later chunks of the same window are held back and flushed
+// together on the next chunk after the window, on any chunk that cannot be merged, or when the stream ends.
+// Chunks are only inspected on arrival, so held back text waits at most until the next upstream chunk.
+type geminiStreamCoalescer struct {
+	window      time.Duration
+	windowStart time.Time
+	pending     *dto.ChatCompletionsStreamResponse
+}
+
+func newGeminiStreamCoalescer() *geminiStreamCoalescer {
+	windowMs := model_setting.GetGeminiSettings().StreamCoalesceWindowMs
+	if windowMs <= 0 {
+		return nil
+	}
+	return &geminiStreamCoalescer{window: time.Duration(windowMs) * time.Millisecond}
+}
+
+// add returns the responses that should be sent now, in order
+func (s *geminiStreamCoalescer) add(response *dto.ChatCompletionsStreamResponse, now time.Time) []*dto.ChatCompletionsStreamResponse {
+	if !isCoalescableStreamResponse(response) {
+		out := s.flush()
+		s.windowStart = now
+		return append(out, response)
+	}
+	if now.Sub(s.windowStart) < s.window {
+		if s.pending == nil {
+			s.pending = response
+		} else {
+			mergeStreamResponse(s.pending, response)
+		}
+		return nil
+	}
+	s.windowStart = now
+	if s.pending == nil {
+		return []*dto.ChatCompletionsStreamResponse{response}
+	}
+	mergeStreamResponse(s.pending, response)
+	return s.flush()
+}
+
+func (s *geminiStreamCoalescer) flush() []*dto.ChatCompletionsStreamResponse {
+	if s.pending == nil {
+		return nil
+	}
+	pending := s.pending
+	s.pending = nil
+	return []*dto.ChatCompletionsStreamResponse{pending}
+}
+
+// isCoalescableStreamResponse reports whether the chunk only carries text or reasoning deltas
+func isCoalescableStreamResponse(response *dto.ChatCompletionsStreamResponse) bool {
+	if response.Usage != nil || len(response.Choices) == 0 {
+		return false
+	}
+	for _, choice := range response.Choices {
+		if choice.FinishReason != nil || choice.Logprobs != nil || choice.Grounding != nil || len(choice.SafetyRatings) > 0 {
+			return false
+		}
+		delta := choice.Delta
+		if len(delta.ToolCalls) > 0 || delta.Audio != nil || delta.Refusal != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func mergeStreamResponse(dst *dto.ChatCompletionsStreamResponse, src *dto.ChatCompletionsStreamResponse) {
+	for _, choice := range src.Choices {
+		merged := false
+		for i := range dst.Choices {
+			if dst.Choices[i].Index != choice.Index {
+				continue
+			}
+			delta := &dst.Choices[i].Delta
+			if choice.Delta.Content != nil {
+				delta.SetContentString(delta.GetContentString() + *choice.Delta.Content)
+			}
+			if choice.Delta.ReasoningContent != nil {
+				reasoning := *choice.Delta.ReasoningContent
+				if delta.ReasoningContent != nil {
+					reasoning = *delta.ReasoningContent + reasoning
+				}
+				delta.SetReasoningContent(reasoning)
+			}
+			if delta.Role == "" {
+				delta.Role = choice.Delta.Role
+			}
+			merged = true
+			break
+		}
+		if !merged {
+			dst.Choices = append(dst.Choices, choice)
+		}
+	}
+}
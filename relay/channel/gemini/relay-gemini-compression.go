@@ -0,0 +1,96 @@
+package gemini
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/relay/channel"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// compressionRejectedTTL is how long a channel whose upstream rejected a gzip body is sent uncompressed bodies
+const compressionRejectedTTL = time.Hour
+
+// compressionRejectedChannels maps channel id to the time its compression may be tried again
+var compressionRejectedChannels sync.Map
+
+func isRequestCompression(info *relaycommon.RelayInfo) bool {
+	if !model_setting.GetGeminiSettings().RequestCompressionEnabled || info.ChannelMeta == nil || info.ChannelType != constant.ChannelTypeGemini {
+		return false
+	}
+	if until, ok := compressionRejectedChannels.Load(info.ChannelId); ok {
+		if time.Now().Before(until.(time.Time)) {
+			return false
+		}
+		compressionRejectedChannels.Delete(info.ChannelId)
+	}
+	return true
+}
+
+// isCompressionRejected reports whether the upstream refused the gzip encoded body itself, rather than its content
+func isCompressionRejected(resp *http.Response, respBody []byte) bool {
+	if resp.StatusCode == http.StatusUnsupportedMediaType {
+		return true
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	// 上游未解压时会把 gzip 字节当作 JSON 解析，报 "Invalid JSON payload received. Unexpected token"
+	message := strings.ToLower(string(respBody))
+	return strings.Contains(message, "gzip") || strings.Contains(message, "content-encoding") ||
+		(strings.Contains(message, "invalid json payload") && strings.Contains(message, "unexpected token"))
+}
+
+// doCompressedRequest sends request bodies above RequestCompressionMinBytes gzip compressed. When the upstream
+// rejects the encoding the request is resent uncompressed and compression stays off for that channel for a while.
+func doCompressedRequest(a *Adaptor, c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader) (any, error) {
+	requestBytes, err := io.ReadAll(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("read request body failed: %w", err)
+	}
+	if len(requestBytes) < model_setting.GetGeminiSettings().RequestCompressionMinBytes {
+		return channel.DoApiRequest(a, c, info, bytes.NewReader(requestBytes))
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(requestBytes); err != nil {
+		return nil, fmt.Errorf("gzip request body failed: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("gzip request body failed: %w", err)
+	}
+
+	common.SetContextKey(c, constant.ContextKeyGeminiRequestCompressed, true)
+	resp, err := channel.DoApiRequest(a, c, info, bytes.NewReader(compressed.Bytes()))
+	common.SetContextKey(c, constant.ContextKeyGeminiRequestCompressed, false)
+	if err != nil || (resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusUnsupportedMediaType) {
+		return resp, err
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	service.CloseResponseBodyGracefully(resp)
+	if err != nil {
+		return nil, fmt.Errorf("read upstream response failed: %w", err)
+	}
+	if !isCompressionRejected(resp, respBody) {
+		resp.Body = io.NopCloser(bytes.NewReader(respBody))
+		return resp, nil
+	}
+	logger.LogWarn(c, fmt.Sprintf("gemini channel #%d rejected gzip request body (status %d), resending uncompressed", info.ChannelId, resp.StatusCode))
+	compressionRejectedChannels.Store(info.ChannelId, time.Now().Add(compressionRejectedTTL))
+	return channel.DoApiRequest(a, c, info, bytes.NewReader(requestBytes))
+}
@@ -0,0 +1,58 @@
+package gemini
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// convertCountTokensRequest wraps the converted chat request, counting generateContentRequest instead of bare
+// contents keeps the system instruction and tools in the count.
+func convertCountTokensRequest(info *relaycommon.RelayInfo, geminiRequest *dto.GeminiChatRequest) *dto.GeminiCountTokensRequest {
+	return &dto.GeminiCountTokensRequest{
+		GenerateContentRequest: dto.GeminiCountTokensContentRequest{
+			Model:             "models/" + geminiUpstreamBaseModel(info),
+			GeminiChatRequest: *geminiRequest,
+		},
+	}
+}
+
+// GeminiCountTokensHandler returns the upstream token count, the breakdown is keyed by lower case modality.
+// The returned usage is empty, counting tokens is not billed.
+func GeminiCountTokensHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response) (*dto.Usage, *types.NewAPIError) {
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, types.NewOpenAIError(err, types.ErrorCodeReadResponseBodyFailed, http.StatusInternalServerError)
+	}
+	service.CloseResponseBodyGracefully(resp)
+	logger.LogDebug(c, "Gemini count tokens response body: %s", responseBody)
+
+	var geminiResponse dto.GeminiCountTokensResponse
+	if err := common.Unmarshal(responseBody, &geminiResponse); err != nil {
+		return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+
+	response := dto.CountTokensResponse{
+		Object:       "count_tokens",
+		Model:        info.UpstreamModelName,
+		TotalTokens:  geminiResponse.TotalTokens,
+		CachedTokens: geminiResponse.CachedContentTokenCount,
+	}
+	if len(geminiResponse.PromptTokensDetails) > 0 {
+		response.PromptTokensDetails = make(map[string]int, len(geminiResponse.PromptTokensDetails))
+		for _, detail := range geminiResponse.PromptTokensDetails {
+			response.PromptTokensDetails[strings.ToLower(detail.Modality)] += detail.TokenCount
+		}
+	}
+	c.JSON(http.StatusOK, response)
+	return &dto.Usage{}, nil
+}
@@ -0,0 +1,71 @@
+package gemini
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/QuantumNous/new-api/i18n"
+	"github.com/QuantumNous/new-api/logger"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const requestDeadlineHeader = "X-Request-Deadline"
+
+// parseRequestDeadline accepts an RFC 3339 timestamp or a unix timestamp in seconds or milliseconds
+func parseRequestDeadline(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	if deadline, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return deadline, true
+	}
+	timestamp, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || timestamp <= 0 {
+		return time.Time{}, false
+	}
+	// 13 位及以上按毫秒处理
+	if timestamp >= 1e12 {
+		return time.UnixMilli(timestamp), true
+	}
+	return time.Unix(timestamp, 0), true
+}
+
+// applyRequestDeadline uses the gateway supplied X-Request-Deadline as the upstream deadline, an earlier
+// deadline already set on the relay info is kept. A deadline that has already passed fails without calling upstream.
+func applyRequestDeadline(c *gin.Context, info *relaycommon.RelayInfo) error {
+	value := c.Request.Header.Get(requestDeadlineHeader)
+	if value != "" {
+		deadline, ok := parseRequestDeadline(value)
+		if !ok {
+			logger.LogWarn(c, fmt.Sprintf("ignore invalid %s header: %q", requestDeadlineHeader, value))
+		} else if info.UpstreamDeadline.IsZero() || deadline.Before(info.UpstreamDeadline) {
+			info.UpstreamDeadline = deadline
+		}
+	}
+	if isRequestDeadlineExceeded(info) {
+		return requestDeadlineExceededError(c, info)
+	}
+	return nil
+}
+
+func isRequestDeadlineExceeded(info *relaycommon.RelayInfo) bool {
+	return !info.UpstreamDeadline.IsZero() && !time.Now().Before(info.UpstreamDeadline)
+}
+
+// requestDeadlineExceededError is not retried, another channel would run past the same deadline
+func requestDeadlineExceededError(c *gin.Context, info *relaycommon.RelayInfo) error {
+	return types.NewErrorWithStatusCode(
+		errors.New(i18n.T(c, i18n.MsgGeminiRequestDeadlineExceeded, map[string]any{"Deadline": info.UpstreamDeadline.UTC().Format(time.RFC3339Nano)})),
+		types.ErrorCodeDoRequestFailed,
+		http.StatusGatewayTimeout,
+		types.ErrOptionWithSkipRetry(),
+	)
+}
@@ -0,0 +1,53 @@
+package gemini
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+)
+
+const (
+	geminiDebugHeader                = "X-Gemini-Debug"
+	geminiDebugGenerationConfig      = "generation_config"
+	geminiGenerationConfigEchoHeader = "X-Gemini-Generation-Config"
+)
+
+func isGenerationConfigEchoRequested(c *gin.Context) bool {
+	if !model_setting.GetGeminiSettings().GenerationConfigEchoEnabled {
+		return false
+	}
+	options := strings.Split(c.Request.Header.Get(geminiDebugHeader), ",")
+	return lo.ContainsBy(options, func(option string) bool {
+		return strings.EqualFold(strings.TrimSpace(option), geminiDebugGenerationConfig)
+	})
+}
+
+// echoGenerationConfig returns the generationConfig of the final upstream body in a response header, the body
+// already has channel defaults, clamping and parameter overrides applied, so it shows which values took effect.
+func echoGenerationConfig(c *gin.Context, requestBody io.Reader) (io.Reader, error) {
+	if !isGenerationConfigEchoRequested(c) {
+		return requestBody, nil
+	}
+	requestBytes, err := io.ReadAll(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("read request body failed: %w", err)
+	}
+	var upstreamRequest struct {
+		GenerationConfig json.RawMessage `json:"generationConfig"`
+	}
+	if common.Unmarshal(requestBytes, &upstreamRequest) == nil && len(upstreamRequest.GenerationConfig) > 0 {
+		var compacted bytes.Buffer
+		if json.Compact(&compacted, upstreamRequest.GenerationConfig) == nil {
+			c.Header(geminiGenerationConfigEchoHeader, compacted.String())
+		}
+	}
+	return bytes.NewReader(requestBytes), nil
+}
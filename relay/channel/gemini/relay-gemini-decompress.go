@@ -0,0 +1,84 @@
+package gemini
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// decodedBody closes the decompressor and the upstream body together
+type decodedBody struct {
+	io.Reader
+	decoder  io.Closer
+	upstream io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	err := b.decoder.Close()
+	if upstreamErr := b.upstream.Close(); upstreamErr != nil {
+		return upstreamErr
+	}
+	return err
+}
+
+// isZlibHeader reports whether the deflate body is zlib wrapped (RFC 1950) rather than raw deflate,
+// servers send both for Content-Encoding: deflate
+func isZlibHeader(header []byte) bool {
+	return len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+// decodeResponseBody transparently decompresses a gzip or deflate encoded upstream body. The http client only does
+// this itself when it added Accept-Encoding, not for passed through headers or proxies that compress anyway.
+// Bodies without Content-Encoding are left untouched, streaming bodies are decoded as they are read.
+func decodeResponseBody(resp *http.Response) error {
+	if resp == nil || resp.Body == nil {
+		return nil
+	}
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return nil
+	}
+
+	upstream := resp.Body
+	var decoder io.ReadCloser
+	switch encoding {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(upstream)
+		if errors.Is(err, io.EOF) {
+			// 空响应体没有 gzip 头
+			decoder = io.NopCloser(strings.NewReader(""))
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("decode gzip response body failed: %w", err)
+		}
+		decoder = reader
+	case "deflate":
+		buffered := bufio.NewReader(upstream)
+		header, _ := buffered.Peek(2)
+		if isZlibHeader(header) {
+			reader, err := zlib.NewReader(buffered)
+			if err != nil {
+				return fmt.Errorf("decode deflate response body failed: %w", err)
+			}
+			decoder = reader
+		} else {
+			decoder = flate.NewReader(buffered)
+		}
+	default:
+		return nil
+	}
+
+	resp.Body = &decodedBody{Reader: decoder, decoder: decoder, upstream: upstream}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
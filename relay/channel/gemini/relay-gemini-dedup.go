@@ -0,0 +1,109 @@
+package gemini
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// inFlightCall holds the upstream result of a request shared by identical concurrent requests.
+// It only lives while the upstream request is running, this is not a result cache.
+type inFlightCall struct {
+	done       chan struct{}
+	statusCode int
+	header     http.Header
+	body       []byte
+	err        error
+}
+
+var (
+	inFlightCalls   = make(map[string]*inFlightCall)
+	inFlightCallsMu sync.Mutex
+)
+
+func isInFlightDedup(info *relaycommon.RelayInfo) bool {
+	return model_setting.GetGeminiSettings().InFlightDedupEnabled && !info.IsStream
+}
+
+// inFlightFingerprint hashes the converted upstream request, scoped by user, channel and model
+func inFlightFingerprint(info *relaycommon.RelayInfo, body []byte) string {
+	hash := sha256.New()
+	channelId := 0
+	if info.ChannelMeta != nil {
+		channelId = info.ChannelId
+	}
+	_, _ = fmt.Fprintf(hash, "%d:%d:%s:%s:", info.UserId, channelId, info.UpstreamModelName, info.RequestURLPath)
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// doInFlightDedupRequest executes the upstream request once for identical concurrent requests,
+// followers wait for the leader and receive a copy of its response.
+func doInFlightDedupRequest(a *Adaptor, c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader) (any, error) {
+	requestBytes, err := io.ReadAll(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("read request body failed: %w", err)
+	}
+	key := inFlightFingerprint(info, requestBytes)
+
+	inFlightCallsMu.Lock()
+	if call, ok := inFlightCalls[key]; ok {
+		inFlightCallsMu.Unlock()
+		select {
+		case <-call.done:
+		case <-c.Request.Context().Done():
+			return nil, c.Request.Context().Err()
+		}
+		if call.err != nil {
+			return nil, call.err
+		}
+		common.SetContextKey(c, constant.ContextKeyGeminiInFlightDedupHit, true)
+		return call.response(), nil
+	}
+	call := &inFlightCall{done: make(chan struct{})}
+	inFlightCalls[key] = call
+	inFlightCallsMu.Unlock()
+
+	defer func() {
+		inFlightCallsMu.Lock()
+		delete(inFlightCalls, key)
+		inFlightCallsMu.Unlock()
+		close(call.done)
+	}()
+
+	result, err := doGeminiUpstreamRequest(a, c, info, bytes.NewReader(requestBytes))
+	if err != nil {
+		call.err = err
+		return nil, err
+	}
+	resp := result.(*http.Response)
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		call.err = fmt.Errorf("read upstream response failed: %w", err)
+		return nil, call.err
+	}
+	call.statusCode = resp.StatusCode
+	call.header = resp.Header.Clone()
+	call.body = body
+	return call.response(), nil
+}
+
+func (call *inFlightCall) response() *http.Response {
+	return &http.Response{
+		StatusCode: call.statusCode,
+		Header:     call.header.Clone(),
+		Body:       io.NopCloser(bytes.NewReader(call.body)),
+	}
+}
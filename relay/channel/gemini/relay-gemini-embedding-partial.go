@@ -0,0 +1,194 @@
+package gemini
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+func isEmbeddingPartialResults(info *relaycommon.RelayInfo) bool {
+	return model_setting.GetGeminiSettings().EmbeddingPartialResultsEnabled &&
+		info.IsGeminiBatchEmbedding && info.RelayMode != relayconstant.RelayModeGemini
+}
+
+// 拆分批量请求定位失败输入时，额外发往上游的请求数上限
+const embeddingPartialMaxRequests = 32
+
+// doEmbeddingPartialRequest sends the batch as usual, when Gemini rejects the whole batch because of invalid
+// input the batch is split in halves until the failing inputs are isolated. The successful embeddings are
+// returned as a regular batch response, the failed indexes are kept in the context for the handler.
+// Errors that are not about an input (key, model, quota) and running out of split requests return the
+// upstream error as is.
+func doEmbeddingPartialRequest(a *Adaptor, c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader) (any, error) {
+	requestBytes, err := io.ReadAll(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("read request body failed: %w", err)
+	}
+	resp, err := doGeminiUpstreamRequest(a, c, info, bytes.NewReader(requestBytes))
+	if err != nil {
+		return nil, err
+	}
+	httpResp := resp.(*http.Response)
+	if httpResp.StatusCode != http.StatusBadRequest {
+		return httpResp, nil
+	}
+
+	var batch struct {
+		Requests []json.RawMessage `json:"requests"`
+	}
+	if common.Unmarshal(requestBytes, &batch) != nil || len(batch.Requests) < 2 {
+		return httpResp, nil
+	}
+	respBody, err := io.ReadAll(httpResp.Body)
+	service.CloseResponseBodyGracefully(httpResp)
+	if err != nil {
+		return nil, fmt.Errorf("read upstream response failed: %w", err)
+	}
+	httpResp.Body = io.NopCloser(bytes.NewReader(respBody))
+	if !isEmbeddingInputError(httpResp.StatusCode, respBody) {
+		return httpResp, nil
+	}
+
+	bisection := &embeddingBisection{
+		a:          a,
+		c:          c,
+		info:       info,
+		embeddings: make([]*dto.ContentEmbedding, len(batch.Requests)),
+		failures:   make(map[int]string),
+	}
+	mid := len(batch.Requests) / 2
+	for _, half := range []struct {
+		requests []json.RawMessage
+		offset   int
+	}{{batch.Requests[:mid], 0}, {batch.Requests[mid:], mid}} {
+		stop, err := bisection.embed(half.requests, half.offset)
+		if errors.Is(err, errEmbeddingBisectionExhausted) {
+			logger.LogWarn(c, fmt.Sprintf("gemini batch embedding: failing inputs not isolated within %d requests", embeddingPartialMaxRequests))
+			return httpResp, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if stop != nil {
+			return stop, nil
+		}
+	}
+	logger.LogWarn(c, fmt.Sprintf("gemini batch embedding: %d of %d inputs failed, returning partial results", len(bisection.failures), len(batch.Requests)))
+	common.SetContextKey(c, constant.ContextKeyGeminiEmbeddingFailures, bisection.failures)
+
+	body, err := common.Marshal(dto.GeminiBatchEmbeddingResponse{Embeddings: bisection.embeddings})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+// errEmbeddingBisectionExhausted stops the bisection once embeddingPartialMaxRequests requests were sent
+var errEmbeddingBisectionExhausted = errors.New("embedding bisection request limit reached")
+
+// isEmbeddingInputError reports whether a rejected batch may be caused by one of its inputs. Gemini marks
+// request level errors such as an invalid key with an ErrorInfo reason, those are not retried per input.
+func isEmbeddingInputError(statusCode int, body []byte) bool {
+	if statusCode != http.StatusBadRequest {
+		return false
+	}
+	envelope := parseGeminiErrorEnvelope(body)
+	if envelope == nil {
+		return true
+	}
+	var details []geminiErrorDetail
+	if common.Unmarshal(envelope.Error.Details, &details) == nil {
+		for _, detail := range details {
+			if detail.Reason != "" && strings.HasSuffix(detail.Type, "google.rpc.ErrorInfo") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+type embeddingBisection struct {
+	a          *Adaptor
+	c          *gin.Context
+	info       *relaycommon.RelayInfo
+	embeddings []*dto.ContentEmbedding
+	failures   map[int]string
+	requests   int
+}
+
+// embed embeds requests (starting at offset of the original batch), a batch rejected because of its inputs
+// is bisected, a rejected single input is recorded in failures with the upstream error message. Any other
+// upstream error is returned as the response to send back, errEmbeddingBisectionExhausted once the
+// request budget is used up.
+func (b *embeddingBisection) embed(requests []json.RawMessage, offset int) (*http.Response, error) {
+	if b.requests >= embeddingPartialMaxRequests {
+		return nil, errEmbeddingBisectionExhausted
+	}
+	b.requests++
+	body, err := common.Marshal(map[string]any{"requests": requests})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doGeminiUpstreamRequest(b.a, b.c, b.info, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpResp := resp.(*http.Response)
+	respBody, err := io.ReadAll(httpResp.Body)
+	service.CloseResponseBodyGracefully(httpResp)
+	if err != nil {
+		return nil, fmt.Errorf("read upstream response failed: %w", err)
+	}
+
+	if httpResp.StatusCode == http.StatusOK {
+		var batchResponse dto.GeminiBatchEmbeddingResponse
+		if err := common.Unmarshal(respBody, &batchResponse); err != nil {
+			return nil, err
+		}
+		for i := range requests {
+			if i < len(batchResponse.Embeddings) && batchResponse.Embeddings[i] != nil {
+				b.embeddings[offset+i] = batchResponse.Embeddings[i]
+			} else {
+				b.failures[offset+i] = "no embedding returned"
+			}
+		}
+		return nil, nil
+	}
+	if !isEmbeddingInputError(httpResp.StatusCode, respBody) {
+		httpResp.Body = io.NopCloser(bytes.NewReader(respBody))
+		return httpResp, nil
+	}
+	if len(requests) > 1 {
+		mid := len(requests) / 2
+		if stop, err := b.embed(requests[:mid], offset); stop != nil || err != nil {
+			return stop, err
+		}
+		return b.embed(requests[mid:], offset+mid)
+	}
+
+	message := fmt.Sprintf("upstream status %d", httpResp.StatusCode)
+	if envelope := parseGeminiErrorEnvelope(respBody); envelope != nil && envelope.Error.Message != "" {
+		message = envelope.Error.Message
+	}
+	b.failures[offset] = message
+	return nil, nil
+}
@@ -0,0 +1,151 @@
+package gemini
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/types"
+)
+
+// geminiErrorEnvelope is the google.rpc.Status error body returned by Gemini,
+// e.g. {"error":{"code":400,"message":"...","status":"INVALID_ARGUMENT","details":[...]}}
+type geminiErrorEnvelope struct {
+	Error *struct {
+		Code    int             `json:"code"`
+		Message string          `json:"message"`
+		Status  string          `json:"status"`
+		Details json.RawMessage `json:"details,omitempty"`
+	} `json:"error"`
+}
+
+type geminiErrorDetail struct {
+	Type   string `json:"@type"`
+	Reason string `json:"reason"`
+}
+
+func (e *geminiErrorEnvelope) valid() bool {
+	return e.Error != nil && (e.Error.Message != "" || e.Error.Status != "")
+}
+
+// parseGeminiErrorEnvelope returns the parsed body when it is a Gemini error, nil otherwise
+func parseGeminiErrorEnvelope(body []byte) *geminiErrorEnvelope {
+	trimmed := bytes.TrimSpace(body)
+	// 流式请求的错误响应可能是数组形式
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var envelopes []geminiErrorEnvelope
+		if common.Unmarshal(trimmed, &envelopes) != nil || len(envelopes) == 0 || !envelopes[0].valid() {
+			return nil
+		}
+		return &envelopes[0]
+	}
+	var envelope geminiErrorEnvelope
+	if common.Unmarshal(trimmed, &envelope) != nil || !envelope.valid() {
+		return nil
+	}
+	return &envelope
+}
+
+// parseGeminiError maps a Gemini error body to an OpenAI error: the Gemini status (e.g. INVALID_ARGUMENT) becomes
+// the code, the ErrorInfo reason (e.g. API_KEY_INVALID) the type and the details are kept as metadata. Bodies that
+// are not a Gemini error are returned as raw text. The upstream HTTP status is kept, a 200 carrying an error
+// uses the code from the body.
+func parseGeminiError(body []byte, statusCode int) *dto.OpenAIErrorWithStatusCode {
+	envelope := parseGeminiErrorEnvelope(body)
+	if envelope == nil {
+		message := strings.TrimSpace(string(body))
+		if message == "" {
+			message = http.StatusText(statusCode)
+		}
+		return &dto.OpenAIErrorWithStatusCode{
+			Error: types.OpenAIError{
+				Message: message,
+				Type:    string(types.ErrorCodeBadResponseStatusCode),
+				Code:    string(types.ErrorCodeBadResponseStatusCode),
+			},
+			StatusCode: statusCode,
+		}
+	}
+
+	status := envelope.Error.Status
+	if status == "" {
+		status = string(types.ErrorCodeBadResponseStatusCode)
+	}
+	errorType := status
+	var details []geminiErrorDetail
+	if common.Unmarshal(envelope.Error.Details, &details) == nil {
+		for _, detail := range details {
+			if detail.Reason != "" && strings.HasSuffix(detail.Type, "google.rpc.ErrorInfo") {
+				errorType = detail.Reason
+				break
+			}
+		}
+	}
+	if statusCode < http.StatusBadRequest {
+		statusCode = envelope.Error.Code
+		if statusCode < http.StatusBadRequest || statusCode > 599 {
+			statusCode = http.StatusInternalServerError
+		}
+	}
+	var metadata json.RawMessage
+	if len(envelope.Error.Details) > 0 && common.GetJsonType(envelope.Error.Details) == "array" {
+		metadata, _ = common.Marshal(map[string]json.RawMessage{"details": envelope.Error.Details})
+	}
+	return &dto.OpenAIErrorWithStatusCode{
+		Error: types.OpenAIError{
+			Message:  envelope.Error.Message,
+			Type:     errorType,
+			Code:     status,
+			Metadata: metadata,
+		},
+		StatusCode: statusCode,
+	}
+}
+
+// geminiResponseError returns the mapped error when a successful response body is a Gemini error envelope,
+// which some proxies send with 200
+func geminiResponseError(body []byte) *types.NewAPIError {
+	if parseGeminiErrorEnvelope(body) == nil {
+		return nil
+	}
+	mapped := parseGeminiError(body, http.StatusOK)
+	return types.WithOpenAIError(mapped.Error, mapped.StatusCode)
+}
+
+// normalizeGeminiErrorResponse rewrites a failed upstream response into an OpenAI error body that keeps the Gemini
+// status, reason and details, so the generic relay error handling (status code mapping, retries) surfaces them.
+// Native Gemini clients keep the original error body.
+func normalizeGeminiErrorResponse(info *relaycommon.RelayInfo, resp any) {
+	httpResp, ok := resp.(*http.Response)
+	if !ok || httpResp == nil || httpResp.Body == nil || httpResp.StatusCode < http.StatusBadRequest || info.RelayFormat == types.RelayFormatGemini {
+		return
+	}
+	body, err := io.ReadAll(httpResp.Body)
+	_ = httpResp.Body.Close()
+	if err != nil {
+		httpResp.Body = io.NopCloser(bytes.NewReader(body))
+		return
+	}
+	if parseGeminiErrorEnvelope(body) == nil {
+		httpResp.Body = io.NopCloser(bytes.NewReader(body))
+		return
+	}
+	mapped := parseGeminiError(body, httpResp.StatusCode)
+	normalized, err := common.Marshal(map[string]types.OpenAIError{"error": mapped.Error})
+	if err != nil {
+		httpResp.Body = io.NopCloser(bytes.NewReader(body))
+		return
+	}
+	httpResp.Body = io.NopCloser(bytes.NewReader(normalized))
+	httpResp.ContentLength = int64(len(normalized))
+	if httpResp.Header == nil {
+		httpResp.Header = make(http.Header)
+	}
+	httpResp.Header.Set("Content-Type", "application/json")
+	httpResp.Header.Del("Content-Length")
+}
@@ -0,0 +1,213 @@
+package gemini
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"sync"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/i18n"
+	"github.com/QuantumNous/new-api/logger"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+)
+
+// applyStreamFanOut marks a streamed n>1 OpenAI request to be served by n concurrent
+// non-stream upstream requests, Gemini streaming only returns a single candidate.
+func applyStreamFanOut(c *gin.Context, textRequest dto.GeneralOpenAIRequest, info *relaycommon.RelayInfo) error {
+	n := lo.FromPtr(textRequest.N)
+	if n <= 1 || !info.IsStream || info.RelayFormat != types.RelayFormatOpenAI {
+		return nil
+	}
+	settings := model_setting.GetGeminiSettings()
+	if !settings.StreamFanOutEnabled {
+		return nil
+	}
+	if settings.StreamFanOutMaxN > 0 && n > settings.StreamFanOutMaxN {
+		return types.NewErrorWithStatusCode(
+			errors.New(i18n.T(c, i18n.MsgGeminiStreamFanOutTooLarge, map[string]any{"Max": settings.StreamFanOutMaxN})),
+			types.ErrorCodeInvalidRequest,
+			http.StatusBadRequest,
+			types.ErrOptionWithSkipRetry(),
+		)
+	}
+	common.SetContextKey(c, constant.ContextKeyGeminiStreamFanOutN, n)
+	return nil
+}
+
+func isStreamFanOut(c *gin.Context, info *relaycommon.RelayInfo) bool {
+	return info.IsStream && common.GetContextKeyInt(c, constant.ContextKeyGeminiStreamFanOutN) > 1
+}
+
+// doStreamFanOutRequest issues n generateContent requests concurrently and waits for all of them.
+// The first failed upstream response is returned as is so the normal error handling and retry apply.
+func doStreamFanOutRequest(a *Adaptor, c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader) (any, error) {
+	n := common.GetContextKeyInt(c, constant.ContextKeyGeminiStreamFanOutN)
+	body, err := io.ReadAll(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("read request body failed: %w", err)
+	}
+	// 先在原始 info 上解析一次 URL，完成模型名后缀的裁剪
+	if _, err = a.GetRequestURL(info); err != nil {
+		return nil, fmt.Errorf("get request url failed: %w", err)
+	}
+
+	responses := make([]*http.Response, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		// 每个子请求使用独立的 gin 上下文与 info，压缩、重试等写入的状态互不影响
+		fanCtx := c.Copy()
+		fanInfo := cloneFanOutInfo(info)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var resp any
+			resp, errs[i] = doGeminiUpstreamRequest(a, fanCtx, fanInfo, bytes.NewReader(body))
+			if errs[i] == nil {
+				responses[i], _ = resp.(*http.Response)
+				if responses[i] == nil {
+					errs[i] = errors.New("invalid fan-out response")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	failed := -1
+	for i := 0; i < n; i++ {
+		if errs[i] != nil || responses[i].StatusCode != http.StatusOK {
+			failed = i
+			break
+		}
+	}
+	if failed >= 0 {
+		for i := 0; i < n; i++ {
+			if i != failed && responses[i] != nil {
+				service.CloseResponseBodyGracefully(responses[i])
+			}
+		}
+		if errs[failed] != nil {
+			return nil, errs[failed]
+		}
+		return responses[failed], nil
+	}
+
+	bodies := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		bodies[i], err = io.ReadAll(responses[i].Body)
+		service.CloseResponseBodyGracefully(responses[i])
+		if err != nil {
+			return nil, fmt.Errorf("read fan-out response body failed: %w", err)
+		}
+	}
+
+	common.SetContextKey(c, constant.ContextKeyGeminiStreamFanOutBodies, bodies)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       http.NoBody,
+		Request:    responses[0].Request,
+	}, nil
+}
+
+// cloneFanOutInfo copies the relay info for one fan-out request, ChannelMeta and the price ratios are
+// copied as well since GetRequestURL and the upstream request write to them concurrently
+func cloneFanOutInfo(info *relaycommon.RelayInfo) *relaycommon.RelayInfo {
+	fanInfo := *info
+	fanInfo.IsStream = false
+	if info.ChannelMeta != nil {
+		channelMeta := *info.ChannelMeta
+		fanInfo.ChannelMeta = &channelMeta
+	}
+	fanInfo.PriceData.OtherRatios = maps.Clone(info.PriceData.OtherRatios)
+	return &fanInfo
+}
+
+// GeminiChatFanOutStreamHandler multiplexes the fanned out non-stream responses into one
+// OpenAI chat stream, using the request position as the choice index.
+func GeminiChatFanOutStreamHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response) (*dto.Usage, *types.NewAPIError) {
+	service.CloseResponseBodyGracefully(resp)
+	bodies, _ := common.GetContextKeyType[[][]byte](c, constant.ContextKeyGeminiStreamFanOutBodies)
+
+	geminiResponses := make([]dto.GeminiChatResponse, len(bodies))
+	for i, body := range bodies {
+		logger.LogDebug(c, "Gemini fan-out response body %d: %s", i, body)
+		if err := common.Unmarshal(body, &geminiResponses[i]); err != nil {
+			return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+		}
+		applySafetyFallback(c, info, &geminiResponses[i])
+		if len(geminiResponses[i].Candidates) > 0 {
+			continue
+		}
+		if feedback := geminiResponses[i].PromptFeedback; feedback != nil && feedback.BlockReason != nil {
+			return nil, geminiPromptBlockedError(c, feedback)
+		}
+		common.SetContextKey(c, constant.ContextKeyAdminRejectReason, "gemini_empty_candidates")
+		return nil, types.NewOpenAIError(errors.New(i18n.T(c, i18n.MsgGeminiEmptyResponse)), types.ErrorCodeEmptyResponse, http.StatusInternalServerError)
+	}
+
+	helper.SetEventStreamHeaders(c)
+	id := helper.GetResponseID(c)
+	createAt := common.GetTimestamp()
+	usage := &dto.Usage{}
+	for i := range geminiResponses {
+		response, _ := streamResponseGeminiChat2OpenAI(&geminiResponses[i])
+		response.Id = id
+		response.Created = createAt
+		response.Model = info.UpstreamModelName
+		if fingerprint, ok := geminiSeedFingerprint(c); ok {
+			response.SetSystemFingerprint(fingerprint)
+		}
+		// 每个子请求只返回一个候选，按请求序号作为 choice index
+		response.Choices = response.Choices[:1]
+		choice := &response.Choices[0]
+		choice.Index = i
+		choice.Delta.Role = "assistant"
+		if len(choice.Delta.ToolCalls) > 0 {
+			choice.FinishReason = &constant.FinishReasonToolCalls
+		} else if choice.FinishReason == nil {
+			choice.FinishReason = &constant.FinishReasonStop
+		}
+		// 子请求为非流式，这里的思考内容已是完整摘要
+		if choice.Delta.ReasoningContent != nil {
+			if reasoningContent, ok := applyThinkingSummaryMode(c, *choice.Delta.ReasoningContent); ok {
+				choice.Delta.SetReasoningContent(reasoningContent)
+			} else {
+				choice.Delta.ReasoningContent = nil
+			}
+		}
+		if err := handleStream(c, info, response); err != nil {
+			logger.LogError(c, err.Error())
+		}
+
+		itemUsage := buildUsageFromGeminiMetadata(geminiResponses[i].UsageMetadata, info.GetEstimatePromptTokens())
+		usage.PromptTokens += itemUsage.PromptTokens
+		usage.CompletionTokens += itemUsage.CompletionTokens
+		usage.TotalTokens += itemUsage.TotalTokens
+		usage.PromptTokensDetails.CachedTokens += itemUsage.PromptTokensDetails.CachedTokens
+		usage.PromptTokensDetails.TextTokens += itemUsage.PromptTokensDetails.TextTokens
+		usage.PromptTokensDetails.AudioTokens += itemUsage.PromptTokensDetails.AudioTokens
+		usage.CompletionTokenDetails.ReasoningTokens += itemUsage.CompletionTokenDetails.ReasoningTokens
+		usage.CompletionTokenDetails.TextTokens += itemUsage.CompletionTokenDetails.TextTokens
+		usage.CompletionTokenDetails.ImageTokens += itemUsage.CompletionTokenDetails.ImageTokens
+		usage.CompletionTokenDetails.AudioTokens += itemUsage.CompletionTokenDetails.AudioTokens
+	}
+
+	if handleErr := handleFinalStream(c, info, helper.GenerateFinalUsageResponse(id, createAt, info.UpstreamModelName, *usage)); handleErr != nil {
+		common.SysLog("send final response failed: " + handleErr.Error())
+	}
+	return usage, nil
+}
@@ -0,0 +1,226 @@
+package gemini
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/i18n"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	geminiFileStateActive = "ACTIVE"
+	geminiFileStateFailed = "FAILED"
+)
+
+// fileActivePollInterval is how often an uploaded file that is still PROCESSING is checked again
+var fileActivePollInterval = time.Second
+
+type geminiFile struct {
+	Name     string `json:"name"`
+	Uri      string `json:"uri"`
+	MimeType string `json:"mimeType"`
+	State    string `json:"state"`
+}
+
+// shouldUploadGeminiFile reports whether media goes through the File API instead of being inlined,
+// video always does, other media only above FileUploadThresholdMB. The File API is Gemini API only.
+func shouldUploadGeminiFile(info *relaycommon.RelayInfo, mimeType string, size int) bool {
+	settings := model_setting.GetGeminiSettings()
+	if !settings.FileUploadEnabled || info.ChannelMeta == nil || info.ChannelType != constant.ChannelTypeGemini {
+		return false
+	}
+	if strings.HasPrefix(mimeType, "video/") {
+		return true
+	}
+	return settings.FileUploadThresholdMB > 0 && size > settings.FileUploadThresholdMB<<20
+}
+
+// uploadGeminiFileData uploads the media and returns the fileData referencing it. Media already uploaded
+// during this request with the same channel and key is reused, a file referenced twice is uploaded once.
+// Files belong to the project of the key, so a retry on another channel or key uploads again.
+func uploadGeminiFileData(c *gin.Context, info *relaycommon.RelayInfo, base64Data string, mimeType string, source string) (*dto.GeminiFileData, error) {
+	hash := sha256.Sum256([]byte(mimeType + ":" + base64Data))
+	contentHash := hex.EncodeToString(hash[:])
+	ownerHash := sha256.Sum256([]byte(strconv.Itoa(info.ChannelId) + ":" + geminiRequestApiKey(c, info)))
+	uploadKey := hex.EncodeToString(ownerHash[:8]) + ":" + contentHash
+	uploaded, _ := common.GetContextKeyType[map[string]string](c, constant.ContextKeyGeminiUploadedFiles)
+	if uri, ok := uploaded[uploadKey]; ok {
+		return &dto.GeminiFileData{MimeType: mimeType, FileUri: uri}, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(base64Data)
+	if err != nil {
+		raw, err = base64.RawStdEncoding.DecodeString(base64Data)
+	}
+	if err != nil {
+		return nil, newGeminiCorruptMediaError(c, source)
+	}
+	client, err := service.GetHttpClientWithProxy(info.ChannelSetting.Proxy)
+	if err != nil {
+		return nil, geminiFileUploadError(c, source, err)
+	}
+	timeout := time.Duration(model_setting.GetGeminiSettings().FileUploadActiveTimeoutSeconds) * time.Second
+	file, err := uploadGeminiFile(c, client, info, raw, mimeType, contentHash[:16])
+	if err != nil {
+		return nil, geminiFileUploadError(c, source, err)
+	}
+	if file, err = waitGeminiFileActive(c, client, info, file, timeout); err != nil {
+		return nil, err
+	}
+
+	if uploaded == nil {
+		uploaded = make(map[string]string)
+		common.SetContextKey(c, constant.ContextKeyGeminiUploadedFiles, uploaded)
+	}
+	uploaded[uploadKey] = file.Uri
+	return &dto.GeminiFileData{MimeType: mimeType, FileUri: file.Uri}, nil
+}
+
+func geminiFileApiUrl(info *relaycommon.RelayInfo, path string) string {
+	return fmt.Sprintf("%s%s", strings.TrimSuffix(info.ChannelBaseUrl, "/"), path)
+}
+
+// uploadGeminiFile runs the two steps of a resumable upload: start the session, then send the bytes and finalize
+func uploadGeminiFile(c *gin.Context, client *http.Client, info *relaycommon.RelayInfo, raw []byte, mimeType string, displayName string) (*geminiFile, error) {
+	version := model_setting.GetGeminiVersionSetting(info.UpstreamModelName)
+	metadata, err := common.Marshal(map[string]any{"file": map[string]string{"display_name": displayName}})
+	if err != nil {
+		return nil, err
+	}
+	startRequest, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, geminiFileApiUrl(info, "/upload/"+version+"/files"), bytes.NewReader(metadata))
+	if err != nil {
+		return nil, err
+	}
+	startRequest.Header.Set("x-goog-api-key", geminiRequestApiKey(c, info))
+	startRequest.Header.Set("Content-Type", "application/json")
+	startRequest.Header.Set("X-Goog-Upload-Protocol", "resumable")
+	startRequest.Header.Set("X-Goog-Upload-Command", "start")
+	startRequest.Header.Set("X-Goog-Upload-Header-Content-Length", strconv.Itoa(len(raw)))
+	startRequest.Header.Set("X-Goog-Upload-Header-Content-Type", mimeType)
+	startResponse, err := doGeminiFileRequest(client, startRequest)
+	if err != nil {
+		return nil, err
+	}
+	uploadUrl := startResponse.Header.Get("X-Goog-Upload-URL")
+	if uploadUrl == "" {
+		return nil, errors.New("upload session has no X-Goog-Upload-URL")
+	}
+
+	uploadRequest, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, uploadUrl, bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	uploadRequest.Header.Set("X-Goog-Upload-Offset", "0")
+	uploadRequest.Header.Set("X-Goog-Upload-Command", "upload, finalize")
+	uploadResponse, err := doGeminiFileRequest(client, uploadRequest)
+	if err != nil {
+		return nil, err
+	}
+	var uploaded struct {
+		File geminiFile `json:"file"`
+	}
+	if err := common.Unmarshal(uploadResponse.Body, &uploaded); err != nil {
+		return nil, fmt.Errorf("invalid upload response: %w", err)
+	}
+	if uploaded.File.Name == "" || uploaded.File.Uri == "" {
+		return nil, errors.New("upload response has no file name or uri")
+	}
+	return &uploaded.File, nil
+}
+
+// waitGeminiFileActive polls a PROCESSING file (e.g. a video) until it is ACTIVE and can be referenced
+func waitGeminiFileActive(c *gin.Context, client *http.Client, info *relaycommon.RelayInfo, file *geminiFile, timeout time.Duration) (*geminiFile, error) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+	version := model_setting.GetGeminiVersionSetting(info.UpstreamModelName)
+	for {
+		switch file.State {
+		case geminiFileStateActive, "":
+			return file, nil
+		case geminiFileStateFailed:
+			return nil, geminiFileNotActiveError(c, file.Name, true, timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, geminiFileNotActiveError(c, file.Name, false, timeout)
+		case <-time.After(fileActivePollInterval):
+		}
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, geminiFileApiUrl(info, "/"+version+"/"+file.Name), nil)
+		if err != nil {
+			return nil, geminiFileUploadError(c, file.Name, err)
+		}
+		request.Header.Set("x-goog-api-key", geminiRequestApiKey(c, info))
+		response, err := doGeminiFileRequest(client, request)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, geminiFileNotActiveError(c, file.Name, false, timeout)
+			}
+			return nil, geminiFileUploadError(c, file.Name, err)
+		}
+		var polled geminiFile
+		if err := common.Unmarshal(response.Body, &polled); err != nil {
+			return nil, geminiFileUploadError(c, file.Name, fmt.Errorf("invalid file response: %w", err))
+		}
+		if polled.Uri == "" {
+			polled.Uri = file.Uri
+		}
+		file = &polled
+	}
+}
+
+type geminiFileResponse struct {
+	Header http.Header
+	Body   []byte
+}
+
+func doGeminiFileRequest(client *http.Client, request *http.Request) (*geminiFileResponse, error) {
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", response.StatusCode, body)
+	}
+	return &geminiFileResponse{Header: response.Header, Body: body}, nil
+}
+
+func geminiFileUploadError(c *gin.Context, source string, err error) error {
+	return types.NewErrorWithStatusCode(
+		errors.New(i18n.T(c, i18n.MsgGeminiFileUploadFailed, map[string]any{"Source": source, "Error": err.Error()})),
+		types.ErrorCodeDoRequestFailed,
+		http.StatusBadGateway,
+	)
+}
+
+// geminiFileNotActiveError is not retried when the upstream failed processing the file, the media itself is unusable
+func geminiFileNotActiveError(c *gin.Context, name string, failed bool, timeout time.Duration) error {
+	message := i18n.T(c, i18n.MsgGeminiFileNotActive, map[string]any{"Source": name, "Failed": failed, "Timeout": int(timeout.Seconds())})
+	if failed {
+		return types.NewErrorWithStatusCode(errors.New(message), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	return types.NewErrorWithStatusCode(errors.New(message), types.ErrorCodeDoRequestFailed, http.StatusGatewayTimeout)
+}
@@ -0,0 +1,152 @@
+package gemini
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/pkg/cachex"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/hot"
+	"github.com/samber/hot/pkg/base"
+)
+
+const (
+	imageIdempotencyHeader         = "Idempotency-Key"
+	imageIdempotencyCacheNamespace = "new-api:gemini_image_idempotency:v1"
+	imageIdempotencyCacheCapacity  = 1000
+	// 内存缓存的响应总大小上限，超过时不再缓存新的响应，直到旧条目过期
+	imageIdempotencyCacheMaxBytes = 64 << 20
+	// 内存缓存清理过期条目的间隔，条目的有效期按写入时的配置单独设置
+	imageIdempotencyJanitorInterval = time.Minute
+)
+
+// ImageResponseCache stores raw upstream image responses keyed by idempotency key.
+// It is satisfied by cachex.HybridCache and can be replaced via SetImageResponseCache.
+type ImageResponseCache interface {
+	Get(key string) (string, bool, error)
+	SetWithTTL(key string, value string, ttl time.Duration) error
+}
+
+var (
+	imageResponseCache     ImageResponseCache
+	imageResponseCacheOnce sync.Once
+	// imageResponseCacheBytes is the size of the responses held by the in-memory cache, nil for a replaced cache
+	imageResponseCacheBytes *atomic.Int64
+)
+
+// SetImageResponseCache replaces the cache used for image idempotency keys.
+func SetImageResponseCache(cache ImageResponseCache) {
+	imageResponseCacheOnce.Do(func() {})
+	imageResponseCache = cache
+	imageResponseCacheBytes = nil
+}
+
+func imageResponseCacheRedisEnabled() bool {
+	return common.RedisEnabled && common.RDB != nil
+}
+
+func getImageResponseCache() ImageResponseCache {
+	imageResponseCacheOnce.Do(func() {
+		cacheBytes := &atomic.Int64{}
+		imageResponseCacheBytes = cacheBytes
+		imageResponseCache = cachex.NewHybridCache[string](cachex.HybridCacheConfig[string]{
+			Namespace:    cachex.Namespace(imageIdempotencyCacheNamespace),
+			Redis:        common.RDB,
+			RedisEnabled: imageResponseCacheRedisEnabled,
+			RedisCodec:   cachex.StringCodec{},
+			Memory: func() *hot.HotCache[string, string] {
+				return hot.NewHotCache[string, string](hot.LRU, imageIdempotencyCacheCapacity).
+					WithTTL(imageIdempotencyJanitorInterval).
+					WithJanitor().
+					WithEvictionCallback(func(_ base.EvictionReason, _ string, body string) {
+						cacheBytes.Add(-int64(len(body)))
+					}).
+					Build()
+			},
+		})
+	})
+	return imageResponseCache
+}
+
+// imageIdempotencyTTL is read on every request so a changed setting applies without a restart, 0 disables the cache
+func imageIdempotencyTTL() time.Duration {
+	return time.Duration(model_setting.GetGeminiSettings().ImageIdempotencyTTLSeconds) * time.Second
+}
+
+// imageIdempotencyCacheKey scopes the client key by user and model so keys never leak across tenants,
+// and by the request body so a reused key with different parameters never replays another result.
+func imageIdempotencyCacheKey(c *gin.Context, info *relaycommon.RelayInfo, requestBody []byte) string {
+	if imageIdempotencyTTL() <= 0 {
+		return ""
+	}
+	key := strings.TrimSpace(c.GetHeader(imageIdempotencyHeader))
+	if key == "" {
+		return ""
+	}
+	bodyHash := sha256.Sum256(requestBody)
+	return fmt.Sprintf("%d:%s:%s:%s", info.UserId, info.OriginModelName, key, hex.EncodeToString(bodyHash[:]))
+}
+
+// getCachedImageResponse returns a synthetic upstream response when the idempotency key was seen before
+// with the same request body, and remembers the key so the response of this request can be cached.
+func getCachedImageResponse(c *gin.Context, info *relaycommon.RelayInfo, requestBody []byte) *http.Response {
+	key := imageIdempotencyCacheKey(c, info, requestBody)
+	if key == "" {
+		return nil
+	}
+	common.SetContextKey(c, constant.ContextKeyGeminiImageIdempotencyKey, key)
+	body, found, err := getImageResponseCache().Get(key)
+	if err != nil {
+		logger.LogWarn(c, "get gemini image idempotency cache failed: "+err.Error())
+		return nil
+	}
+	if !found {
+		return nil
+	}
+	common.SetContextKey(c, constant.ContextKeyGeminiImageIdempotencyHit, true)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// cacheImageResponse stores a successful upstream image response for later retries.
+func cacheImageResponse(c *gin.Context, responseBody []byte) {
+	if common.GetContextKeyBool(c, constant.ContextKeyGeminiImageIdempotencyHit) {
+		return
+	}
+	key := common.GetContextKeyString(c, constant.ContextKeyGeminiImageIdempotencyKey)
+	ttl := imageIdempotencyTTL()
+	if key == "" || ttl <= 0 {
+		return
+	}
+	size := int64(len(responseBody))
+	if size > imageIdempotencyCacheMaxBytes {
+		return
+	}
+	cache := getImageResponseCache()
+	if cacheBytes := imageResponseCacheBytes; cacheBytes != nil && !imageResponseCacheRedisEnabled() {
+		if cacheBytes.Add(size) > imageIdempotencyCacheMaxBytes {
+			cacheBytes.Add(-size)
+			logger.LogWarn(c, "gemini image idempotency cache is full, response not cached")
+			return
+		}
+	}
+	if err := cache.SetWithTTL(key, string(responseBody), ttl); err != nil {
+		logger.LogWarn(c, "set gemini image idempotency cache failed: "+err.Error())
+	}
+}
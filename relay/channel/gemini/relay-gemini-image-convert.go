@@ -0,0 +1,214 @@
+package gemini
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/i18n"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+)
+
+// geminiTranscodableImageDecoders decodes image formats Gemini rejects but that can be converted to png.
+// HEIC/HEIF are accepted by Gemini natively and are passed through unchanged.
+var geminiTranscodableImageDecoders = map[string]func(r io.Reader) (image.Image, error){
+	"image/tiff":  tiff.Decode,
+	"image/bmp":   bmp.Decode,
+	"image/x-bmp": bmp.Decode,
+	"image/gif":   gif.Decode,
+}
+
+// geminiMediaSignatures lists the leading magic bytes of formats whose header can be checked cheaply
+var geminiMediaSignatures = map[string][][]byte{
+	"image/png":       {[]byte("\x89PNG\r\n\x1a\n")},
+	"image/jpeg":      {{0xFF, 0xD8, 0xFF}},
+	"image/jpg":       {{0xFF, 0xD8, 0xFF}},
+	"image/gif":       {[]byte("GIF87a"), []byte("GIF89a")},
+	"image/webp":      {[]byte("RIFF")},
+	"application/pdf": {[]byte("%PDF-")},
+}
+
+// geminiMediaHeaderBase64Chars is the base64 prefix decoded to check the media header (18 bytes)
+const geminiMediaHeaderBase64Chars = 24
+
+// validateGeminiInlineMedia rejects media that is empty, has an impossible base64 length or whose header does not
+// match the mime type, truncated client uploads otherwise surface as an opaque upstream error.
+// Only the header is decoded, the payload itself is not copied.
+func validateGeminiInlineMedia(c *gin.Context, base64Data string, mimeType string, source string) error {
+	head := base64Data
+	if len(head) > geminiMediaHeaderBase64Chars {
+		head = head[:geminiMediaHeaderBase64Chars]
+	}
+	raw, err := base64.StdEncoding.DecodeString(head)
+	if err != nil {
+		raw, err = base64.RawStdEncoding.DecodeString(head)
+	}
+	valid := err == nil && len(raw) > 0 && len(strings.TrimRight(base64Data, "="))%4 != 1
+	if valid {
+		if signatures, ok := geminiMediaSignatures[strings.ToLower(mimeType)]; ok {
+			valid = false
+			for _, signature := range signatures {
+				if bytes.HasPrefix(raw, signature) {
+					valid = true
+					break
+				}
+			}
+			if valid && strings.EqualFold(mimeType, "image/webp") {
+				valid = len(raw) >= 12 && string(raw[8:12]) == "WEBP"
+			}
+		}
+	}
+	if valid {
+		return nil
+	}
+	return newGeminiCorruptMediaError(c, source)
+}
+
+// geminiCorruptMediaError reports inline base64 that failed to decode while loading the file source,
+// other load failures (download errors, size limits) return nil and keep their original error.
+func geminiCorruptMediaError(c *gin.Context, err error, source string) error {
+	var corruptErr base64.CorruptInputError
+	if !errors.As(err, &corruptErr) {
+		return nil
+	}
+	return newGeminiCorruptMediaError(c, source)
+}
+
+func newGeminiCorruptMediaError(c *gin.Context, source string) error {
+	return types.NewErrorWithStatusCode(
+		errors.New(i18n.T(c, i18n.MsgGeminiCorruptMediaData, map[string]any{"Source": source})),
+		types.ErrorCodeInvalidRequest,
+		http.StatusBadRequest,
+		types.ErrOptionWithSkipRetry(),
+	)
+}
+
+// transcodeGeminiUnsupportedImage converts tiff/bmp/gif input images to png when ImageFormatConversionEnabled is set.
+// Formats that are not convertible or fail to decode are returned unchanged so the mime type check reports them.
+func transcodeGeminiUnsupportedImage(base64Data string, mimeType string) (string, string) {
+	if !model_setting.GetGeminiSettings().ImageFormatConversionEnabled {
+		return base64Data, mimeType
+	}
+	decode, ok := geminiTranscodableImageDecoders[strings.ToLower(mimeType)]
+	if !ok {
+		return base64Data, mimeType
+	}
+	raw, err := base64.StdEncoding.DecodeString(base64Data)
+	if err != nil {
+		return base64Data, mimeType
+	}
+	img, err := decode(bytes.NewReader(raw))
+	if err != nil {
+		return base64Data, mimeType
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return base64Data, mimeType
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), "image/png"
+}
+
+// downscaleGeminiLowDetailImage shrinks an image_url with detail=low to a single tile for tile-billed models,
+// so the upstream cost matches the single tile estimated locally. Models without a tile config are shrunk to
+// LowDetailImageMaxSide, models billed by mediaResolution get the resolution level instead.
+// Any decode failure keeps the original data.
+func downscaleGeminiLowDetailImage(modelName string, base64Data string, mimeType string) (string, string) {
+	settings := model_setting.GetGeminiSettings()
+	if !settings.LowDetailImageDownscaleEnabled {
+		return base64Data, mimeType
+	}
+	cost, ok := model_setting.GetGeminiImageTokenCost(modelName)
+	if ok && len(cost.MediaResolutionTokens) > 0 {
+		return base64Data, mimeType
+	}
+	maxSide := settings.LowDetailImageMaxSide
+	if ok && cost.SmallImageMaxSide > 0 {
+		maxSide = cost.SmallImageMaxSide
+	}
+	if maxSide <= 0 {
+		return base64Data, mimeType
+	}
+	raw, err := base64.StdEncoding.DecodeString(base64Data)
+	if err != nil {
+		return base64Data, mimeType
+	}
+
+	var src image.Image
+	switch strings.ToLower(mimeType) {
+	case "image/png":
+		src, err = png.Decode(bytes.NewReader(raw))
+	case "image/jpeg", "image/jpg":
+		src, err = jpeg.Decode(bytes.NewReader(raw))
+	case "image/webp":
+		src, err = webp.Decode(bytes.NewReader(raw))
+	default:
+		return base64Data, mimeType
+	}
+	if err != nil {
+		return base64Data, mimeType
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSide && height <= maxSide {
+		return base64Data, mimeType
+	}
+	if width >= height {
+		height = max(1, height*maxSide/width)
+		width = maxSide
+	} else {
+		width = max(1, width*maxSide/height)
+		height = maxSide
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	// png 保留透明通道，其它格式统一转为 jpeg
+	outMimeType := "image/jpeg"
+	if strings.ToLower(mimeType) == "image/png" {
+		outMimeType = "image/png"
+		err = png.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		return base64Data, mimeType
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), outMimeType
+}
+
+// generatedImageTokenCost bills generated images by 768x768 tiles like tile based input images
+var generatedImageTokenCost = model_setting.GeminiImageTokenCost{TileTokens: 258, TileSize: 768, SmallImageMaxSide: 384}
+
+// GeminiGeneratedImageTokens returns the tokens of a generated image, unknown dimensions count as a single tile
+func GeminiGeneratedImageTokens(width int, height int) int {
+	if width <= 0 || height <= 0 {
+		return generatedImageTokenCost.TileTokens
+	}
+	return service.GeminiImageTiles(width, height, generatedImageTokenCost) * generatedImageTokenCost.TileTokens
+}
+
+// generatedImageTokens reads the dimensions from the image header without decoding the whole image
+func generatedImageTokens(base64Data string) int {
+	config, _, err := image.DecodeConfig(base64.NewDecoder(base64.StdEncoding, strings.NewReader(base64Data)))
+	if err != nil {
+		return GeminiGeneratedImageTokens(0, 0)
+	}
+	return GeminiGeneratedImageTokens(config.Width, config.Height)
+}
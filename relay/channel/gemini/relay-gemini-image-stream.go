@@ -0,0 +1,192 @@
+package gemini
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isImagenStreamModel reports whether the upstream serves streamPredict for the model, configured by prefix in
+// ImagenStreamModels since the public Gemini API only offers a buffered predict for Imagen
+func isImagenStreamModel(modelName string) bool {
+	for _, prefix := range model_setting.GetGeminiSettings().ImagenStreamModels {
+		if prefix != "" && strings.HasPrefix(modelName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeGeminiImageStreamEvent(c *gin.Context, eventName string, payload any) error {
+	data, err := common.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", eventName, data); err != nil {
+		return err
+	}
+	return helper.FlushWriter(c)
+}
+
+// writeGeminiImageCompletedEvents sends one image_generation.completed event per image, the usage rides on the
+// last one so the whole request is accounted once, then terminates the stream. Images already sent as a
+// partial_image event (partialIndexes maps the image position to its partial_image_index) only reference
+// that event instead of repeating the base64 data.
+func writeGeminiImageCompletedEvents(c *gin.Context, info *relaycommon.RelayInfo, response *dto.ImageResponse, usage *dto.Usage, partialIndexes map[int]int) {
+	for i, image := range response.Data {
+		payload := map[string]any{
+			"type":       "image_generation.completed",
+			"created_at": response.Created,
+		}
+		if partialIndex, ok := partialIndexes[i]; ok {
+			payload["partial_image_index"] = partialIndex
+		} else {
+			payload["b64_json"] = image.B64Json
+		}
+		if i == len(response.Data)-1 {
+			payload["usage"] = usage
+		}
+		if err := writeGeminiImageStreamEvent(c, "image_generation.completed", payload); err != nil {
+			info.StreamStatus.SetEndReason(relaycommon.StreamEndReasonClientGone, err)
+			return
+		}
+	}
+	if _, err := fmt.Fprint(c.Writer, "data: [DONE]\n\n"); err != nil {
+		info.StreamStatus.SetEndReason(relaycommon.StreamEndReasonClientGone, err)
+		return
+	}
+	_ = helper.FlushWriter(c)
+}
+
+// writeGeminiImageStreamError ends an already started event stream with an error event, the status line is
+// sent so the error cannot be returned as a JSON response anymore. Nothing was delivered, so nothing is billed.
+func writeGeminiImageStreamError(c *gin.Context, info *relaycommon.RelayInfo, apiErr *types.NewAPIError) *dto.Usage {
+	err := writeGeminiImageStreamEvent(c, "error", map[string]any{
+		"type":  "error",
+		"error": apiErr.ToOpenAIError(),
+	})
+	if err == nil {
+		_, err = fmt.Fprint(c.Writer, "data: [DONE]\n\n")
+	}
+	if err != nil {
+		info.StreamStatus.SetEndReason(relaycommon.StreamEndReasonClientGone, err)
+	} else {
+		_ = helper.FlushWriter(c)
+		info.StreamStatus.SetEndReason(relaycommon.StreamEndReasonHandlerStop, apiErr)
+	}
+	if info.PriceData.OtherRatios == nil {
+		info.PriceData.OtherRatios = make(map[string]float64)
+	}
+	info.PriceData.OtherRatios["n"] = 0
+	return &dto.Usage{}
+}
+
+// GeminiImageStreamHandler relays a stream=true image request as OpenAI image_generation events. Predictions of a
+// streamPredict response are sent as partial_image events as they arrive and the completed events follow at the end.
+// An upstream answering with a single JSON body is buffered like GeminiImageHandler and replayed as completed events.
+func GeminiImageStreamHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response) (*dto.Usage, *types.NewAPIError) {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return geminiImageJSONAsStreamHandler(c, info, resp)
+	}
+
+	var geminiResponse dto.GeminiImageResponse
+	var streamErr, writeErr error
+	createdAt := common.GetTimestamp()
+	// 未被过滤的 prediction 在最终响应中的位置 -> 已发送的 partial_image_index
+	partialIndexes := make(map[int]int)
+	imageCount := 0
+	helper.StreamScannerHandler(c, resp, info, func(data string, sr *helper.StreamResult) {
+		var chunk dto.GeminiImageResponse
+		if err := common.UnmarshalJsonStr(data, &chunk); err != nil {
+			streamErr = fmt.Errorf("unmarshal: %w", err)
+			sr.Stop(streamErr)
+			return
+		}
+		if geminiResponse.CreateTime == "" {
+			geminiResponse.CreateTime = chunk.CreateTime
+		}
+		if chunk.UpdateTime != "" {
+			geminiResponse.UpdateTime = chunk.UpdateTime
+		}
+		for _, prediction := range chunk.Predictions {
+			geminiResponse.Predictions = append(geminiResponse.Predictions, prediction)
+			if prediction.RaiFilteredReason != "" {
+				continue
+			}
+			imageCount++
+			if prediction.BytesBase64Encoded == "" {
+				continue
+			}
+			err := writeGeminiImageStreamEvent(c, "image_generation.partial_image", map[string]any{
+				"type":                "image_generation.partial_image",
+				"b64_json":            prediction.BytesBase64Encoded,
+				"created_at":          createdAt,
+				"partial_image_index": len(partialIndexes),
+			})
+			if err != nil {
+				writeErr = err
+				info.StreamStatus.SetEndReason(relaycommon.StreamEndReasonClientGone, err)
+				sr.Stop(err)
+				return
+			}
+			partialIndexes[imageCount-1] = len(partialIndexes)
+		}
+	})
+	if streamErr != nil {
+		return writeGeminiImageStreamError(c, info, types.NewOpenAIError(streamErr, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)), nil
+	}
+
+	openAIResponse, apiErr := convertGeminiImageResponse(c, info, &geminiResponse)
+	if apiErr != nil {
+		return writeGeminiImageStreamError(c, info, apiErr), nil
+	}
+	usage := geminiImageUsage(c, info, openAIResponse.Data)
+	if writeErr == nil {
+		writeGeminiImageCompletedEvents(c, info, openAIResponse, usage, partialIndexes)
+	}
+	if responseBody, err := common.Marshal(geminiResponse); err == nil && writeErr == nil {
+		cacheImageResponse(c, responseBody)
+	}
+	return usage, nil
+}
+
+func geminiImageJSONAsStreamHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response) (*dto.Usage, *types.NewAPIError) {
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+	_ = resp.Body.Close()
+	if apiErr := geminiResponseError(responseBody); apiErr != nil {
+		return nil, apiErr
+	}
+
+	var geminiResponse dto.GeminiImageResponse
+	if err := common.Unmarshal(responseBody, &geminiResponse); err != nil {
+		return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+	openAIResponse, apiErr := convertGeminiImageResponse(c, info, &geminiResponse)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	info.StreamStatus = relaycommon.NewStreamStatus()
+	info.SetFirstResponseTime()
+	helper.SetEventStreamHeaders(c)
+	c.Status(http.StatusOK)
+	usage := geminiImageUsage(c, info, openAIResponse.Data)
+	writeGeminiImageCompletedEvents(c, info, openAIResponse, usage, nil)
+	info.StreamStatus.SetEndReason(relaycommon.StreamEndReasonDone, nil)
+
+	cacheImageResponse(c, responseBody)
+	return usage, nil
+}
@@ -0,0 +1,141 @@
+package gemini
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/pkg/jqtransform"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// responseJqMaxBytes 非流式响应执行 jq 转换时最多读入内存的字节数，与流式单行上限一致
+var responseJqMaxBytes int64 = 64 << 20
+
+func channelRequestJq(info *relaycommon.RelayInfo) string {
+	if info.ChannelMeta == nil {
+		return ""
+	}
+	return info.ChannelOtherSettings.GeminiRequestJq
+}
+
+func channelResponseJq(info *relaycommon.RelayInfo) string {
+	if info.ChannelMeta == nil {
+		return ""
+	}
+	return info.ChannelOtherSettings.GeminiResponseJq
+}
+
+// applyRequestJq runs the channel jq expression on the final upstream request body.
+// A failing expression is logged and the untransformed body is sent.
+func applyRequestJq(c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader) (io.Reader, error) {
+	expression := channelRequestJq(info)
+	if expression == "" {
+		return requestBody, nil
+	}
+	requestBytes, err := io.ReadAll(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("read request body failed: %w", err)
+	}
+	transformed, err := jqtransform.Apply(c.Request.Context(), expression, requestBytes)
+	if err != nil {
+		logger.LogWarn(c, fmt.Sprintf("gemini request jq transformation skipped: %s", err.Error()))
+		return bytes.NewReader(requestBytes), nil
+	}
+	return bytes.NewReader(transformed), nil
+}
+
+// responseJqBufferLimit returns how much of a non-stream body may be buffered for jq, with response spooling
+// enabled bodies above the spool threshold are left to the spool instead of being read into memory here
+func responseJqBufferLimit() int64 {
+	limit := responseJqMaxBytes
+	settings := model_setting.GetGeminiSettings()
+	if settings.ResponseSpoolEnabled && settings.ResponseSpoolThresholdMB > 0 {
+		limit = min(limit, int64(settings.ResponseSpoolThresholdMB)<<20)
+	}
+	return limit
+}
+
+// applyResponseJq runs the channel jq expression on the upstream response before it is converted,
+// streaming responses are transformed per SSE data line. A failing expression keeps the original data,
+// a non-stream body larger than responseJqMaxBytes, or than the spool threshold when response spooling
+// is enabled, is relayed untransformed.
+func applyResponseJq(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response) {
+	expression := channelResponseJq(info)
+	if expression == "" || resp == nil || resp.Body == nil || resp.StatusCode != http.StatusOK {
+		return
+	}
+	transform := func(data []byte) []byte {
+		transformed, err := jqtransform.Apply(c.Request.Context(), expression, data)
+		if err != nil {
+			logger.LogWarn(c, fmt.Sprintf("gemini response jq transformation skipped: %s", err.Error()))
+			return data
+		}
+		return transformed
+	}
+
+	if !info.IsStream {
+		limit := responseJqBufferLimit()
+		body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+		if err == nil && int64(len(body)) > limit {
+			// 超过上限时不做转换，原样转发剩余的响应体
+			logger.LogWarn(c, fmt.Sprintf("gemini response jq transformation skipped: response body exceeds %d bytes", limit))
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			return
+		}
+		_ = resp.Body.Close()
+		transformed := body
+		if err == nil {
+			transformed = transform(body)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(transformed))
+		resp.ContentLength = int64(len(transformed))
+		resp.Header.Del("Content-Length")
+		return
+	}
+
+	upstream := resp.Body
+	reader, writer := io.Pipe()
+	go func() {
+		defer upstream.Close()
+		scanner := bufio.NewScanner(upstream)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if data, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+				if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && !strings.EqualFold(string(trimmed), "[DONE]") {
+					line = append([]byte("data: "), transform(trimmed)...)
+				}
+			}
+			if _, err := writer.Write(line); err != nil {
+				return
+			}
+			if _, err := writer.Write([]byte{'\n'}); err != nil {
+				return
+			}
+		}
+		_ = writer.CloseWithError(scanner.Err())
+	}()
+	resp.Body = &jqStreamBody{PipeReader: reader, upstream: upstream}
+}
+
+// jqStreamBody also closes the upstream body so the transforming goroutine stops when the handler gives up early
+type jqStreamBody struct {
+	*io.PipeReader
+	upstream io.Closer
+}
+
+func (b *jqStreamBody) Close() error {
+	_ = b.upstream.Close()
+	return b.PipeReader.Close()
+}
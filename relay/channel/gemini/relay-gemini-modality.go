@@ -0,0 +1,154 @@
+package gemini
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/i18n"
+
+	"github.com/gin-gonic/gin"
+)
+
+var geminiResponseModalities = []string{"TEXT", "IMAGE", "AUDIO"}
+
+func parseGeminiResponseModalities(c *gin.Context, value any) ([]string, error) {
+	invalid := errors.New(i18n.T(c, i18n.MsgGeminiResponseModalitiesInvalid, map[string]any{
+		"Allowed": strings.Join(geminiResponseModalities, ", "),
+	}))
+	list, ok := value.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, invalid
+	}
+	modalities := make([]string, 0, len(list))
+	for _, item := range list {
+		modality, ok := item.(string)
+		modality = strings.ToUpper(modality)
+		if !ok || !common.StringsContains(geminiResponseModalities, modality) {
+			return nil, invalid
+		}
+		if !common.StringsContains(modalities, modality) {
+			modalities = append(modalities, modality)
+		}
+	}
+	return modalities, nil
+}
+
+func isGeminiMixedModalities(c *gin.Context) bool {
+	return common.GetContextKeyBool(c, constant.ContextKeyGeminiMixedModalities)
+}
+
+// geminiPartText renders the text of a non-thought part the same way as the plain string response
+func geminiPartText(part dto.GeminiPart) (string, bool) {
+	switch {
+	case part.ExecutableCode != nil:
+		return "```" + part.ExecutableCode.Language + "\n" + part.ExecutableCode.Code + "\n```", true
+	case part.CodeExecutionResult != nil:
+		return "```output\n" + part.CodeExecutionResult.Output + "\n```", true
+	case part.Text != "" && part.Text != "\n":
+		return part.Text, true
+	}
+	return "", false
+}
+
+// buildGeminiMixedModalityContent keeps text, image and audio parts as ordered content blocks,
+// consecutive text parts are merged into one text block.
+func buildGeminiMixedModalityContent(parts []dto.GeminiPart) []dto.MediaContent {
+	blocks := make([]dto.MediaContent, 0, len(parts))
+	for _, part := range parts {
+		if part.Thought || part.FunctionCall != nil || part.FunctionResponse != nil {
+			continue
+		}
+		if part.InlineData != nil {
+			mimeType := part.InlineData.MimeType
+			switch {
+			case strings.HasPrefix(mimeType, "image"):
+				blocks = append(blocks, dto.MediaContent{
+					Type:     dto.ContentTypeImageURL,
+					ImageUrl: &dto.MessageImageUrl{Url: "data:" + mimeType + ";base64," + part.InlineData.Data, MimeType: mimeType},
+				})
+			case strings.HasPrefix(mimeType, "audio"):
+				format, sampleRate := geminiOutputAudioFormat(mimeType)
+				blocks = append(blocks, dto.MediaContent{
+					Type:  dto.ContentTypeAudio,
+					Audio: &dto.MessageInputAudio{Data: part.InlineData.Data, Format: format, SampleRate: sampleRate},
+				})
+			}
+			continue
+		}
+		text, ok := geminiPartText(part)
+		if !ok {
+			continue
+		}
+		if last := len(blocks) - 1; last >= 0 && blocks[last].Type == dto.ContentTypeText {
+			blocks[last].Text += "\n" + text
+			continue
+		}
+		blocks = append(blocks, dto.MediaContent{Type: dto.ContentTypeText, Text: text})
+	}
+	return blocks
+}
+
+// geminiOutputAudioFormat maps the audio mime type to an OpenAI style format,
+// raw PCM (audio/L16;codec=pcm;rate=24000) is reported as pcm16 with its sample rate.
+func geminiOutputAudioFormat(mimeType string) (string, int) {
+	base, params, _ := strings.Cut(mimeType, ";")
+	format := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(base), "audio/"))
+	sampleRate := 0
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(key, "rate") {
+			sampleRate, _ = strconv.Atoi(value)
+		}
+	}
+	switch format {
+	case "l16", "pcm":
+		format = "pcm16"
+	case "mpeg":
+		format = "mp3"
+	case "x-wav", "wave":
+		format = "wav"
+	}
+	return format, sampleRate
+}
+
+// splitGeminiMixedModalityChunk splits a single-candidate stream chunk at audio boundaries so text, images
+// and audio are emitted as separate deltas in arrival order instead of audio being merged into one delta.
+// Finish reason, grounding, safety ratings and logprobs stay on the last segment.
+func splitGeminiMixedModalityChunk(c *gin.Context, response *dto.GeminiChatResponse) []*dto.GeminiChatResponse {
+	if !isGeminiMixedModalities(c) || len(response.Candidates) != 1 {
+		return []*dto.GeminiChatResponse{response}
+	}
+	candidate := response.Candidates[0]
+	isAudio := func(part dto.GeminiPart) bool {
+		return part.InlineData != nil && strings.HasPrefix(part.InlineData.MimeType, "audio")
+	}
+	var groups [][]dto.GeminiPart
+	for i, part := range candidate.Content.Parts {
+		if i == 0 || isAudio(part) != isAudio(candidate.Content.Parts[i-1]) {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], part)
+	}
+	if len(groups) <= 1 {
+		return []*dto.GeminiChatResponse{response}
+	}
+	segments := make([]*dto.GeminiChatResponse, 0, len(groups))
+	for i, parts := range groups {
+		segment := *response
+		segmentCandidate := candidate
+		segmentCandidate.Content.Parts = parts
+		if i < len(groups)-1 {
+			segmentCandidate.FinishReason = nil
+			segmentCandidate.GroundingMetadata = nil
+			segmentCandidate.SafetyRatings = nil
+			segmentCandidate.LogprobsResult = nil
+		}
+		segment.Candidates = []dto.GeminiChatCandidate{segmentCandidate}
+		segments = append(segments, &segment)
+	}
+	return segments
+}
@@ -20,17 +20,24 @@ import (
 func GeminiTextGenerationHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response) (*dto.Usage, *types.NewAPIError) {
 	defer service.CloseResponseBodyGracefully(resp)
 
-	// 读取响应体
-	responseBody, err := io.ReadAll(resp.Body)
+	// 读取响应体，超过落盘阈值时写入临时文件
+	responseBody, spooled, err := readGeminiResponseBody(c, resp)
 	if err != nil {
 		return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
 	}
 
-	logger.LogDebug(c, "Gemini native response body: %s", responseBody)
-
 	// 解析为 Gemini 原生响应格式
 	var geminiResponse dto.GeminiChatResponse
-	err = common.Unmarshal(responseBody, &geminiResponse)
+	if spooled != nil {
+		defer spooled.Close()
+		var reader io.Reader
+		if reader, err = spooled.reader(); err == nil {
+			err = common.DecodeJson(reader, &geminiResponse)
+		}
+	} else {
+		logger.LogDebug(c, "Gemini native response body: %s", responseBody)
+		err = common.Unmarshal(responseBody, &geminiResponse)
+	}
 	if err != nil {
 		return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
 	}
@@ -38,10 +45,19 @@ func GeminiTextGenerationHandler(c *gin.Context, info *relaycommon.RelayInfo, re
 	if len(geminiResponse.Candidates) == 0 && geminiResponse.PromptFeedback != nil && geminiResponse.PromptFeedback.BlockReason != nil {
 		common.SetContextKey(c, constant.ContextKeyAdminRejectReason, fmt.Sprintf("gemini_block_reason=%s", *geminiResponse.PromptFeedback.BlockReason))
 	}
+	recordGeminiFinishReasons(c, geminiResponse.Candidates)
 
 	// 计算使用量（基于 UsageMetadata）
 	usage := buildUsageFromGeminiMetadata(geminiResponse.UsageMetadata, info.GetEstimatePromptTokens())
 
+	if spooled != nil {
+		reader, err := spooled.reader()
+		if err != nil {
+			return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+		}
+		service.IOCopyReaderGracefully(c, resp, reader, spooled.size)
+		return &usage, nil
+	}
 	service.IOCopyBytesGracefully(c, resp, responseBody)
 
 	return &usage, nil
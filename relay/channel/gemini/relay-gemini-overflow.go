@@ -0,0 +1,101 @@
+package gemini
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/model"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/relay/helper"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// channelServesModel reports whether the channel lists the model or maps one of its models to it
+var channelServesModel = func(channelId int, modelName string) bool {
+	channel, err := model.CacheGetChannel(channelId)
+	if err != nil {
+		return false
+	}
+	if slices.Contains(channel.GetModels(), modelName) {
+		return true
+	}
+	var mapping map[string]string
+	if mappingStr := channel.GetModelMapping(); mappingStr != "" && common.UnmarshalJsonStr(mappingStr, &mapping) == nil {
+		return slices.Contains(slices.Collect(maps.Values(mapping)), modelName)
+	}
+	return false
+}
+
+// applyContextOverflowUpgrade routes the request to the configured larger context model when the estimated
+// prompt tokens exceed the context window of the current upstream model. Upgrades are followed as a chain
+// until a model fits, the original model is kept in the context so the log records both models.
+// Only models the channel serves are used and the request is then billed at the price of the upgraded model,
+// when the channel does not serve it or it has no price the request keeps its model and gets the upstream error.
+func applyContextOverflowUpgrade(c *gin.Context, info *relaycommon.RelayInfo) {
+	common.SetContextKey(c, constant.ContextKeyGeminiContextOverflowFrom, "")
+	settings := model_setting.GetGeminiSettings()
+	if !settings.ContextOverflowUpgradeEnabled || len(settings.ContextOverflowUpgradeModels) == 0 {
+		return
+	}
+	promptTokens := info.GetEstimatePromptTokens()
+	if promptTokens <= 0 {
+		return
+	}
+	originModel := info.UpstreamModelName
+	modelName := originModel
+	visited := map[string]bool{modelName: true}
+	for {
+		limits, ok := model_setting.GetGeminiModelLimits(modelName)
+		if !ok || limits.ContextLength <= 0 || promptTokens <= limits.ContextLength {
+			break
+		}
+		target := settings.ContextOverflowUpgradeModels[modelName]
+		if target == "" || visited[target] {
+			break
+		}
+		if !channelServesModel(info.ChannelId, target) {
+			logger.LogWarn(c, fmt.Sprintf("gemini context overflow: channel #%d does not serve upgrade model %s", info.ChannelId, target))
+			break
+		}
+		visited[target] = true
+		modelName = target
+	}
+	if modelName == originModel {
+		return
+	}
+	if err := applyContextOverflowPrice(c, info, modelName, promptTokens); err != nil {
+		logger.LogWarn(c, fmt.Sprintf("gemini context overflow: upgrade model %s has no usable price, keeping %s: %s", modelName, originModel, err.Error()))
+		return
+	}
+	logger.LogInfo(c, fmt.Sprintf("gemini context overflow: %d estimated prompt tokens, upgrade model %s -> %s", promptTokens, originModel, modelName))
+	info.UpstreamModelName = modelName
+	info.IsModelMapped = true
+	common.SetContextKey(c, constant.ContextKeyGeminiContextOverflowFrom, originModel)
+}
+
+// applyContextOverflowPrice replaces the price of the request with the price of the upgraded model, ratios other
+// steps added are kept. On error the price of the request is left unchanged.
+func applyContextOverflowPrice(c *gin.Context, info *relaycommon.RelayInfo, modelName string, promptTokens int) error {
+	originModelName, priceData := info.OriginModelName, info.PriceData
+	snapshot, requestInput := info.TieredBillingSnapshot, info.BillingRequestInput
+	info.OriginModelName = modelName
+	info.TieredBillingSnapshot, info.BillingRequestInput = nil, nil
+	_, err := helper.ModelPriceHelper(c, info, promptTokens, &types.TokenCountMeta{})
+	info.OriginModelName = originModelName
+	if err != nil {
+		info.PriceData = priceData
+		info.TieredBillingSnapshot, info.BillingRequestInput = snapshot, requestInput
+		return err
+	}
+	for key, ratio := range priceData.OtherRatios {
+		info.PriceData.AddOtherRatio(key, ratio)
+	}
+	return nil
+}
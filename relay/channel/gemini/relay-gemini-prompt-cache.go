@@ -0,0 +1,389 @@
+package gemini
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/pkg/cachex"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/hot"
+)
+
+const (
+	promptCacheNamespace = "new-api:gemini_prompt_cache:v1"
+	promptCacheCapacity  = 10000
+	// promptCacheExpiryMargin stops reusing a cachedContent shortly before Gemini expires it
+	promptCacheExpiryMargin = 30 * time.Second
+)
+
+// promptCacheRestore keeps what the cachedContent replaced in the request sent upstream
+type promptCacheRestore struct {
+	StoreKey   string
+	ModelName  string
+	SystemHash string
+	Request    *dto.GeminiChatRequest
+	Contents   []dto.GeminiChatContent
+	// CreatedTokens counts the tokens written to cachedContents by this request, billed as cache creation
+	CreatedTokens int
+}
+
+// promptCacheEntry maps a prompt_cache_key to the cachedContent holding the first ContentsCount contents.
+// An entry without Name records a failed creation (e.g. below the minimum cacheable tokens) for that prefix.
+type promptCacheEntry struct {
+	Name          string `json:"name"`
+	SystemHash    string `json:"system_hash"`
+	ContentsCount int    `json:"contents_count"`
+	ContentsHash  string `json:"contents_hash"`
+}
+
+var (
+	promptCacheStore     *cachex.HybridCache[string]
+	promptCacheStoreOnce sync.Once
+)
+
+func getPromptCacheStore() *cachex.HybridCache[string] {
+	promptCacheStoreOnce.Do(func() {
+		promptCacheStore = cachex.NewHybridCache[string](cachex.HybridCacheConfig[string]{
+			Namespace: cachex.Namespace(promptCacheNamespace),
+			Redis:     common.RDB,
+			RedisEnabled: func() bool {
+				return common.RedisEnabled && common.RDB != nil
+			},
+			RedisCodec: cachex.StringCodec{},
+			Memory: func() *hot.HotCache[string, string] {
+				return hot.NewHotCache[string, string](hot.LRU, promptCacheCapacity).
+					WithTTL(promptCacheEntryTTL()).
+					WithJanitor().
+					Build()
+			},
+		})
+	})
+	return promptCacheStore
+}
+
+func promptCacheTTL() time.Duration {
+	return time.Duration(model_setting.GetGeminiSettings().PromptCacheTTLSeconds) * time.Second
+}
+
+func promptCacheEntryTTL() time.Duration {
+	ttl := promptCacheTTL()
+	if ttl > 2*promptCacheExpiryMargin {
+		return ttl - promptCacheExpiryMargin
+	}
+	return ttl / 2
+}
+
+// promptCacheStoreKey scopes the client key by user, channel, API key and model, a cachedContent only works
+// with the API key and model that created it.
+func promptCacheStoreKey(c *gin.Context, info *relaycommon.RelayInfo, modelName string, promptCacheKey string) string {
+	keyHash := sha256.Sum256([]byte(geminiRequestApiKey(c, info)))
+	return fmt.Sprintf("%d:%d:%s:%s:%s", info.UserId, info.ChannelId, hex.EncodeToString(keyHash[:8]), modelName, promptCacheKey)
+}
+
+func hashPromptCacheValue(values ...any) string {
+	hash := sha256.New()
+	for _, value := range values {
+		data, _ := common.Marshal(value)
+		hash.Write(data)
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// applyPromptCacheKey maps the OpenAI prompt_cache_key to a Gemini cachedContent. The system instruction,
+// tools and every content but the last are cached under the key, later requests whose contents still start
+// with the cached ones reference the cachedContent and only send the new contents.
+// Without a key, channels with GeminiContextCacheEnabled key the cache by the system instruction, tools and first content.
+// Any failure falls back to sending the full request uncached.
+func applyPromptCacheKey(c *gin.Context, info *relaycommon.RelayInfo, request *dto.GeminiChatRequest, promptCacheKey string) {
+	// 重试到其他渠道时不能沿用上一次的缓存信息
+	common.SetContextKey(c, constant.ContextKeyGeminiPromptCache, nil)
+	if promptCacheTTL() <= 0 || info.ChannelMeta == nil || info.ChannelType != constant.ChannelTypeGemini {
+		return
+	}
+	autoCache := promptCacheKey == "" && info.ChannelOtherSettings.GeminiContextCacheEnabled
+	if !autoCache && (promptCacheKey == "" || !model_setting.GetGeminiSettings().PromptCacheKeyEnabled) {
+		return
+	}
+	if request.CachedContent != "" {
+		return
+	}
+	contents := splitFinalGeminiTurn(c, request.Contents)
+	if len(contents) < 2 {
+		return
+	}
+	modelName := geminiUpstreamBaseModel(info)
+	systemHash := hashPromptCacheValue(modelName, request.SystemInstructions, request.Tools, request.ToolConfig)
+	if autoCache {
+		promptCacheKey = "auto:" + hashPromptCacheValue(systemHash, contents[0])
+	}
+	storeKey := promptCacheStoreKey(c, info, modelName, promptCacheKey)
+	store := getPromptCacheStore()
+	cachedContents := contents[:len(contents)-1]
+	contentsHash := hashPromptCacheValue(cachedContents)
+
+	var entry promptCacheEntry
+	if raw, found, err := store.Get(storeKey); err == nil && found && common.UnmarshalJsonStr(raw, &entry) == nil {
+		if entry.Name == "" && entry.SystemHash == systemHash && entry.ContentsHash == contentsHash {
+			return
+		}
+		if entry.SystemHash != systemHash || entry.ContentsCount >= len(contents) ||
+			entry.ContentsHash != hashPromptCacheValue(contents[:entry.ContentsCount]) {
+			entry = promptCacheEntry{}
+		}
+	}
+	createdTokens := 0
+	if entry.Name == "" {
+		var err error
+		entry, createdTokens, err = storePromptCacheEntry(c, info, storeKey, modelName, systemHash, request, cachedContents)
+		if err != nil {
+			logger.LogWarn(c, fmt.Sprintf("gemini prompt cache %q not created, sending uncached: %s", promptCacheKey, err.Error()))
+			return
+		}
+	}
+
+	common.SetContextKey(c, constant.ContextKeyGeminiPromptCache, &promptCacheRestore{
+		StoreKey:   storeKey,
+		ModelName:  modelName,
+		SystemHash: systemHash,
+		Request: &dto.GeminiChatRequest{
+			SystemInstructions: request.SystemInstructions,
+			Tools:              request.Tools,
+			ToolConfig:         request.ToolConfig,
+		},
+		Contents:      contents[:entry.ContentsCount],
+		CreatedTokens: createdTokens,
+	})
+	request.CachedContent = entry.Name
+	request.Contents = contents[entry.ContentsCount:]
+	request.SystemInstructions = nil
+	request.Tools = nil
+	request.ToolConfig = nil
+}
+
+// splitFinalGeminiTurn splits the final chat message back out of the last content when earlier messages of the
+// same role were merged into it (e.g. a document and the question as two user messages), so the volatile final
+// message is never part of the cached prefix or the automatic cache key
+func splitFinalGeminiTurn(c *gin.Context, contents []dto.GeminiChatContent) []dto.GeminiChatContent {
+	finalParts := common.GetContextKeyInt(c, constant.ContextKeyGeminiFinalTurnParts)
+	last := len(contents) - 1
+	if last < 0 || finalParts <= 0 || finalParts >= len(contents[last].Parts) {
+		return contents
+	}
+	split := len(contents[last].Parts) - finalParts
+	result := make([]dto.GeminiChatContent, 0, len(contents)+1)
+	result = append(result, contents[:last]...)
+	result = append(result,
+		dto.GeminiChatContent{Role: contents[last].Role, Parts: contents[last].Parts[:split]},
+		dto.GeminiChatContent{Role: contents[last].Role, Parts: contents[last].Parts[split:]},
+	)
+	return result
+}
+
+// storePromptCacheEntry creates the cachedContent and records it, a failed creation is recorded too so the same
+// prefix is not retried on every request. It returns the number of cached tokens.
+func storePromptCacheEntry(c *gin.Context, info *relaycommon.RelayInfo, storeKey string, modelName string, systemHash string, request *dto.GeminiChatRequest, contents []dto.GeminiChatContent) (promptCacheEntry, int, error) {
+	name, tokens, err := createGeminiCachedContent(c, info, modelName, request, contents)
+	entry := promptCacheEntry{
+		Name:          name,
+		SystemHash:    systemHash,
+		ContentsCount: len(contents),
+		ContentsHash:  hashPromptCacheValue(contents),
+	}
+	if data, marshalErr := common.Marshal(entry); marshalErr == nil {
+		_ = getPromptCacheStore().SetWithTTL(storeKey, string(data), promptCacheEntryTTL())
+	}
+	return entry, tokens, err
+}
+
+// applyPromptCacheCreationUsage bills the tokens written to cachedContents by the request as cache creation tokens,
+// Gemini charges for creating and storing them on top of the generateContent call
+func applyPromptCacheCreationUsage(c *gin.Context, usage any) {
+	restore, ok := common.GetContextKeyType[*promptCacheRestore](c, constant.ContextKeyGeminiPromptCache)
+	textUsage, isUsage := usage.(*dto.Usage)
+	if !ok || restore == nil || restore.CreatedTokens <= 0 || !isUsage || textUsage == nil {
+		return
+	}
+	textUsage.PromptTokens += restore.CreatedTokens
+	textUsage.TotalTokens += restore.CreatedTokens
+	textUsage.PromptTokensDetails.CachedCreationTokens += restore.CreatedTokens
+}
+
+// isCachedContentRejected reports whether the upstream no longer knows the referenced cachedContent, e.g. it
+// expired early or was deleted. Only NOT_FOUND and PERMISSION_DENIED errors about the cachedContent resource count,
+// other errors mentioning it (e.g. INVALID_ARGUMENT for a request that also sets systemInstruction) would fail
+// again with a recreated cache.
+func isCachedContentRejected(resp *http.Response, respBody []byte) bool {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusNotFound {
+		return false
+	}
+	envelope := parseGeminiErrorEnvelope(respBody)
+	if envelope == nil {
+		return false
+	}
+	if envelope.Error.Status != "" && envelope.Error.Status != "NOT_FOUND" && envelope.Error.Status != "PERMISSION_DENIED" {
+		return false
+	}
+	message := strings.ToLower(envelope.Error.Message)
+	return strings.Contains(message, "cachedcontent") || strings.Contains(message, "cached content")
+}
+
+// doPromptCacheRequest sends a request that references a cachedContent. When the upstream no longer knows the
+// cache it is recreated and the request resent with the new name, if that fails the request is resent uncached.
+func doPromptCacheRequest(a *Adaptor, c *gin.Context, info *relaycommon.RelayInfo, restore *promptCacheRestore, requestBody io.Reader) (any, error) {
+	requestBytes, err := io.ReadAll(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("read request body failed: %w", err)
+	}
+	result, err := doGeminiUpstreamRequest(a, c, info, bytes.NewReader(requestBytes))
+	resp, ok := result.(*http.Response)
+	if err != nil || !ok || resp.StatusCode == http.StatusOK {
+		return result, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	service.CloseResponseBodyGracefully(resp)
+	if err != nil {
+		return nil, fmt.Errorf("read upstream response failed: %w", err)
+	}
+	if !isCachedContentRejected(resp, respBody) {
+		resp.Body = io.NopCloser(bytes.NewReader(respBody))
+		return resp, nil
+	}
+
+	var body map[string]json.RawMessage
+	if err := common.Unmarshal(requestBytes, &body); err != nil {
+		return nil, fmt.Errorf("unmarshal request body failed: %w", err)
+	}
+	entry, createdTokens, createErr := storePromptCacheEntry(c, info, restore.StoreKey, restore.ModelName, restore.SystemHash, restore.Request, restore.Contents)
+	restore.CreatedTokens += createdTokens
+	if createErr == nil {
+		logger.LogInfo(c, fmt.Sprintf("gemini cachedContent rejected by upstream (status %d), recreated as %s", resp.StatusCode, entry.Name))
+		body["cachedContent"], _ = common.Marshal(entry.Name)
+	} else {
+		logger.LogWarn(c, fmt.Sprintf("gemini cachedContent rejected by upstream (status %d) and not recreated, sending uncached: %s", resp.StatusCode, createErr.Error()))
+		if err := restorePromptCacheBody(body, restore); err != nil {
+			return nil, err
+		}
+	}
+	resentBytes, err := common.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request body failed: %w", err)
+	}
+	info.UpstreamRequestBodySize = int64(len(resentBytes))
+	return doGeminiUpstreamRequest(a, c, info, bytes.NewReader(resentBytes))
+}
+
+// restorePromptCacheBody puts the cached system instruction, tools and contents back into the request body
+func restorePromptCacheBody(body map[string]json.RawMessage, restore *promptCacheRestore) error {
+	delete(body, "cachedContent")
+	var contents []json.RawMessage
+	if raw, ok := body["contents"]; ok {
+		if err := common.Unmarshal(raw, &contents); err != nil {
+			return fmt.Errorf("unmarshal request contents failed: %w", err)
+		}
+	}
+	restored := make([]any, 0, len(restore.Contents)+len(contents))
+	for _, content := range restore.Contents {
+		restored = append(restored, content)
+	}
+	for _, content := range contents {
+		restored = append(restored, content)
+	}
+	fields := map[string]any{"contents": restored}
+	if restore.Request.SystemInstructions != nil {
+		fields["systemInstruction"] = restore.Request.SystemInstructions
+	}
+	if len(restore.Request.Tools) > 0 {
+		fields["tools"] = restore.Request.Tools
+	}
+	if restore.Request.ToolConfig != nil {
+		fields["toolConfig"] = restore.Request.ToolConfig
+	}
+	for field, value := range fields {
+		data, err := common.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("marshal request %s failed: %w", field, err)
+		}
+		body[field] = data
+	}
+	return nil
+}
+
+// createGeminiCachedContent creates a cachedContent holding the system instruction, tools and contents with the
+// key the request itself uses, and returns its name and token count. It is not retried on 429/503, a failed
+// creation sends the request uncached and that request goes through the rate limit retry.
+func createGeminiCachedContent(c *gin.Context, info *relaycommon.RelayInfo, modelName string, request *dto.GeminiChatRequest, contents []dto.GeminiChatContent) (string, int, error) {
+	payload := map[string]any{
+		"model":    "models/" + modelName,
+		"contents": contents,
+		"ttl":      fmt.Sprintf("%ds", int(promptCacheTTL().Seconds())),
+	}
+	if request.SystemInstructions != nil {
+		payload["systemInstruction"] = request.SystemInstructions
+	}
+	if len(request.Tools) > 0 {
+		payload["tools"] = request.Tools
+	}
+	if request.ToolConfig != nil {
+		payload["toolConfig"] = request.ToolConfig
+	}
+	body, err := common.Marshal(payload)
+	if err != nil {
+		return "", 0, err
+	}
+	client, err := service.GetHttpClientWithProxy(info.ChannelSetting.Proxy)
+	if err != nil {
+		return "", 0, err
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+	url := fmt.Sprintf("%s/%s/cachedContents", strings.TrimSuffix(info.ChannelBaseUrl, "/"), model_setting.GetGeminiVersionSetting(modelName))
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", 0, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("x-goog-api-key", geminiRequestApiKey(c, info))
+	resp, err := client.Do(httpRequest)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("status %d: %s", resp.StatusCode, respBody)
+	}
+	var cached struct {
+		Name          string `json:"name"`
+		UsageMetadata struct {
+			TotalTokenCount int `json:"totalTokenCount"`
+		} `json:"usageMetadata"`
+	}
+	if err := common.Unmarshal(respBody, &cached); err != nil {
+		return "", 0, err
+	}
+	if cached.Name == "" {
+		return "", 0, fmt.Errorf("empty cachedContent name")
+	}
+	return cached.Name, cached.UsageMetadata.TotalTokenCount, nil
+}
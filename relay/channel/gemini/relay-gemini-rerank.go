@@ -0,0 +1,156 @@
+package gemini
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/i18n"
+	"github.com/QuantumNous/new-api/logger"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const rerankSystemInstruction = "You are a search relevance ranker. Score how relevant each document is to the query, " +
+	"from 0 (unrelated) to 1 (directly answers the query). Return one entry for every document, " +
+	"using the document index shown in brackets."
+
+// rerankResponseSchema constrains the model output to [{"index": 0, "relevance_score": 0.9}, ...]
+var rerankResponseSchema = map[string]any{
+	"type": "ARRAY",
+	"items": map[string]any{
+		"type": "OBJECT",
+		"properties": map[string]any{
+			"index":           map[string]any{"type": "INTEGER"},
+			"relevance_score": map[string]any{"type": "NUMBER"},
+		},
+		"required": []string{"index", "relevance_score"},
+	},
+}
+
+// rerankDocumentText returns the text to score, documents are plain strings or objects with a text field
+func rerankDocumentText(document any) string {
+	switch doc := document.(type) {
+	case string:
+		return doc
+	case map[string]any:
+		if text, ok := doc["text"].(string); ok {
+			return text
+		}
+	}
+	data, _ := common.Marshal(document)
+	return string(data)
+}
+
+// convertRerankRequest emulates rerank with a generateContent call whose structured output scores every document.
+// The original request is kept in the context, the handler needs the documents, top_n and return_documents.
+func convertRerankRequest(c *gin.Context, request dto.RerankRequest) (*dto.GeminiChatRequest, error) {
+	if request.TopN != nil && *request.TopN > len(request.Documents) {
+		return nil, types.NewErrorWithStatusCode(
+			errors.New(i18n.T(c, i18n.MsgGeminiRerankTopNExceeded, map[string]any{"TopN": *request.TopN, "Documents": len(request.Documents)})),
+			types.ErrorCodeInvalidRequest,
+			http.StatusBadRequest,
+			types.ErrOptionWithSkipRetry(),
+		)
+	}
+
+	var prompt strings.Builder
+	prompt.WriteString("Query: ")
+	prompt.WriteString(request.Query)
+	prompt.WriteString("\n\nDocuments:\n")
+	for i, document := range request.Documents {
+		prompt.WriteString(fmt.Sprintf("[%d] %s\n", i, rerankDocumentText(document)))
+	}
+	common.SetContextKey(c, constant.ContextKeyGeminiRerankRequest, &request)
+
+	return &dto.GeminiChatRequest{
+		Contents: []dto.GeminiChatContent{{
+			Role:  "user",
+			Parts: []dto.GeminiPart{{Text: prompt.String()}},
+		}},
+		SystemInstructions: &dto.GeminiChatContent{
+			Parts: []dto.GeminiPart{{Text: rerankSystemInstruction}},
+		},
+		GenerationConfig: dto.GeminiChatGenerationConfig{
+			Temperature:      common.GetPointer(0.0),
+			ResponseMimeType: "application/json",
+			ResponseSchema:   rerankResponseSchema,
+		},
+	}, nil
+}
+
+// GeminiRerankHandler turns the scores returned by the model into a rerank response ordered by relevance.
+// Documents the model did not score get 0, scores are clamped to [0, 1].
+func GeminiRerankHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response) (*dto.Usage, *types.NewAPIError) {
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, types.NewOpenAIError(err, types.ErrorCodeReadResponseBodyFailed, http.StatusInternalServerError)
+	}
+	service.CloseResponseBodyGracefully(resp)
+	logger.LogDebug(c, "Gemini rerank response body: %s", responseBody)
+
+	request, ok := common.GetContextKeyType[*dto.RerankRequest](c, constant.ContextKeyGeminiRerankRequest)
+	if !ok {
+		return nil, types.NewError(errors.New("rerank request not found in context"), types.ErrorCodeBadResponseBody)
+	}
+	var geminiResponse dto.GeminiChatResponse
+	if err := common.Unmarshal(responseBody, &geminiResponse); err != nil {
+		return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+	if len(geminiResponse.Candidates) == 0 {
+		return nil, types.NewOpenAIError(errors.New(i18n.T(c, i18n.MsgGeminiEmptyResponse)), types.ErrorCodeEmptyResponse, http.StatusInternalServerError)
+	}
+	var output strings.Builder
+	for _, part := range geminiResponse.Candidates[0].Content.Parts {
+		if !part.Thought {
+			output.WriteString(part.Text)
+		}
+	}
+	var scores []struct {
+		Index          int     `json:"index"`
+		RelevanceScore float64 `json:"relevance_score"`
+	}
+	if err := common.UnmarshalJsonStr(output.String(), &scores); err != nil {
+		return nil, types.NewOpenAIError(fmt.Errorf("invalid rerank scores from gemini: %w", err), types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+
+	results := make([]dto.RerankResponseResult, len(request.Documents))
+	for i := range results {
+		results[i].Index = i
+	}
+	for _, score := range scores {
+		if score.Index < 0 || score.Index >= len(results) {
+			continue
+		}
+		results[score.Index].RelevanceScore = min(max(score.RelevanceScore, 0), 1)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].RelevanceScore > results[j].RelevanceScore
+	})
+	if request.TopN != nil && *request.TopN > 0 && *request.TopN < len(results) {
+		results = results[:*request.TopN]
+	}
+	if request.GetReturnDocuments() {
+		for i := range results {
+			document := request.Documents[results[i].Index]
+			if text, isText := document.(string); isText {
+				results[i].Document = dto.RerankDocument{Text: text}
+			} else {
+				results[i].Document = document
+			}
+		}
+	}
+
+	usage := buildUsageFromGeminiMetadata(geminiResponse.UsageMetadata, info.GetEstimatePromptTokens())
+	c.JSON(http.StatusOK, dto.RerankResponse{Results: results, Usage: usage})
+	return &usage, nil
+}
@@ -0,0 +1,128 @@
+package gemini
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/logger"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateLimitRetryBaseDelay is the first backoff when the upstream suggests no retry delay, doubled per attempt
+var rateLimitRetryBaseDelay = time.Second
+
+// rateLimitRetryMaxAttempts returns how many times a 429/503 is retried on the same channel
+func rateLimitRetryMaxAttempts(info *relaycommon.RelayInfo) int {
+	if info.ChannelMeta == nil || info.ChannelType != constant.ChannelTypeGemini {
+		return 0
+	}
+	attempts := model_setting.GetGeminiSettings().RateLimitRetryMaxAttempts
+	if override := info.ChannelOtherSettings.GeminiRateLimitRetryMaxAttempts; override != 0 {
+		attempts = override
+	}
+	return max(attempts, 0)
+}
+
+func isRateLimitRetryable(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// parseRetryDelay reads the google.rpc.RetryInfo retryDelay (e.g. "37s") from the error body,
+// falling back to a Retry-After header in seconds
+func parseRetryDelay(resp *http.Response, respBody []byte) (time.Duration, bool) {
+	type geminiErrorBody struct {
+		Error struct {
+			Details []struct {
+				Type       string `json:"@type"`
+				RetryDelay string `json:"retryDelay"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	var bodies []geminiErrorBody
+	// 流式请求的错误响应可能是数组形式
+	if trimmed := bytes.TrimSpace(respBody); len(trimmed) > 0 && trimmed[0] == '[' {
+		_ = common.Unmarshal(trimmed, &bodies)
+	} else {
+		var body geminiErrorBody
+		if common.Unmarshal(trimmed, &body) == nil {
+			bodies = append(bodies, body)
+		}
+	}
+	for _, body := range bodies {
+		for _, detail := range body.Error.Details {
+			if detail.RetryDelay == "" || !strings.HasSuffix(detail.Type, "google.rpc.RetryInfo") {
+				continue
+			}
+			if delay, err := time.ParseDuration(detail.RetryDelay); err == nil && delay >= 0 {
+				return delay, true
+			}
+		}
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(resp.Header.Get("Retry-After"))); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// doRateLimitRetryRequest resends the request when Gemini answers 429 RESOURCE_EXHAUSTED or 503, waiting the
+// suggested retryDelay (or an exponential backoff). A delay above RateLimitRetryMaxDelaySeconds, or one that would
+// run past the request deadline or a cancelled client, returns the last upstream response for the usual error
+// handling. Other statuses, including 400 and 403, are never retried.
+func doRateLimitRetryRequest(c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader, maxAttempts int, send func(io.Reader) (any, error)) (any, error) {
+	requestBytes, err := io.ReadAll(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("read request body failed: %w", err)
+	}
+	maxDelay := time.Duration(model_setting.GetGeminiSettings().RateLimitRetryMaxDelaySeconds) * time.Second
+	for attempt := 0; ; attempt++ {
+		result, err := send(bytes.NewReader(requestBytes))
+		resp, ok := result.(*http.Response)
+		if err != nil || !ok || resp == nil || !isRateLimitRetryable(resp.StatusCode) || attempt >= maxAttempts {
+			return result, err
+		}
+
+		respBody, err := io.ReadAll(resp.Body)
+		service.CloseResponseBodyGracefully(resp)
+		if err != nil {
+			return nil, fmt.Errorf("read upstream response failed: %w", err)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(respBody))
+		delay, suggested := parseRetryDelay(resp, respBody)
+		if !suggested {
+			delay = rateLimitRetryBaseDelay << attempt
+			if maxDelay > 0 {
+				delay = min(delay, maxDelay)
+			}
+		}
+		if maxDelay > 0 && delay > maxDelay {
+			return resp, nil
+		}
+		retryAt := time.Now().Add(delay)
+		if !info.UpstreamDeadline.IsZero() && !retryAt.Before(info.UpstreamDeadline) {
+			return resp, nil
+		}
+		if deadline, ok := c.Request.Context().Deadline(); ok && !retryAt.Before(deadline) {
+			return resp, nil
+		}
+
+		logger.LogWarn(c, fmt.Sprintf("gemini channel #%d returned %d, retrying in %s (attempt %d/%d)", info.ChannelId, resp.StatusCode, delay, attempt+1, maxAttempts))
+		timer := time.NewTimer(delay)
+		select {
+		case <-c.Request.Context().Done():
+			timer.Stop()
+			return resp, nil
+		case <-timer.C:
+		}
+	}
+}
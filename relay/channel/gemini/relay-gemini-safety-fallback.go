@@ -0,0 +1,78 @@
+package gemini
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/i18n"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+func channelSafetyFallbackMessage(info *relaycommon.RelayInfo) string {
+	if info.ChannelMeta == nil {
+		return ""
+	}
+	return info.ChannelOtherSettings.GeminiSafetyFallbackMessage
+}
+
+// applySafetyFallback replaces content blocked by Gemini safety filters with the channel fallback message,
+// so the client receives a normal completion (finish_reason=stop) instead of a content_filter error.
+// A blocked prompt gets one synthetic candidate, a blocked candidate has its parts replaced.
+// Streams are not buffered: only the blocked chunk is replaced, text streamed before it has already
+// reached the client and stays in front of the fallback message.
+func applySafetyFallback(c *gin.Context, info *relaycommon.RelayInfo, geminiResponse *dto.GeminiChatResponse) {
+	message := channelSafetyFallbackMessage(info)
+	if message == "" {
+		return
+	}
+	stop := "STOP"
+	if len(geminiResponse.Candidates) == 0 {
+		if geminiResponse.PromptFeedback == nil || geminiResponse.PromptFeedback.BlockReason == nil {
+			return
+		}
+		common.SetContextKey(c, constant.ContextKeyAdminRejectReason, fmt.Sprintf("gemini_block_reason=%s", *geminiResponse.PromptFeedback.BlockReason))
+		geminiResponse.Candidates = []dto.GeminiChatCandidate{{
+			Content:      dto.GeminiChatContent{Role: "model", Parts: []dto.GeminiPart{{Text: message}}},
+			FinishReason: &stop,
+		}}
+		return
+	}
+	for i := range geminiResponse.Candidates {
+		candidate := &geminiResponse.Candidates[i]
+		if _, blocked := geminiRefusalMessage(candidate.FinishReason); !blocked {
+			continue
+		}
+		candidate.Content = dto.GeminiChatContent{Role: "model", Parts: []dto.GeminiPart{{Text: message}}}
+		candidate.FinishReason = &stop
+	}
+}
+
+// isGeminiPromptBlocked reports a response rejected before generation, no candidates and a promptFeedback block reason
+func isGeminiPromptBlocked(geminiResponse *dto.GeminiChatResponse) bool {
+	return len(geminiResponse.Candidates) == 0 && geminiResponse.PromptFeedback != nil && geminiResponse.PromptFeedback.BlockReason != nil
+}
+
+// geminiPromptBlockedError builds a 400 content_filter error naming the block reason and the safety ratings that triggered it,
+// so clients can tell a filtered prompt apart from an upstream failure.
+func geminiPromptBlockedError(c *gin.Context, feedback *dto.GeminiChatPromptFeedback) *types.NewAPIError {
+	common.SetContextKey(c, constant.ContextKeyAdminRejectReason, fmt.Sprintf("gemini_block_reason=%s", *feedback.BlockReason))
+	ratings := make([]string, 0, len(feedback.SafetyRatings))
+	for _, rating := range feedback.SafetyRatings {
+		if rating.Blocked || rating.Probability == "MEDIUM" || rating.Probability == "HIGH" {
+			ratings = append(ratings, fmt.Sprintf("%s=%s", rating.Category, rating.Probability))
+		}
+	}
+	message := i18n.T(c, i18n.MsgGeminiPromptBlocked, map[string]any{"Reason": *feedback.BlockReason, "Ratings": strings.Join(ratings, ", ")})
+	return types.WithOpenAIError(types.OpenAIError{
+		Message: message,
+		Type:    "content_filter",
+		Code:    string(types.ErrorCodePromptBlocked),
+	}, http.StatusBadRequest)
+}
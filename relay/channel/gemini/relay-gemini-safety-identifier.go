@@ -0,0 +1,60 @@
+package gemini
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+
+	"github.com/gin-gonic/gin"
+)
+
+// vertexLabelMaxLength is the maximum length of a Vertex AI label value
+const vertexLabelMaxLength = 63
+
+// openAIEndUserIdentifier returns safety_identifier, falling back to the deprecated user field it replaces
+func openAIEndUserIdentifier(textRequest dto.GeneralOpenAIRequest) string {
+	for _, raw := range []json.RawMessage{textRequest.SafetyIdentifier, textRequest.User} {
+		var identifier string
+		if len(raw) > 0 && common.Unmarshal(raw, &identifier) == nil && strings.TrimSpace(identifier) != "" {
+			return strings.TrimSpace(identifier)
+		}
+	}
+	return ""
+}
+
+// applySafetyIdentifier records the end-user identifier for the admin log, Gemini has no equivalent field.
+// Vertex AI channels that allow safety_identifier also receive it as a request label.
+func applySafetyIdentifier(c *gin.Context, geminiRequest *dto.GeminiChatRequest, textRequest dto.GeneralOpenAIRequest, info *relaycommon.RelayInfo) {
+	identifier := openAIEndUserIdentifier(textRequest)
+	if identifier == "" {
+		return
+	}
+	common.SetContextKey(c, constant.ContextKeySafetyIdentifier, identifier)
+	if info.ChannelMeta == nil || info.ChannelType != constant.ChannelTypeVertexAi || !info.ChannelOtherSettings.AllowSafetyIdentifier {
+		return
+	}
+	if geminiRequest.Labels == nil {
+		geminiRequest.Labels = make(map[string]string, 1)
+	}
+	geminiRequest.Labels["safety_identifier"] = vertexLabelValue(identifier)
+}
+
+// vertexLabelValue lowercases the value and replaces characters not allowed in label values
+func vertexLabelValue(value string) string {
+	var builder strings.Builder
+	for _, r := range strings.ToLower(value) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			builder.WriteRune(r)
+		} else {
+			builder.WriteByte('_')
+		}
+		if builder.Len() >= vertexLabelMaxLength {
+			break
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,83 @@
+package gemini
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/i18n"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+)
+
+// parseSafetySettingsOverride accepts extra_body.google.safety_settings either as a category to threshold
+// object or in the native Gemini form [{"category": "...", "threshold": "..."}]
+func parseSafetySettingsOverride(c *gin.Context, value any) (map[string]string, error) {
+	invalid := errors.New(i18n.T(c, i18n.MsgGeminiSafetySettingsInvalid))
+	overrides := make(map[string]string)
+	add := func(category any, threshold any) error {
+		categoryName, ok1 := category.(string)
+		thresholdName, ok2 := threshold.(string)
+		if !ok1 || !ok2 || strings.TrimSpace(categoryName) == "" || strings.TrimSpace(thresholdName) == "" {
+			return invalid
+		}
+		categoryName = strings.ToUpper(strings.TrimSpace(categoryName))
+		if !strings.HasPrefix(categoryName, "HARM_CATEGORY_") {
+			return errors.New(i18n.T(c, i18n.MsgGeminiSafetyCategoryUnknown, map[string]any{"Category": categoryName}))
+		}
+		overrides[categoryName] = strings.ToUpper(strings.TrimSpace(thresholdName))
+		return nil
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for category, threshold := range v {
+			if err := add(category, threshold); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			setting, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, invalid
+			}
+			if err := add(setting["category"], setting["threshold"]); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, invalid
+	}
+	return overrides, nil
+}
+
+// buildSafetySettings covers every harm category with the configured threshold, per-request overrides win.
+// Categories without a threshold are left to the Google defaults, nil when nothing is configured.
+func buildSafetySettings(overrides map[string]string) []dto.GeminiChatSafetySettings {
+	var safetySettings []dto.GeminiChatSafetySettings
+	for _, category := range SafetySettingList {
+		threshold, ok := overrides[category]
+		if !ok {
+			threshold = model_setting.GetGeminiSafetySetting(category)
+		}
+		if threshold != "" {
+			safetySettings = append(safetySettings, dto.GeminiChatSafetySettings{Category: category, Threshold: threshold})
+		}
+	}
+	// 其余类别（如 HARM_CATEGORY_CIVIC_INTEGRITY）只在调用方显式指定时发送
+	extra := make([]string, 0, len(overrides))
+	for category := range overrides {
+		if !lo.Contains(SafetySettingList, category) {
+			extra = append(extra, category)
+		}
+	}
+	sort.Strings(extra)
+	for _, category := range extra {
+		safetySettings = append(safetySettings, dto.GeminiChatSafetySettings{Category: category, Threshold: overrides[category]})
+	}
+	return safetySettings
+}
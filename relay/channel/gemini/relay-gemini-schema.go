@@ -0,0 +1,370 @@
+package gemini
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// translateJSONSchema converts a client JSON Schema into the OpenAPI schema subset accepted by Gemini.
+// It is shared by functionDeclarations.parameters and generationConfig.responseSchema:
+// local $ref are inlined from $defs/definitions, oneOf becomes anyOf, allOf is merged,
+// const becomes a single value enum and unsupported keywords are dropped.
+func translateJSONSchema(schema interface{}) interface{} {
+	root, ok := schema.(map[string]interface{})
+	if !ok {
+		return cleanFunctionParameters(schema)
+	}
+	defs := make(map[string]interface{})
+	for _, key := range []string{"$defs", "definitions"} {
+		if values, ok := root[key].(map[string]interface{}); ok {
+			for name, def := range values {
+				defs["#/"+key+"/"+name] = def
+			}
+		}
+	}
+	return cleanFunctionParameters(normalizeJSONSchema(root, defs, make(map[string]bool), 0))
+}
+
+func normalizeJSONSchema(node interface{}, defs map[string]interface{}, resolving map[string]bool, depth int) interface{} {
+	if depth >= geminiFunctionSchemaMaxDepth {
+		return node
+	}
+	switch v := node.(type) {
+	case map[string]interface{}:
+		return normalizeJSONSchemaObject(v, defs, resolving, depth)
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, item := range v {
+			normalized[i] = normalizeJSONSchema(item, defs, resolving, depth+1)
+		}
+		return normalized
+	default:
+		return node
+	}
+}
+
+func normalizeJSONSchemaObject(schema map[string]interface{}, defs map[string]interface{}, resolving map[string]bool, depth int) interface{} {
+	if ref, ok := schema["$ref"].(string); ok {
+		def, found := defs[ref]
+		defMap, isMap := def.(map[string]interface{})
+		if !found || !isMap || resolving[ref] {
+			// 无法解析或递归引用，退化为不带约束的 object
+			fallback := map[string]interface{}{"type": "object"}
+			if description, ok := schema["description"]; ok {
+				fallback["description"] = description
+			}
+			return fallback
+		}
+		merged := make(map[string]interface{}, len(defMap)+len(schema))
+		for k, val := range defMap {
+			merged[k] = val
+		}
+		for k, val := range schema {
+			if k != "$ref" {
+				merged[k] = val
+			}
+		}
+		resolving[ref] = true
+		defer delete(resolving, ref)
+		return normalizeJSONSchemaObject(merged, defs, resolving, depth+1)
+	}
+
+	result := make(map[string]interface{}, len(schema))
+	for k, val := range schema {
+		result[k] = val
+	}
+
+	if constValue, ok := result["const"]; ok {
+		if _, hasEnum := result["enum"]; !hasEnum {
+			result["enum"] = []interface{}{constValue}
+		}
+		// Gemini 的 enum 需要显式 type
+		if _, hasType := result["type"]; !hasType {
+			if _, isString := constValue.(string); isString {
+				result["type"] = "string"
+			}
+		}
+		delete(result, "const")
+	}
+	splitJSONSchemaTypeUnion(result)
+	if oneOf, ok := result["oneOf"]; ok {
+		if _, hasAnyOf := result["anyOf"]; !hasAnyOf {
+			result["anyOf"] = oneOf
+		}
+		delete(result, "oneOf")
+	}
+	if allOf, ok := result["allOf"].([]interface{}); ok {
+		delete(result, "allOf")
+		for _, item := range allOf {
+			if sub, ok := normalizeJSONSchema(item, defs, resolving, depth+1).(map[string]interface{}); ok {
+				mergeJSONSchema(result, sub)
+			}
+		}
+	}
+
+	if props, ok := result["properties"].(map[string]interface{}); ok {
+		normalizedProps := make(map[string]interface{}, len(props))
+		for name, prop := range props {
+			normalizedProps[name] = normalizeJSONSchema(prop, defs, resolving, depth+1)
+		}
+		result["properties"] = normalizedProps
+	}
+	if items, ok := result["items"]; ok {
+		result["items"] = normalizeJSONSchema(items, defs, resolving, depth+1)
+	}
+	if anyOf, ok := result["anyOf"].([]interface{}); ok {
+		variants := make([]interface{}, 0, len(anyOf))
+		nullable := false
+		for _, item := range anyOf {
+			normalized := normalizeJSONSchema(item, defs, resolving, depth+1)
+			if isNullJSONSchema(normalized) {
+				nullable = true
+				continue
+			}
+			variants = append(variants, normalized)
+		}
+		if nullable {
+			result["nullable"] = true
+		}
+		// anyOf: [X, null] 是可空字段的常见写法，Gemini 更适合直接展开为 nullable 的 X
+		if single, ok := singleJSONSchemaVariant(variants); ok && nullable {
+			delete(result, "anyOf")
+			mergeJSONSchema(result, single)
+		} else if len(variants) == 0 {
+			delete(result, "anyOf")
+		} else {
+			result["anyOf"] = variants
+		}
+	}
+	return result
+}
+
+// jsonSchemaTypeKeywords lists the keywords that only apply to one type, they move into the matching
+// anyOf variant when a type union is split.
+var jsonSchemaTypeKeywords = map[string][]string{
+	"object":  {"properties", "required", "additionalProperties", "propertyOrdering", "minProperties", "maxProperties"},
+	"array":   {"items", "prefixItems", "minItems", "maxItems"},
+	"string":  {"minLength", "maxLength", "pattern", "format"},
+	"number":  {"minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "format"},
+	"integer": {"minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "format"},
+}
+
+// splitJSONSchemaTypeUnion maps JSON Schema type arrays to Gemini's dialect: "null" becomes nullable,
+// a single remaining type is kept as type and several types become anyOf with one variant per type.
+// A null inside enum is also expressed as nullable because Gemini enums only accept strings.
+func splitJSONSchemaTypeUnion(schema map[string]interface{}) {
+	if enum, ok := schema["enum"].([]interface{}); ok && lo.Contains(enum, nil) {
+		schema["enum"] = lo.Without(enum, nil)
+		schema["nullable"] = true
+	}
+	types, ok := schema["type"].([]interface{})
+	if !ok {
+		return
+	}
+	typeNames := make([]string, 0, len(types))
+	for _, item := range types {
+		typeName, ok := item.(string)
+		if !ok {
+			continue
+		}
+		typeName = strings.ToLower(strings.TrimSpace(typeName))
+		if typeName == "null" {
+			schema["nullable"] = true
+			continue
+		}
+		if !lo.Contains(typeNames, typeName) {
+			typeNames = append(typeNames, typeName)
+		}
+	}
+	switch {
+	case len(typeNames) == 0:
+		delete(schema, "type")
+		return
+	case len(typeNames) == 1:
+		schema["type"] = typeNames[0]
+		return
+	}
+	_, hasAnyOf := schema["anyOf"]
+	_, hasOneOf := schema["oneOf"]
+	if hasAnyOf || hasOneOf {
+		// 已有 anyOf/oneOf 时不再展开类型联合，保留第一个类型
+		schema["type"] = typeNames[0]
+		return
+	}
+	delete(schema, "type")
+	variants := make([]interface{}, 0, len(typeNames))
+	for _, typeName := range typeNames {
+		variant := map[string]interface{}{"type": typeName}
+		for _, keyword := range jsonSchemaTypeKeywords[typeName] {
+			if val, ok := schema[keyword]; ok {
+				variant[keyword] = val
+			}
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			if values := lo.Filter(enum, func(item interface{}, _ int) bool { return jsonValueHasType(item, typeName) }); len(values) > 0 {
+				variant["enum"] = values
+			}
+		}
+		variants = append(variants, variant)
+	}
+	for _, keywords := range jsonSchemaTypeKeywords {
+		for _, keyword := range keywords {
+			delete(schema, keyword)
+		}
+	}
+	delete(schema, "enum")
+	schema["anyOf"] = variants
+}
+
+// mergeJSONSchema merges src into dst, properties and required are combined while other keys keep dst values.
+func mergeJSONSchema(dst map[string]interface{}, src map[string]interface{}) {
+	for k, val := range src {
+		switch k {
+		case "properties":
+			srcProps, ok := val.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			dstProps, _ := dst["properties"].(map[string]interface{})
+			merged := make(map[string]interface{}, len(dstProps)+len(srcProps))
+			for name, prop := range dstProps {
+				merged[name] = prop
+			}
+			for name, prop := range srcProps {
+				if _, exists := merged[name]; !exists {
+					merged[name] = prop
+				}
+			}
+			dst["properties"] = merged
+		case "required":
+			srcRequired, ok := val.([]interface{})
+			if !ok {
+				continue
+			}
+			dstRequired, _ := dst["required"].([]interface{})
+			seen := make(map[interface{}]bool, len(dstRequired))
+			merged := make([]interface{}, 0, len(dstRequired)+len(srcRequired))
+			for _, required := range [][]interface{}{dstRequired, srcRequired} {
+				for _, name := range required {
+					if !seen[name] {
+						seen[name] = true
+						merged = append(merged, name)
+					}
+				}
+			}
+			dst["required"] = merged
+		default:
+			if _, exists := dst[k]; !exists {
+				dst[k] = val
+			}
+		}
+	}
+}
+
+func isNullJSONSchema(schema interface{}) bool {
+	v, ok := schema.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	typeName, ok := v["type"].(string)
+	return ok && strings.EqualFold(typeName, "null")
+}
+
+func singleJSONSchemaVariant(variants []interface{}) (map[string]interface{}, bool) {
+	if len(variants) != 1 {
+		return nil, false
+	}
+	v, ok := variants[0].(map[string]interface{})
+	return v, ok
+}
+
+// validateJSONSchemaValue checks a decoded JSON value against a schema produced by translateJSONSchema.
+// Only the keywords kept by the translation are checked: type, nullable, enum, anyOf, properties, required and items.
+func validateJSONSchemaValue(schema interface{}, value interface{}, path string) error {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if nullable, _ := s["nullable"].(bool); nullable && value == nil {
+		return nil
+	}
+	if anyOf, ok := s["anyOf"].([]interface{}); ok && len(anyOf) > 0 {
+		matched := false
+		for _, variant := range anyOf {
+			if validateJSONSchemaValue(variant, value, path) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: does not match any of the allowed schemas", path)
+		}
+	}
+	if typeName, ok := s["type"].(string); ok && !jsonValueHasType(value, typeName) {
+		return fmt.Errorf("%s: expected %s", path, strings.ToLower(typeName))
+	}
+	if enum, ok := s["enum"].([]interface{}); ok && len(enum) > 0 {
+		if !lo.ContainsBy(enum, func(item interface{}) bool { return reflect.DeepEqual(item, value) }) {
+			return fmt.Errorf("%s: value is not one of the allowed enum values", path)
+		}
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if required, ok := s["required"].([]interface{}); ok {
+			for _, name := range required {
+				if key, ok := name.(string); ok {
+					if _, exists := v[key]; !exists {
+						return fmt.Errorf("%s: missing required property %q", path, key)
+					}
+				}
+			}
+		}
+		if props, ok := s["properties"].(map[string]interface{}); ok {
+			for name, prop := range props {
+				if item, exists := v[name]; exists {
+					if err := validateJSONSchemaValue(prop, item, path+"."+name); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	case []interface{}:
+		if items, ok := s["items"]; ok {
+			for i, item := range v {
+				if err := validateJSONSchemaValue(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func jsonValueHasType(value interface{}, typeName string) bool {
+	switch strings.ToUpper(typeName) {
+	case "OBJECT":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "ARRAY":
+		_, ok := value.([]interface{})
+		return ok
+	case "STRING":
+		_, ok := value.(string)
+		return ok
+	case "NUMBER":
+		_, ok := value.(float64)
+		return ok
+	case "INTEGER":
+		v, ok := value.(float64)
+		return ok && v == math.Trunc(v)
+	case "BOOLEAN":
+		_, ok := value.(bool)
+		return ok
+	default:
+		return true
+	}
+}
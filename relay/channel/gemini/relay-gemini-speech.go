@@ -0,0 +1,201 @@
+package gemini
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/i18n"
+	"github.com/QuantumNous/new-api/logger"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultSpeechVoice = "Kore"
+	// Gemini TTS 输出 24kHz 16bit 单声道 PCM，与 OpenAI 的 pcm 格式一致
+	defaultSpeechSampleRate = 24000
+)
+
+// openAISpeechVoices maps the OpenAI voices to Gemini prebuilt voices of a similar character,
+// any other voice is sent as a Gemini voice name unchanged.
+var openAISpeechVoices = map[string]string{
+	"alloy":   "Zephyr",
+	"ash":     "Charon",
+	"ballad":  "Algieba",
+	"coral":   "Aoede",
+	"echo":    "Puck",
+	"fable":   "Fenrir",
+	"nova":    "Leda",
+	"onyx":    "Orus",
+	"sage":    "Achernar",
+	"shimmer": "Despina",
+	"verse":   "Sulafat",
+}
+
+var speechContentTypes = map[string]string{
+	"wav": "audio/wav",
+	"pcm": "audio/pcm",
+}
+
+func geminiSpeechVoice(voice string) string {
+	voice = strings.TrimSpace(voice)
+	if voice == "" {
+		return defaultSpeechVoice
+	}
+	if mapped, ok := openAISpeechVoices[strings.ToLower(voice)]; ok {
+		return mapped
+	}
+	return voice
+}
+
+// convertSpeechRequest maps an OpenAI audio/speech request to a generateContent call with AUDIO output.
+// Gemini only returns PCM, an empty response_format defaults to wav and formats that would need an encoder
+// (mp3, opus, aac, flac) are rejected rather than answered with audio in another format.
+func convertSpeechRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.AudioRequest) (*dto.GeminiChatRequest, error) {
+	if !isGeminiAudioOutputModel(info.UpstreamModelName) {
+		return nil, types.NewErrorWithStatusCode(
+			errors.New(i18n.T(c, i18n.MsgGeminiSpeechModelUnsupported, map[string]any{"Model": info.UpstreamModelName})),
+			types.ErrorCodeInvalidRequest,
+			http.StatusBadRequest,
+			types.ErrOptionWithSkipRetry(),
+		)
+	}
+	if strings.TrimSpace(request.Input) == "" {
+		return nil, types.NewErrorWithStatusCode(
+			errors.New(i18n.T(c, i18n.MsgGeminiSpeechInputRequired)),
+			types.ErrorCodeInvalidRequest,
+			http.StatusBadRequest,
+			types.ErrOptionWithSkipRetry(),
+		)
+	}
+	format := strings.ToLower(strings.TrimSpace(request.ResponseFormat))
+	if format == "" {
+		format = "wav"
+	}
+	if _, ok := speechContentTypes[format]; !ok {
+		return nil, types.NewErrorWithStatusCode(
+			errors.New(i18n.T(c, i18n.MsgGeminiSpeechFormatUnsupported, map[string]any{"Format": format})),
+			types.ErrorCodeInvalidRequest,
+			http.StatusBadRequest,
+			types.ErrOptionWithSkipRetry(),
+		)
+	}
+	common.SetContextKey(c, constant.ContextKeyGeminiSpeechFormat, format)
+
+	// TTS 模型通过自然语言控制语气，instructions 作为朗读提示放在文本前
+	text := request.Input
+	if instructions := strings.TrimSpace(request.Instructions); instructions != "" {
+		text = instructions + ": " + text
+	}
+	speechConfig, err := common.Marshal(map[string]any{
+		"voiceConfig": map[string]any{
+			"prebuiltVoiceConfig": map[string]any{"voiceName": geminiSpeechVoice(request.Voice)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dto.GeminiChatRequest{
+		Contents: []dto.GeminiChatContent{{
+			Role:  "user",
+			Parts: []dto.GeminiPart{{Text: text}},
+		}},
+		GenerationConfig: dto.GeminiChatGenerationConfig{
+			ResponseModalities: []string{"AUDIO"},
+			SpeechConfig:       speechConfig,
+		},
+	}, nil
+}
+
+// pcmToWav wraps 16bit mono little endian PCM in a WAV container
+func pcmToWav(pcm []byte, sampleRate int) []byte {
+	var buf bytes.Buffer
+	buf.Grow(44 + len(pcm))
+	buf.WriteString("RIFF")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(36+len(pcm)))
+	buf.WriteString("WAVEfmt ")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(16))
+	_ = binary.Write(&buf, binary.LittleEndian, uint16(1)) // PCM
+	_ = binary.Write(&buf, binary.LittleEndian, uint16(1)) // mono
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(sampleRate))
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(sampleRate*2))
+	_ = binary.Write(&buf, binary.LittleEndian, uint16(2))
+	_ = binary.Write(&buf, binary.LittleEndian, uint16(16))
+	buf.WriteString("data")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(pcm)))
+	buf.Write(pcm)
+	return buf.Bytes()
+}
+
+// GeminiSpeechHandler writes the PCM audio returned by a TTS model in the requested response_format.
+// All output tokens are audio, so they are billed as audio tokens when usageMetadata has no modality breakdown.
+func GeminiSpeechHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response) (*dto.Usage, *types.NewAPIError) {
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, types.NewOpenAIError(err, types.ErrorCodeReadResponseBodyFailed, http.StatusInternalServerError)
+	}
+	service.CloseResponseBodyGracefully(resp)
+
+	var geminiResponse dto.GeminiChatResponse
+	if err := common.Unmarshal(responseBody, &geminiResponse); err != nil {
+		return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+	var audio []byte
+	audioFormat, sampleRate := "", 0
+	for _, candidate := range geminiResponse.Candidates {
+		for _, part := range candidate.Content.Parts {
+			if part.InlineData == nil || !strings.HasPrefix(part.InlineData.MimeType, "audio") {
+				continue
+			}
+			data, err := base64.StdEncoding.DecodeString(part.InlineData.Data)
+			if err != nil {
+				return nil, types.NewOpenAIError(fmt.Errorf("invalid audio data from gemini: %w", err), types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+			}
+			audioFormat, sampleRate = geminiOutputAudioFormat(part.InlineData.MimeType)
+			audio = append(audio, data...)
+		}
+		if len(audio) > 0 {
+			break
+		}
+	}
+	if len(audio) == 0 {
+		return nil, types.NewOpenAIError(errors.New(i18n.T(c, i18n.MsgGeminiEmptyResponse)), types.ErrorCodeEmptyResponse, http.StatusInternalServerError)
+	}
+	if audioFormat != "pcm16" {
+		return nil, types.NewOpenAIError(fmt.Errorf("unexpected audio format from gemini: %s", audioFormat), types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+	if sampleRate <= 0 {
+		sampleRate = defaultSpeechSampleRate
+	}
+
+	format := common.GetContextKeyString(c, constant.ContextKeyGeminiSpeechFormat)
+	if format == "wav" {
+		audio = pcmToWav(audio, sampleRate)
+	} else if sampleRate != defaultSpeechSampleRate {
+		logger.LogWarn(c, fmt.Sprintf("gemini speech returned %d Hz pcm, clients expect %d Hz", sampleRate, defaultSpeechSampleRate))
+	}
+	contentType, ok := speechContentTypes[format]
+	if !ok {
+		contentType = speechContentTypes["pcm"]
+	}
+	c.Data(http.StatusOK, contentType, audio)
+
+	usage := buildUsageFromGeminiMetadata(geminiResponse.UsageMetadata, info.GetEstimatePromptTokens())
+	if usage.CompletionTokenDetails.AudioTokens == 0 {
+		usage.CompletionTokenDetails.AudioTokens = usage.CompletionTokens
+		usage.CompletionTokenDetails.TextTokens = 0
+	}
+	return &usage, nil
+}
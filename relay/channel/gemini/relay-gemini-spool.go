@@ -0,0 +1,64 @@
+package gemini
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/QuantumNous/new-api/logger"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// spooledResponse is an upstream response body that exceeded the spool threshold and was written to a temp file
+type spooledResponse struct {
+	file *os.File
+	size int64
+}
+
+// reader rewinds the temp file, the body is read once to decode and once to relay it
+func (s *spooledResponse) reader() (io.Reader, error) {
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.file, nil
+}
+
+func (s *spooledResponse) Close() {
+	_ = s.file.Close()
+	_ = os.Remove(s.file.Name())
+}
+
+// readGeminiResponseBody reads a non-stream response body. With response spooling enabled only the first
+// ResponseSpoolThresholdMB are buffered in memory, a larger body is moved to a temp file and returned as spooled.
+// Only native passthrough relays the spooled file as is, the OpenAI-format handlers still decode it into a
+// GeminiChatResponse and build the converted response in memory, so spooling there only saves the raw copy.
+func readGeminiResponseBody(c *gin.Context, resp *http.Response) ([]byte, *spooledResponse, error) {
+	settings := model_setting.GetGeminiSettings()
+	if !settings.ResponseSpoolEnabled || settings.ResponseSpoolThresholdMB <= 0 {
+		body, err := io.ReadAll(resp.Body)
+		return body, nil, err
+	}
+	threshold := int64(settings.ResponseSpoolThresholdMB) << 20
+	head, err := io.ReadAll(io.LimitReader(resp.Body, threshold+1))
+	if err != nil || int64(len(head)) <= threshold {
+		return head, nil, err
+	}
+
+	file, err := os.CreateTemp("", "new-api-gemini-response-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("create response spool file failed: %w", err)
+	}
+	spooled := &spooledResponse{file: file}
+	size, err := io.Copy(file, io.MultiReader(bytes.NewReader(head), resp.Body))
+	if err != nil {
+		spooled.Close()
+		return nil, nil, fmt.Errorf("spool response body failed: %w", err)
+	}
+	spooled.size = size
+	logger.LogInfo(c, fmt.Sprintf("gemini response body of %d bytes spooled to disk", size))
+	return nil, spooled, nil
+}
@@ -0,0 +1,74 @@
+package gemini
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+)
+
+// applyChannelRequestTimeout caps non-stream requests at the channel GeminiRequestTimeoutSeconds by moving the
+// upstream deadline forward, an earlier deadline (e.g. from X-Request-Deadline) is kept.
+func applyChannelRequestTimeout(info *relaycommon.RelayInfo) {
+	if info.ChannelMeta == nil || info.IsStream || info.ChannelOtherSettings.GeminiRequestTimeoutSeconds <= 0 {
+		return
+	}
+	deadline := time.Now().Add(time.Duration(info.ChannelOtherSettings.GeminiRequestTimeoutSeconds) * time.Second)
+	if info.UpstreamDeadline.IsZero() || deadline.Before(info.UpstreamDeadline) {
+		info.UpstreamDeadline = deadline
+	}
+}
+
+func channelStreamIdleTimeout(info *relaycommon.RelayInfo) time.Duration {
+	if info.ChannelMeta == nil || !info.IsStream || info.ChannelOtherSettings.GeminiStreamIdleTimeoutSeconds <= 0 {
+		return 0
+	}
+	return time.Duration(info.ChannelOtherSettings.GeminiStreamIdleTimeoutSeconds) * time.Second
+}
+
+// idleTimeoutBody closes the upstream stream when no data arrives for timeout, the timer restarts on every read,
+// so a long stream that keeps producing chunks is never cut.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration) *idleTimeoutBody {
+	b := &idleTimeoutBody{ReadCloser: body, timeout: timeout}
+	b.timer = time.AfterFunc(timeout, func() {
+		b.timedOut.Store(true)
+		_ = b.ReadCloser.Close()
+	})
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.timedOut.Load() {
+		return n, fmt.Errorf("gemini stream idle for more than %s", b.timeout)
+	}
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
+
+// applyStreamIdleTimeout wraps a successful streaming response with the channel GeminiStreamIdleTimeoutSeconds
+func applyStreamIdleTimeout(info *relaycommon.RelayInfo, resp any) {
+	timeout := channelStreamIdleTimeout(info)
+	httpResp, ok := resp.(*http.Response)
+	if timeout <= 0 || !ok || httpResp == nil || httpResp.Body == nil || httpResp.StatusCode != http.StatusOK {
+		return
+	}
+	httpResp.Body = newIdleTimeoutBody(httpResp.Body, timeout)
+}
@@ -0,0 +1,145 @@
+package gemini
+
+import (
+	"context"
+	"net/http"
+	"slices"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const geminiTracerName = "github.com/QuantumNous/new-api/relay/channel/gemini"
+
+func isGeminiTracingEnabled() bool {
+	return model_setting.GetGeminiSettings().TracingEnabled
+}
+
+// startGeminiSpan starts a span for one stage of the relay, a no-op span is returned when tracing is disabled.
+// Every stage is a child of the gemini.request span of the client request, so conversion, upstream call and
+// response handling of all attempts end up under one parent.
+func startGeminiSpan(c *gin.Context, info *relaycommon.RelayInfo, name string) trace.Span {
+	if !isGeminiTracingEnabled() {
+		return noop.Span{}
+	}
+	attributes := geminiSpanAttributes(info)
+	if info.ChannelMeta != nil {
+		attributes = append(attributes,
+			attribute.String("new_api.upstream_model", info.UpstreamModelName),
+			attribute.Int("new_api.channel_id", info.ChannelId),
+		)
+	}
+	_, span := otel.Tracer(geminiTracerName).Start(geminiRequestTraceContext(c, info), name,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(attributes...),
+	)
+	return span
+}
+
+// startGeminiUpstreamSpan starts the span of an upstream call and keeps it so SetupRequestHeader can send it
+// to Gemini in the traceparent header
+func startGeminiUpstreamSpan(c *gin.Context, info *relaycommon.RelayInfo) trace.Span {
+	span := startGeminiSpan(c, info, "gemini.upstream_request")
+	if span.SpanContext().IsValid() {
+		common.SetContextKey(c, constant.ContextKeyGeminiUpstreamTraceContext, trace.ContextWithSpan(context.Background(), span))
+	}
+	return span
+}
+
+// injectGeminiTraceHeaders propagates the current upstream span through the configured propagator
+func injectGeminiTraceHeaders(c *gin.Context, header http.Header) {
+	if !isGeminiTracingEnabled() {
+		return
+	}
+	if ctx, ok := common.GetContextKeyType[context.Context](c, constant.ContextKeyGeminiUpstreamTraceContext); ok {
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+	}
+}
+
+// geminiRequestTraceContext returns the context of the gemini.request span, starting it on first use.
+// The span continues the incoming trace (traceparent header) and ends when the client request is done.
+func geminiRequestTraceContext(c *gin.Context, info *relaycommon.RelayInfo) context.Context {
+	if ctx, ok := common.GetContextKeyType[context.Context](c, constant.ContextKeyGeminiTraceContext); ok {
+		return ctx
+	}
+	parent := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	ctx, span := otel.Tracer(geminiTracerName).Start(parent, "gemini.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(geminiSpanAttributes(info)...),
+	)
+	// net/http cancels the request context once the handler returns
+	context.AfterFunc(c.Request.Context(), func() { span.End() })
+	common.SetContextKey(c, constant.ContextKeyGeminiTraceContext, ctx)
+	return ctx
+}
+
+func geminiSpanAttributes(info *relaycommon.RelayInfo) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("gen_ai.system", "gemini"),
+		attribute.String("gen_ai.request.model", info.OriginModelName),
+		attribute.Bool("gen_ai.request.stream", info.IsStream),
+	}
+}
+
+func endGeminiSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func setGeminiUpstreamSpanAttributes(span trace.Span, resp any) {
+	if httpResp, ok := resp.(*http.Response); ok && httpResp != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", httpResp.StatusCode))
+	}
+}
+
+func setGeminiResponseSpanAttributes(c *gin.Context, span trace.Span, usage any) {
+	if u, ok := usage.(*dto.Usage); ok && u != nil {
+		span.SetAttributes(
+			attribute.Int("gen_ai.usage.input_tokens", u.PromptTokens),
+			attribute.Int("gen_ai.usage.output_tokens", u.CompletionTokens),
+		)
+	}
+	if reasons, _ := common.GetContextKeyType[[]string](c, constant.ContextKeyGeminiFinishReasons); len(reasons) > 0 {
+		span.SetAttributes(attribute.StringSlice("gen_ai.response.finish_reasons", reasons))
+	}
+}
+
+// resetGeminiFinishReasons drops the finish reasons of a previous attempt before a retry
+func resetGeminiFinishReasons(c *gin.Context) {
+	if isGeminiTracingEnabled() {
+		common.SetContextKey(c, constant.ContextKeyGeminiFinishReasons, []string(nil))
+	}
+}
+
+// recordGeminiFinishReasons remembers the distinct upstream finish reasons for the response span
+func recordGeminiFinishReasons(c *gin.Context, candidates []dto.GeminiChatCandidate) {
+	if !isGeminiTracingEnabled() {
+		return
+	}
+	reasons, _ := common.GetContextKeyType[[]string](c, constant.ContextKeyGeminiFinishReasons)
+	changed := false
+	for _, candidate := range candidates {
+		if candidate.FinishReason == nil || *candidate.FinishReason == "" || slices.Contains(reasons, *candidate.FinishReason) {
+			continue
+		}
+		reasons = append(reasons, *candidate.FinishReason)
+		changed = true
+	}
+	if changed {
+		common.SetContextKey(c, constant.ContextKeyGeminiFinishReasons, reasons)
+	}
+}
@@ -0,0 +1,325 @@
+package gemini
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/i18n"
+	"github.com/QuantumNous/new-api/logger"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const transcriptionInstruction = "Transcribe the speech in this audio verbatim. Output only the spoken words, " +
+	"without commentary, descriptions, translation or speaker labels."
+
+// transcriptionAudioExtensions is used when the uploaded file carries no usable Content-Type
+var transcriptionAudioExtensions = map[string]string{
+	".mp3":  "audio/mp3",
+	".mpga": "audio/mpeg",
+	".mpeg": "audio/mpeg",
+	".wav":  "audio/wav",
+	".aac":  "audio/aac",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".aif":  "audio/aiff",
+	".aiff": "audio/aiff",
+}
+
+// transcriptionAudioAliases normalizes non standard Content-Type values sent by common clients
+var transcriptionAudioAliases = map[string]string{
+	"audio/x-wav":  "audio/wav",
+	"audio/wave":   "audio/wav",
+	"audio/x-flac": "audio/flac",
+	"audio/x-aiff": "audio/aiff",
+	"audio/x-aac":  "audio/aac",
+}
+
+var transcriptionTextSchema = map[string]any{
+	"type": "OBJECT",
+	"properties": map[string]any{
+		"text": map[string]any{"type": "STRING"},
+	},
+	"required": []string{"text"},
+}
+
+// transcriptionSegmentSchema is used for verbose_json, srt and vtt, which all need segment timing
+var transcriptionSegmentSchema = map[string]any{
+	"type": "OBJECT",
+	"properties": map[string]any{
+		"language": map[string]any{"type": "STRING"},
+		"text":     map[string]any{"type": "STRING"},
+		"segments": map[string]any{
+			"type": "ARRAY",
+			"items": map[string]any{
+				"type": "OBJECT",
+				"properties": map[string]any{
+					"start": map[string]any{"type": "NUMBER"},
+					"end":   map[string]any{"type": "NUMBER"},
+					"text":  map[string]any{"type": "STRING"},
+				},
+				"required": []string{"start", "end", "text"},
+			},
+		},
+	},
+	"required": []string{"text", "segments"},
+}
+
+var transcriptionFormats = map[string]bool{
+	"json":         true,
+	"text":         true,
+	"verbose_json": true,
+	"srt":          true,
+	"vtt":          true,
+}
+
+// transcriptionRequest keeps what the handler needs to shape the OpenAI transcription response
+type transcriptionRequest struct {
+	ResponseFormat string
+	Language       string
+}
+
+type transcriptionOutput struct {
+	Language string `json:"language"`
+	Text     string `json:"text"`
+	Segments []struct {
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+		Text  string  `json:"text"`
+	} `json:"segments"`
+}
+
+func transcriptionInvalidRequestError(message string) error {
+	return types.NewErrorWithStatusCode(errors.New(message), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+}
+
+// transcriptionAudioMimeType returns the Gemini mime type of the uploaded audio, from its Content-Type or extension
+func transcriptionAudioMimeType(contentType string, filename string) (string, bool) {
+	mimeType, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(contentType)), ";")
+	if alias, ok := transcriptionAudioAliases[mimeType]; ok {
+		mimeType = alias
+	}
+	if strings.HasPrefix(mimeType, "audio/") && isGeminiSupportedMimeType(mimeType) {
+		return mimeType, true
+	}
+	if byExtension, ok := transcriptionAudioExtensions[strings.ToLower(filepath.Ext(filename))]; ok {
+		return byExtension, true
+	}
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = strings.ToLower(filepath.Ext(filename))
+	}
+	return mimeType, false
+}
+
+// convertTranscriptionRequest maps an OpenAI audio/transcriptions upload to a generateContent call that carries the
+// audio next to a verbatim transcription instruction. Structured output is requested for every format except text.
+func convertTranscriptionRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.AudioRequest) (*dto.GeminiChatRequest, error) {
+	form, err := common.ParseMultipartFormReusable(c)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing multipart form: %w", err)
+	}
+	formValue := func(key string) string {
+		if values := form.Value[key]; len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+		return ""
+	}
+	fileHeaders := form.File["file"]
+	if len(fileHeaders) == 0 {
+		return nil, transcriptionInvalidRequestError(i18n.T(c, i18n.MsgGeminiTranscriptionFileRequired))
+	}
+	fileHeader := fileHeaders[0]
+
+	format := strings.ToLower(formValue("response_format"))
+	if format == "" {
+		format = strings.ToLower(strings.TrimSpace(request.ResponseFormat))
+	}
+	if format == "" {
+		format = "json"
+	}
+	if !transcriptionFormats[format] {
+		return nil, transcriptionInvalidRequestError(i18n.T(c, i18n.MsgGeminiTranscriptionFormatUnsupported, map[string]any{"Format": format}))
+	}
+	mimeType, ok := transcriptionAudioMimeType(fileHeader.Header.Get("Content-Type"), fileHeader.Filename)
+	if !ok {
+		return nil, transcriptionInvalidRequestError(i18n.T(c, i18n.MsgGeminiTranscriptionAudioUnsupported, map[string]any{"MimeType": mimeType}))
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audio file: %w", err)
+	}
+	audio, err := io.ReadAll(file)
+	_ = file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audio file: %w", err)
+	}
+	if len(audio) == 0 {
+		return nil, transcriptionInvalidRequestError(i18n.T(c, i18n.MsgGeminiTranscriptionFileRequired))
+	}
+
+	audioPart := dto.GeminiPart{
+		InlineData: &dto.GeminiInlineData{MimeType: mimeType, Data: base64.StdEncoding.EncodeToString(audio)},
+	}
+	// 超过阈值的音频走 File API，避免 inline 请求体超出上游限制
+	if shouldUploadGeminiFile(info, mimeType, len(audio)) {
+		fileData, err := uploadGeminiFileData(c, info, audioPart.InlineData.Data, mimeType, fileHeader.Filename)
+		if err != nil {
+			return nil, err
+		}
+		audioPart = dto.GeminiPart{FileData: fileData}
+	}
+
+	var instruction strings.Builder
+	instruction.WriteString(transcriptionInstruction)
+	language := formValue("language")
+	if language != "" {
+		instruction.WriteString(fmt.Sprintf(" The audio is in the language %q, write the transcript in that language.", language))
+	}
+	generationConfig := dto.GeminiChatGenerationConfig{}
+	switch format {
+	case "json":
+		generationConfig.ResponseMimeType = "application/json"
+		generationConfig.ResponseSchema = transcriptionTextSchema
+	case "verbose_json", "srt", "vtt":
+		instruction.WriteString(" Split the transcript into segments at natural pauses, with start and end times " +
+			"in seconds from the beginning of the audio, and report the detected language as an ISO-639-1 code.")
+		generationConfig.ResponseMimeType = "application/json"
+		generationConfig.ResponseSchema = transcriptionSegmentSchema
+	}
+	if prompt := formValue("prompt"); prompt != "" {
+		instruction.WriteString("\n\nThe following text is context for spelling and style, do not transcribe it:\n")
+		instruction.WriteString(prompt)
+	}
+	if temperature, err := strconv.ParseFloat(formValue("temperature"), 64); err == nil {
+		generationConfig.Temperature = &temperature
+	}
+
+	common.SetContextKey(c, constant.ContextKeyGeminiTranscriptionRequest, &transcriptionRequest{
+		ResponseFormat: format,
+		Language:       language,
+	})
+	return &dto.GeminiChatRequest{
+		Contents: []dto.GeminiChatContent{{
+			Role:  "user",
+			Parts: []dto.GeminiPart{{Text: instruction.String()}, audioPart},
+		}},
+		GenerationConfig: generationConfig,
+	}, nil
+}
+
+// formatSubtitleTimestamp renders seconds as HH:MM:SS,mmm (srt) or HH:MM:SS.mmm (vtt)
+func formatSubtitleTimestamp(seconds float64, separator string) string {
+	millis := int64(max(seconds, 0)*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", millis/3600000, millis/60000%60, millis/1000%60, separator, millis%1000)
+}
+
+func renderSubtitles(format string, segments []dto.Segment) string {
+	var out strings.Builder
+	separator := ","
+	if format == "vtt" {
+		out.WriteString("WEBVTT\n\n")
+		separator = "."
+	}
+	for i, segment := range segments {
+		if format == "srt" {
+			out.WriteString(fmt.Sprintf("%d\n", i+1))
+		}
+		out.WriteString(fmt.Sprintf("%s --> %s\n%s\n\n",
+			formatSubtitleTimestamp(segment.Start, separator), formatSubtitleTimestamp(segment.End, separator), segment.Text))
+	}
+	return out.String()
+}
+
+// GeminiTranscriptionHandler shapes the transcript returned by Gemini as an OpenAI transcription response.
+// Output that is not the requested JSON is used as the transcript text, the audio input is billed as audio tokens.
+func GeminiTranscriptionHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response) (*dto.Usage, *types.NewAPIError) {
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, types.NewOpenAIError(err, types.ErrorCodeReadResponseBodyFailed, http.StatusInternalServerError)
+	}
+	service.CloseResponseBodyGracefully(resp)
+	logger.LogDebug(c, "Gemini transcription response body: %s", responseBody)
+
+	request, ok := common.GetContextKeyType[*transcriptionRequest](c, constant.ContextKeyGeminiTranscriptionRequest)
+	if !ok {
+		return nil, types.NewError(errors.New("transcription request not found in context"), types.ErrorCodeBadResponseBody)
+	}
+	var geminiResponse dto.GeminiChatResponse
+	if err := common.Unmarshal(responseBody, &geminiResponse); err != nil {
+		return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	}
+	if len(geminiResponse.Candidates) == 0 {
+		return nil, types.NewOpenAIError(errors.New(i18n.T(c, i18n.MsgGeminiEmptyResponse)), types.ErrorCodeEmptyResponse, http.StatusInternalServerError)
+	}
+	var output strings.Builder
+	for _, part := range geminiResponse.Candidates[0].Content.Parts {
+		if !part.Thought {
+			output.WriteString(part.Text)
+		}
+	}
+
+	var transcript transcriptionOutput
+	if request.ResponseFormat == "text" || common.UnmarshalJsonStr(output.String(), &transcript) != nil {
+		transcript = transcriptionOutput{Text: output.String()}
+	}
+	transcript.Text = strings.TrimSpace(transcript.Text)
+	segments := make([]dto.Segment, 0, len(transcript.Segments))
+	for i, segment := range transcript.Segments {
+		segments = append(segments, dto.Segment{
+			Id:     i,
+			Start:  segment.Start,
+			End:    segment.End,
+			Text:   strings.TrimSpace(segment.Text),
+			Tokens: []int{},
+		})
+	}
+
+	switch request.ResponseFormat {
+	case "text":
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(transcript.Text))
+	case "srt", "vtt":
+		if len(segments) == 0 && transcript.Text != "" {
+			segments = append(segments, dto.Segment{Text: transcript.Text})
+		}
+		contentType := "text/plain; charset=utf-8"
+		if request.ResponseFormat == "vtt" {
+			contentType = "text/vtt; charset=utf-8"
+		}
+		c.Data(http.StatusOK, contentType, []byte(renderSubtitles(request.ResponseFormat, segments)))
+	case "verbose_json":
+		language := transcript.Language
+		if language == "" {
+			language = request.Language
+		}
+		duration := 0.0
+		if len(segments) > 0 {
+			duration = segments[len(segments)-1].End
+		}
+		c.JSON(http.StatusOK, dto.WhisperVerboseJSONResponse{
+			Task:     "transcribe",
+			Language: language,
+			Duration: duration,
+			Text:     transcript.Text,
+			Segments: segments,
+		})
+	default:
+		c.JSON(http.StatusOK, dto.AudioResponse{Text: transcript.Text})
+	}
+
+	usage := buildUsageFromGeminiMetadata(geminiResponse.UsageMetadata, info.GetEstimatePromptTokens())
+	return &usage, nil
+}
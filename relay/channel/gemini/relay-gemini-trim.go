@@ -0,0 +1,46 @@
+package gemini
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/QuantumNous/new-api/setting/model_setting"
+)
+
+func isGeminiOutputTrimEnabled() bool {
+	return model_setting.GetGeminiSettings().OutputTrimEnabled
+}
+
+// trimGeminiOutput removes leading and trailing whitespace (including trailing newlines) from a complete output
+func trimGeminiOutput(text string) string {
+	return strings.TrimSpace(text)
+}
+
+// geminiStreamTrimmer trims stream outputs per choice without knowing where the output ends:
+// leading whitespace is dropped until the first visible character, trailing whitespace of each delta
+// is held back and only flushed once more visible text follows, so it is discarded when the stream ends.
+type geminiStreamTrimmer struct {
+	started map[int]bool
+	pending map[int]string
+}
+
+func newGeminiStreamTrimmer() *geminiStreamTrimmer {
+	return &geminiStreamTrimmer{
+		started: make(map[int]bool),
+		pending: make(map[int]string),
+	}
+}
+
+func (t *geminiStreamTrimmer) trim(choiceIndex int, text string) string {
+	if !t.started[choiceIndex] {
+		text = strings.TrimLeftFunc(text, unicode.IsSpace)
+		if text == "" {
+			return ""
+		}
+		t.started[choiceIndex] = true
+	}
+	text = t.pending[choiceIndex] + text
+	trimmed := strings.TrimRightFunc(text, unicode.IsSpace)
+	t.pending[choiceIndex] = text[len(trimmed):]
+	return trimmed
+}
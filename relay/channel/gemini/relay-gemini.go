@@ -1,12 +1,17 @@
 package gemini
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -15,6 +20,7 @@ import (
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/i18n"
 	"github.com/QuantumNous/new-api/logger"
 	"github.com/QuantumNous/new-api/relay/channel/openai"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
@@ -33,6 +39,11 @@ var geminiSupportedMimeTypes = map[string]bool{
 	"audio/mpeg":      true,
 	"audio/mp3":       true,
 	"audio/wav":       true,
+	"audio/aac":       true,
+	"audio/aiff":      true,
+	"audio/flac":      true,
+	"audio/ogg":       true,
+	"audio/pcm":       true, // 需要携带采样率，如 audio/pcm;rate=16000
 	"image/png":       true,
 	"image/jpeg":      true,
 	"image/jpg":       true, // support old image/jpeg
@@ -50,8 +61,139 @@ var geminiSupportedMimeTypes = map[string]bool{
 	"video/flv":       true,
 }
 
+// isGeminiSupportedMimeType checks the mime type against the whitelist, ignoring parameters such as ;rate=16000
+func isGeminiSupportedMimeType(mimeType string) bool {
+	baseType, _, _ := strings.Cut(mimeType, ";")
+	return geminiSupportedMimeTypes[strings.ToLower(strings.TrimSpace(baseType))]
+}
+
+// Gemini 对未标明采样率的原始 PCM 输入默认按 16kHz 处理
+const geminiDefaultPcmSampleRate = 16000
+
+// geminiInputAudioMimeType resolves the mime type of raw PCM input_audio, Gemini reads the sample rate from it
+// (audio/pcm;rate=16000). WAV data sent with a pcm format is detected by its RIFF header and kept as audio/wav.
+func geminiInputAudioMimeType(audio *dto.MessageInputAudio, base64Data string, mimeType string) string {
+	if audio == nil {
+		return mimeType
+	}
+	format, params, _ := strings.Cut(strings.ToLower(strings.TrimSpace(audio.Format)), ";")
+	switch format {
+	case "pcm", "pcm16", "l16", "s16le":
+	default:
+		return mimeType
+	}
+	if header, err := base64.StdEncoding.DecodeString(base64Data[:min(len(base64Data), 16)]); err == nil && bytes.HasPrefix(header, []byte("RIFF")) {
+		return "audio/wav"
+	}
+	rate := audio.SampleRate
+	if rate <= 0 {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "rate="); ok {
+			rate, _ = strconv.Atoi(value)
+		}
+	}
+	if rate <= 0 {
+		rate = geminiDefaultPcmSampleRate
+	}
+	return fmt.Sprintf("audio/pcm;rate=%d", rate)
+}
+
 const thoughtSignatureBypassValue = "context_engineering_is_the_way_to_go"
 
+// Gemini returns at most 20 top candidates per decoding step
+const geminiMaxTopLogprobs = 20
+
+// thought summary verbosity, controlled by extra_body.google.thinking_summary
+const (
+	thinkingSummaryFull    = "full"
+	thinkingSummaryConcise = "concise"
+	thinkingSummaryNone    = "none"
+
+	conciseThinkingSummaryMaxRunes = 200
+)
+
+// trimThinkingSummary reduces a Gemini thought summary to its bold headings,
+// falling back to a truncated first line when no heading is present.
+func trimThinkingSummary(text string) string {
+	var headings []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 4 && strings.HasPrefix(line, "**") && strings.HasSuffix(line, "**") {
+			headings = append(headings, line)
+		}
+	}
+	if len(headings) > 0 {
+		return strings.Join(headings, "\n")
+	}
+	firstLine := strings.TrimSpace(strings.SplitN(strings.TrimSpace(text), "\n", 2)[0])
+	if utf8.RuneCountInString(firstLine) > conciseThinkingSummaryMaxRunes {
+		firstLine = string([]rune(firstLine)[:conciseThinkingSummaryMaxRunes]) + "..."
+	}
+	return firstLine
+}
+
+// geminiConciseReasoning buffers the streamed thought summary per choice in concise mode, the headings can only be
+// picked from the whole summary. It is sent as one reasoning delta with the first content, tool call or finish
+// of the choice.
+type geminiConciseReasoning map[int]*strings.Builder
+
+func newGeminiConciseReasoning(c *gin.Context) geminiConciseReasoning {
+	if common.GetContextKeyString(c, constant.ContextKeyGeminiThinkingSummary) != thinkingSummaryConcise {
+		return nil
+	}
+	return make(geminiConciseReasoning)
+}
+
+func (r geminiConciseReasoning) apply(choice *dto.ChatCompletionsStreamResponseChoice) {
+	buffer := r[choice.Index]
+	if choice.Delta.ReasoningContent != nil {
+		if buffer == nil {
+			buffer = &strings.Builder{}
+			r[choice.Index] = buffer
+		}
+		buffer.WriteString(*choice.Delta.ReasoningContent)
+		choice.Delta.ReasoningContent = nil
+	}
+	if buffer == nil || buffer.Len() == 0 {
+		return
+	}
+	hasContent := choice.Delta.Content != nil && *choice.Delta.Content != ""
+	if !hasContent && len(choice.Delta.ToolCalls) == 0 && choice.FinishReason == nil {
+		return
+	}
+	choice.Delta.SetReasoningContent(trimThinkingSummary(buffer.String()))
+	buffer.Reset()
+}
+
+// pending returns the summaries of choices whose stream ended while still thinking
+func (r geminiConciseReasoning) pending() []dto.ChatCompletionsStreamResponseChoice {
+	indexes := lo.Keys(r)
+	sort.Ints(indexes)
+	var choices []dto.ChatCompletionsStreamResponseChoice
+	for _, index := range indexes {
+		if r[index].Len() == 0 {
+			continue
+		}
+		choice := dto.ChatCompletionsStreamResponseChoice{Index: index}
+		choice.Delta.SetReasoningContent(trimThinkingSummary(r[index].String()))
+		r[index].Reset()
+		choices = append(choices, choice)
+	}
+	return choices
+}
+
+// applyThinkingSummaryMode post-processes reasoning content according to the requested verbosity.
+// Content passed in must be the whole summary, streams buffer it with geminiConciseReasoning.
+func applyThinkingSummaryMode(c *gin.Context, reasoning string) (string, bool) {
+	switch common.GetContextKeyString(c, constant.ContextKeyGeminiThinkingSummary) {
+	case thinkingSummaryNone:
+		return "", false
+	case thinkingSummaryConcise:
+		return trimThinkingSummary(reasoning), true
+	default:
+		return reasoning, true
+	}
+}
+
 // Gemini 允许的思考预算范围
 const (
 	pro25MinBudget       = 128
@@ -61,12 +203,71 @@ const (
 	flash25LiteMaxBudget = 24576
 )
 
+// gemini 2.5+ 的 maxOutputTokens 上限
+const geminiMaxOutputTokens = 65536
+
 func isNew25ProModel(modelName string) bool {
 	return strings.HasPrefix(modelName, "gemini-2.5-pro") &&
 		!strings.HasPrefix(modelName, "gemini-2.5-pro-preview-05-06") &&
 		!strings.HasPrefix(modelName, "gemini-2.5-pro-preview-03-25")
 }
 
+// parseGeminiModelVersion extracts the major/minor version from names like gemini-1.5-pro or gemini-3-pro-preview.
+// Aliases such as gemini-flash-latest are reported as unknown and treated as the newest generation.
+func parseGeminiModelVersion(modelName string) (major int, minor int, ok bool) {
+	rest, found := strings.CutPrefix(modelName, "gemini-")
+	if !found {
+		return 0, 0, false
+	}
+	version, _, _ := strings.Cut(rest, "-")
+	majorStr, minorStr, hasMinor := strings.Cut(version, ".")
+	major, err := strconv.Atoi(majorStr)
+	if err != nil {
+		return 0, 0, false
+	}
+	if hasMinor {
+		if minor, err = strconv.Atoi(minorStr); err != nil {
+			return 0, 0, false
+		}
+	}
+	return major, minor, true
+}
+
+// isGeminiModelAtLeast reports whether the model is at least the given version, unknown names are assumed to be newer.
+func isGeminiModelAtLeast(modelName string, major int, minor int) bool {
+	modelMajor, modelMinor, ok := parseGeminiModelVersion(modelName)
+	if !ok {
+		return true
+	}
+	if modelMajor != major {
+		return modelMajor > major
+	}
+	return modelMinor >= minor
+}
+
+// adaptGenerationConfigForModelVersion drops or remaps generationConfig fields that the resolved model version does not support.
+func adaptGenerationConfigForModelVersion(geminiRequest *dto.GeminiChatRequest, modelName string) {
+	if !strings.HasPrefix(modelName, "gemini-") {
+		return
+	}
+	config := &geminiRequest.GenerationConfig
+	// thinkingConfig is only accepted by models with thinking in the capability list (gemini 2.5+ and the
+	// 2.0 flash thinking previews), other listed models reject the whole request, unlisted ones are kept
+	if capabilities, ok := model_setting.GetGeminiModelCapabilities(modelName); ok && !capabilities.Thinking {
+		config.ThinkingConfig = nil
+	} else if config.ThinkingConfig != nil && config.ThinkingConfig.ThinkingLevel != "" && !isGeminiModelAtLeast(modelName, 3, 0) {
+		// thinkingLevel was introduced with gemini 3, map it to an equivalent budget for 2.5
+		if config.ThinkingConfig.ThinkingBudget == nil {
+			config.ThinkingConfig.ThinkingBudget = common.GetPointer(clampThinkingBudgetByEffort(modelName, config.ThinkingConfig.ThinkingLevel))
+		}
+		config.ThinkingConfig.ThinkingLevel = ""
+	}
+	// multimodal output is only available since gemini 2.0
+	if !isGeminiModelAtLeast(modelName, 2, 0) {
+		config.ResponseModalities = nil
+	}
+}
+
 func is25FlashLiteModel(modelName string) bool {
 	return strings.HasPrefix(modelName, "gemini-2.5-flash-lite")
 }
@@ -132,7 +333,8 @@ func clampThinkingBudgetByEffort(modelName string, effort string) int {
 }
 
 func ThinkingAdaptor(geminiRequest *dto.GeminiChatRequest, info *relaycommon.RelayInfo, oaiRequest ...dto.GeneralOpenAIRequest) {
-	if model_setting.GetGeminiSettings().ThinkingAdapterEnabled {
+	if model_setting.GetGeminiSettings().ThinkingAdapterEnabled &&
+		!model_setting.ShouldPreserveThinkingSuffix(info.OriginModelName) {
 		modelName := info.UpstreamModelName
 		isNew25Pro := strings.HasPrefix(modelName, "gemini-2.5-pro") &&
 			!strings.HasPrefix(modelName, "gemini-2.5-pro-preview-05-06") &&
@@ -197,6 +399,24 @@ func ThinkingAdaptor(geminiRequest *dto.GeminiChatRequest, info *relaycommon.Rel
 	}
 }
 
+// applyReasoningEffort maps OpenAI reasoning_effort to a thinkingBudget from the configured mapping, clamped to
+// the model range. A thinking config from extra_body or the model name suffix takes precedence.
+func applyReasoningEffort(geminiRequest *dto.GeminiChatRequest, textRequest dto.GeneralOpenAIRequest, info *relaycommon.RelayInfo) {
+	if textRequest.ReasoningEffort == "" || geminiRequest.GenerationConfig.ThinkingConfig != nil {
+		return
+	}
+	budget, ok := model_setting.GetReasoningEffortBudget(textRequest.ReasoningEffort)
+	if !ok {
+		return
+	}
+	// 客户端显式请求推理时同时返回思考摘要，映射到 reasoning_content
+	geminiRequest.GenerationConfig.ThinkingConfig = &dto.GeminiThinkingConfig{
+		ThinkingBudget:  common.GetPointer(clampThinkingBudget(info.UpstreamModelName, budget)),
+		IncludeThoughts: budget != 0,
+	}
+	info.ReasoningEffort = textRequest.ReasoningEffort
+}
+
 // Setting safety to the lowest possible values since Gemini is already powerless enough
 func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, info *relaycommon.RelayInfo) (*dto.GeminiChatRequest, error) {
 
@@ -211,13 +431,39 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 		geminiRequest.GenerationConfig.TopP = common.GetPointer(*textRequest.TopP)
 	}
 
+	if textRequest.FrequencyPenalty != nil && *textRequest.FrequencyPenalty != 0 {
+		geminiRequest.GenerationConfig.FrequencyPenalty = common.GetPointer(float32(*textRequest.FrequencyPenalty))
+	}
+	if textRequest.PresencePenalty != nil && *textRequest.PresencePenalty != 0 {
+		geminiRequest.GenerationConfig.PresencePenalty = common.GetPointer(float32(*textRequest.PresencePenalty))
+	}
+
 	if maxTokens := textRequest.GetMaxTokens(); maxTokens > 0 {
 		geminiRequest.GenerationConfig.MaxOutputTokens = common.GetPointer(maxTokens)
+	} else {
+		applyDefaultMaxOutputTokens(&geminiRequest, info)
+	}
+
+	// top_logprobs 控制每个 token 返回的候选数量，单独指定时同样开启 logprobs
+	if lo.FromPtr(textRequest.LogProbs) || lo.FromPtr(textRequest.TopLogProbs) > 0 {
+		geminiRequest.GenerationConfig.ResponseLogprobs = common.GetPointer(true)
+		if topLogprobs := lo.FromPtr(textRequest.TopLogProbs); topLogprobs > 0 {
+			geminiRequest.GenerationConfig.Logprobs = common.GetPointer(int32(min(topLogprobs, geminiMaxTopLogprobs)))
+		}
 	}
 
 	if textRequest.Seed != nil && *textRequest.Seed != 0 {
 		geminiSeed := int64(lo.FromPtr(textRequest.Seed))
 		geminiRequest.GenerationConfig.Seed = common.GetPointer(geminiSeed)
+		common.SetContextKey(c, constant.ContextKeyGeminiSeed, geminiSeed)
+	}
+	applySafetyIdentifier(c, &geminiRequest, textRequest, info)
+
+	if err := applyStreamFanOut(c, textRequest, info); err != nil {
+		return nil, err
+	}
+	if err := applyCandidateCount(c, &geminiRequest, textRequest, info); err != nil {
+		return nil, err
 	}
 
 	attachThoughtSignature := (info.ChannelType == constant.ChannelTypeGemini ||
@@ -230,6 +476,9 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 			"IMAGE",
 		}
 	}
+	if err := applyOpenAIModalities(c, &geminiRequest, textRequest, info); err != nil {
+		return nil, err
+	}
 	if stopSequences := parseStopSequences(textRequest.Stop); len(stopSequences) > 0 {
 		// Gemini supports up to 5 stop sequences
 		if len(stopSequences) > 5 {
@@ -239,6 +488,9 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 	}
 
 	adaptorWithExtraBody := false
+	thinkingSummaryMode := thinkingSummaryFull
+	var safetyOverrides map[string]string
+	var allowedFunctionNames []string
 
 	// patch extra_body
 	if len(textRequest.ExtraBody) > 0 {
@@ -253,13 +505,13 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 				adaptorWithExtraBody = true
 				// check error param name like thinkingConfig, should be thinking_config
 				if _, hasErrorParam := googleBody["thinkingConfig"]; hasErrorParam {
-					return nil, errors.New("extra_body.google.thinkingConfig is not supported, use extra_body.google.thinking_config instead")
+					return nil, errors.New(i18n.T(c, i18n.MsgGeminiExtraBodyFieldRenamed, map[string]any{"Field": "thinkingConfig", "Replacement": "thinking_config"}))
 				}
 
 				if thinkingConfig, ok := googleBody["thinking_config"].(map[string]interface{}); ok {
 					// check error param name like thinkingBudget, should be thinking_budget
 					if _, hasErrorParam := thinkingConfig["thinkingBudget"]; hasErrorParam {
-						return nil, errors.New("extra_body.google.thinking_config.thinkingBudget is not supported, use extra_body.google.thinking_config.thinking_budget instead")
+						return nil, errors.New(i18n.T(c, i18n.MsgGeminiExtraBodyFieldRenamed, map[string]any{"Field": "thinking_config.thinkingBudget", "Replacement": "thinking_config.thinking_budget"}))
 					}
 					var hasThinkingConfig bool
 					var tempThinkingConfig dto.GeminiThinkingConfig
@@ -278,7 +530,7 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 							}
 							hasThinkingConfig = true
 						default:
-							return nil, errors.New("extra_body.google.thinking_config.thinking_budget must be an integer")
+							return nil, errors.New(i18n.T(c, i18n.MsgGeminiExtraBodyNotInteger, map[string]any{"Field": "thinking_config.thinking_budget"}))
 						}
 					}
 
@@ -287,7 +539,7 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 							tempThinkingConfig.IncludeThoughts = v
 							hasThinkingConfig = true
 						} else {
-							return nil, errors.New("extra_body.google.thinking_config.include_thoughts must be a boolean")
+							return nil, errors.New(i18n.T(c, i18n.MsgGeminiExtraBodyNotBoolean, map[string]any{"Field": "thinking_config.include_thoughts"}))
 						}
 					}
 					if thinkingLevel, exists := thinkingConfig["thinking_level"]; exists {
@@ -295,7 +547,7 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 							tempThinkingConfig.ThinkingLevel = v
 							hasThinkingConfig = true
 						} else {
-							return nil, errors.New("extra_body.google.thinking_config.thinking_level must be a string")
+							return nil, errors.New(i18n.T(c, i18n.MsgGeminiExtraBodyNotString, map[string]any{"Field": "thinking_config.thinking_level"}))
 						}
 					}
 
@@ -317,19 +569,92 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 				}
 			}
 
+			// eg. {"google":{"thinking_summary":"concise"}}
+			if thinkingSummary, exists := googleBody["thinking_summary"]; exists {
+				v, ok := thinkingSummary.(string)
+				if !ok {
+					return nil, errors.New(i18n.T(c, i18n.MsgGeminiExtraBodyNotString, map[string]any{"Field": "thinking_summary"}))
+				}
+				switch v {
+				case thinkingSummaryFull, thinkingSummaryConcise, thinkingSummaryNone:
+					thinkingSummaryMode = v
+				default:
+					return nil, errors.New(i18n.T(c, i18n.MsgGeminiThinkingSummaryInvalid, map[string]any{
+						"Allowed": strings.Join([]string{thinkingSummaryFull, thinkingSummaryConcise, thinkingSummaryNone}, ", "),
+					}))
+				}
+			}
+
+			// eg. {"google":{"safety_settings":{"HARM_CATEGORY_DANGEROUS_CONTENT":"BLOCK_ONLY_HIGH"}}}
+			if value, exists := googleBody["safety_settings"]; exists {
+				overrides, err := parseSafetySettingsOverride(c, value)
+				if err != nil {
+					return nil, err
+				}
+				safetyOverrides = overrides
+			}
+
+			// eg. {"google":{"include_safety_ratings":true}}
+			if includeSafetyRatings, exists := googleBody["include_safety_ratings"]; exists {
+				v, ok := includeSafetyRatings.(bool)
+				if !ok {
+					return nil, errors.New(i18n.T(c, i18n.MsgGeminiExtraBodyNotBoolean, map[string]any{"Field": "include_safety_ratings"}))
+				}
+				common.SetContextKey(c, constant.ContextKeyGeminiIncludeSafetyRatings, v)
+			}
+
+			// eg. {"google":{"response_modalities":["TEXT","IMAGE","AUDIO"]}}
+			if responseModalities, exists := googleBody["response_modalities"]; exists {
+				modalities, err := parseGeminiResponseModalities(c, responseModalities)
+				if err != nil {
+					return nil, err
+				}
+				geminiRequest.GenerationConfig.ResponseModalities = modalities
+				// 显式请求多种模态时按 part 顺序组装 text / image_url / audio 内容块
+				common.SetContextKey(c, constant.ContextKeyGeminiMixedModalities, len(modalities) > 1)
+			}
+
+			// eg. {"google":{"allowed_function_names":["get_weather"]}}
+			if names, exists := googleBody["allowed_function_names"]; exists {
+				nameList, ok := names.([]interface{})
+				if !ok {
+					return nil, errors.New(i18n.T(c, i18n.MsgGeminiExtraBodyNotStringArray, map[string]any{"Field": "allowed_function_names"}))
+				}
+				for _, name := range nameList {
+					nameStr, ok := name.(string)
+					if !ok || nameStr == "" {
+						return nil, errors.New(i18n.T(c, i18n.MsgGeminiExtraBodyNotStringArray, map[string]any{"Field": "allowed_function_names"}))
+					}
+					allowedFunctionNames = append(allowedFunctionNames, nameStr)
+				}
+			}
+
+			// eg. {"google":{"generation_config":{"mediaResolution":"MEDIA_RESOLUTION_LOW"}}}
+			// 原样合并进 generationConfig，用于适配器尚未映射的新字段，字段名按 Gemini API 书写，已映射的参数优先
+			if _, hasErrorParam := googleBody["generationConfig"]; hasErrorParam {
+				return nil, errors.New(i18n.T(c, i18n.MsgGeminiExtraBodyFieldRenamed, map[string]any{"Field": "generationConfig", "Replacement": "generation_config"}))
+			}
+			if generationConfig, exists := googleBody["generation_config"]; exists {
+				passthrough, ok := generationConfig.(map[string]interface{})
+				if !ok {
+					return nil, errors.New(i18n.T(c, i18n.MsgGeminiExtraBodyNotObject, map[string]any{"Field": "generation_config"}))
+				}
+				geminiRequest.GenerationConfig.Passthrough = passthrough
+			}
+
 			// check error param name like imageConfig, should be image_config
 			if _, hasErrorParam := googleBody["imageConfig"]; hasErrorParam {
-				return nil, errors.New("extra_body.google.imageConfig is not supported, use extra_body.google.image_config instead")
+				return nil, errors.New(i18n.T(c, i18n.MsgGeminiExtraBodyFieldRenamed, map[string]any{"Field": "imageConfig", "Replacement": "image_config"}))
 			}
 
 			if imageConfig, ok := googleBody["image_config"].(map[string]interface{}); ok {
 				// check error param name like aspectRatio, should be aspect_ratio
 				if _, hasErrorParam := imageConfig["aspectRatio"]; hasErrorParam {
-					return nil, errors.New("extra_body.google.image_config.aspectRatio is not supported, use extra_body.google.image_config.aspect_ratio instead")
+					return nil, errors.New(i18n.T(c, i18n.MsgGeminiExtraBodyFieldRenamed, map[string]any{"Field": "image_config.aspectRatio", "Replacement": "image_config.aspect_ratio"}))
 				}
 				// check error param name like imageSize, should be image_size
 				if _, hasErrorParam := imageConfig["imageSize"]; hasErrorParam {
-					return nil, errors.New("extra_body.google.image_config.imageSize is not supported, use extra_body.google.image_config.image_size instead")
+					return nil, errors.New(i18n.T(c, i18n.MsgGeminiExtraBodyFieldRenamed, map[string]any{"Field": "image_config.imageSize", "Replacement": "image_config.image_size"}))
 				}
 
 				// convert snake_case to camelCase for Gemini API
@@ -355,15 +680,26 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 	if !adaptorWithExtraBody {
 		ThinkingAdaptor(&geminiRequest, info, textRequest)
 	}
+	applyReasoningEffort(&geminiRequest, textRequest, info)
 
-	safetySettings := make([]dto.GeminiChatSafetySettings, 0, len(SafetySettingList))
-	for _, category := range SafetySettingList {
-		safetySettings = append(safetySettings, dto.GeminiChatSafetySettings{
-			Category:  category,
-			Threshold: model_setting.GetGeminiSafetySetting(category),
-		})
+	if thinkingSummaryMode != thinkingSummaryFull {
+		// Gemini has no native verbosity control, "none" drops thoughts upstream and "concise" is trimmed in the response handler
+		if thinkingSummaryMode == thinkingSummaryNone && geminiRequest.GenerationConfig.ThinkingConfig != nil {
+			geminiRequest.GenerationConfig.ThinkingConfig.IncludeThoughts = false
+		}
+		common.SetContextKey(c, constant.ContextKeyGeminiThinkingSummary, thinkingSummaryMode)
+	}
+
+	geminiRequest.SafetySettings = buildSafetySettings(safetyOverrides)
+
+	if len(textRequest.Tools) == 0 && toolChoiceRequiresTools(textRequest.ToolChoice) {
+		return nil, types.NewErrorWithStatusCode(
+			errors.New(i18n.T(c, i18n.MsgGeminiToolChoiceRequiresTools)),
+			types.ErrorCodeInvalidRequest,
+			http.StatusBadRequest,
+			types.ErrOptionWithSkipRetry(),
+		)
 	}
-	geminiRequest.SafetySettings = safetySettings
 
 	// openaiContent.FuncToToolCalls()
 	if textRequest.Tools != nil {
@@ -396,7 +732,7 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 				}
 			}
 			// Clean the parameters before appending
-			cleanedParams := cleanFunctionParameters(tool.Function.Parameters)
+			cleanedParams := translateJSONSchema(tool.Function.Parameters)
 			tool.Function.Parameters = cleanedParams
 			functions = append(functions, tool.Function)
 		}
@@ -426,29 +762,59 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 		// [NEW] Convert OpenAI tool_choice to Gemini toolConfig.functionCallingConfig
 		// Mapping: "auto" -> "AUTO", "none" -> "NONE", "required" -> "ANY"
 		// Object format: {"type": "function", "function": {"name": "xxx"}} -> "ANY" + allowedFunctionNames
-		if textRequest.ToolChoice != nil {
+		// functionCallingConfig is rejected upstream when no function is declared (e.g. only googleSearch)
+		if textRequest.ToolChoice != nil && len(functions) > 0 {
 			geminiRequest.ToolConfig = convertToolChoiceToGeminiConfig(textRequest.ToolChoice)
 		}
+		if len(allowedFunctionNames) > 0 {
+			if err := applyAllowedFunctionNames(c, &geminiRequest, functions, allowedFunctionNames); err != nil {
+				return nil, err
+			}
+		}
+	} else if len(allowedFunctionNames) > 0 {
+		return nil, types.NewErrorWithStatusCode(
+			errors.New(i18n.T(c, i18n.MsgGeminiAllowedFunctionsRequireTools)),
+			types.ErrorCodeInvalidRequest,
+			http.StatusBadRequest,
+			types.ErrOptionWithSkipRetry(),
+		)
+	}
+
+	// operators may force JSON output for an exposed model name, an explicit client response_format still takes precedence
+	if model_setting.IsGeminiModelForceJsonMode(info.OriginModelName) {
+		geminiRequest.GenerationConfig.ResponseMimeType = "application/json"
 	}
 
-	if textRequest.ResponseFormat != nil && (textRequest.ResponseFormat.Type == "json_schema" || textRequest.ResponseFormat.Type == "json_object") {
+	if textRequest.ResponseFormat != nil && textRequest.ResponseFormat.Type == "text" {
+		// explicit text output overrides any forced JSON mode
+		geminiRequest.GenerationConfig.ResponseMimeType = "text/plain"
+		geminiRequest.GenerationConfig.ResponseSchema = nil
+		geminiRequest.GenerationConfig.ResponseJsonSchema = nil
+	} else if textRequest.ResponseFormat != nil && (textRequest.ResponseFormat.Type == "json_schema" || textRequest.ResponseFormat.Type == "json_object") {
 		geminiRequest.GenerationConfig.ResponseMimeType = "application/json"
 
 		if len(textRequest.ResponseFormat.JsonSchema) > 0 {
 			// 先将json.RawMessage解析
 			var jsonSchema dto.FormatJsonSchema
 			if err := common.Unmarshal(textRequest.ResponseFormat.JsonSchema, &jsonSchema); err == nil {
-				cleanedSchema := removeAdditionalPropertiesWithDepth(jsonSchema.Schema, 0)
-				geminiRequest.GenerationConfig.ResponseSchema = cleanedSchema
+				geminiRequest.GenerationConfig.ResponseSchema = translateJSONSchema(jsonSchema.Schema)
+				if info.IsStream && jsonSchema.Schema != nil && model_setting.GetGeminiSettings().StreamSchemaValidationEnabled {
+					common.SetContextKey(c, constant.ContextKeyGeminiStreamResponseSchema, geminiRequest.GenerationConfig.ResponseSchema)
+				}
 			}
 		}
 	}
 	tool_call_ids := make(map[string]string)
 	var system_content []string
+	// 最后一条消息贡献的 part 数，提示缓存据此拆出合并进同一轮次的最终消息
+	var finalTurnParts int
 	//shouldAddDummyModelMessage := false
 	for _, message := range textRequest.Messages {
 		if message.Role == "system" || message.Role == "developer" {
-			system_content = append(system_content, message.StringContent())
+			// 对话中间出现的 system 消息同样合并进 systemInstruction，空内容直接忽略
+			if content := message.StringContent(); strings.TrimSpace(content) != "" {
+				system_content = append(system_content, content)
+			}
 			continue
 		} else if message.Role == "tool" || message.Role == "function" {
 			if len(geminiRequest.Contents) == 0 || geminiRequest.Contents[len(geminiRequest.Contents)-1].Role == "model" {
@@ -463,6 +829,15 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 			} else if val, exists := tool_call_ids[message.ToolCallId]; exists {
 				name = val
 			}
+			// Gemini 按函数名匹配 functionResponse，缺少名称时上游只会返回含糊的 400
+			if name == "" {
+				return nil, types.NewErrorWithStatusCode(
+					errors.New(i18n.T(c, i18n.MsgGeminiToolResultUnmatched, map[string]any{"ToolCallId": message.ToolCallId})),
+					types.ErrorCodeInvalidRequest,
+					http.StatusBadRequest,
+					types.ErrOptionWithSkipRetry(),
+				)
+			}
 			var contentMap map[string]interface{}
 			contentStr := message.StringContent()
 
@@ -484,9 +859,27 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 				Response: contentMap,
 			}
 
+			// 数组形式的 tool content 可以包含工具返回的图片等媒体
+			mediaParts, err := convertToolMessageMediaParts(c, &message)
+			if err != nil {
+				return nil, err
+			}
+			// gemini 3 支持在 functionResponse.parts 中携带多模态内容，旧模型作为同一轮的 inlineData 追加
+			nestMedia := len(mediaParts) > 0 && isGeminiModelAtLeast(info.UpstreamModelName, 3, 0)
+			if nestMedia {
+				mediaBytes, err := common.Marshal(mediaParts)
+				if err != nil {
+					return nil, fmt.Errorf("marshal function response parts failed: %w", err)
+				}
+				functionResp.Parts = mediaBytes
+			}
+
 			*parts = append(*parts, dto.GeminiPart{
 				FunctionResponse: functionResp,
 			})
+			if !nestMedia {
+				*parts = append(*parts, mediaParts...)
+			}
 			continue
 		}
 		var parts []dto.GeminiPart
@@ -503,7 +896,7 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 				args := map[string]interface{}{}
 				if call.Function.Arguments != "" {
 					if json.Unmarshal([]byte(call.Function.Arguments), &args) != nil {
-						return nil, fmt.Errorf("invalid arguments for function %s, args: %s", call.Function.Name, call.Function.Arguments)
+						return nil, errors.New(i18n.T(c, i18n.MsgGeminiFunctionArgumentsInvalid, map[string]any{"Name": call.Function.Name, "Arguments": call.Function.Arguments}))
 					}
 				}
 				toolCall := dto.GeminiPart{
@@ -521,6 +914,13 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 			}
 		}
 
+		if contentType := unsupportedGeminiContentType(&message); contentType != "" {
+			return nil, geminiContentPartError(c, i18n.MsgGeminiUnsupportedContentPart, message.Role, contentType)
+		}
+		if content, ok := audioBlocksAsInputAudio(message.Content); ok {
+			message.SetNullContent()
+			message.Content = content
+		}
 		openaiContent := message.ParseContent()
 		for _, part := range openaiContent {
 			if part.Type == dto.ContentTypeText {
@@ -564,7 +964,10 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 					dataUrl := text[bracketIdx+2 : closeIdx]
 					format, base64String, err := service.DecodeBase64FileData(dataUrl)
 					if err != nil {
-						return nil, fmt.Errorf("decode markdown base64 image data failed: %s", err.Error())
+						return nil, errors.New(i18n.T(c, i18n.MsgGeminiMarkdownImageDecodeFailed, map[string]any{"Error": err.Error()}))
+					}
+					if err := validateGeminiInlineMedia(c, base64String, format, "markdown image"); err != nil {
+						return nil, err
 					}
 					imgPart := dto.GeminiPart{
 						InlineData: &dto.GeminiInlineData{
@@ -588,24 +991,53 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 			} else {
 				source := part.ToFileSource()
 				if source == nil {
-					continue
+					// 如只带 file_id 的 file part，Gemini 无法读取
+					return nil, geminiContentPartError(c, i18n.MsgGeminiContentPartMissingData, message.Role, part.Type)
 				}
 				base64Data, mimeType, err := service.GetBase64Data(c, source, "formatting image for Gemini")
 				if err != nil {
+					if corruptErr := geminiCorruptMediaError(c, err, source.GetIdentifier()); corruptErr != nil {
+						return nil, corruptErr
+					}
 					return nil, fmt.Errorf("get file data from '%s' failed: %w", source.GetIdentifier(), err)
 				}
+				if err := validateGeminiInlineMedia(c, base64Data, mimeType, source.GetIdentifier()); err != nil {
+					return nil, err
+				}
+				base64Data, mimeType = transcodeGeminiUnsupportedImage(base64Data, mimeType)
+				if part.Type == dto.ContentTypeInputAudio {
+					mimeType = geminiInputAudioMimeType(part.GetInputAudio(), base64Data, mimeType)
+				}
 
 				// 校验 MimeType 是否在 Gemini 支持的白名单中
-				if _, ok := geminiSupportedMimeTypes[strings.ToLower(mimeType)]; !ok {
-					return nil, fmt.Errorf("mime type is not supported by Gemini: '%s', url: '%s', supported types are: %v", mimeType, source.GetIdentifier(), getSupportedMimeTypesList())
+				if !isGeminiSupportedMimeType(mimeType) {
+					return nil, errors.New(i18n.T(c, i18n.MsgGeminiMimeTypeUnsupported, map[string]any{"MimeType": mimeType, "Source": source.GetIdentifier(), "Supported": strings.Join(getSupportedMimeTypesList(), ", ")}))
 				}
 
-				parts = append(parts, dto.GeminiPart{
+				mediaPart := dto.GeminiPart{
 					InlineData: &dto.GeminiInlineData{
 						MimeType: mimeType,
 						Data:     base64Data,
 					},
-				})
+				}
+				// detail 只对图片生效，image_url 携带的 PDF 等文件忽略该字段
+				if part.Type == dto.ContentTypeImageURL && strings.HasPrefix(mimeType, "image/") {
+					image := part.GetImageMedia()
+					if image != nil && image.Detail == "low" {
+						mediaPart.InlineData.Data, mediaPart.InlineData.MimeType = downscaleGeminiLowDetailImage(info.UpstreamModelName, base64Data, mimeType)
+					}
+					mediaPart.MediaResolution = geminiPartMediaResolution(info.UpstreamModelName, image)
+				}
+				// 视频与超过内联上限的文件通过 File API 上传后以 fileData 引用
+				if shouldUploadGeminiFile(info, mediaPart.InlineData.MimeType, base64.StdEncoding.DecodedLen(len(mediaPart.InlineData.Data))) {
+					fileData, err := uploadGeminiFileData(c, info, mediaPart.InlineData.Data, mediaPart.InlineData.MimeType, source.GetIdentifier())
+					if err != nil {
+						return nil, err
+					}
+					mediaPart.InlineData = nil
+					mediaPart.FileData = fileData
+				}
+				parts = append(parts, mediaPart)
 			}
 		}
 
@@ -627,7 +1059,28 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 			content.Role = "model"
 		}
 		if len(content.Parts) > 0 {
-			geminiRequest.Contents = append(geminiRequest.Contents, content)
+			geminiRequest.Contents = appendGeminiContent(geminiRequest.Contents, content)
+			finalTurnParts = len(content.Parts)
+		}
+	}
+	geminiRequest.Contents = ensureFunctionCallFollowsUserTurn(geminiRequest.Contents)
+	common.SetContextKey(c, constant.ContextKeyGeminiFinalTurnParts, finalTurnParts)
+
+	if !hasGeminiContentPayload(geminiRequest.Contents) {
+		fallbackText := model_setting.GetGeminiSettings().EmptyContentsFallbackText
+		if fallbackText == "" {
+			return nil, types.NewErrorWithStatusCode(
+				errors.New(i18n.T(c, i18n.MsgGeminiEmptyContents)),
+				types.ErrorCodeInvalidRequest,
+				http.StatusBadRequest,
+				types.ErrOptionWithSkipRetry(),
+			)
+		}
+		geminiRequest.Contents = []dto.GeminiChatContent{
+			{
+				Role:  "user",
+				Parts: []dto.GeminiPart{{Text: fallbackText}},
+			},
 		}
 	}
 
@@ -641,107 +1094,468 @@ func CovertOpenAI2Gemini(c *gin.Context, textRequest dto.GeneralOpenAIRequest, i
 		}
 	}
 
+	applyChannelThinkingPolicy(&geminiRequest, info)
+	adaptGenerationConfigForModelVersion(&geminiRequest, info.UpstreamModelName)
+	applyChannelThinkingBudgetCap(c, &geminiRequest, info)
+	if model_setting.GetGeminiSettings().ThinkingOutputReserveEnabled {
+		reserveThinkingOutputTokens(&geminiRequest, info.UpstreamModelName)
+	}
+
 	return &geminiRequest, nil
 }
 
-// parseStopSequences 解析停止序列，支持字符串或字符串数组
-func parseStopSequences(stop any) []string {
-	if stop == nil {
-		return nil
+// reserveThinkingOutputTokens raises maxOutputTokens by the expected thinking budget.
+// OpenAI max_tokens only covers the visible answer, while Gemini counts thoughts against maxOutputTokens,
+// so a small limit could otherwise be spent entirely on thinking and return an empty answer.
+func reserveThinkingOutputTokens(geminiRequest *dto.GeminiChatRequest, modelName string) {
+	config := &geminiRequest.GenerationConfig
+	if config.MaxOutputTokens == nil || *config.MaxOutputTokens == 0 || !strings.HasPrefix(modelName, "gemini-") || !isGeminiModelAtLeast(modelName, 2, 5) {
+		return
+	}
+	reserve := 0
+	thinkingConfig := config.ThinkingConfig
+	switch {
+	case thinkingConfig == nil || (thinkingConfig.ThinkingBudget == nil && thinkingConfig.ThinkingLevel == ""):
+		// 未指定时 flash-lite 默认关闭思考，其它模型默认动态思考
+		if !is25FlashLiteModel(modelName) {
+			reserve = clampThinkingBudgetByEffort(modelName, "medium")
+		}
+	case thinkingConfig.ThinkingBudget != nil && *thinkingConfig.ThinkingBudget > 0:
+		reserve = *thinkingConfig.ThinkingBudget
+	case thinkingConfig.ThinkingBudget != nil && *thinkingConfig.ThinkingBudget < 0:
+		reserve = clampThinkingBudgetByEffort(modelName, "medium")
+	case thinkingConfig.ThinkingLevel != "":
+		reserve = clampThinkingBudgetByEffort(modelName, thinkingConfig.ThinkingLevel)
+	}
+	if reserve <= 0 {
+		return
 	}
+	config.MaxOutputTokens = common.GetPointer(uint(min(int(*config.MaxOutputTokens)+reserve, GetGeminiModelLimits(modelName).MaxOutputTokens)))
+}
 
-	switch v := stop.(type) {
-	case string:
-		if v != "" {
-			return []string{v}
+// convertToolMessageMediaParts converts the non-text blocks of an array tool message content into inlineData parts
+func convertToolMessageMediaParts(c *gin.Context, message *dto.Message) ([]dto.GeminiPart, error) {
+	if message.IsStringContent() {
+		return nil, nil
+	}
+	var mediaParts []dto.GeminiPart
+	for _, item := range message.ParseContent() {
+		if item.Type == dto.ContentTypeText {
+			continue
 		}
-	case []string:
-		return v
-	case []interface{}:
-		sequences := make([]string, 0, len(v))
-		for _, item := range v {
-			if str, ok := item.(string); ok && str != "" {
-				sequences = append(sequences, str)
+		source := item.ToFileSource()
+		if source == nil {
+			continue
+		}
+		base64Data, mimeType, err := service.GetBase64Data(c, source, "formatting tool result for Gemini")
+		if err != nil {
+			if corruptErr := geminiCorruptMediaError(c, err, source.GetIdentifier()); corruptErr != nil {
+				return nil, corruptErr
 			}
+			return nil, fmt.Errorf("get file data from '%s' failed: %w", source.GetIdentifier(), err)
 		}
-		return sequences
+		if err := validateGeminiInlineMedia(c, base64Data, mimeType, source.GetIdentifier()); err != nil {
+			return nil, err
+		}
+		base64Data, mimeType = transcodeGeminiUnsupportedImage(base64Data, mimeType)
+		if item.Type == dto.ContentTypeInputAudio {
+			mimeType = geminiInputAudioMimeType(item.GetInputAudio(), base64Data, mimeType)
+		}
+		if !isGeminiSupportedMimeType(mimeType) {
+			return nil, errors.New(i18n.T(c, i18n.MsgGeminiMimeTypeUnsupported, map[string]any{"MimeType": mimeType, "Source": source.GetIdentifier(), "Supported": strings.Join(getSupportedMimeTypesList(), ", ")}))
+		}
+		mediaParts = append(mediaParts, dto.GeminiPart{
+			InlineData: &dto.GeminiInlineData{
+				MimeType: mimeType,
+				Data:     base64Data,
+			},
+		})
 	}
-	return nil
+	return mediaParts, nil
 }
 
-func hasFunctionCallContent(call *dto.FunctionCall) bool {
-	if call == nil {
-		return false
-	}
-	if strings.TrimSpace(call.FunctionName) != "" {
-		return true
-	}
+// geminiContentTypes are the OpenAI content part types that can be converted to Gemini parts
+var geminiContentTypes = map[string]bool{
+	dto.ContentTypeText:       true,
+	dto.ContentTypeImageURL:   true,
+	dto.ContentTypeInputAudio: true,
+	dto.ContentTypeFile:       true,
+	dto.ContentTypeVideoUrl:   true,
+	dto.ContentTypeAudio:      true,
+}
 
-	switch v := call.Arguments.(type) {
-	case nil:
-		return false
-	case string:
-		return strings.TrimSpace(v) != ""
-	case map[string]interface{}:
-		return len(v) > 0
-	case []interface{}:
-		return len(v) > 0
-	default:
-		return true
+// audioBlocksAsInputAudio rewrites the audio content blocks of an earlier mixed-modality response
+// into input_audio parts, so an assistant turn sent back in the history keeps its audio as inlineData
+func audioBlocksAsInputAudio(content any) ([]any, bool) {
+	items, ok := content.([]any)
+	if !ok {
+		return nil, false
+	}
+	var converted []any
+	for i, item := range items {
+		contentItem, ok := item.(map[string]any)
+		if !ok || contentItem["type"] != dto.ContentTypeAudio {
+			continue
+		}
+		if converted == nil {
+			converted = slices.Clone(items)
+		}
+		converted[i] = map[string]any{"type": dto.ContentTypeInputAudio, "input_audio": contentItem["audio"]}
 	}
+	return converted, converted != nil
 }
 
-// Helper function to get a list of supported MIME types for error messages
-func getSupportedMimeTypesList() []string {
-	keys := make([]string, 0, len(geminiSupportedMimeTypes))
-	for k := range geminiSupportedMimeTypes {
-		keys = append(keys, k)
+// unsupportedGeminiContentType returns the first content part type that cannot be sent to Gemini.
+// ParseContent drops unknown types, so the raw content is checked to avoid sending a silently emptied message.
+func unsupportedGeminiContentType(message *dto.Message) string {
+	items, ok := message.Content.([]any)
+	if !ok {
+		return ""
 	}
-	return keys
+	for _, item := range items {
+		contentItem, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		if contentType, _ := contentItem["type"].(string); !geminiContentTypes[contentType] {
+			return contentType
+		}
+	}
+	return ""
 }
 
-var geminiOpenAPISchemaAllowedFields = map[string]struct{}{
-	"anyOf":            {},
-	"default":          {},
-	"description":      {},
-	"enum":             {},
-	"example":          {},
-	"format":           {},
-	"items":            {},
-	"maxItems":         {},
-	"maxLength":        {},
-	"maxProperties":    {},
-	"maximum":          {},
-	"minItems":         {},
-	"minLength":        {},
-	"minProperties":    {},
-	"minimum":          {},
-	"nullable":         {},
-	"pattern":          {},
-	"properties":       {},
-	"propertyOrdering": {},
-	"required":         {},
-	"title":            {},
-	"type":             {},
+func geminiContentPartError(c *gin.Context, key string, role string, contentType string) error {
+	return types.NewErrorWithStatusCode(
+		errors.New(i18n.T(c, key, map[string]any{"Role": role, "Type": contentType})),
+		types.ErrorCodeInvalidRequest,
+		http.StatusBadRequest,
+		types.ErrOptionWithSkipRetry(),
+	)
 }
 
-const geminiFunctionSchemaMaxDepth = 64
-
-// cleanFunctionParameters recursively removes unsupported fields from Gemini function parameters.
-func cleanFunctionParameters(params interface{}) interface{} {
-	return cleanFunctionParametersWithDepth(params, 0)
+// geminiPartMediaResolution maps the OpenAI image_url detail hint to a per-part mediaResolution.
+// Only models billed by media resolution accept it; older models keep their default tiling.
+func geminiPartMediaResolution(modelName string, image *dto.MessageImageUrl) json.RawMessage {
+	if image == nil || (image.Detail != "low" && image.Detail != "high") {
+		return nil
+	}
+	cost, ok := model_setting.GetGeminiImageTokenCost(modelName)
+	if !ok || len(cost.MediaResolutionTokens) == 0 {
+		return nil
+	}
+	return json.RawMessage(`{"level":"media_resolution_` + image.Detail + `"}`)
 }
 
-func cleanFunctionParametersWithDepth(params interface{}, depth int) interface{} {
-	if params == nil {
-		return nil
+// appendGeminiContent merges a message into the previous turn when both have the same role, Gemini rejects
+// consecutive turns of one role (e.g. a split user message or a user message right after tool results)
+func appendGeminiContent(contents []dto.GeminiChatContent, content dto.GeminiChatContent) []dto.GeminiChatContent {
+	if last := len(contents) - 1; last >= 0 && contents[last].Role == content.Role {
+		contents[last].Parts = append(contents[last].Parts, content.Parts...)
+		return contents
 	}
+	return append(contents, content)
+}
 
-	if depth >= geminiFunctionSchemaMaxDepth {
-		return cleanFunctionParametersShallow(params)
+// geminiPlaceholderUserText opens a conversation whose first turn is a model function call
+const geminiPlaceholderUserText = "."
+
+// ensureFunctionCallFollowsUserTurn inserts a placeholder user turn before a leading model turn with function calls,
+// Gemini requires a function call turn to come right after a user or function response turn.
+// This is the only case where a turn is added, model text may open the conversation.
+func ensureFunctionCallFollowsUserTurn(contents []dto.GeminiChatContent) []dto.GeminiChatContent {
+	if len(contents) == 0 || contents[0].Role != "model" {
+		return contents
 	}
+	for _, part := range contents[0].Parts {
+		if part.FunctionCall != nil {
+			placeholder := dto.GeminiChatContent{Role: "user", Parts: []dto.GeminiPart{{Text: geminiPlaceholderUserText}}}
+			return append([]dto.GeminiChatContent{placeholder}, contents...)
+		}
+	}
+	return contents
+}
 
-	switch v := params.(type) {
+// hasGeminiContentPayload reports whether any part carries text, media or a function call/response,
+// Gemini rejects requests whose contents are missing or only hold empty text parts.
+func hasGeminiContentPayload(contents []dto.GeminiChatContent) bool {
+	for _, content := range contents {
+		for _, part := range content.Parts {
+			if part.Text != "" || part.InlineData != nil || part.FileData != nil ||
+				part.FunctionCall != nil || part.FunctionResponse != nil ||
+				part.ExecutableCode != nil || part.CodeExecutionResult != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isGeminiAudioOutputModel reports whether the model can produce audio output
+func isGeminiAudioOutputModel(modelName string) bool {
+	return strings.Contains(modelName, "-tts") || strings.Contains(modelName, "native-audio")
+}
+
+// applyOpenAIModalities maps OpenAI modalities to Gemini responseModalities.
+// Modalities explicitly sent by the client replace the defaults (e.g. TEXT+IMAGE for image models),
+// so a text only request never produces image or audio output.
+// When audio is requested from a text-only model the request fails, unless the audio fallback
+// setting is enabled, in which case audio is dropped and a Warning header is returned.
+func applyOpenAIModalities(c *gin.Context, geminiRequest *dto.GeminiChatRequest, textRequest dto.GeneralOpenAIRequest, info *relaycommon.RelayInfo) error {
+	if len(textRequest.Modalities) == 0 {
+		return nil
+	}
+	var modalities []string
+	if err := common.Unmarshal(textRequest.Modalities, &modalities); err != nil {
+		return fmt.Errorf("invalid modalities: %w", err)
+	}
+	if len(modalities) == 0 {
+		return nil
+	}
+	responseModalities := make([]string, 0, len(modalities))
+	for _, modality := range modalities {
+		switch strings.ToLower(modality) {
+		case "text":
+			responseModalities = append(responseModalities, "TEXT")
+		case "image":
+			responseModalities = append(responseModalities, "IMAGE")
+		}
+	}
+	responseModalities = lo.Uniq(responseModalities)
+	if !lo.Contains(modalities, "audio") {
+		geminiRequest.GenerationConfig.ResponseModalities = responseModalities
+		return nil
+	}
+	if isGeminiAudioOutputModel(info.UpstreamModelName) {
+		geminiRequest.GenerationConfig.ResponseModalities = []string{"AUDIO"}
+		return setGeminiAudioOutputFormat(c, textRequest)
+	}
+	if !model_setting.GetGeminiSettings().AudioOutputFallbackEnabled {
+		return types.NewErrorWithStatusCode(
+			errors.New(i18n.T(c, i18n.MsgGeminiAudioOutputUnsupported, map[string]any{"Model": info.UpstreamModelName})),
+			types.ErrorCodeInvalidRequest,
+			http.StatusBadRequest,
+			types.ErrOptionWithSkipRetry(),
+		)
+	}
+	c.Header("Warning", fmt.Sprintf(`199 new-api "model %s does not support audio output, falling back to text"`, info.UpstreamModelName))
+	if !lo.Contains(responseModalities, "TEXT") {
+		responseModalities = append([]string{"TEXT"}, responseModalities...)
+	}
+	geminiRequest.GenerationConfig.ResponseModalities = responseModalities
+	return nil
+}
+
+// geminiMaxCandidateCount is the largest candidateCount Gemini accepts
+const geminiMaxCandidateCount = 8
+
+// applyCandidateCount passes OpenAI n through as candidateCount. Gemini rejects candidateCount when streaming,
+// so n>1 with stream is only served by the stream fan-out.
+func applyCandidateCount(c *gin.Context, geminiRequest *dto.GeminiChatRequest, textRequest dto.GeneralOpenAIRequest, info *relaycommon.RelayInfo) error {
+	n := lo.FromPtr(textRequest.N)
+	if n <= 1 || isStreamFanOut(c, info) {
+		return nil
+	}
+	var message string
+	if info.IsStream {
+		message = i18n.T(c, i18n.MsgGeminiCandidateCountStream)
+	} else if n > geminiMaxCandidateCount {
+		message = i18n.T(c, i18n.MsgGeminiCandidateCountTooLarge, map[string]any{"N": n, "Max": geminiMaxCandidateCount})
+	}
+	if message != "" {
+		return types.NewErrorWithStatusCode(errors.New(message), types.ErrorCodeInvalidRequest, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
+	}
+	geminiRequest.GenerationConfig.CandidateCount = common.GetPointer(n)
+	return nil
+}
+
+// geminiSeedFingerprint echoes the effective seed as system_fingerprint so clients can verify determinism.
+func geminiSeedFingerprint(c *gin.Context) (string, bool) {
+	seed, ok := common.GetContextKeyType[int64](c, constant.ContextKeyGeminiSeed)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("gemini_seed_%d", seed), true
+}
+
+// applyDefaultMaxOutputTokens fills in the channel default maxOutputTokens when the client omits it
+func applyDefaultMaxOutputTokens(geminiRequest *dto.GeminiChatRequest, info *relaycommon.RelayInfo) {
+	if info.ChannelMeta == nil || info.ChannelOtherSettings.GeminiDefaultMaxOutputTokens == 0 {
+		return
+	}
+	if geminiRequest.GenerationConfig.MaxOutputTokens != nil && *geminiRequest.GenerationConfig.MaxOutputTokens > 0 {
+		return
+	}
+	geminiRequest.GenerationConfig.MaxOutputTokens = common.GetPointer(info.ChannelOtherSettings.GeminiDefaultMaxOutputTokens)
+}
+
+// applyChannelThinkingPolicy enforces the channel thinking policy, overriding the thinkingConfig derived from the client
+func applyChannelThinkingPolicy(geminiRequest *dto.GeminiChatRequest, info *relaycommon.RelayInfo) {
+	if info.ChannelMeta == nil {
+		return
+	}
+	modelName := info.UpstreamModelName
+	switch info.ChannelOtherSettings.GeminiThinkingPolicy {
+	case dto.GeminiThinkingPolicyForceOn:
+		thinkingConfig := geminiRequest.GenerationConfig.ThinkingConfig
+		if thinkingConfig == nil {
+			thinkingConfig = &dto.GeminiThinkingConfig{}
+			geminiRequest.GenerationConfig.ThinkingConfig = thinkingConfig
+		}
+		thinkingConfig.IncludeThoughts = true
+		// 预算为 0 表示关闭思考，交由上游动态决定预算
+		if thinkingConfig.ThinkingBudget != nil && *thinkingConfig.ThinkingBudget <= 0 {
+			thinkingConfig.ThinkingBudget = nil
+		}
+	case dto.GeminiThinkingPolicyForceOff:
+		switch {
+		case isGeminiModelAtLeast(modelName, 3, 0):
+			// gemini 3 无法完全关闭思考，使用最低的思考等级
+			geminiRequest.GenerationConfig.ThinkingConfig = &dto.GeminiThinkingConfig{ThinkingLevel: "low"}
+		case isNew25ProModel(modelName):
+			// 2.5 pro 无法关闭思考，使用最小预算并隐藏思考内容
+			geminiRequest.GenerationConfig.ThinkingConfig = &dto.GeminiThinkingConfig{ThinkingBudget: common.GetPointer(pro25MinBudget)}
+		default:
+			geminiRequest.GenerationConfig.ThinkingConfig = &dto.GeminiThinkingConfig{ThinkingBudget: common.GetPointer(0)}
+		}
+	}
+}
+
+// applyChannelThinkingBudgetCap clamps the thinking budget to the channel limit. Dynamic thinking, including the
+// default of models that think unless told otherwise, is pinned to the limit as well so the cost stays bounded.
+func applyChannelThinkingBudgetCap(c *gin.Context, geminiRequest *dto.GeminiChatRequest, info *relaycommon.RelayInfo) {
+	if info.ChannelMeta == nil || info.ChannelOtherSettings.GeminiMaxThinkingBudget <= 0 {
+		return
+	}
+	modelName := info.UpstreamModelName
+	if !strings.HasPrefix(modelName, "gemini-") || !isGeminiModelAtLeast(modelName, 2, 5) {
+		return
+	}
+	limit := clampThinkingBudget(modelName, info.ChannelOtherSettings.GeminiMaxThinkingBudget)
+	thinkingConfig := geminiRequest.GenerationConfig.ThinkingConfig
+	var requested string
+	switch {
+	case thinkingConfig == nil || (thinkingConfig.ThinkingBudget == nil && thinkingConfig.ThinkingLevel == ""):
+		// flash-lite 默认不思考
+		if is25FlashLiteModel(modelName) {
+			return
+		}
+		requested = "dynamic"
+	case thinkingConfig.ThinkingBudget != nil && *thinkingConfig.ThinkingBudget < 0:
+		requested = "dynamic"
+	case thinkingConfig.ThinkingBudget != nil && *thinkingConfig.ThinkingBudget > limit:
+		requested = strconv.Itoa(*thinkingConfig.ThinkingBudget)
+	case thinkingConfig.ThinkingBudget == nil && clampThinkingBudgetByEffort(modelName, thinkingConfig.ThinkingLevel) > limit:
+		requested = "thinking_level " + thinkingConfig.ThinkingLevel
+	default:
+		return
+	}
+	if thinkingConfig == nil {
+		thinkingConfig = &dto.GeminiThinkingConfig{}
+		geminiRequest.GenerationConfig.ThinkingConfig = thinkingConfig
+	}
+	thinkingConfig.ThinkingBudget = common.GetPointer(limit)
+	thinkingConfig.ThinkingLevel = ""
+	logger.LogWarn(c, fmt.Sprintf("gemini thinking budget %s exceeds the limit of channel #%d, clamped to %d", requested, info.ChannelId, limit))
+}
+
+// parseStopSequences 解析停止序列，支持字符串或字符串数组
+func parseStopSequences(stop any) []string {
+	if stop == nil {
+		return nil
+	}
+
+	switch v := stop.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []string:
+		return v
+	case []interface{}:
+		sequences := make([]string, 0, len(v))
+		for _, item := range v {
+			if str, ok := item.(string); ok && str != "" {
+				sequences = append(sequences, str)
+			}
+		}
+		return sequences
+	}
+	return nil
+}
+
+func hasFunctionCallContent(call *dto.FunctionCall) bool {
+	if call == nil {
+		return false
+	}
+	if strings.TrimSpace(call.FunctionName) != "" {
+		return true
+	}
+
+	switch v := call.Arguments.(type) {
+	case nil:
+		return false
+	case string:
+		return strings.TrimSpace(v) != ""
+	case map[string]interface{}:
+		return len(v) > 0
+	case []interface{}:
+		return len(v) > 0
+	default:
+		return true
+	}
+}
+
+// Helper function to get a list of supported MIME types for error messages
+func getSupportedMimeTypesList() []string {
+	keys := make([]string, 0, len(geminiSupportedMimeTypes))
+	for k := range geminiSupportedMimeTypes {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+var geminiOpenAPISchemaAllowedFields = map[string]struct{}{
+	"anyOf":            {},
+	"default":          {},
+	"description":      {},
+	"enum":             {},
+	"example":          {},
+	"format":           {},
+	"items":            {},
+	"maxItems":         {},
+	"maxLength":        {},
+	"maxProperties":    {},
+	"maximum":          {},
+	"minItems":         {},
+	"minLength":        {},
+	"minProperties":    {},
+	"minimum":          {},
+	"nullable":         {},
+	"pattern":          {},
+	"properties":       {},
+	"propertyOrdering": {},
+	"required":         {},
+	"title":            {},
+	"type":             {},
+}
+
+const geminiFunctionSchemaMaxDepth = 64
+
+// cleanFunctionParameters recursively removes unsupported fields from Gemini function parameters.
+func cleanFunctionParameters(params interface{}) interface{} {
+	return cleanFunctionParametersWithDepth(params, 0)
+}
+
+func cleanFunctionParametersWithDepth(params interface{}, depth int) interface{} {
+	if params == nil {
+		return nil
+	}
+
+	if depth >= geminiFunctionSchemaMaxDepth {
+		return cleanFunctionParametersShallow(params)
+	}
+
+	switch v := params.(type) {
 	case map[string]interface{}:
 		// Keep only Gemini-supported OpenAPI schema subset fields (per official SDK Schema).
 		cleanedMap := make(map[string]interface{}, len(v))
@@ -881,47 +1695,6 @@ func normalizeGeminiSchemaTypeAndNullable(schema map[string]interface{}) {
 	}
 }
 
-func removeAdditionalPropertiesWithDepth(schema interface{}, depth int) interface{} {
-	if depth >= 5 {
-		return schema
-	}
-
-	v, ok := schema.(map[string]interface{})
-	if !ok || len(v) == 0 {
-		return schema
-	}
-	// 删除所有的title字段
-	delete(v, "title")
-	delete(v, "$schema")
-	// 如果type不为object和array，则直接返回
-	if typeVal, exists := v["type"]; !exists || (typeVal != "object" && typeVal != "array") {
-		return schema
-	}
-	switch v["type"] {
-	case "object":
-		delete(v, "additionalProperties")
-		// 处理 properties
-		if properties, ok := v["properties"].(map[string]interface{}); ok {
-			for key, value := range properties {
-				properties[key] = removeAdditionalPropertiesWithDepth(value, depth+1)
-			}
-		}
-		for _, field := range []string{"allOf", "anyOf", "oneOf"} {
-			if nested, ok := v[field].([]interface{}); ok {
-				for i, item := range nested {
-					nested[i] = removeAdditionalPropertiesWithDepth(item, depth+1)
-				}
-			}
-		}
-	case "array":
-		if items, ok := v["items"].(map[string]interface{}); ok {
-			v["items"] = removeAdditionalPropertiesWithDepth(items, depth+1)
-		}
-	}
-
-	return v
-}
-
 func unescapeString(s string) (string, error) {
 	var result []rune
 	escaped := false
@@ -1062,16 +1835,25 @@ func buildUsageFromGeminiMetadata(metadata dto.GeminiUsageMetadata, fallbackProm
 }
 
 func responseGeminiChat2OpenAI(c *gin.Context, response *dto.GeminiChatResponse) *dto.OpenAITextResponse {
+	createdAt := common.GetTimestamp()
 	fullTextResponse := dto.OpenAITextResponse{
 		Id:      helper.GetResponseID(c),
 		Object:  "chat.completion",
-		Created: common.GetTimestamp(),
+		Created: createdAt,
 		Choices: make([]dto.OpenAITextResponseChoice, 0, len(response.Candidates)),
 	}
-	isToolCall := false
-	for _, candidate := range response.Candidates {
+	audioId := "audio_" + strings.TrimPrefix(fullTextResponse.Id, "chatcmpl-")
+	usedIndexes := make(map[int]bool, len(response.Candidates))
+	for i, candidate := range response.Candidates {
+		isToolCall := false
+		// Gemini omits a zero index, fall back to the position when indexes collide so n>1 choices stay distinct
+		choiceIndex := int(candidate.Index)
+		if usedIndexes[choiceIndex] {
+			choiceIndex = i
+		}
+		usedIndexes[choiceIndex] = true
 		choice := dto.OpenAITextResponseChoice{
-			Index: int(candidate.Index),
+			Index: choiceIndex,
 			Message: dto.Message{
 				Role:    "assistant",
 				Content: "",
@@ -1084,7 +1866,7 @@ func responseGeminiChat2OpenAI(c *gin.Context, response *dto.GeminiChatResponse)
 			//   2) 末尾 strings.Join 再分配一份等大缓冲
 			// Gemini 图片返回时 InlineData.Data 可能是数 MB 的 base64，
 			// 上述两份临时分配在高并发下会显著放大堆驻留。
-			var content strings.Builder
+			var content, reasoning strings.Builder
 			var inlineGrow int
 			for _, part := range candidate.Content.Parts {
 				if part.InlineData != nil {
@@ -1102,6 +1884,7 @@ func responseGeminiChat2OpenAI(c *gin.Context, response *dto.GeminiChatResponse)
 				appended++
 			}
 			var toolCalls []dto.ToolCallResponse
+			var audioParts []dto.GeminiInlineData
 			for _, part := range candidate.Content.Parts {
 				if part.InlineData != nil {
 					// 媒体内容
@@ -1112,6 +1895,9 @@ func responseGeminiChat2OpenAI(c *gin.Context, response *dto.GeminiChatResponse)
 						content.WriteString(";base64,")
 						content.WriteString(part.InlineData.Data)
 						content.WriteByte(')')
+					} else if strings.HasPrefix(part.InlineData.MimeType, "audio") {
+						// 音频放入 message.audio，不拼接到正文
+						audioParts = append(audioParts, *part.InlineData)
 					} else {
 						// 其他媒体类型，直接显示链接
 						writeSep()
@@ -1127,7 +1913,11 @@ func responseGeminiChat2OpenAI(c *gin.Context, response *dto.GeminiChatResponse)
 						toolCalls = append(toolCalls, *call)
 					}
 				} else if part.Thought {
-					choice.Message.ReasoningContent = &part.Text
+					// 思考摘要可能拆成多个 part，全部拼接到 reasoning_content
+					if reasoning.Len() > 0 {
+						reasoning.WriteByte('\n')
+					}
+					reasoning.WriteString(part.Text)
 				} else {
 					if part.ExecutableCode != nil {
 						writeSep()
@@ -1154,46 +1944,219 @@ func responseGeminiChat2OpenAI(c *gin.Context, response *dto.GeminiChatResponse)
 				choice.Message.SetToolCalls(toolCalls)
 				isToolCall = true
 			}
-			choice.Message.SetStringContent(content.String())
+			if reasoning.Len() > 0 {
+				if reasoningContent, ok := applyThinkingSummaryMode(c, reasoning.String()); ok {
+					choice.Message.ReasoningContent = &reasoningContent
+				}
+			}
+			if isGeminiMixedModalities(c) {
+				choice.Message.SetMediaContent(buildGeminiMixedModalityContent(candidate.Content.Parts))
+			} else {
+				output := content.String()
+				if isGeminiOutputTrimEnabled() {
+					output = trimGeminiOutput(output)
+				}
+				// 与 OpenAI 一致，音频回复的文字作为 transcript，content 留空
+				if len(audioParts) > 0 {
+					choice.Message.Audio = buildGeminiMessageAudio(c, audioParts, audioId, createdAt+geminiAudioExpiresSeconds)
+					choice.Message.Audio.Transcript = output
+					output = ""
+				}
+				choice.Message.SetStringContent(output)
+			}
 
 		}
 		if candidate.FinishReason != nil {
-			switch *candidate.FinishReason {
-			case "STOP":
-				choice.FinishReason = constant.FinishReasonStop
-			case "MAX_TOKENS":
-				choice.FinishReason = constant.FinishReasonLength
-			case "SAFETY":
-				// Safety filter triggered
-				choice.FinishReason = constant.FinishReasonContentFilter
-			case "RECITATION":
-				// Recitation (citation) detected
-				choice.FinishReason = constant.FinishReasonContentFilter
-			case "BLOCKLIST":
-				// Blocklist triggered
-				choice.FinishReason = constant.FinishReasonContentFilter
-			case "PROHIBITED_CONTENT":
-				// Prohibited content detected
-				choice.FinishReason = constant.FinishReasonContentFilter
-			case "SPII":
-				// Sensitive personally identifiable information
-				choice.FinishReason = constant.FinishReasonContentFilter
-			case "OTHER":
-				// Other reasons
-				choice.FinishReason = constant.FinishReasonContentFilter
-			default:
-				choice.FinishReason = constant.FinishReasonContentFilter
-			}
+			choice.FinishReason = geminiFinishReason(*candidate.FinishReason)
 		}
 		if isToolCall {
 			choice.FinishReason = constant.FinishReasonToolCalls
 		}
+		choice.Grounding = convertGroundingMetadata(candidate.GroundingMetadata)
+		choice.UrlContext = convertUrlContextMetadata(candidate.UrlContextMetadata)
+		choice.Logprobs = convertGeminiLogprobs(candidate.LogprobsResult)
+		choice.SafetyRatings = convertSafetyRatings(c, candidate.SafetyRatings)
+		if refusal, ok := geminiRefusalMessage(candidate.FinishReason); ok && choice.Message.StringContent() == "" {
+			choice.Message.Refusal = &refusal
+		} else if note, ok := geminiTruncationNote(candidate.FinishReason); ok && choice.Message.StringContent() == "" && !isToolCall {
+			choice.Message.Refusal = &note
+		}
 
 		fullTextResponse.Choices = append(fullTextResponse.Choices, choice)
 	}
 	return &fullTextResponse
 }
 
+// convertGeminiLogprobs maps Gemini logprobsResult to the OpenAI logprobs object.
+func convertGeminiLogprobs(result *dto.GeminiLogprobsResult) *dto.OpenAILogprobs {
+	if result == nil || len(result.ChosenCandidates) == 0 {
+		return nil
+	}
+	logprobs := &dto.OpenAILogprobs{
+		Content: make([]dto.OpenAILogprobsContent, 0, len(result.ChosenCandidates)),
+	}
+	for i, chosen := range result.ChosenCandidates {
+		content := dto.OpenAILogprobsContent{
+			Token:       chosen.Token,
+			Logprob:     chosen.LogProbability,
+			Bytes:       tokenBytes(chosen.Token),
+			TopLogprobs: make([]dto.OpenAITopLogprobs, 0),
+		}
+		if i < len(result.TopCandidates) {
+			for _, top := range result.TopCandidates[i].Candidates {
+				content.TopLogprobs = append(content.TopLogprobs, dto.OpenAITopLogprobs{
+					Token:   top.Token,
+					Logprob: top.LogProbability,
+					Bytes:   tokenBytes(top.Token),
+				})
+			}
+		}
+		logprobs.Content = append(logprobs.Content, content)
+	}
+	return logprobs
+}
+
+func tokenBytes(token string) []int {
+	bytes := make([]int, len(token))
+	for i := 0; i < len(token); i++ {
+		bytes[i] = int(token[i])
+	}
+	return bytes
+}
+
+// geminiFinishReason maps a Gemini candidate finishReason to the OpenAI finish_reason. Only MAX_TOKENS means the
+// output was cut by the token limit, every reason other than STOP where Gemini stopped the output is content_filter.
+func geminiFinishReason(finishReason string) string {
+	switch finishReason {
+	case "STOP", "FINISH_REASON_UNSPECIFIED":
+		return constant.FinishReasonStop
+	case "MAX_TOKENS":
+		return constant.FinishReasonLength
+	default:
+		// SAFETY、RECITATION、BLOCKLIST、PROHIBITED_CONTENT、SPII、IMAGE_SAFETY、OTHER 及未知原因
+		return constant.FinishReasonContentFilter
+	}
+}
+
+// geminiTruncationNote explains why output stopped early when Gemini cut it for reciting a source,
+// it is only sent as refusal when the candidate carries no content or tool calls.
+func geminiTruncationNote(finishReason *string) (string, bool) {
+	if finishReason == nil {
+		return "", false
+	}
+	switch *finishReason {
+	case "RECITATION", "IMAGE_RECITATION":
+		return fmt.Sprintf("The response was truncated because Gemini detected recitation of source material (finish_reason=%s)", *finishReason), true
+	}
+	return "", false
+}
+
+// geminiRefusalMessage builds the OpenAI refusal text for candidates stopped by Gemini safety filters.
+func geminiRefusalMessage(finishReason *string) (string, bool) {
+	if finishReason == nil {
+		return "", false
+	}
+	switch *finishReason {
+	case "SAFETY", "PROHIBITED_CONTENT", "BLOCKLIST", "SPII", "IMAGE_SAFETY":
+		return fmt.Sprintf("The response was blocked by Gemini safety filters (finish_reason=%s)", *finishReason), true
+	}
+	return "", false
+}
+
+// convertSafetyRatings maps candidate safety ratings to the OpenAI response, only when the client opted in
+func convertSafetyRatings(c *gin.Context, ratings []dto.GeminiChatSafetyRating) []dto.SafetyRating {
+	if len(ratings) == 0 || !common.GetContextKeyBool(c, constant.ContextKeyGeminiIncludeSafetyRatings) {
+		return nil
+	}
+	converted := make([]dto.SafetyRating, 0, len(ratings))
+	for _, rating := range ratings {
+		converted = append(converted, dto.SafetyRating{
+			Category:         rating.Category,
+			Probability:      rating.Probability,
+			ProbabilityScore: rating.ProbabilityScore,
+			Severity:         rating.Severity,
+			SeverityScore:    rating.SeverityScore,
+			Blocked:          rating.Blocked,
+		})
+	}
+	return converted
+}
+
+// convertGroundingMetadata exposes the search suggestions, sources and cited answer spans of a grounded candidate
+func convertGroundingMetadata(metadata *dto.GeminiGroundingMetadata) *dto.GroundingInfo {
+	if metadata == nil {
+		return nil
+	}
+	grounding := &dto.GroundingInfo{
+		WebSearchQueries: metadata.WebSearchQueries,
+	}
+	if metadata.SearchEntryPoint != nil {
+		grounding.RenderedContent = metadata.SearchEntryPoint.RenderedContent
+	}
+	// 跳过没有 web 来源的 chunk 后，groundingChunkIndices 需要映射到 Sources 中的位置
+	sourceIndexes := make(map[int]int, len(metadata.GroundingChunks))
+	for i, chunk := range metadata.GroundingChunks {
+		if chunk.Web == nil || chunk.Web.Uri == "" {
+			continue
+		}
+		sourceIndexes[i] = len(grounding.Sources)
+		grounding.Sources = append(grounding.Sources, dto.GroundingSource{Url: chunk.Web.Uri, Title: chunk.Web.Title})
+	}
+	for _, support := range metadata.GroundingSupports {
+		if support.Segment == nil {
+			continue
+		}
+		citation := dto.GroundingCitation{
+			Text:          support.Segment.Text,
+			StartIndex:    support.Segment.StartIndex,
+			EndIndex:      support.Segment.EndIndex,
+			SourceIndexes: make([]int, 0, len(support.GroundingChunkIndices)),
+		}
+		for _, chunkIndex := range support.GroundingChunkIndices {
+			if sourceIndex, ok := sourceIndexes[chunkIndex]; ok {
+				citation.SourceIndexes = append(citation.SourceIndexes, sourceIndex)
+			}
+		}
+		if len(citation.SourceIndexes) == 0 {
+			continue
+		}
+		grounding.Citations = append(grounding.Citations, citation)
+	}
+	if grounding.RenderedContent == "" && len(grounding.WebSearchQueries) == 0 && len(grounding.Sources) == 0 {
+		return nil
+	}
+	return grounding
+}
+
+// urlContextAllFailedWarning is reported when the url context tool could not retrieve any URL
+const urlContextAllFailedWarning = "None of the URLs could be retrieved, the response is not grounded on their content"
+
+// convertUrlContextMetadata exposes the per-URL retrieval status of the urlContext tool
+func convertUrlContextMetadata(metadata *dto.GeminiUrlContextMetadata) *dto.UrlContextInfo {
+	if metadata == nil || len(metadata.UrlMetadata) == 0 {
+		return nil
+	}
+	info := &dto.UrlContextInfo{Urls: make([]dto.UrlContextSource, 0, len(metadata.UrlMetadata))}
+	retrieved := false
+	for _, url := range metadata.UrlMetadata {
+		status := "failed"
+		switch url.UrlRetrievalStatus {
+		case "URL_RETRIEVAL_STATUS_SUCCESS":
+			status = "success"
+			retrieved = true
+		case "URL_RETRIEVAL_STATUS_UNSAFE":
+			status = "unsafe"
+		case "URL_RETRIEVAL_STATUS_PAYWALL":
+			status = "paywall"
+		}
+		info.Urls = append(info.Urls, dto.UrlContextSource{Url: url.RetrievedUrl, Status: status})
+	}
+	if !retrieved {
+		info.Warning = urlContextAllFailedWarning
+	}
+	return info
+}
+
 func streamResponseGeminiChat2OpenAI(geminiResponse *dto.GeminiChatResponse) (*dto.ChatCompletionsStreamResponse, bool) {
 	choices := make([]dto.ChatCompletionsStreamResponseChoice, 0, len(geminiResponse.Candidates))
 	isStop := false
@@ -1207,6 +2170,8 @@ func streamResponseGeminiChat2OpenAI(geminiResponse *dto.GeminiChatResponse) (*d
 			Delta: dto.ChatCompletionsStreamResponseChoiceDelta{
 				//Role: "assistant",
 			},
+			Grounding:  convertGroundingMetadata(candidate.GroundingMetadata),
+			UrlContext: convertUrlContextMetadata(candidate.UrlContextMetadata),
 		}
 		// 使用 strings.Builder 直接累积 delta content，避免每张 image / 每个
 		// 文本片段都先 `+` 拼出一份临时 string，再 strings.Join 再拷贝一遍。
@@ -1228,39 +2193,12 @@ func streamResponseGeminiChat2OpenAI(geminiResponse *dto.GeminiChatResponse) (*d
 			appended++
 		}
 		isTools := false
-		isThought := false
+		var reasoning strings.Builder
 		if candidate.FinishReason != nil {
-			// Map Gemini FinishReason to OpenAI finish_reason
-			switch *candidate.FinishReason {
-			case "STOP":
-				// Normal completion
-				choice.FinishReason = &constant.FinishReasonStop
-			case "MAX_TOKENS":
-				// Reached maximum token limit
-				choice.FinishReason = &constant.FinishReasonLength
-			case "SAFETY":
-				// Safety filter triggered
-				choice.FinishReason = &constant.FinishReasonContentFilter
-			case "RECITATION":
-				// Recitation (citation) detected
-				choice.FinishReason = &constant.FinishReasonContentFilter
-			case "BLOCKLIST":
-				// Blocklist triggered
-				choice.FinishReason = &constant.FinishReasonContentFilter
-			case "PROHIBITED_CONTENT":
-				// Prohibited content detected
-				choice.FinishReason = &constant.FinishReasonContentFilter
-			case "SPII":
-				// Sensitive personally identifiable information
-				choice.FinishReason = &constant.FinishReasonContentFilter
-			case "OTHER":
-				// Other reasons
-				choice.FinishReason = &constant.FinishReasonContentFilter
-			default:
-				// Unknown reason, treat as content filter
-				choice.FinishReason = &constant.FinishReasonContentFilter
-			}
+			finishReason := geminiFinishReason(*candidate.FinishReason)
+			choice.FinishReason = &finishReason
 		}
+		var audioChunks []string
 		for _, part := range candidate.Content.Parts {
 			if part.InlineData != nil {
 				if strings.HasPrefix(part.InlineData.MimeType, "image") {
@@ -1270,6 +2208,8 @@ func streamResponseGeminiChat2OpenAI(geminiResponse *dto.GeminiChatResponse) (*d
 					content.WriteString(";base64,")
 					content.WriteString(part.InlineData.Data)
 					content.WriteByte(')')
+				} else if strings.HasPrefix(part.InlineData.MimeType, "audio") {
+					audioChunks = append(audioChunks, part.InlineData.Data)
 				}
 			} else if part.FunctionCall != nil {
 				isTools = true
@@ -1279,9 +2219,11 @@ func streamResponseGeminiChat2OpenAI(geminiResponse *dto.GeminiChatResponse) (*d
 				}
 
 			} else if part.Thought {
-				isThought = true
-				writeSep()
-				content.WriteString(part.Text)
+				// 同一分片中的思考与正文分开输出，避免正文被当作 reasoning_content
+				if reasoning.Len() > 0 {
+					reasoning.WriteByte('\n')
+				}
+				reasoning.WriteString(part.Text)
 			} else {
 				if part.ExecutableCode != nil {
 					writeSep()
@@ -1303,13 +2245,24 @@ func streamResponseGeminiChat2OpenAI(geminiResponse *dto.GeminiChatResponse) (*d
 				}
 			}
 		}
-		if isThought {
-			choice.Delta.SetReasoningContent(content.String())
-		} else {
+		if reasoning.Len() > 0 {
+			choice.Delta.SetReasoningContent(reasoning.String())
+		}
+		if content.Len() > 0 || reasoning.Len() == 0 {
 			choice.Delta.SetContentString(content.String())
 		}
-		if isTools {
-			choice.FinishReason = &constant.FinishReasonToolCalls
+		if audioData := joinBase64Chunks(audioChunks); audioData != "" {
+			choice.Delta.Audio = &dto.StreamAudioDelta{Data: audioData}
+		}
+		// 工具调用分片不携带 finish_reason，由流结束时的分片统一给出 tool_calls
+		if refusal, ok := geminiRefusalMessage(candidate.FinishReason); ok && content.Len() == 0 && !isTools {
+			choice.Delta.Refusal = &refusal
+		} else if note, ok := geminiTruncationNote(candidate.FinishReason); ok && content.Len() == 0 && !isTools {
+			choice.Delta.Refusal = &note
+		}
+		if logprobs := convertGeminiLogprobs(candidate.LogprobsResult); logprobs != nil {
+			var choiceLogprobs any = logprobs
+			choice.Logprobs = &choiceLogprobs
 		}
 		choices = append(choices, choice)
 	}
@@ -1320,6 +2273,25 @@ func streamResponseGeminiChat2OpenAI(geminiResponse *dto.GeminiChatResponse) (*d
 	return &response, isStop
 }
 
+// geminiAudioExpiresSeconds mirrors the expires_at OpenAI reports for assistant audio
+const geminiAudioExpiresSeconds = 3600
+
+// joinBase64Chunks merges several base64 payloads into one, base64 strings cannot be concatenated when padded
+func joinBase64Chunks(chunks []string) string {
+	if len(chunks) <= 1 {
+		return strings.Join(chunks, "")
+	}
+	var raw []byte
+	for _, chunk := range chunks {
+		decoded, err := base64.StdEncoding.DecodeString(chunk)
+		if err != nil {
+			return strings.Join(chunks, "")
+		}
+		raw = append(raw, decoded...)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
 func handleStream(c *gin.Context, info *relaycommon.RelayInfo, resp *dto.ChatCompletionsStreamResponse) error {
 	streamData, err := common.Marshal(resp)
 	if err != nil {
@@ -1344,6 +2316,7 @@ func handleFinalStream(c *gin.Context, info *relaycommon.RelayInfo, resp *dto.Ch
 func geminiStreamHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response, callback func(data string, geminiResponse *dto.GeminiChatResponse) bool) (*dto.Usage, *types.NewAPIError) {
 	var usage = &dto.Usage{}
 	var imageCount int
+	var blockedError *types.NewAPIError
 	responseText := strings.Builder{}
 
 	helper.StreamScannerHandler(c, resp, info, func(data string, sr *helper.StreamResult) {
@@ -1353,14 +2326,22 @@ func geminiStreamHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http
 			return
 		}
 
-		if len(geminiResponse.Candidates) == 0 && geminiResponse.PromptFeedback != nil && geminiResponse.PromptFeedback.BlockReason != nil {
+		if isGeminiPromptBlocked(&geminiResponse) {
+			// 首个分片即被拦截且尚未向客户端输出时，返回 content_filter 错误而不是空的流，原生 Gemini 格式保持透传
+			if info.RelayFormat != types.RelayFormatGemini && channelSafetyFallbackMessage(info) == "" && !c.Writer.Written() {
+				blockedError = geminiPromptBlockedError(c, geminiResponse.PromptFeedback)
+				sr.Stop(blockedError)
+				return
+			}
 			common.SetContextKey(c, constant.ContextKeyAdminRejectReason, fmt.Sprintf("gemini_block_reason=%s", *geminiResponse.PromptFeedback.BlockReason))
 		}
 
+		recordGeminiFinishReasons(c, geminiResponse.Candidates)
+
 		// 统计图片数量
 		for _, candidate := range geminiResponse.Candidates {
 			for _, part := range candidate.Content.Parts {
-				if part.InlineData != nil && part.InlineData.MimeType != "" {
+				if part.InlineData != nil && strings.HasPrefix(part.InlineData.MimeType, "image") {
 					imageCount++
 				}
 				if part.Text != "" {
@@ -1379,6 +2360,10 @@ func geminiStreamHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http
 			sr.Stop(fmt.Errorf("gemini callback stopped"))
 		}
 	})
+	if blockedError != nil {
+		c.Writer.Header().Set("Content-Type", "application/json")
+		return nil, blockedError
+	}
 
 	if imageCount != 0 {
 		if usage.CompletionTokens == 0 {
@@ -1403,13 +2388,135 @@ func GeminiChatStreamHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *
 	finishReason := constant.FinishReasonStop
 	toolCallIndexByChoice := make(map[int]map[string]int)
 	nextToolCallIndexByChoice := make(map[int]int)
+	roleSentChoices := make(map[int]bool)
+	// 按 choice 记录是否出现过工具调用、是否已下发 finish_reason，结束分片据此逐个 choice 给出 finish_reason
+	toolCallChoices := make(map[int]bool)
+	finishedChoices := make(map[int]bool)
+	var outputTrimmer *geminiStreamTrimmer
+	if isGeminiOutputTrimEnabled() {
+		outputTrimmer = newGeminiStreamTrimmer()
+	}
+	coalescer := newGeminiStreamCoalescer()
+	conciseReasoning := newGeminiConciseReasoning(c)
+	// 开启流式 schema 校验时按 choice 累积输出，结束时校验
+	responseSchema, validateSchema := common.GetContextKey(c, constant.ContextKeyGeminiStreamResponseSchema)
+	schemaOutputs := make(map[int]*strings.Builder)
+	// 音频输出按 choice 使用同一个 audio id 串联各个分片，结束时补发 audio done 分片
+	audioId := "audio_" + strings.TrimPrefix(id, "chatcmpl-")
+	audioChoices := make([]int, 0, 1)
+	transcriptAudio := isGeminiAudioOutputRequested(c) && info.RelayFormat == types.RelayFormatOpenAI
+	var audioSeconds float64
+	// 首个下发给客户端的分片时间，用于统计 TTFT
+	var firstTokenAt time.Time
+	defer func() {
+		recordGeminiStreamTiming(c, info, firstTokenAt)
+	}()
+	sendResponse := func(response *dto.ChatCompletionsStreamResponse) {
+		err := handleStream(c, info, response)
+		if err != nil {
+			logger.LogError(c, err.Error())
+		} else if firstTokenAt.IsZero() && len(response.Choices) > 0 {
+			firstTokenAt = time.Now()
+		}
+	}
+	flushCoalesced := func() {
+		if coalescer == nil {
+			return
+		}
+		for _, pending := range coalescer.flush() {
+			sendResponse(pending)
+		}
+	}
+	sendAudioDone := func() {
+		if len(audioChoices) == 0 || info.RelayFormat != types.RelayFormatOpenAI {
+			return
+		}
+		done := &dto.ChatCompletionsStreamResponse{
+			Id:      id,
+			Object:  "chat.completion.chunk",
+			Created: createAt,
+			Model:   info.UpstreamModelName,
+		}
+		for _, choiceIdx := range audioChoices {
+			done.Choices = append(done.Choices, dto.ChatCompletionsStreamResponseChoice{
+				Index: choiceIdx,
+				Delta: dto.ChatCompletionsStreamResponseChoiceDelta{
+					Audio: &dto.StreamAudioDelta{Id: audioId, ExpiresAt: createAt + geminiAudioExpiresSeconds},
+				},
+			})
+		}
+		audioChoices = audioChoices[:0]
+		if err := handleStream(c, info, done); err != nil {
+			logger.LogError(c, err.Error())
+		}
+	}
 
-	usage, err := geminiStreamHandler(c, info, resp, func(data string, geminiResponse *dto.GeminiChatResponse) bool {
+	handleChunk := func(geminiResponse *dto.GeminiChatResponse) {
 		response, isStop := streamResponseGeminiChat2OpenAI(geminiResponse)
+		// choices 与 candidates 一一对应
+		for i, candidate := range geminiResponse.Candidates {
+			response.Choices[i].SafetyRatings = convertSafetyRatings(c, candidate.SafetyRatings)
+		}
+		for choiceIdx := range response.Choices {
+			if audio := response.Choices[choiceIdx].Delta.Audio; audio != nil {
+				audio.Id = audioId
+				if !lo.Contains(audioChoices, response.Choices[choiceIdx].Index) {
+					audioChoices = append(audioChoices, response.Choices[choiceIdx].Index)
+				}
+			}
+		}
 
 		response.Id = id
 		response.Created = createAt
 		response.Model = info.UpstreamModelName
+		if fingerprint, ok := geminiSeedFingerprint(c); ok {
+			response.SetSystemFingerprint(fingerprint)
+		}
+		if outputTrimmer != nil {
+			for choiceIdx := range response.Choices {
+				delta := &response.Choices[choiceIdx].Delta
+				if delta.Content == nil {
+					continue
+				}
+				if trimmed := outputTrimmer.trim(response.Choices[choiceIdx].Index, *delta.Content); trimmed != "" {
+					delta.SetContentString(trimmed)
+				} else {
+					delta.Content = nil
+				}
+			}
+		}
+		for choiceIdx := range response.Choices {
+			if conciseReasoning != nil {
+				conciseReasoning.apply(&response.Choices[choiceIdx])
+				continue
+			}
+			delta := &response.Choices[choiceIdx].Delta
+			if delta.ReasoningContent == nil {
+				continue
+			}
+			if reasoningContent, ok := applyThinkingSummaryMode(c, *delta.ReasoningContent); ok {
+				delta.SetReasoningContent(reasoningContent)
+			} else {
+				delta.ReasoningContent = nil
+			}
+		}
+		// 请求音频输出时文字作为 audio.transcript 下发，音频数据保持 PCM 分片，WAV 需要完整长度无法流式下发
+		if transcriptAudio {
+			for choiceIdx := range response.Choices {
+				delta := &response.Choices[choiceIdx].Delta
+				if delta.Content == nil || *delta.Content == "" {
+					continue
+				}
+				if delta.Audio == nil {
+					delta.Audio = &dto.StreamAudioDelta{Id: audioId}
+				}
+				delta.Audio.Transcript = *delta.Content
+				delta.Content = nil
+				if !lo.Contains(audioChoices, response.Choices[choiceIdx].Index) {
+					audioChoices = append(audioChoices, response.Choices[choiceIdx].Index)
+				}
+			}
+		}
 		if response.IsToolCall() {
 			finishReason = constant.FinishReasonToolCalls
 			if info.RelayFormat == types.RelayFormatClaude {
@@ -1420,6 +2527,12 @@ func GeminiChatStreamHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *
 		}
 		for choiceIdx := range response.Choices {
 			choiceKey := response.Choices[choiceIdx].Index
+			if len(response.Choices[choiceIdx].Delta.ToolCalls) > 0 {
+				toolCallChoices[choiceKey] = true
+			}
+			if response.Choices[choiceIdx].FinishReason != nil {
+				finishedChoices[choiceKey] = true
+			}
 			for toolIdx := range response.Choices[choiceIdx].Delta.ToolCalls {
 				tool := &response.Choices[choiceIdx].Delta.ToolCalls[toolIdx]
 				if tool.ID == "" {
@@ -1445,6 +2558,10 @@ func GeminiChatStreamHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *
 		if info.SendResponseCount == 0 {
 			// send first response
 			emptyResponse := helper.GenerateStartEmptyResponse(id, createAt, info.UpstreamModelName, nil)
+			if fingerprint, ok := geminiSeedFingerprint(c); ok {
+				emptyResponse.SetSystemFingerprint(fingerprint)
+			}
+			roleSentChoices[0] = true
 			if response.IsToolCall() {
 				if len(emptyResponse.Choices) > 0 && len(response.Choices) > 0 {
 					toolCalls := response.Choices[0].Delta.ToolCalls
@@ -1473,21 +2590,65 @@ func GeminiChatStreamHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *
 			}
 		}
 
-		err := handleStream(c, info, response)
-		if err != nil {
-			logger.LogError(c, err.Error())
+		// OpenAI 只在每个 choice 的首个 delta 中携带 role，n>1 时其余 choice 也需要补发一次
+		for choiceIdx := range response.Choices {
+			choiceKey := response.Choices[choiceIdx].Index
+			if !roleSentChoices[choiceKey] {
+				response.Choices[choiceIdx].Delta.Role = "assistant"
+				roleSentChoices[choiceKey] = true
+			}
+		}
+
+		if validateSchema {
+			for _, choice := range response.Choices {
+				if choice.Delta.Content == nil {
+					continue
+				}
+				if schemaOutputs[choice.Index] == nil {
+					schemaOutputs[choice.Index] = &strings.Builder{}
+				}
+				schemaOutputs[choice.Index].WriteString(*choice.Delta.Content)
+			}
+		}
+		if coalescer != nil {
+			for _, coalesced := range coalescer.add(response, time.Now()) {
+				sendResponse(coalesced)
+			}
+		} else {
+			sendResponse(response)
 		}
 		if isStop {
+			flushCoalesced()
+			sendAudioDone()
 			if info.RelayFormat != types.RelayFormatClaude {
-				_ = handleStream(c, info, helper.GenerateStopResponse(id, createAt, info.UpstreamModelName, finishReason))
+				_ = handleStream(c, info, geminiStreamStopResponse(id, createAt, info.UpstreamModelName, roleSentChoices, toolCallChoices, finishedChoices))
 			}
 		}
+	}
+
+	usage, err := geminiStreamHandler(c, info, resp, func(data string, geminiResponse *dto.GeminiChatResponse) bool {
+		applySafetyFallback(c, info, geminiResponse)
+		audioSeconds += geminiOutputAudioSeconds(geminiResponse)
+		for _, chunk := range splitGeminiMixedModalityChunk(c, geminiResponse) {
+			handleChunk(chunk)
+		}
 		return true
 	})
 
 	if err != nil {
 		return usage, err
 	}
+	applyGeminiAudioOutputUsage(usage, audioSeconds)
+	flushCoalesced()
+	if pending := conciseReasoning.pending(); len(pending) > 0 {
+		response := helper.GenerateStopResponse(id, createAt, info.UpstreamModelName, constant.FinishReasonStop)
+		response.Choices = pending
+		sendResponse(response)
+	}
+	sendAudioDone()
+	if validateSchema {
+		reportGeminiStreamSchemaMismatch(c, info, responseSchema, schemaOutputs)
+	}
 
 	response := helper.GenerateFinalUsageResponse(id, createAt, info.UpstreamModelName, *usage)
 	if info.RelayFormat == types.RelayFormatClaude && info.ClaudeConvertInfo != nil && !info.ClaudeConvertInfo.Done {
@@ -1501,33 +2662,120 @@ func GeminiChatStreamHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *
 	return usage, nil
 }
 
+// geminiStreamStopResponse builds the final chunk with a finish_reason for every choice that has not finished yet,
+// choices that produced tool calls finish with tool_calls, the others with stop.
+func geminiStreamStopResponse(id string, createAt int64, model string, choices map[int]bool, toolCallChoices map[int]bool, finishedChoices map[int]bool) *dto.ChatCompletionsStreamResponse {
+	response := helper.GenerateStopResponse(id, createAt, model, constant.FinishReasonStop)
+	indexes := lo.Keys(choices)
+	sort.Ints(indexes)
+	response.Choices = response.Choices[:0]
+	for _, index := range indexes {
+		if finishedChoices[index] {
+			continue
+		}
+		finishReason := constant.FinishReasonStop
+		if toolCallChoices[index] {
+			finishReason = constant.FinishReasonToolCalls
+		}
+		response.Choices = append(response.Choices, dto.ChatCompletionsStreamResponseChoice{
+			Index:        index,
+			FinishReason: &finishReason,
+		})
+	}
+	return response
+}
+
+// reportGeminiStreamSchemaMismatch validates each choice's assembled output against the response schema
+// and emits an error event for the first choice that does not conform.
+func reportGeminiStreamSchemaMismatch(c *gin.Context, info *relaycommon.RelayInfo, schema any, outputs map[int]*strings.Builder) {
+	indexes := lo.Keys(outputs)
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		var value any
+		reason := ""
+		if err := common.UnmarshalJsonStr(outputs[index].String(), &value); err != nil {
+			reason = "invalid JSON: " + err.Error()
+		} else if err := validateJSONSchemaValue(schema, value, "$"); err != nil {
+			reason = err.Error()
+		}
+		if reason == "" {
+			continue
+		}
+		logger.LogWarn(c, fmt.Sprintf("gemini stream schema mismatch: model=%s, choice=%d, reason=%s", info.UpstreamModelName, index, reason))
+		newAPIError := types.NewOpenAIError(
+			errors.New(i18n.T(c, i18n.MsgGeminiStreamSchemaMismatch, map[string]any{"Index": index, "Reason": reason})),
+			types.ErrorCodeBadResponse,
+			http.StatusBadGateway,
+		)
+		var err error
+		if info.RelayFormat == types.RelayFormatClaude {
+			err = helper.ClaudeData(c, dto.ClaudeResponse{Type: "error", Error: newAPIError.ToClaudeError()})
+		} else {
+			err = helper.ObjectData(c, gin.H{"error": newAPIError.ToOpenAIError()})
+		}
+		if err != nil {
+			logger.LogError(c, err.Error())
+		}
+		return
+	}
+}
+
+// recordGeminiStreamTiming stores time-to-first-token and total stream duration for the consume log
+// and writes them to the system log so upstream slowdowns can be tracked per model and channel.
+func recordGeminiStreamTiming(c *gin.Context, info *relaycommon.RelayInfo, firstTokenAt time.Time) {
+	if info == nil || info.StartTime.IsZero() {
+		return
+	}
+	durationMs := time.Since(info.StartTime).Milliseconds()
+	firstTokenMs := int64(-1)
+	if !firstTokenAt.IsZero() {
+		firstTokenMs = firstTokenAt.Sub(info.StartTime).Milliseconds()
+		common.SetContextKey(c, constant.ContextKeyGeminiStreamFirstTokenMs, firstTokenMs)
+	}
+	common.SetContextKey(c, constant.ContextKeyGeminiStreamDurationMs, durationMs)
+	channelId := 0
+	if info.ChannelMeta != nil {
+		channelId = info.ChannelId
+	}
+	logger.LogInfo(c, fmt.Sprintf("gemini stream timing: model=%s, channel=%d, ttft_ms=%d, duration_ms=%d",
+		info.OriginModelName, channelId, firstTokenMs, durationMs))
+}
+
 func GeminiChatHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response) (*dto.Usage, *types.NewAPIError) {
-	responseBody, err := io.ReadAll(resp.Body)
+	responseBody, spooled, err := readGeminiResponseBody(c, resp)
 	if err != nil {
 		return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
 	}
 	service.CloseResponseBodyGracefully(resp)
-	logger.LogDebug(c, "Gemini response body: %s", responseBody)
 	var geminiResponse dto.GeminiChatResponse
-	err = common.Unmarshal(responseBody, &geminiResponse)
+	if spooled != nil {
+		defer spooled.Close()
+		var reader io.Reader
+		if reader, err = spooled.reader(); err == nil {
+			err = common.DecodeJson(reader, &geminiResponse)
+		}
+	} else {
+		logger.LogDebug(c, "Gemini response body: %s", responseBody)
+		if apiErr := geminiResponseError(responseBody); apiErr != nil {
+			return nil, apiErr
+		}
+		err = common.Unmarshal(responseBody, &geminiResponse)
+	}
 	if err != nil {
 		return nil, types.NewOpenAIError(err, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
 	}
+	recordGeminiFinishReasons(c, geminiResponse.Candidates)
+	applySafetyFallback(c, info, &geminiResponse)
 	if len(geminiResponse.Candidates) == 0 {
 		usage := buildUsageFromGeminiMetadata(geminiResponse.UsageMetadata, info.GetEstimatePromptTokens())
 
 		var newAPIError *types.NewAPIError
-		if geminiResponse.PromptFeedback != nil && geminiResponse.PromptFeedback.BlockReason != nil {
-			common.SetContextKey(c, constant.ContextKeyAdminRejectReason, fmt.Sprintf("gemini_block_reason=%s", *geminiResponse.PromptFeedback.BlockReason))
-			newAPIError = types.NewOpenAIError(
-				errors.New("request blocked by Gemini API: "+*geminiResponse.PromptFeedback.BlockReason),
-				types.ErrorCodePromptBlocked,
-				http.StatusBadRequest,
-			)
+		if isGeminiPromptBlocked(&geminiResponse) {
+			newAPIError = geminiPromptBlockedError(c, geminiResponse.PromptFeedback)
 		} else {
 			common.SetContextKey(c, constant.ContextKeyAdminRejectReason, "gemini_empty_candidates")
 			newAPIError = types.NewOpenAIError(
-				errors.New("empty response from Gemini API"),
+				errors.New(i18n.T(c, i18n.MsgGeminiEmptyResponse)),
 				types.ErrorCodeEmptyResponse,
 				http.StatusInternalServerError,
 			)
@@ -1550,7 +2798,11 @@ func GeminiChatHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http.R
 	}
 	fullTextResponse := responseGeminiChat2OpenAI(c, &geminiResponse)
 	fullTextResponse.Model = info.UpstreamModelName
+	if fingerprint, ok := geminiSeedFingerprint(c); ok {
+		fullTextResponse.SystemFingerprint = fingerprint
+	}
 	usage := buildUsageFromGeminiMetadata(geminiResponse.UsageMetadata, info.GetEstimatePromptTokens())
+	applyGeminiAudioOutputUsage(&usage, geminiOutputAudioSeconds(&geminiResponse))
 
 	fullTextResponse.Usage = usage
 
@@ -1583,10 +2835,21 @@ func GeminiEmbeddingHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *h
 	if readErr != nil {
 		return nil, types.NewOpenAIError(readErr, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
 	}
+	if apiErr := geminiResponseError(responseBody); apiErr != nil {
+		return nil, apiErr
+	}
 
 	var geminiResponse dto.GeminiBatchEmbeddingResponse
-	if jsonErr := common.Unmarshal(responseBody, &geminiResponse); jsonErr != nil {
-		return nil, types.NewOpenAIError(jsonErr, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+	if info.IsGeminiBatchEmbedding {
+		if jsonErr := common.Unmarshal(responseBody, &geminiResponse); jsonErr != nil {
+			return nil, types.NewOpenAIError(jsonErr, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+		}
+	} else {
+		var singleResponse dto.GeminiEmbeddingResponse
+		if jsonErr := common.Unmarshal(responseBody, &singleResponse); jsonErr != nil {
+			return nil, types.NewOpenAIError(jsonErr, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+		}
+		geminiResponse.Embeddings = []*dto.ContentEmbedding{&singleResponse.Embedding}
 	}
 
 	// convert to openai format response
@@ -1596,20 +2859,56 @@ func GeminiEmbeddingHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *h
 		Model:  info.UpstreamModelName,
 	}
 
+	inputTokens, _ := common.GetContextKeyType[[]int](c, constant.ContextKeyGeminiEmbeddingInputTokens)
+	dimensions, normalize := common.GetContextKeyType[int](c, constant.ContextKeyGeminiEmbeddingDimensions)
+	failures, _ := common.GetContextKeyType[map[int]string](c, constant.ContextKeyGeminiEmbeddingFailures)
+	promptTokens := info.GetEstimatePromptTokens()
+	failedCount, firstFailure := 0, ""
 	for i, embedding := range geminiResponse.Embeddings {
-		openAIResponse.Data = append(openAIResponse.Data, dto.OpenAIEmbeddingResponseItem{
-			Object:    "embedding",
-			Embedding: embedding.Values,
-			Index:     i,
-		})
+		item := dto.OpenAIEmbeddingResponseItem{
+			Object: "embedding",
+			Index:  i,
+		}
+		if message, failed := failures[i]; failed || embedding == nil {
+			// 部分失败的输入不计费
+			if i < len(inputTokens) {
+				promptTokens -= inputTokens[i]
+			}
+			if firstFailure == "" {
+				firstFailure = message
+			}
+			if message == "" {
+				message = i18n.T(c, i18n.MsgGeminiEmptyResponse)
+			}
+			failedCount++
+			item.Error = &types.OpenAIError{Message: message, Type: "upstream_error", Code: "embedding_failed"}
+			openAIResponse.Data = append(openAIResponse.Data, item)
+			continue
+		}
+		values := embedding.Values
+		if normalize {
+			values = truncateAndNormalizeEmbedding(values, dimensions)
+		}
+		item.Embedding = values
+		if i < len(inputTokens) {
+			item.PromptTokens = inputTokens[i]
+		}
+		openAIResponse.Data = append(openAIResponse.Data, item)
 	}
+	if failedCount > 0 && failedCount == len(geminiResponse.Embeddings) {
+		if firstFailure == "" {
+			firstFailure = i18n.T(c, i18n.MsgGeminiEmptyResponse)
+		}
+		return nil, types.NewOpenAIError(errors.New(i18n.T(c, i18n.MsgGeminiEmbeddingAllFailed, map[string]any{"Count": failedCount, "Reason": firstFailure})), types.ErrorCodeBadResponse, http.StatusBadRequest)
+	}
+	promptTokens = max(promptTokens, 0)
 
 	// calculate usage
 	// https://ai.google.dev/gemini-api/docs/pricing?hl=zh-cn#text-embedding-004
 	// Google has not yet clarified how embedding models will be billed
 	// refer to openai billing method to use input tokens billing
 	// https://platform.openai.com/docs/guides/embeddings#what-are-embeddings
-	usage := service.ResponseText2Usage(c, "", info.UpstreamModelName, info.GetEstimatePromptTokens())
+	usage := service.ResponseText2Usage(c, "", info.UpstreamModelName, promptTokens)
 	openAIResponse.Usage = *usage
 
 	jsonResponse, jsonErr := common.Marshal(openAIResponse)
@@ -1621,58 +2920,151 @@ func GeminiEmbeddingHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *h
 	return usage, nil
 }
 
+// truncateAndNormalizeEmbedding applies the Matryoshka workflow: keep the first dimensions values
+// (outputDimensionality is not honored by every model), then L2-normalize the truncated vector.
+// Normalizing before truncation would leave the shortened vector with a norm below 1.
+func truncateAndNormalizeEmbedding(values []float64, dimensions int) []float64 {
+	if dimensions > 0 && len(values) > dimensions {
+		values = values[:dimensions]
+	}
+	var sum float64
+	for _, value := range values {
+		sum += value * value
+	}
+	if sum == 0 {
+		return values
+	}
+	norm := math.Sqrt(sum)
+	normalized := make([]float64, len(values))
+	for i, value := range values {
+		normalized[i] = value / norm
+	}
+	return normalized
+}
+
 func GeminiImageHandler(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response) (*dto.Usage, *types.NewAPIError) {
 	responseBody, readErr := io.ReadAll(resp.Body)
 	if readErr != nil {
 		return nil, types.NewOpenAIError(readErr, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
 	}
 	_ = resp.Body.Close()
+	if apiErr := geminiResponseError(responseBody); apiErr != nil {
+		return nil, apiErr
+	}
 
 	var geminiResponse dto.GeminiImageResponse
 	if jsonErr := common.Unmarshal(responseBody, &geminiResponse); jsonErr != nil {
 		return nil, types.NewOpenAIError(jsonErr, types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
 	}
 
+	openAIResponse, apiErr := convertGeminiImageResponse(c, info, &geminiResponse)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	jsonResponse, jsonErr := json.Marshal(openAIResponse)
+	if jsonErr != nil {
+		return nil, types.NewError(jsonErr, types.ErrorCodeBadResponseBody)
+	}
+
+	c.Writer.Header().Set("Content-Type", "application/json")
+	c.Writer.WriteHeader(resp.StatusCode)
+	_, _ = c.Writer.Write(jsonResponse)
+
+	cacheImageResponse(c, responseBody)
+	return geminiImageUsage(c, info, openAIResponse.Data), nil
+}
+
+// convertGeminiImageResponse converts Imagen predictions to OpenAI images. Filtered predictions are dropped and
+// reported in the metadata, an error is returned when no image is left.
+func convertGeminiImageResponse(c *gin.Context, info *relaycommon.RelayInfo, geminiResponse *dto.GeminiImageResponse) (*dto.ImageResponse, *types.NewAPIError) {
 	if len(geminiResponse.Predictions) == 0 {
-		return nil, types.NewOpenAIError(errors.New("no images generated"), types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
+		return nil, types.NewOpenAIError(errors.New(i18n.T(c, i18n.MsgGeminiNoImagesGenerated)), types.ErrorCodeBadResponseBody, http.StatusInternalServerError)
 	}
 
 	// convert to openai format response
 	openAIResponse := dto.ImageResponse{
-		Created: common.GetTimestamp(),
+		Created: parseGeminiTimestamp(geminiResponse.CreateTime, geminiResponse.UpdateTime),
 		Data:    make([]dto.ImageData, 0, len(geminiResponse.Predictions)),
 	}
 
+	var filteredReasons []string
+	filteredCount := 0
 	for _, prediction := range geminiResponse.Predictions {
 		if prediction.RaiFilteredReason != "" {
-			continue // skip filtered image
+			filteredCount++
+			filteredReasons = append(filteredReasons, prediction.RaiFilteredReason)
+			continue
 		}
 		openAIResponse.Data = append(openAIResponse.Data, dto.ImageData{
 			B64Json: prediction.BytesBase64Encoded,
 		})
 	}
-
-	jsonResponse, jsonErr := json.Marshal(openAIResponse)
-	if jsonErr != nil {
-		return nil, types.NewError(jsonErr, types.ErrorCodeBadResponseBody)
+	filteredReasons = lo.Uniq(filteredReasons)
+	if len(openAIResponse.Data) == 0 && filteredCount > 0 {
+		return nil, types.WithOpenAIError(types.OpenAIError{
+			Message: i18n.T(c, i18n.MsgGeminiImagesFiltered, map[string]any{"Count": filteredCount, "Reasons": strings.Join(filteredReasons, "; ")}),
+			Type:    "content_filter",
+			Code:    string(types.ErrorCodePromptBlocked),
+		}, http.StatusBadRequest)
+	}
+	if filteredCount > 0 {
+		// 部分图片被过滤时仍返回其余图片，并告知客户端过滤的数量和原因
+		metadata, err := common.Marshal(map[string]any{
+			"filtered_count":   filteredCount,
+			"filtered_reasons": filteredReasons,
+		})
+		if err != nil {
+			return nil, types.NewError(err, types.ErrorCodeBadResponseBody)
+		}
+		openAIResponse.Metadata = metadata
+		if info.PriceData.UsePrice {
+			// 按次计费只计实际返回的图片
+			info.PriceData.AddOtherRatio("n", float64(len(openAIResponse.Data)))
+		}
 	}
+	return &openAIResponse, nil
+}
 
-	c.Writer.Header().Set("Content-Type", "application/json")
-	c.Writer.WriteHeader(resp.StatusCode)
-	_, _ = c.Writer.Write(jsonResponse)
+// geminiImageUsage bills the returned images, replays from the idempotency cache cost nothing
+func geminiImageUsage(c *gin.Context, info *relaycommon.RelayInfo, data []dto.ImageData) *dto.Usage {
+	if common.GetContextKeyBool(c, constant.ContextKeyGeminiImageIdempotencyHit) {
+		// replayed from the idempotency cache, nothing was generated upstream so the price multiplier is zero
+		if info.PriceData.OtherRatios == nil {
+			info.PriceData.OtherRatios = make(map[string]float64)
+		}
+		info.PriceData.OtherRatios["n"] = 0
+		return &dto.Usage{}
+	}
 
 	// https://github.com/google-gemini/cookbook/blob/719a27d752aac33f39de18a8d3cb42a70874917e/quickstarts/Counting_Tokens.ipynb
-	// each image has fixed 258 tokens
-	const imageTokens = 258
-	generatedImages := len(openAIResponse.Data)
+	// generated images are billed per 768x768 tile (258 tokens each)
+	imageTokens := 0
+	for _, image := range data {
+		imageTokens += generatedImageTokens(image.B64Json)
+	}
 
 	usage := &dto.Usage{
-		PromptTokens:     imageTokens * generatedImages, // each generated image has fixed 258 tokens
-		CompletionTokens: 0,                             // image generation does not calculate completion tokens
-		TotalTokens:      imageTokens * generatedImages,
+		PromptTokens:     imageTokens,
+		CompletionTokens: 0, // image generation does not calculate completion tokens
+		TotalTokens:      imageTokens,
 	}
 
-	return usage, nil
+	return usage
+}
+
+// parseGeminiTimestamp returns the first valid RFC3339 timestamp as unix seconds,
+// falling back to the current time when upstream does not provide one.
+func parseGeminiTimestamp(timestamps ...string) int64 {
+	for _, ts := range timestamps {
+		if ts == "" {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			return t.Unix()
+		}
+	}
+	return common.GetTimestamp()
 }
 
 type GeminiModelsResponse struct {
@@ -1737,6 +3129,10 @@ func FetchGeminiModels(baseURL, apiKey, proxyURL string) ([]string, error) {
 			}
 			modelName := strings.TrimPrefix(modelNameValue, "models/")
 			allModels = append(allModels, modelName)
+			model_setting.SetGeminiLiveModelLimits(modelName, model_setting.GeminiModelLimits{
+				ContextLength:   geminiTokenLimit(model.InputTokenLimit),
+				MaxOutputTokens: geminiTokenLimit(model.OutputTokenLimit),
+			})
 		}
 
 		nextPageToken = modelsResponse.NextPageToken
@@ -1748,6 +3144,101 @@ func FetchGeminiModels(baseURL, apiKey, proxyURL string) ([]string, error) {
 	return allModels, nil
 }
 
+func geminiTokenLimit(value interface{}) int {
+	switch v := value.(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	case int64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+// GetGeminiModelLimits returns the context window and max output tokens of a model,
+// falling back to the largest output limit of current Gemini models when the model is unknown.
+func GetGeminiModelLimits(modelName string) model_setting.GeminiModelLimits {
+	limits, _ := model_setting.GetGeminiModelLimits(modelName)
+	if limits.MaxOutputTokens <= 0 {
+		limits.MaxOutputTokens = geminiMaxOutputTokens
+	}
+	return limits
+}
+
+// applyAllowedFunctionNames restricts callable functions to a declared subset.
+// Gemini only accepts allowedFunctionNames with ANY or VALIDATED mode, so AUTO is upgraded to VALIDATED
+// which still lets the model answer in natural language. When tool_choice already names functions the two
+// lists are intersected, and a 400 is returned if they have no function in common.
+func applyAllowedFunctionNames(c *gin.Context, geminiRequest *dto.GeminiChatRequest, functions []dto.FunctionRequest, allowedFunctionNames []string) error {
+	declared := make(map[string]bool, len(functions))
+	for _, function := range functions {
+		declared[function.Name] = true
+	}
+	for _, name := range allowedFunctionNames {
+		if !declared[name] {
+			return types.NewErrorWithStatusCode(
+				errors.New(i18n.T(c, i18n.MsgGeminiAllowedFunctionUndeclared, map[string]any{"Name": name})),
+				types.ErrorCodeInvalidRequest,
+				http.StatusBadRequest,
+				types.ErrOptionWithSkipRetry(),
+			)
+		}
+	}
+	if geminiRequest.ToolConfig == nil {
+		geminiRequest.ToolConfig = &dto.ToolConfig{}
+	}
+	if geminiRequest.ToolConfig.FunctionCallingConfig == nil {
+		geminiRequest.ToolConfig.FunctionCallingConfig = &dto.FunctionCallingConfig{}
+	}
+	config := geminiRequest.ToolConfig.FunctionCallingConfig
+	switch config.Mode {
+	case "NONE":
+		return nil
+	case "", "AUTO":
+		config.Mode = "VALIDATED"
+	}
+	if len(config.AllowedFunctionNames) == 0 {
+		config.AllowedFunctionNames = allowedFunctionNames
+		return nil
+	}
+	// tool_choice 已指定函数时取两者交集，交集为空说明两者冲突
+	allowed := make(map[string]bool, len(allowedFunctionNames))
+	for _, name := range allowedFunctionNames {
+		allowed[name] = true
+	}
+	intersection := make([]string, 0, len(config.AllowedFunctionNames))
+	for _, name := range config.AllowedFunctionNames {
+		if allowed[name] {
+			intersection = append(intersection, name)
+		}
+	}
+	if len(intersection) == 0 {
+		return types.NewErrorWithStatusCode(
+			errors.New(i18n.T(c, i18n.MsgGeminiAllowedFunctionsConflict, map[string]any{"ToolChoice": strings.Join(config.AllowedFunctionNames, ", ")})),
+			types.ErrorCodeInvalidRequest,
+			http.StatusBadRequest,
+			types.ErrOptionWithSkipRetry(),
+		)
+	}
+	config.AllowedFunctionNames = intersection
+	return nil
+}
+
+// toolChoiceRequiresTools reports whether tool_choice forces a tool call, which is meaningless without tools.
+// "auto" and "none" are harmless defaults many clients always send, so they are tolerated.
+func toolChoiceRequiresTools(toolChoice any) bool {
+	switch v := toolChoice.(type) {
+	case nil:
+		return false
+	case string:
+		return v != "" && v != "auto" && v != "none"
+	default:
+		return true
+	}
+}
+
 // convertToolChoiceToGeminiConfig converts OpenAI tool_choice to Gemini toolConfig
 // OpenAI tool_choice values:
 //   - "auto": Let the model decide (default)
@@ -0,0 +1,79 @@
+package gemini
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/QuantumNous/new-api/constant"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoRequestCompressesBodyAndFallsBackWhenRejected(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled, oldMinBytes := settings.RequestCompressionEnabled, settings.RequestCompressionMinBytes
+	settings.RequestCompressionEnabled = true
+	settings.RequestCompressionMinBytes = 16
+	t.Cleanup(func() {
+		settings.RequestCompressionEnabled, settings.RequestCompressionMinBytes = oldEnabled, oldMinBytes
+	})
+	service.InitHttpClient()
+
+	requestBody := `{"contents":[{"role":"user","parts":[{"text":"` + strings.Repeat("large ", 64) + `"}]}]}`
+	acceptGzip := true
+	var encodings []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.Header.Get("Content-Encoding")
+		encodings = append(encodings, encoding)
+		var body io.Reader = r.Body
+		if encoding == "gzip" {
+			if !acceptGzip {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			gz, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			body = gz
+		}
+		data, _ := io.ReadAll(body)
+		require.Equal(t, requestBody, string(data))
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	doRequest := func(channelId int) *http.Response {
+		gin.SetMode(gin.TestMode)
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		info := &relaycommon.RelayInfo{ChannelMeta: &relaycommon.ChannelMeta{
+			ChannelType:       constant.ChannelTypeGemini,
+			ChannelId:         channelId,
+			ChannelBaseUrl:    upstream.URL,
+			UpstreamModelName: "gemini-2.5-flash",
+		}}
+		resp, err := (&Adaptor{}).DoRequest(c, info, strings.NewReader(requestBody))
+		require.NoError(t, err)
+		return resp.(*http.Response)
+	}
+
+	require.Equal(t, http.StatusOK, doRequest(90001).StatusCode)
+	require.Equal(t, []string{"gzip"}, encodings)
+
+	acceptGzip = false
+	encodings = nil
+	require.Equal(t, http.StatusOK, doRequest(90002).StatusCode)
+	require.Equal(t, []string{"gzip", ""}, encodings)
+
+	// the rejecting channel is no longer compressed
+	encodings = nil
+	require.Equal(t, http.StatusOK, doRequest(90002).StatusCode)
+	require.Equal(t, []string{""}, encodings)
+}
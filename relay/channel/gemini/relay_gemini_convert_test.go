@@ -0,0 +1,3006 @@
+package gemini
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/i18n"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
+	"github.com/QuantumNous/new-api/types"
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/tiff"
+)
+
+func TestMain(m *testing.M) {
+	if err := i18n.Init(); err != nil {
+		panic("failed to init i18n: " + err.Error())
+	}
+	os.Exit(m.Run())
+}
+
+func newGeminiConvertTestContext(modelName string) (*gin.Context, *relaycommon.RelayInfo) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{
+		OriginModelName: modelName,
+		ChannelMeta: &relaycommon.ChannelMeta{
+			UpstreamModelName: modelName,
+		},
+	}
+	return c, info
+}
+
+func TestCovertOpenAI2GeminiDeveloperRoleBecomesSystemInstruction(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	request := dto.GeneralOpenAIRequest{
+		Model: "gemini-2.5-flash",
+		Messages: []dto.Message{
+			{Role: "system", Content: "be brief"},
+			{Role: "developer", Content: "answer in english"},
+			{Role: "user", Content: "hi"},
+		},
+	}
+
+	geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.NotNil(t, geminiRequest.SystemInstructions)
+	require.Len(t, geminiRequest.SystemInstructions.Parts, 1)
+	require.Equal(t, "be brief\nanswer in english", geminiRequest.SystemInstructions.Parts[0].Text)
+	require.Len(t, geminiRequest.Contents, 1)
+	require.Equal(t, "user", geminiRequest.Contents[0].Role)
+}
+
+func TestCovertOpenAI2GeminiMergesInterleavedSystemMessages(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	request := dto.GeneralOpenAIRequest{
+		Model: "gemini-2.5-flash",
+		Messages: []dto.Message{
+			{Role: "system", Content: "You are a travel assistant."},
+			{Role: "user", Content: "Plan a day in Paris"},
+			{Role: "assistant", Content: "Start at the Louvre."},
+			{Role: "system", Content: "Answer in French from now on."},
+			{Role: "system", Content: ""},
+			{Role: "user", Content: "And the evening?"},
+		},
+	}
+
+	geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.NotNil(t, geminiRequest.SystemInstructions)
+	require.Equal(t, []dto.GeminiPart{{Text: "You are a travel assistant.\nAnswer in French from now on."}}, geminiRequest.SystemInstructions.Parts)
+	roles := lo.Map(geminiRequest.Contents, func(content dto.GeminiChatContent, _ int) string { return content.Role })
+	require.Equal(t, []string{"user", "model", "user"}, roles)
+	require.Equal(t, "And the evening?", geminiRequest.Contents[2].Parts[0].Text)
+
+	request.Messages = []dto.Message{{Role: "system", Content: "be brief"}, {Role: "user", Content: "hi"}}
+	geminiRequest, err = CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.Equal(t, "be brief", geminiRequest.SystemInstructions.Parts[0].Text)
+	require.Len(t, geminiRequest.Contents, 1)
+	require.Equal(t, "user", geminiRequest.Contents[0].Role)
+}
+
+func TestCovertOpenAI2GeminiRejectsToolChoiceWithoutTools(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	request := dto.GeneralOpenAIRequest{
+		Model:      "gemini-2.5-flash",
+		Messages:   []dto.Message{{Role: "user", Content: "hi"}},
+		ToolChoice: "required",
+	}
+
+	_, err := CovertOpenAI2Gemini(c, request, info)
+	require.Error(t, err)
+	var newAPIError *types.NewAPIError
+	require.ErrorAs(t, err, &newAPIError)
+	require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+	require.Equal(t, "tool_choice requires a non-empty tools array", newAPIError.Error())
+
+	c.Request.Header.Set("Accept-Language", "zh-CN,zh;q=0.9")
+	_, err = CovertOpenAI2Gemini(c, request, info)
+	require.ErrorAs(t, err, &newAPIError)
+	require.Equal(t, "设置 tool_choice 时必须提供非空的 tools 数组", newAPIError.Error())
+
+	request.ToolChoice = "auto"
+	geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.Nil(t, geminiRequest.ToolConfig)
+}
+
+func TestResponseGeminiChat2OpenAIKeepsCandidateIndexes(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newGeminiConvertTestContext("gemini-2.5-flash")
+	stop := "STOP"
+	response := &dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{
+			{Index: 0, FinishReason: &stop, Content: dto.GeminiChatContent{Parts: []dto.GeminiPart{{FunctionCall: &dto.FunctionCall{FunctionName: "lookup"}}}}},
+			{Index: 1, FinishReason: &stop, Content: dto.GeminiChatContent{Parts: []dto.GeminiPart{{Text: "b"}}}},
+			{Index: 1, FinishReason: &stop, Content: dto.GeminiChatContent{Parts: []dto.GeminiPart{{Text: "c"}}}},
+		},
+	}
+
+	openAIResponse := responseGeminiChat2OpenAI(c, response)
+	require.Len(t, openAIResponse.Choices, 3)
+	require.Equal(t, 0, openAIResponse.Choices[0].Index)
+	require.Equal(t, 1, openAIResponse.Choices[1].Index)
+	require.Equal(t, 2, openAIResponse.Choices[2].Index)
+	require.Equal(t, "tool_calls", openAIResponse.Choices[0].FinishReason)
+	require.Equal(t, "stop", openAIResponse.Choices[1].FinishReason)
+}
+
+func TestCovertOpenAI2GeminiTextResponseFormatOverridesForcedJson(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldModels := settings.ForceJsonModeModels
+	settings.ForceJsonModeModels = []string{"gemini-json"}
+	t.Cleanup(func() {
+		settings.ForceJsonModeModels = oldModels
+	})
+
+	c, info := newGeminiConvertTestContext("gemini-json")
+	request := dto.GeneralOpenAIRequest{
+		Model:    "gemini-json",
+		Messages: []dto.Message{{Role: "user", Content: "hi"}},
+	}
+	geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.Equal(t, "application/json", geminiRequest.GenerationConfig.ResponseMimeType)
+
+	request.ResponseFormat = &dto.ResponseFormat{Type: "text"}
+	geminiRequest, err = CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.Equal(t, "text/plain", geminiRequest.GenerationConfig.ResponseMimeType)
+}
+
+func TestGeminiChatStreamHandlerFramesAudioDeltas(t *testing.T) {
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+	})
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{
+		IsStream:    true,
+		RelayFormat: types.RelayFormatOpenAI,
+		StartTime:   time.Now(),
+		ChannelMeta: &relaycommon.ChannelMeta{
+			UpstreamModelName: "gemini-2.5-flash-preview-tts",
+		},
+	}
+	body := "data: " + `{"candidates":[{"content":{"role":"model","parts":[{"inlineData":{"mimeType":"audio/L16;codec=pcm;rate=24000","data":"AAE="}},{"inlineData":{"mimeType":"audio/L16;codec=pcm;rate=24000","data":"Ag=="}}]}}]}` + "\n\n" +
+		"data: " + `{"candidates":[{"content":{"role":"model","parts":[{"inlineData":{"mimeType":"audio/L16;codec=pcm;rate=24000","data":"AwQ="}}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":2,"candidatesTokenCount":3,"totalTokenCount":5}}` + "\n\n"
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+
+	_, apiErr := GeminiChatStreamHandler(c, info, resp)
+	require.Nil(t, apiErr)
+
+	output := recorder.Body.String()
+	// 两个分片合并后重新编码，而不是直接拼接 base64 字符串
+	require.Contains(t, output, `"audio":{"id":"audio_`)
+	require.Contains(t, output, `"data":"AAEC"`)
+	require.Contains(t, output, `"data":"AwQ="`)
+	require.Contains(t, output, `"expires_at":`)
+	require.Less(t, strings.Index(output, `"expires_at":`), strings.Index(output, `"finish_reason":"stop"`))
+
+	firstTokenMs, ok := common.GetContextKeyType[int64](c, constant.ContextKeyGeminiStreamFirstTokenMs)
+	require.True(t, ok)
+	durationMs, ok := common.GetContextKeyType[int64](c, constant.ContextKeyGeminiStreamDurationMs)
+	require.True(t, ok)
+	require.LessOrEqual(t, firstTokenMs, durationMs)
+}
+
+func TestCovertOpenAI2GeminiEmptyContents(t *testing.T) {
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	request := dto.GeneralOpenAIRequest{
+		Model: "gemini-2.5-flash",
+		Messages: []dto.Message{
+			{Role: "system", Content: "be brief"},
+			{Role: "user", Content: ""},
+		},
+	}
+
+	_, err := CovertOpenAI2Gemini(c, request, info)
+	var newAPIError *types.NewAPIError
+	require.ErrorAs(t, err, &newAPIError)
+	require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+
+	settings := model_setting.GetGeminiSettings()
+	oldFallbackText := settings.EmptyContentsFallbackText
+	settings.EmptyContentsFallbackText = "continue"
+	t.Cleanup(func() {
+		settings.EmptyContentsFallbackText = oldFallbackText
+	})
+
+	geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.Len(t, geminiRequest.Contents, 1)
+	require.Equal(t, "user", geminiRequest.Contents[0].Role)
+	require.Equal(t, "continue", geminiRequest.Contents[0].Parts[0].Text)
+	require.NotNil(t, geminiRequest.SystemInstructions)
+}
+
+func TestGeminiLowDetailImage(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1000, 500))))
+	data := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	resized, mimeType := downscaleGeminiLowDetailImage("gemini-2.5-flash", data, "image/png")
+	require.Equal(t, "image/png", mimeType)
+	raw, err := base64.StdEncoding.DecodeString(resized)
+	require.NoError(t, err)
+	config, err := png.DecodeConfig(bytes.NewReader(raw))
+	require.NoError(t, err)
+	require.Equal(t, 384, config.Width)
+	require.Equal(t, 192, config.Height)
+
+	// 按 mediaResolution 计费的模型不降采样，而是透传分辨率档位
+	resized, _ = downscaleGeminiLowDetailImage("gemini-3-pro-preview", data, "image/png")
+	require.Equal(t, data, resized)
+	require.JSONEq(t, `{"level":"media_resolution_low"}`, string(geminiPartMediaResolution("gemini-3-pro-preview", &dto.MessageImageUrl{Detail: "low"})))
+	require.Nil(t, geminiPartMediaResolution("gemini-2.5-flash", &dto.MessageImageUrl{Detail: "low"}))
+	require.Nil(t, geminiPartMediaResolution("gemini-3-pro-preview", &dto.MessageImageUrl{Detail: "auto"}))
+}
+
+func TestGeminiLowDetailImageFallbackAndSetting(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled := settings.LowDetailImageDownscaleEnabled
+	t.Cleanup(func() {
+		settings.LowDetailImageDownscaleEnabled = oldEnabled
+	})
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 600, 1200))))
+	data := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	// 没有按块计费配置的模型缩放到 LowDetailImageMaxSide
+	resized, _ := downscaleGeminiLowDetailImage("gemma-3-27b-it", data, "image/png")
+	raw, err := base64.StdEncoding.DecodeString(resized)
+	require.NoError(t, err)
+	config, err := png.DecodeConfig(bytes.NewReader(raw))
+	require.NoError(t, err)
+	require.Equal(t, 256, config.Width)
+	require.Equal(t, 512, config.Height)
+
+	settings.LowDetailImageDownscaleEnabled = false
+	resized, _ = downscaleGeminiLowDetailImage("gemini-2.5-flash", data, "image/png")
+	require.Equal(t, data, resized)
+
+	// 非图片的 image_url 忽略 detail
+	c, info := newGeminiConvertTestContext("gemini-3-pro-preview")
+	geminiRequest, err := CovertOpenAI2Gemini(c, dto.GeneralOpenAIRequest{
+		Model: "gemini-3-pro-preview",
+		Messages: []dto.Message{{Role: "user", Content: []any{
+			map[string]any{"type": "image_url", "image_url": map[string]any{"url": "data:application/pdf;base64," + base64.StdEncoding.EncodeToString([]byte("%PDF-1.4")), "detail": "low"}},
+		}}},
+	}, info)
+	require.NoError(t, err)
+	part := geminiRequest.Contents[0].Parts[0]
+	require.Equal(t, "application/pdf", part.InlineData.MimeType)
+	require.Nil(t, part.MediaResolution)
+}
+
+func TestConvertOpenAIRequestRejectsOversizedBody(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldLimit := settings.MaxRequestBodyMB
+	settings.MaxRequestBodyMB = 1
+	t.Cleanup(func() {
+		settings.MaxRequestBodyMB = oldLimit
+	})
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	request := &dto.GeneralOpenAIRequest{
+		Model:    "gemini-2.5-flash",
+		Messages: []dto.Message{{Role: "user", Content: "hi"}},
+	}
+	adaptor := &Adaptor{}
+
+	c.Request.ContentLength = 2 << 20
+	_, err := adaptor.ConvertOpenAIRequest(c, info, request)
+	var newAPIError *types.NewAPIError
+	require.ErrorAs(t, err, &newAPIError)
+	require.Equal(t, http.StatusRequestEntityTooLarge, newAPIError.StatusCode)
+
+	// 渠道配置优先于全局配置
+	info.ChannelOtherSettings.GeminiMaxRequestBodyMB = 4
+	_, err = adaptor.ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+}
+
+func TestCovertOpenAI2GeminiToolArrayContentNestsMediaForGemini3(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1))))
+	dataUrl := "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	c, info := newGeminiConvertTestContext("gemini-3-pro-preview")
+	name := "screenshot"
+	request := dto.GeneralOpenAIRequest{
+		Model: "gemini-3-pro-preview",
+		Messages: []dto.Message{
+			{Role: "user", Content: "hi"},
+			{Role: "tool", Name: &name, Content: []any{
+				map[string]any{"type": "text", "text": "captured"},
+				map[string]any{"type": "image_url", "image_url": map[string]any{"url": dataUrl}},
+			}},
+		},
+	}
+
+	geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	// 图片嵌入 functionResponse.parts，而不是追加为独立的 inlineData part
+	parts := geminiRequest.Contents[len(geminiRequest.Contents)-1].Parts
+	require.Len(t, parts, 2)
+	functionResponse := parts[1].FunctionResponse
+	require.NotNil(t, functionResponse)
+	require.Equal(t, "captured", functionResponse.Response["content"])
+	require.Contains(t, string(functionResponse.Parts), `"mimeType":"image/png"`)
+}
+
+func TestResponseGeminiChat2OpenAIExposesGrounding(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newGeminiConvertTestContext("gemini-2.5-flash")
+	stop := "STOP"
+	response := &dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{{
+			FinishReason: &stop,
+			Content:      dto.GeminiChatContent{Parts: []dto.GeminiPart{{Text: "Spain won."}}},
+			GroundingMetadata: &dto.GeminiGroundingMetadata{
+				SearchEntryPoint: &dto.GeminiSearchEntryPoint{RenderedContent: "<div>suggestions</div>"},
+				WebSearchQueries: []string{"euro 2024 winner"},
+				GroundingChunks: []dto.GeminiGroundingChunk{
+					{},
+					{Web: &dto.GeminiGroundingChunkWeb{Uri: "https://example.com/euro", Title: "example.com"}},
+				},
+				GroundingSupports: []dto.GeminiGroundingSupport{
+					{Segment: &dto.GeminiGroundingSegment{EndIndex: 10, Text: "Spain won."}, GroundingChunkIndices: []int{0, 1}},
+					{Segment: &dto.GeminiGroundingSegment{EndIndex: 5, Text: "Spain"}, GroundingChunkIndices: []int{0}},
+				},
+			},
+		}},
+	}
+
+	openAIResponse := responseGeminiChat2OpenAI(c, response)
+	grounding := openAIResponse.Choices[0].Grounding
+	require.NotNil(t, grounding)
+	require.Equal(t, "<div>suggestions</div>", grounding.RenderedContent)
+	require.Equal(t, []string{"euro 2024 winner"}, grounding.WebSearchQueries)
+	require.Equal(t, []dto.GroundingSource{{Url: "https://example.com/euro", Title: "example.com"}}, grounding.Sources)
+	// 引用的 chunk 下标映射到 Sources，只引用了无效 chunk 的片段被丢弃
+	require.Equal(t, []dto.GroundingCitation{{Text: "Spain won.", EndIndex: 10, SourceIndexes: []int{0}}}, grounding.Citations)
+
+	streamResponse, _ := streamResponseGeminiChat2OpenAI(response)
+	require.Equal(t, grounding, streamResponse.Choices[0].Grounding)
+}
+
+func TestGeminiImageOutputModelRequestsAndReturnsImages(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash-image-preview")
+	geminiRequest, err := CovertOpenAI2Gemini(c, dto.GeneralOpenAIRequest{
+		Model:    "gemini-2.5-flash-image-preview",
+		Messages: []dto.Message{{Role: "user", Content: "draw a cat"}},
+	}, info)
+	require.NoError(t, err)
+	require.Equal(t, []string{"TEXT", "IMAGE"}, geminiRequest.GenerationConfig.ResponseModalities)
+
+	stop := "STOP"
+	response := &dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{{
+			FinishReason: &stop,
+			Content: dto.GeminiChatContent{Parts: []dto.GeminiPart{
+				{Text: "Here is a cat:"},
+				{InlineData: &dto.GeminiInlineData{MimeType: "image/png", Data: "iVBORw0KGgo="}},
+			}},
+		}},
+	}
+	openAIResponse := responseGeminiChat2OpenAI(c, response)
+	require.Contains(t, openAIResponse.Choices[0].Message.StringContent(), "Here is a cat:")
+	require.Contains(t, openAIResponse.Choices[0].Message.StringContent(), "![image](data:image/png;base64,iVBORw0KGgo=)")
+
+	streamResponse, _ := streamResponseGeminiChat2OpenAI(response)
+	require.Contains(t, *streamResponse.Choices[0].Delta.Content, "![image](data:image/png;base64,iVBORw0KGgo=)")
+}
+
+func TestResponseGeminiChat2OpenAIExposesUrlContextStatus(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newGeminiConvertTestContext("gemini-2.5-flash")
+	stop := "STOP"
+	response := &dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{{
+			FinishReason: &stop,
+			Content:      dto.GeminiChatContent{Parts: []dto.GeminiPart{{Text: "summary"}}},
+			UrlContextMetadata: &dto.GeminiUrlContextMetadata{UrlMetadata: []dto.GeminiUrlMetadata{
+				{RetrievedUrl: "https://example.com/a", UrlRetrievalStatus: "URL_RETRIEVAL_STATUS_SUCCESS"},
+				{RetrievedUrl: "https://example.com/b", UrlRetrievalStatus: "URL_RETRIEVAL_STATUS_UNSAFE"},
+			}},
+		}},
+	}
+
+	urlContext := responseGeminiChat2OpenAI(c, response).Choices[0].UrlContext
+	require.Equal(t, &dto.UrlContextInfo{Urls: []dto.UrlContextSource{
+		{Url: "https://example.com/a", Status: "success"},
+		{Url: "https://example.com/b", Status: "unsafe"},
+	}}, urlContext)
+	streamResponse, _ := streamResponseGeminiChat2OpenAI(response)
+	require.Equal(t, urlContext, streamResponse.Choices[0].UrlContext)
+
+	response.Candidates[0].UrlContextMetadata.UrlMetadata[0].UrlRetrievalStatus = "URL_RETRIEVAL_STATUS_ERROR"
+	urlContext = responseGeminiChat2OpenAI(c, response).Choices[0].UrlContext
+	require.Equal(t, "failed", urlContext.Urls[0].Status)
+	require.Equal(t, urlContextAllFailedWarning, urlContext.Warning)
+}
+
+func TestResponseGeminiChat2OpenAIIncludesSafetyRatingsOnRequest(t *testing.T) {
+	t.Parallel()
+
+	score := 0.12
+	response := &dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{{
+			Content: dto.GeminiChatContent{Parts: []dto.GeminiPart{{Text: "ok"}}},
+			SafetyRatings: []dto.GeminiChatSafetyRating{
+				{Category: "HARM_CATEGORY_HARASSMENT", Probability: "NEGLIGIBLE", ProbabilityScore: &score},
+			},
+		}},
+	}
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	require.Nil(t, responseGeminiChat2OpenAI(c, response).Choices[0].SafetyRatings)
+
+	request := dto.GeneralOpenAIRequest{
+		Model:     "gemini-2.5-flash",
+		Messages:  []dto.Message{{Role: "user", Content: "hi"}},
+		ExtraBody: []byte(`{"google":{"include_safety_ratings":true}}`),
+	}
+	_, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	ratings := responseGeminiChat2OpenAI(c, response).Choices[0].SafetyRatings
+	require.Equal(t, []dto.SafetyRating{{Category: "HARM_CATEGORY_HARASSMENT", Probability: "NEGLIGIBLE", ProbabilityScore: &score}}, ratings)
+}
+
+func TestConvertOpenAIRequestChannelAlwaysIncludesUsage(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	info.IsStream = true
+	info.RelayFormat = types.RelayFormatOpenAI
+	info.ShouldIncludeUsage = false
+	request := &dto.GeneralOpenAIRequest{
+		Model:    "gemini-2.5-flash",
+		Messages: []dto.Message{{Role: "user", Content: "hi"}},
+	}
+
+	_, err := (&Adaptor{}).ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+	require.False(t, info.ShouldIncludeUsage)
+
+	info.ChannelOtherSettings.GeminiAlwaysIncludeUsage = true
+	_, err = (&Adaptor{}).ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+	require.True(t, info.ShouldIncludeUsage)
+}
+
+func TestTranscodeGeminiUnsupportedImage(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, tiff.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2, 2)), nil))
+	data := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	converted, mimeType := transcodeGeminiUnsupportedImage(data, "image/tiff")
+	require.Equal(t, data, converted)
+	require.Equal(t, "image/tiff", mimeType)
+
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled := settings.ImageFormatConversionEnabled
+	settings.ImageFormatConversionEnabled = true
+	t.Cleanup(func() {
+		settings.ImageFormatConversionEnabled = oldEnabled
+	})
+
+	converted, mimeType = transcodeGeminiUnsupportedImage(data, "image/tiff")
+	require.Equal(t, "image/png", mimeType)
+	raw, err := base64.StdEncoding.DecodeString(converted)
+	require.NoError(t, err)
+	config, err := png.DecodeConfig(bytes.NewReader(raw))
+	require.NoError(t, err)
+	require.Equal(t, 2, config.Width)
+
+	// HEIC 由 Gemini 原生支持，不做转换
+	converted, mimeType = transcodeGeminiUnsupportedImage("aGVpYw==", "image/heic")
+	require.Equal(t, "aGVpYw==", converted)
+	require.Equal(t, "image/heic", mimeType)
+}
+
+func TestGeminiChatStreamHandlerEmitsRoleOncePerChoice(t *testing.T) {
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+	})
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{
+		IsStream:    true,
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{
+			UpstreamModelName: "gemini-2.5-flash",
+		},
+	}
+	body := "data: " + `{"candidates":[{"index":0,"content":{"role":"model","parts":[{"text":"a"}]}},{"index":1,"content":{"role":"model","parts":[{"text":"b"}]}}]}` + "\n\n" +
+		"data: " + `{"candidates":[{"index":0,"content":{"role":"model","parts":[{"text":"c"}]}},{"index":1,"content":{"role":"model","parts":[{"text":"d"}]}}]}` + "\n\n"
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+
+	_, apiErr := GeminiChatStreamHandler(c, info, resp)
+	require.Nil(t, apiErr)
+
+	roles := 0
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk dto.ChatCompletionsStreamResponse
+		require.NoError(t, common.UnmarshalJsonStr(data, &chunk))
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Role != "" {
+				require.Equal(t, "assistant", choice.Delta.Role)
+				roles++
+			}
+		}
+	}
+	require.Equal(t, 2, roles)
+	require.True(t, strings.HasPrefix(recorder.Body.String(), `data: {"id"`))
+}
+
+func TestGeminiChatStreamHandlerBuffersConciseThinkingSummary(t *testing.T) {
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+	})
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	common.SetContextKey(c, constant.ContextKeyGeminiThinkingSummary, thinkingSummaryConcise)
+	info := &relaycommon.RelayInfo{
+		IsStream:    true,
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{
+			UpstreamModelName: "gemini-2.5-flash",
+		},
+	}
+	// 标题分散在多个分片中，只有完整摘要才能提取
+	body := "data: " + `{"candidates":[{"index":0,"content":{"role":"model","parts":[{"text":"**Planning**\nI need to","thought":true}]}}]}` + "\n\n" +
+		"data: " + `{"candidates":[{"index":0,"content":{"role":"model","parts":[{"text":" think.\n**Check","thought":true}]}}]}` + "\n\n" +
+		"data: " + `{"candidates":[{"index":0,"content":{"role":"model","parts":[{"text":"ing**\nlooks fine","thought":true}]}}]}` + "\n\n" +
+		"data: " + `{"candidates":[{"index":0,"content":{"role":"model","parts":[{"text":"answer"}]},"finishReason":"STOP"}]}` + "\n\n"
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+
+	_, apiErr := GeminiChatStreamHandler(c, info, resp)
+	require.Nil(t, apiErr)
+
+	var reasoning []string
+	var content strings.Builder
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk dto.ChatCompletionsStreamResponse
+		require.NoError(t, common.UnmarshalJsonStr(data, &chunk))
+		for _, choice := range chunk.Choices {
+			if choice.Delta.ReasoningContent != nil {
+				reasoning = append(reasoning, *choice.Delta.ReasoningContent)
+			}
+			if choice.Delta.Content != nil {
+				content.WriteString(*choice.Delta.Content)
+			}
+		}
+	}
+	require.Equal(t, []string{"**Planning**\n**Checking**"}, reasoning)
+	require.Equal(t, "answer", content.String())
+}
+
+func TestGeminiChatStreamHandlerFinishesToolCallChoicesWithToolCalls(t *testing.T) {
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+	})
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{
+		IsStream:    true,
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{
+			UpstreamModelName: "gemini-2.5-flash",
+		},
+	}
+	body := "data: " + `{"candidates":[{"index":0,"content":{"role":"model","parts":[{"text":"checking"}]}},{"index":1,"content":{"role":"model","parts":[{"text":"a"}]}}]}` + "\n\n" +
+		"data: " + `{"candidates":[{"index":0,"content":{"role":"model","parts":[{"functionCall":{"name":"lookup","args":{}}}]}},{"index":1,"content":{"role":"model","parts":[{"text":"b"}]}}]}` + "\n\n" +
+		"data: " + `{"candidates":[{"index":0,"content":{"role":"model","parts":[{"text":""}]},"finishReason":"STOP"},{"index":1,"content":{"role":"model","parts":[{"text":""}]},"finishReason":"STOP"}]}` + "\n\n"
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+
+	_, apiErr := GeminiChatStreamHandler(c, info, resp)
+	require.Nil(t, apiErr)
+
+	finishReasons := make(map[int][]string)
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk dto.ChatCompletionsStreamResponse
+		require.NoError(t, common.UnmarshalJsonStr(data, &chunk))
+		for _, choice := range chunk.Choices {
+			if choice.FinishReason != nil {
+				finishReasons[choice.Index] = append(finishReasons[choice.Index], *choice.FinishReason)
+			}
+		}
+	}
+	// finish_reason 只出现在最后的分片中
+	require.Equal(t, map[int][]string{0: {"tool_calls"}, 1: {"stop"}}, finishReasons)
+}
+
+func TestGeminiChatStreamHandlerStreamsFunctionCallsAsToolCallDeltas(t *testing.T) {
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+	})
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{
+		IsStream:    true,
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{
+			UpstreamModelName: "gemini-2.5-flash",
+		},
+	}
+	// 上游抓包：首个分片即为 functionCall，第二个 functionCall 与 finishReason 同时到达
+	body := "data: " + `{"candidates":[{"content":{"role":"model","parts":[{"functionCall":{"name":"get_weather","args":{"city":"Paris","unit":"celsius"}}}]},"index":0}],"modelVersion":"gemini-2.5-flash"}` + "\r\n\r\n" +
+		"data: " + `{"candidates":[{"content":{"role":"model","parts":[{"functionCall":{"name":"get_time","args":{"timezone":"Europe/Paris"}}}]},"finishReason":"STOP","index":0}],"usageMetadata":{"promptTokenCount":42,"candidatesTokenCount":18,"totalTokenCount":60},"modelVersion":"gemini-2.5-flash"}` + "\r\n\r\n"
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+
+	_, apiErr := GeminiChatStreamHandler(c, info, resp)
+	require.Nil(t, apiErr)
+
+	type streamedCall struct {
+		ids       []string
+		names     []string
+		arguments strings.Builder
+	}
+	calls := make(map[int]*streamedCall)
+	var finishReasons []string
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk dto.ChatCompletionsStreamResponse
+		require.NoError(t, common.UnmarshalJsonStr(data, &chunk))
+		for _, choice := range chunk.Choices {
+			if choice.FinishReason != nil {
+				finishReasons = append(finishReasons, *choice.FinishReason)
+			}
+			for _, toolCall := range choice.Delta.ToolCalls {
+				require.NotNil(t, toolCall.Index)
+				call := calls[*toolCall.Index]
+				if call == nil {
+					call = &streamedCall{}
+					calls[*toolCall.Index] = call
+				}
+				if toolCall.ID != "" {
+					call.ids = append(call.ids, toolCall.ID)
+				}
+				if toolCall.Function.Name != "" {
+					call.names = append(call.names, toolCall.Function.Name)
+				}
+				call.arguments.WriteString(toolCall.Function.Arguments)
+			}
+		}
+	}
+
+	require.Len(t, calls, 2)
+	for index, expected := range []struct {
+		name      string
+		arguments string
+	}{
+		{name: "get_weather", arguments: `{"city":"Paris","unit":"celsius"}`},
+		{name: "get_time", arguments: `{"timezone":"Europe/Paris"}`},
+	} {
+		call := calls[index]
+		require.NotNil(t, call)
+		// id 和函数名只在该 tool call 的首个 delta 中出现一次
+		require.Len(t, call.ids, 1)
+		require.Equal(t, []string{expected.name}, call.names)
+		require.JSONEq(t, expected.arguments, call.arguments.String())
+	}
+	require.Equal(t, []string{"tool_calls"}, finishReasons)
+}
+
+// slowStreamBody returns each chunk in its own Read, waiting delay before every chunk but the first
+type slowStreamBody struct {
+	chunks []string
+	delay  time.Duration
+	sent   int
+}
+
+func (b *slowStreamBody) Read(p []byte) (int, error) {
+	if b.sent >= len(b.chunks) {
+		return 0, io.EOF
+	}
+	if b.sent > 0 {
+		time.Sleep(b.delay)
+	}
+	n := copy(p, b.chunks[b.sent])
+	b.sent++
+	return n, nil
+}
+
+func (b *slowStreamBody) Close() error { return nil }
+
+func TestGeminiChatStreamHandlerKeepsCreatedStableAcrossChunks(t *testing.T) {
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+	})
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{
+		IsStream:    true,
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{
+			UpstreamModelName: "gemini-2.5-flash",
+		},
+	}
+	// 分片之间跨过秒级边界，created 仍需保持一致
+	body := &slowStreamBody{delay: 1100 * time.Millisecond, chunks: []string{
+		"data: " + `{"candidates":[{"content":{"role":"model","parts":[{"text":"a"}]}}]}` + "\n\n",
+		"data: " + `{"candidates":[{"content":{"role":"model","parts":[{"text":"b"}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":1,"candidatesTokenCount":2,"totalTokenCount":3}}` + "\n\n",
+	}}
+
+	_, apiErr := GeminiChatStreamHandler(c, info, &http.Response{StatusCode: http.StatusOK, Body: body})
+	require.Nil(t, apiErr)
+
+	created := make(map[int64]bool)
+	chunks := 0
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk dto.ChatCompletionsStreamResponse
+		require.NoError(t, common.UnmarshalJsonStr(data, &chunk))
+		created[chunk.Created] = true
+		chunks++
+	}
+	require.Greater(t, chunks, 2)
+	require.Len(t, created, 1)
+}
+
+func TestCovertOpenAI2GeminiExplicitModalitiesOverrideDefaults(t *testing.T) {
+	t.Parallel()
+
+	convert := func(modelName string, modalities string) []string {
+		c, info := newGeminiConvertTestContext(modelName)
+		request := dto.GeneralOpenAIRequest{
+			Model:      modelName,
+			Messages:   []dto.Message{{Role: "user", Content: "hi"}},
+			Modalities: []byte(modalities),
+		}
+		geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+		require.NoError(t, err)
+		return geminiRequest.GenerationConfig.ResponseModalities
+	}
+
+	// 图片模型默认返回 TEXT+IMAGE，客户端只要文本时不再请求图片
+	require.Equal(t, []string{"TEXT"}, convert("gemini-2.5-flash-image", `["text"]`))
+	require.Equal(t, []string{"TEXT", "IMAGE"}, convert("gemini-2.5-flash-image", `["text","image"]`))
+	require.Equal(t, []string{"AUDIO"}, convert("gemini-2.5-flash-preview-tts", `["text","audio"]`))
+}
+
+func TestCovertOpenAI2GeminiMapsReasoningEffortToThinkingBudget(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldBudgets := settings.ReasoningEffortBudgets
+	settings.ReasoningEffortBudgets = map[string]int{"low": 1024, "medium": 8192, "high": 50000}
+	t.Cleanup(func() {
+		settings.ReasoningEffortBudgets = oldBudgets
+	})
+
+	convert := func(modelName string, effort string, extraBody string) *dto.GeminiThinkingConfig {
+		c, info := newGeminiConvertTestContext(modelName)
+		request := dto.GeneralOpenAIRequest{
+			Model:           modelName,
+			Messages:        []dto.Message{{Role: "user", Content: "hi"}},
+			ReasoningEffort: effort,
+		}
+		if extraBody != "" {
+			request.ExtraBody = []byte(extraBody)
+		}
+		geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+		require.NoError(t, err)
+		return geminiRequest.GenerationConfig.ThinkingConfig
+	}
+
+	require.Equal(t, 1024, *convert("gemini-2.5-flash", "low", "").ThinkingBudget)
+	require.True(t, convert("gemini-2.5-flash", "low", "").IncludeThoughts)
+	require.Equal(t, 8192, *convert("gemini-2.5-flash", "medium", "").ThinkingBudget)
+	// 超过模型上限时按模型范围截断
+	require.Equal(t, flash25MaxBudget, *convert("gemini-2.5-flash", "high", "").ThinkingBudget)
+	require.Equal(t, pro25MaxBudget, *convert("gemini-2.5-pro", "high", "").ThinkingBudget)
+	require.Nil(t, convert("gemini-2.5-flash", "", ""))
+	require.Nil(t, convert("gemini-2.5-flash", "unknown", ""))
+	// extra_body 中显式的 thinking_config 优先
+	require.Equal(t, 100, *convert("gemini-2.5-flash", "high", `{"google":{"thinking_config":{"thinking_budget":100}}}`).ThinkingBudget)
+}
+
+func TestGeminiMixedModalityResponseKeepsPartOrder(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash-image")
+	request := dto.GeneralOpenAIRequest{
+		Model:     "gemini-2.5-flash-image",
+		Messages:  []dto.Message{{Role: "user", Content: "draw and describe"}},
+		ExtraBody: []byte(`{"google":{"response_modalities":["text","IMAGE","audio"]}}`),
+	}
+	geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.Equal(t, []string{"TEXT", "IMAGE", "AUDIO"}, geminiRequest.GenerationConfig.ResponseModalities)
+
+	stop := "STOP"
+	candidate := dto.GeminiChatCandidate{
+		FinishReason: &stop,
+		Content: dto.GeminiChatContent{Role: "model", Parts: []dto.GeminiPart{
+			{Text: "Here is a cat:"},
+			{InlineData: &dto.GeminiInlineData{MimeType: "image/png", Data: "aW1n"}},
+			{Text: "and its sound"},
+			{Text: "(meow)"},
+			{InlineData: &dto.GeminiInlineData{MimeType: "audio/L16;codec=pcm;rate=24000", Data: "YXVk"}},
+		}},
+	}
+	message := responseGeminiChat2OpenAI(c, &dto.GeminiChatResponse{Candidates: []dto.GeminiChatCandidate{candidate}}).Choices[0].Message
+	blocks := message.ParseContent()
+	require.Len(t, blocks, 4)
+	require.Equal(t, "Here is a cat:", blocks[0].Text)
+	require.Equal(t, dto.ContentTypeImageURL, blocks[1].Type)
+	require.Equal(t, "data:image/png;base64,aW1n", blocks[1].GetImageMedia().Url)
+	require.Equal(t, "and its sound\n(meow)", blocks[2].Text)
+	require.Equal(t, dto.ContentTypeAudio, blocks[3].Type)
+	require.Equal(t, &dto.MessageInputAudio{Data: "YXVk", Format: "pcm16", SampleRate: 24000}, blocks[3].Audio)
+
+	segments := splitGeminiMixedModalityChunk(c, &dto.GeminiChatResponse{Candidates: []dto.GeminiChatCandidate{candidate}})
+	require.Len(t, segments, 2)
+	require.Len(t, segments[0].Candidates[0].Content.Parts, 4)
+	require.Nil(t, segments[0].Candidates[0].FinishReason)
+	require.Equal(t, "audio/L16;codec=pcm;rate=24000", segments[1].Candidates[0].Content.Parts[0].InlineData.MimeType)
+	require.Equal(t, &stop, segments[1].Candidates[0].FinishReason)
+
+	plain, _ := newGeminiConvertTestContext("gemini-2.5-flash-image")
+	require.Len(t, splitGeminiMixedModalityChunk(plain, &dto.GeminiChatResponse{Candidates: []dto.GeminiChatCandidate{candidate}}), 1)
+	require.True(t, responseGeminiChat2OpenAI(plain, &dto.GeminiChatResponse{Candidates: []dto.GeminiChatCandidate{candidate}}).Choices[0].Message.IsStringContent())
+}
+
+func TestConvertImageRequestChecksImagenPromptLength(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldTrim, oldMaxChars := settings.ImagenPromptTrimEnabled, settings.ImagenPromptMaxChars
+	t.Cleanup(func() {
+		settings.ImagenPromptTrimEnabled, settings.ImagenPromptMaxChars = oldTrim, oldMaxChars
+	})
+
+	// 默认不限制提示词长度
+	request := dto.ImageRequest{Model: "imagen-4.0-generate-001", Prompt: strings.Repeat("猫", 1921)}
+	c, info := newGeminiConvertTestContext("imagen-4.0-generate-001")
+	_, err := (&Adaptor{}).ConvertImageRequest(c, info, request)
+	require.NoError(t, err)
+
+	settings.ImagenPromptMaxChars = map[string]int{"imagen": 1920}
+	_, err = (&Adaptor{}).ConvertImageRequest(c, info, request)
+	var newAPIError *types.NewAPIError
+	require.ErrorAs(t, err, &newAPIError)
+	require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+	require.Contains(t, err.Error(), "1921")
+	require.Contains(t, err.Error(), "1920")
+
+	settings.ImagenPromptTrimEnabled = true
+	converted, err := (&Adaptor{}).ConvertImageRequest(c, info, request)
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("猫", 1920), converted.(dto.GeminiImageRequest).Instances[0].Prompt)
+	require.NotEmpty(t, c.Writer.Header().Get("Warning"))
+
+	request.Prompt = strings.Repeat("a", 1920)
+	converted, err = (&Adaptor{}).ConvertImageRequest(c, info, request)
+	require.NoError(t, err)
+	require.Equal(t, request.Prompt, converted.(dto.GeminiImageRequest).Instances[0].Prompt)
+}
+
+func TestImagenAspectRatioPicksClosestSupportedRatio(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"1024x1024": "1:1",
+		"512x512":   "1:1",
+		"1536x1024": "4:3",
+		"1024x1536": "3:4",
+		"1792x1024": "16:9",
+		"1024x1792": "9:16",
+		"2560X1080": "16:9",
+		"1100x1000": "1:1",
+		"3:2":       "4:3",
+		"16:9":      "16:9",
+		" 900x1600": "9:16",
+	}
+	for size, expected := range cases {
+		aspectRatio, ok := imagenAspectRatio(size)
+		require.True(t, ok, size)
+		require.Equal(t, expected, aspectRatio, size)
+	}
+	for _, size := range []string{"large", "1024", "1024x", "x1024", "0x1024", "-512x512", "axb", "NaNx1", "Infx1", "1:0"} {
+		_, ok := imagenAspectRatio(size)
+		require.False(t, ok, size)
+	}
+}
+
+func TestConvertImageRequestValidatesSizeAndCount(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("imagen-4.0-generate-001")
+	converted, err := (&Adaptor{}).ConvertImageRequest(c, info, dto.ImageRequest{Prompt: "cat", Size: "1536x1024", N: common.GetPointer(uint(4))})
+	require.NoError(t, err)
+	require.Equal(t, "4:3", converted.(dto.GeminiImageRequest).Parameters.AspectRatio)
+	require.Equal(t, 4, converted.(dto.GeminiImageRequest).Parameters.SampleCount)
+
+	var newAPIError *types.NewAPIError
+	_, err = (&Adaptor{}).ConvertImageRequest(c, info, dto.ImageRequest{Prompt: "cat", Size: "huge"})
+	require.ErrorAs(t, err, &newAPIError)
+	require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+
+	for _, n := range []*uint{nil, common.GetPointer(uint(0))} {
+		converted, err = (&Adaptor{}).ConvertImageRequest(c, info, dto.ImageRequest{Prompt: "cat", N: n})
+		require.NoError(t, err)
+		require.Equal(t, 1, converted.(dto.GeminiImageRequest).Parameters.SampleCount)
+		require.Equal(t, "allow_adult", converted.(dto.GeminiImageRequest).Parameters.PersonGeneration)
+	}
+
+	_, err = (&Adaptor{}).ConvertImageRequest(c, info, dto.ImageRequest{Prompt: "cat", N: common.GetPointer(uint(5))})
+	require.ErrorAs(t, err, &newAPIError)
+	require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+	require.Contains(t, newAPIError.Error(), "between 1 and 4")
+
+	ultraContext, ultraInfo := newGeminiConvertTestContext("imagen-4.0-ultra-generate-001")
+	_, err = (&Adaptor{}).ConvertImageRequest(ultraContext, ultraInfo, dto.ImageRequest{Prompt: "cat", N: common.GetPointer(uint(2))})
+	require.ErrorAs(t, err, &newAPIError)
+	require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+}
+
+func TestConvertImageRequestUsesChannelPersonGeneration(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("imagen-3.0-generate-002")
+	info.ChannelOtherSettings.GeminiImagenPersonGeneration = "dont_allow"
+	converted, err := (&Adaptor{}).ConvertImageRequest(c, info, dto.ImageRequest{Prompt: "cat"})
+	require.NoError(t, err)
+	require.Equal(t, "dont_allow", converted.(dto.GeminiImageRequest).Parameters.PersonGeneration)
+
+	info.ChannelOtherSettings.GeminiImagenPersonGeneration = "everyone"
+	converted, err = (&Adaptor{}).ConvertImageRequest(c, info, dto.ImageRequest{Prompt: "cat"})
+	require.NoError(t, err)
+	require.Equal(t, "allow_adult", converted.(dto.GeminiImageRequest).Parameters.PersonGeneration)
+}
+
+func TestGeminiOutputTrimming(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled := settings.OutputTrimEnabled
+	settings.OutputTrimEnabled = true
+	t.Cleanup(func() {
+		settings.OutputTrimEnabled = oldEnabled
+	})
+
+	c, _ := newGeminiConvertTestContext("gemini-2.5-flash")
+	stop := "STOP"
+	response := &dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{
+			{FinishReason: &stop, Content: dto.GeminiChatContent{Parts: []dto.GeminiPart{{Text: "\n  {\"a\":1}\n\n\n"}}}},
+		},
+	}
+	openAIResponse := responseGeminiChat2OpenAI(c, response)
+	require.Equal(t, `{"a":1}`, openAIResponse.Choices[0].Message.StringContent())
+
+	trimmer := newGeminiStreamTrimmer()
+	var output strings.Builder
+	for _, delta := range []string{"\n ", " hello", " world\n", "\n", "!\n\n"} {
+		output.WriteString(trimmer.trim(0, delta))
+	}
+	require.Equal(t, "hello world\n\n!", output.String())
+	require.Equal(t, "b", trimmer.trim(1, " b "))
+}
+
+func TestConvertOpenAIRequestUpgradesModelOnContextOverflow(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled := settings.ContextOverflowUpgradeEnabled
+	oldModels := settings.ContextOverflowUpgradeModels
+	settings.ContextOverflowUpgradeEnabled = true
+	settings.ContextOverflowUpgradeModels = map[string]string{
+		"gemma-overflow-small":  "gemma-overflow-medium",
+		"gemma-overflow-medium": "gemma-overflow-large",
+	}
+	servedModels := map[string]bool{"gemma-overflow-medium": true, "gemma-overflow-large": true}
+	oldServes := channelServesModel
+	channelServesModel = func(_ int, modelName string) bool {
+		return servedModels[modelName]
+	}
+	oldRatios := ratio_setting.ModelRatio2JSONString()
+	ratios := map[string]float64{}
+	require.NoError(t, common.UnmarshalJsonStr(oldRatios, &ratios))
+	ratios["gemma-overflow-small"] = 1
+	ratios["gemma-overflow-large"] = 4
+	ratiosJson, err := common.Marshal(ratios)
+	require.NoError(t, err)
+	require.NoError(t, ratio_setting.UpdateModelRatioByJSONString(string(ratiosJson)))
+	t.Cleanup(func() {
+		settings.ContextOverflowUpgradeEnabled = oldEnabled
+		settings.ContextOverflowUpgradeModels = oldModels
+		channelServesModel = oldServes
+		_ = ratio_setting.UpdateModelRatioByJSONString(oldRatios)
+	})
+	model_setting.SetGeminiLiveModelLimits("gemma-overflow-small", model_setting.GeminiModelLimits{ContextLength: 1000})
+	model_setting.SetGeminiLiveModelLimits("gemma-overflow-medium", model_setting.GeminiModelLimits{ContextLength: 4000})
+	model_setting.SetGeminiLiveModelLimits("gemma-overflow-large", model_setting.GeminiModelLimits{ContextLength: 100000})
+
+	request := &dto.GeneralOpenAIRequest{
+		Model:    "gemma-overflow-small",
+		Messages: []dto.Message{{Role: "user", Content: "hello"}},
+	}
+
+	c, info := newGeminiConvertTestContext("gemma-overflow-small")
+	info.SetEstimatePromptTokens(800)
+	_, err = (&Adaptor{}).ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+	require.Equal(t, "gemma-overflow-small", info.UpstreamModelName)
+	require.False(t, info.IsModelMapped)
+	require.Empty(t, common.GetContextKeyString(c, constant.ContextKeyGeminiContextOverflowFrom))
+
+	c, info = newGeminiConvertTestContext("gemma-overflow-small")
+	info.SetEstimatePromptTokens(5000)
+	info.PriceData.AddOtherRatio("audio_input", 2)
+	_, err = (&Adaptor{}).ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+	require.Equal(t, "gemma-overflow-large", info.UpstreamModelName)
+	require.True(t, info.IsModelMapped)
+	require.Equal(t, "gemma-overflow-small", common.GetContextKeyString(c, constant.ContextKeyGeminiContextOverflowFrom))
+	// 按升级后的模型计费
+	require.Equal(t, "gemma-overflow-small", info.OriginModelName)
+	require.Equal(t, 4.0, info.PriceData.ModelRatio)
+	require.Equal(t, 2.0, info.PriceData.OtherRatios["audio_input"])
+
+	// 渠道不提供的模型不会被使用，链路停在上一个模型
+	servedModels["gemma-overflow-large"] = false
+	c, info = newGeminiConvertTestContext("gemma-overflow-small")
+	info.SetEstimatePromptTokens(5000)
+	info.PriceData.ModelRatio = 1
+	_, err = (&Adaptor{}).ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+	// gemma-overflow-medium 没有配置价格，保留原模型
+	require.Equal(t, "gemma-overflow-small", info.UpstreamModelName)
+	require.False(t, info.IsModelMapped)
+	require.Equal(t, 1.0, info.PriceData.ModelRatio)
+	require.Empty(t, common.GetContextKeyString(c, constant.ContextKeyGeminiContextOverflowFrom))
+	servedModels["gemma-overflow-large"] = true
+
+	settings.ContextOverflowUpgradeEnabled = false
+	c, info = newGeminiConvertTestContext("gemma-overflow-small")
+	info.SetEstimatePromptTokens(5000)
+	_, err = (&Adaptor{}).ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+	require.Equal(t, "gemma-overflow-small", info.UpstreamModelName)
+}
+
+func TestGeminiEmbeddingHandlerTruncatesThenNormalizes(t *testing.T) {
+	t.Parallel()
+
+	_, info := newGeminiConvertTestContext("gemini-embedding-001")
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/embeddings", nil)
+	common.SetContextKey(c, constant.ContextKeyGeminiEmbeddingDimensions, 2)
+
+	body, err := common.Marshal(dto.GeminiBatchEmbeddingResponse{
+		Embeddings: []*dto.ContentEmbedding{{Values: []float64{3, 4, 12}}},
+	})
+	require.NoError(t, err)
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(body))}
+
+	_, newAPIError := GeminiEmbeddingHandler(c, info, resp)
+	require.Nil(t, newAPIError)
+
+	var openAIResponse dto.OpenAIEmbeddingResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &openAIResponse))
+	require.Len(t, openAIResponse.Data, 1)
+	require.InDeltaSlice(t, []float64{0.6, 0.8}, openAIResponse.Data[0].Embedding, 1e-9)
+
+	require.Equal(t, []float64{0, 0}, truncateAndNormalizeEmbedding([]float64{0, 0, 0}, 2))
+}
+
+func TestConvertOpenAIRequestUsesAllowedRegionBaseUrl(t *testing.T) {
+	t.Parallel()
+
+	request := &dto.GeneralOpenAIRequest{
+		Model:    "gemini-2.5-flash",
+		Messages: []dto.Message{{Role: "user", Content: "hello"}},
+	}
+	newContext := func(region string) (*gin.Context, *relaycommon.RelayInfo) {
+		c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+		c.Request.Header.Set("X-Gemini-Region", region)
+		info.ChannelBaseUrl = "https://generativelanguage.googleapis.com"
+		info.ChannelOtherSettings.GeminiRegionBaseUrls = map[string]string{
+			"eu": "https://europe-west4-aiplatform.example.com/",
+		}
+		return c, info
+	}
+
+	c, info := newContext("EU")
+	_, err := (&Adaptor{}).ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+	requestURL, err := (&Adaptor{}).GetRequestURL(info)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(requestURL, "https://europe-west4-aiplatform.example.com/v1beta/models/gemini-2.5-flash:"), requestURL)
+
+	c, info = newContext("https://europe-west4-aiplatform.example.com")
+	_, err = (&Adaptor{}).ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+	require.Equal(t, "https://europe-west4-aiplatform.example.com", info.ChannelBaseUrl)
+
+	c, info = newContext("https://attacker.example.com")
+	_, err = (&Adaptor{}).ConvertOpenAIRequest(c, info, request)
+	var newAPIError *types.NewAPIError
+	require.ErrorAs(t, err, &newAPIError)
+	require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+	require.Equal(t, "https://generativelanguage.googleapis.com", info.ChannelBaseUrl)
+}
+
+func TestSetupRequestHeaderUsesProviderKeyWithPermission(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	info.ApiKey = "channel-key"
+	c.Request.Header.Set("X-Provider-Api-Key", "client-key")
+
+	header := http.Header{}
+	require.NoError(t, (&Adaptor{}).SetupRequestHeader(c, &header, info))
+	require.Equal(t, "channel-key", header.Get("x-goog-api-key"))
+	require.False(t, common.GetContextKeyBool(c, constant.ContextKeyProviderKeyUsed))
+
+	common.SetContextKey(c, constant.ContextKeyTokenProviderKey, true)
+	require.NoError(t, (&Adaptor{}).SetupRequestHeader(c, &header, info))
+	require.Equal(t, "client-key", header.Get("x-goog-api-key"))
+	require.Empty(t, header.Get("X-Provider-Api-Key"))
+	require.False(t, common.GetContextKeyBool(c, constant.ContextKeyProviderKeyUsed))
+
+	// 只有实际发往上游的请求携带了客户 key 才免除计费，header override 替换后仍按渠道计费
+	sent := &http.Response{Request: &http.Request{Header: header}}
+	markProviderKeyUsed(c, sent)
+	require.True(t, common.GetContextKeyBool(c, constant.ContextKeyProviderKeyUsed))
+	sent.Request.Header = http.Header{"X-Goog-Api-Key": []string{"channel-key"}}
+	markProviderKeyUsed(c, sent)
+	require.False(t, common.GetContextKeyBool(c, constant.ContextKeyProviderKeyUsed))
+	markProviderKeyUsed(c, nil)
+	require.False(t, common.GetContextKeyBool(c, constant.ContextKeyProviderKeyUsed))
+}
+
+func TestCovertOpenAI2GeminiRejectsCorruptMedia(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))))
+	pngData := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	cases := map[string]string{
+		"valid":         pngData,
+		"truncated":     pngData[:len(pngData)-3],
+		"wrong header":  base64.StdEncoding.EncodeToString([]byte("not a png image")),
+		"invalid chars": "!!!!",
+	}
+	for name, data := range cases {
+		c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+		request := dto.GeneralOpenAIRequest{
+			Model: "gemini-2.5-flash",
+			Messages: []dto.Message{{
+				Role: "user",
+				Content: []any{
+					map[string]any{"type": "image_url", "image_url": map[string]any{"url": "data:image/png;base64," + data}},
+				},
+			}},
+		}
+		_, err := CovertOpenAI2Gemini(c, request, info)
+		if name == "valid" {
+			require.NoError(t, err, name)
+			continue
+		}
+		require.Error(t, err, name)
+		var apiErr *types.NewAPIError
+		require.ErrorAs(t, err, &apiErr, name)
+		require.Equal(t, http.StatusBadRequest, apiErr.StatusCode, name)
+		require.Contains(t, err.Error(), "Corrupt media data", name)
+	}
+}
+
+func TestGeminiStreamCoalescerMergesChunksWithinWindow(t *testing.T) {
+	t.Parallel()
+
+	textChunk := func(text string) *dto.ChatCompletionsStreamResponse {
+		chunk := &dto.ChatCompletionsStreamResponse{Choices: []dto.ChatCompletionsStreamResponseChoice{{Index: 0}}}
+		chunk.Choices[0].Delta.SetContentString(text)
+		return chunk
+	}
+	coalescer := &geminiStreamCoalescer{window: 20 * time.Millisecond}
+	start := time.Now()
+
+	var sent []*dto.ChatCompletionsStreamResponse
+	sent = append(sent, coalescer.add(textChunk("a"), start)...)
+	require.Len(t, sent, 1, "first chunk of a window is sent immediately")
+	sent = append(sent, coalescer.add(textChunk("b"), start.Add(5*time.Millisecond))...)
+	sent = append(sent, coalescer.add(textChunk("c"), start.Add(10*time.Millisecond))...)
+	require.Len(t, sent, 1)
+	sent = append(sent, coalescer.add(textChunk("d"), start.Add(25*time.Millisecond))...)
+	require.Len(t, sent, 2)
+	require.Equal(t, "bcd", sent[1].Choices[0].Delta.GetContentString())
+
+	sent = append(sent, coalescer.add(textChunk("e"), start.Add(30*time.Millisecond))...)
+	stop := textChunk("f")
+	finishReason := "stop"
+	stop.Choices[0].FinishReason = &finishReason
+	sent = append(sent, coalescer.add(stop, start.Add(31*time.Millisecond))...)
+	require.Len(t, sent, 4)
+	require.Equal(t, "e", sent[2].Choices[0].Delta.GetContentString())
+	require.Same(t, stop, sent[3])
+	require.Empty(t, coalescer.flush())
+
+	var content strings.Builder
+	for _, chunk := range sent {
+		content.WriteString(chunk.Choices[0].Delta.GetContentString())
+	}
+	require.Equal(t, "abcdef", content.String())
+}
+
+func TestGeminiChatStreamHandlerReportsSchemaMismatch(t *testing.T) {
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+	})
+
+	schema := translateJSONSchema(map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"name": map[string]interface{}{"type": "string"}, "age": map[string]interface{}{"type": "integer"}},
+		"required":   []interface{}{"name", "age"},
+	})
+	run := func(output string) string {
+		gin.SetMode(gin.TestMode)
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		common.SetContextKey(c, constant.ContextKeyGeminiStreamResponseSchema, schema)
+		info := &relaycommon.RelayInfo{
+			IsStream:    true,
+			RelayFormat: types.RelayFormatOpenAI,
+			ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "gemini-2.5-flash"},
+		}
+		chunk, err := common.Marshal(dto.GeminiChatResponse{Candidates: []dto.GeminiChatCandidate{{
+			Content: dto.GeminiChatContent{Role: "model", Parts: []dto.GeminiPart{{Text: output}}},
+		}}})
+		require.NoError(t, err)
+		resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("data: " + string(chunk) + "\n\n"))}
+		_, apiErr := GeminiChatStreamHandler(c, info, resp)
+		require.Nil(t, apiErr)
+		return recorder.Body.String()
+	}
+
+	require.NotContains(t, run(`{"name":"a","age":3}`), `"error"`)
+	body := run(`{"name":"a","age":3.5}`)
+	require.Contains(t, body, `"error"`)
+	require.Contains(t, body, "$.age: expected integer")
+	require.Contains(t, run(`{"name":"a"`), "invalid JSON")
+}
+
+func TestValidateJSONSchemaValue(t *testing.T) {
+	t.Parallel()
+
+	schema := translateJSONSchema(map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"status": map[string]interface{}{"enum": []interface{}{"ok", "fail"}, "type": "string"},
+			"tags":   map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			"note":   map[string]interface{}{"anyOf": []interface{}{map[string]interface{}{"type": "string"}, map[string]interface{}{"type": "null"}}},
+		},
+		"required": []interface{}{"status"},
+	})
+	decode := func(raw string) interface{} {
+		var value interface{}
+		require.NoError(t, common.UnmarshalJsonStr(raw, &value))
+		return value
+	}
+
+	require.NoError(t, validateJSONSchemaValue(schema, decode(`{"status":"ok","tags":["a"],"note":null}`), "$"))
+	require.EqualError(t, validateJSONSchemaValue(schema, decode(`{"tags":[]}`), "$"), `$: missing required property "status"`)
+	require.EqualError(t, validateJSONSchemaValue(schema, decode(`{"status":"maybe"}`), "$"), "$.status: value is not one of the allowed enum values")
+	require.EqualError(t, validateJSONSchemaValue(schema, decode(`{"status":"ok","tags":[1]}`), "$"), "$.tags[0]: expected string")
+	require.EqualError(t, validateJSONSchemaValue(schema, decode(`[]`), "$"), "$: expected object")
+}
+
+func TestTranslateJSONSchemaMapsNullableAndTypeUnions(t *testing.T) {
+	t.Parallel()
+
+	schema := translateJSONSchema(map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"nickname": map[string]interface{}{"type": []interface{}{"string", "null"}, "maxLength": 10},
+			"status":   map[string]interface{}{"type": []interface{}{"string", "null"}, "enum": []interface{}{"ok", "fail", nil}},
+			"value": map[string]interface{}{
+				"type":        []interface{}{"string", "array", "null"},
+				"description": "a value or a list",
+				"items":       map[string]interface{}{"type": "integer"},
+				"minLength":   1,
+			},
+			"missing": map[string]interface{}{"anyOf": []interface{}{map[string]interface{}{"type": "null"}}},
+		},
+	}).(map[string]interface{})
+	props := schema["properties"].(map[string]interface{})
+
+	require.Equal(t, map[string]interface{}{"type": "STRING", "nullable": true, "maxLength": 10}, props["nickname"])
+	require.Equal(t, map[string]interface{}{"type": "STRING", "nullable": true, "enum": []interface{}{"ok", "fail"}}, props["status"])
+	require.Equal(t, map[string]interface{}{
+		"description": "a value or a list",
+		"nullable":    true,
+		"anyOf": []interface{}{
+			map[string]interface{}{"type": "STRING", "minLength": 1},
+			map[string]interface{}{"type": "ARRAY", "items": map[string]interface{}{"type": "INTEGER"}},
+		},
+	}, props["value"])
+	require.Equal(t, map[string]interface{}{"nullable": true}, props["missing"])
+
+	decode := func(raw string) interface{} {
+		var value interface{}
+		require.NoError(t, common.UnmarshalJsonStr(raw, &value))
+		return value
+	}
+	require.NoError(t, validateJSONSchemaValue(schema, decode(`{"nickname":null,"status":null,"value":[1,2]}`), "$"))
+	require.NoError(t, validateJSONSchemaValue(schema, decode(`{"value":"x"}`), "$"))
+	require.EqualError(t, validateJSONSchemaValue(schema, decode(`{"value":3}`), "$"), "$.value: does not match any of the allowed schemas")
+}
+
+func TestCovertOpenAI2GeminiPcmInputAudioCarriesSampleRate(t *testing.T) {
+	t.Parallel()
+
+	pcm := base64.StdEncoding.EncodeToString(make([]byte, 64))
+	wav := base64.StdEncoding.EncodeToString(append([]byte("RIFF\x24\x00\x00\x00WAVEfmt "), make([]byte, 32)...))
+	cases := []struct {
+		audio    map[string]any
+		mimeType string
+	}{
+		{map[string]any{"data": pcm, "format": "pcm", "sample_rate": 24000}, "audio/pcm;rate=24000"},
+		{map[string]any{"data": pcm, "format": "pcm16"}, "audio/pcm;rate=16000"},
+		{map[string]any{"data": pcm, "format": "pcm;rate=8000"}, "audio/pcm;rate=8000"},
+		{map[string]any{"data": wav, "format": "pcm"}, "audio/wav"},
+		{map[string]any{"data": wav, "format": "wav"}, "audio/wav"},
+	}
+	for _, tc := range cases {
+		c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+		raw, err := common.Marshal(map[string]any{
+			"model": "gemini-2.5-flash",
+			"messages": []any{map[string]any{
+				"role":    "user",
+				"content": []any{map[string]any{"type": "input_audio", "input_audio": tc.audio}},
+			}},
+		})
+		require.NoError(t, err)
+		var request dto.GeneralOpenAIRequest
+		require.NoError(t, common.Unmarshal(raw, &request))
+
+		geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+		require.NoError(t, err, tc.audio["format"])
+		require.Equal(t, tc.mimeType, geminiRequest.Contents[0].Parts[0].InlineData.MimeType)
+	}
+}
+
+func TestCovertOpenAI2GeminiAcceptsAssistantAudioBlocks(t *testing.T) {
+	t.Parallel()
+
+	pcm := base64.StdEncoding.EncodeToString(make([]byte, 64))
+	// 混合模态响应的内容块原样回传到历史中
+	blocks := buildGeminiMixedModalityContent([]dto.GeminiPart{
+		{Text: "listen"},
+		{InlineData: &dto.GeminiInlineData{MimeType: "audio/L16;codec=pcm;rate=24000", Data: pcm}},
+	})
+	raw, err := common.Marshal(map[string]any{
+		"model": "gemini-2.5-flash",
+		"messages": []any{
+			map[string]any{"role": "user", "content": "say hi"},
+			map[string]any{"role": "assistant", "content": blocks},
+			map[string]any{"role": "user", "content": "again"},
+		},
+	})
+	require.NoError(t, err)
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.Unmarshal(raw, &request))
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.Len(t, geminiRequest.Contents, 3)
+	parts := geminiRequest.Contents[1].Parts
+	require.Equal(t, "model", geminiRequest.Contents[1].Role)
+	require.Len(t, parts, 2)
+	require.Equal(t, "listen", parts[0].Text)
+	require.Equal(t, &dto.GeminiInlineData{MimeType: "audio/pcm;rate=24000", Data: pcm}, parts[1].InlineData)
+}
+
+func TestConvertEmbeddingRequestAppliesPerItemTaskTypes(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-embedding-001")
+	adaptor := &Adaptor{}
+	converted, err := adaptor.ConvertEmbeddingRequest(c, info, dto.EmbeddingRequest{
+		Input:    []any{"query", "doc one", "doc two"},
+		TaskType: json.RawMessage(`["retrieval_query","RETRIEVAL_DOCUMENT","RETRIEVAL_DOCUMENT"]`),
+	})
+	require.NoError(t, err)
+	requests := converted.(map[string]interface{})["requests"].([]map[string]interface{})
+	require.Equal(t, "RETRIEVAL_QUERY", requests[0]["taskType"])
+	require.Equal(t, "RETRIEVAL_DOCUMENT", requests[1]["taskType"])
+	require.Equal(t, "RETRIEVAL_DOCUMENT", requests[2]["taskType"])
+
+	converted, err = adaptor.ConvertEmbeddingRequest(c, info, dto.EmbeddingRequest{
+		Input:    []any{"a", "b"},
+		TaskType: json.RawMessage(`"SEMANTIC_SIMILARITY"`),
+	})
+	require.NoError(t, err)
+	for _, request := range converted.(map[string]interface{})["requests"].([]map[string]interface{}) {
+		require.Equal(t, "SEMANTIC_SIMILARITY", request["taskType"])
+	}
+
+	_, err = adaptor.ConvertEmbeddingRequest(c, info, dto.EmbeddingRequest{
+		Input:    []any{"a", "b"},
+		TaskType: json.RawMessage(`["RETRIEVAL_QUERY"]`),
+	})
+	var newAPIError *types.NewAPIError
+	require.ErrorAs(t, err, &newAPIError)
+	require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+}
+
+func TestConvertEmbeddingRequestValidatesTaskTypeAndTitle(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-embedding-001")
+	adaptor := &Adaptor{}
+	converted, err := adaptor.ConvertEmbeddingRequest(c, info, dto.EmbeddingRequest{
+		Input:    "Paris is the capital of France.",
+		TaskType: json.RawMessage(`"retrieval_document"`),
+		Title:    json.RawMessage(`"France"`),
+	})
+	require.NoError(t, err)
+	request := converted.(map[string]interface{})
+	require.Equal(t, "RETRIEVAL_DOCUMENT", request["taskType"])
+	require.Equal(t, "France", request["title"])
+
+	converted, err = adaptor.ConvertEmbeddingRequest(c, info, dto.EmbeddingRequest{
+		Input:    []any{"capital of france", "Paris is the capital of France."},
+		TaskType: json.RawMessage(`["RETRIEVAL_QUERY","RETRIEVAL_DOCUMENT"]`),
+		Title:    json.RawMessage(`["","France"]`),
+	})
+	require.NoError(t, err)
+	requests := converted.(map[string]interface{})["requests"].([]map[string]interface{})
+	require.NotContains(t, requests[0], "title")
+	require.Equal(t, "France", requests[1]["title"])
+
+	for _, tc := range []struct {
+		name    string
+		request dto.EmbeddingRequest
+		message string
+	}{
+		{
+			name:    "unknown task type",
+			request: dto.EmbeddingRequest{Input: "a", TaskType: json.RawMessage(`"RETRIEVAL"`)},
+			message: "task_type RETRIEVAL is not supported",
+		},
+		{
+			name:    "title without task type",
+			request: dto.EmbeddingRequest{Input: "a", Title: json.RawMessage(`"France"`)},
+			message: "title is only allowed for inputs with task_type RETRIEVAL_DOCUMENT",
+		},
+		{
+			name:    "title on query",
+			request: dto.EmbeddingRequest{Input: []any{"a", "b"}, TaskType: json.RawMessage(`["RETRIEVAL_QUERY","RETRIEVAL_DOCUMENT"]`), Title: json.RawMessage(`"France"`)},
+			message: "title is only allowed for inputs with task_type RETRIEVAL_DOCUMENT",
+		},
+		{
+			name:    "title count mismatch",
+			request: dto.EmbeddingRequest{Input: []any{"a", "b"}, TaskType: json.RawMessage(`"RETRIEVAL_DOCUMENT"`), Title: json.RawMessage(`["France"]`)},
+			message: "title must be a string or an array with one title per input (2 inputs, got 1)",
+		},
+	} {
+		_, err := adaptor.ConvertEmbeddingRequest(c, info, tc.request)
+		var newAPIError *types.NewAPIError
+		require.ErrorAs(t, err, &newAPIError, tc.name)
+		require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode, tc.name)
+		require.Contains(t, newAPIError.Error(), tc.message, tc.name)
+	}
+}
+
+func TestCovertOpenAI2GeminiMapsTopLogprobsCount(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name        string
+		logprobs    *bool
+		topLogprobs *int
+		expected    *int32
+	}{
+		{name: "top 5", logprobs: common.GetPointer(true), topLogprobs: common.GetPointer(5), expected: common.GetPointer(int32(5))},
+		{name: "clamped", logprobs: common.GetPointer(true), topLogprobs: common.GetPointer(50), expected: common.GetPointer(int32(geminiMaxTopLogprobs))},
+		{name: "implied by top_logprobs", topLogprobs: common.GetPointer(3), expected: common.GetPointer(int32(3))},
+		{name: "logprobs only", logprobs: common.GetPointer(true)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+			geminiRequest, err := CovertOpenAI2Gemini(c, dto.GeneralOpenAIRequest{
+				Model:       "gemini-2.5-flash",
+				Messages:    []dto.Message{{Role: "user", Content: "hi"}},
+				LogProbs:    tc.logprobs,
+				TopLogProbs: tc.topLogprobs,
+			}, info)
+			require.NoError(t, err)
+			require.Equal(t, common.GetPointer(true), geminiRequest.GenerationConfig.ResponseLogprobs)
+			require.Equal(t, tc.expected, geminiRequest.GenerationConfig.Logprobs)
+		})
+	}
+
+	c, _ := newGeminiConvertTestContext("gemini-2.5-flash")
+	response := responseGeminiChat2OpenAI(c, &dto.GeminiChatResponse{Candidates: []dto.GeminiChatCandidate{{
+		Content: dto.GeminiChatContent{Parts: []dto.GeminiPart{{Text: "hi"}}},
+		LogprobsResult: &dto.GeminiLogprobsResult{
+			ChosenCandidates: []dto.GeminiLogprobsCandidate{{Token: "hi", LogProbability: -0.1}},
+			TopCandidates: []dto.GeminiTopLogprobsCandidates{{Candidates: []dto.GeminiLogprobsCandidate{
+				{Token: "hi", LogProbability: -0.1},
+				{Token: "hey", LogProbability: -2.5},
+			}}},
+		},
+	}}})
+	logprobs := response.Choices[0].Logprobs
+	require.NotNil(t, logprobs)
+	require.Len(t, logprobs.Content, 1)
+	require.Len(t, logprobs.Content[0].TopLogprobs, 2)
+	require.Equal(t, "hey", logprobs.Content[0].TopLogprobs[1].Token)
+}
+
+func TestGeminiChatHandlersRoundTripCapturedLogprobs(t *testing.T) {
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+	})
+
+	newContext := func(stream bool) (*gin.Context, *httptest.ResponseRecorder, *relaycommon.RelayInfo) {
+		gin.SetMode(gin.TestMode)
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		return c, recorder, &relaycommon.RelayInfo{
+			IsStream:    stream,
+			RelayFormat: types.RelayFormatOpenAI,
+			ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "gemini-2.5-flash"},
+		}
+	}
+	// 上游抓包：responseLogprobs=true, logprobs=2
+	chunks := []string{
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"Yes"}]},"index":0,"logprobsResult":{"topCandidates":[{"candidates":[{"token":"Yes","logProbability":-0.0123},{"token":"No","logProbability":-4.41}]}],"chosenCandidates":[{"token":"Yes","logProbability":-0.0123}]}}]}`,
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"."}]},"finishReason":"STOP","index":0,"logprobsResult":{"topCandidates":[{"candidates":[{"token":".","logProbability":-0.2},{"token":"!","logProbability":-1.7}]}],"chosenCandidates":[{"token":".","logProbability":-0.2}]}}],"usageMetadata":{"promptTokenCount":7,"candidatesTokenCount":2,"totalTokenCount":9}}`,
+	}
+
+	c, recorder, info := newContext(false)
+	_, apiErr := GeminiChatHandler(c, info, &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(chunks[0]))})
+	require.Nil(t, apiErr)
+	var response dto.OpenAITextResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &response))
+	require.NotNil(t, response.Choices[0].Logprobs)
+	require.Equal(t, []dto.OpenAILogprobsContent{{
+		Token:   "Yes",
+		Logprob: -0.0123,
+		Bytes:   []int{'Y', 'e', 's'},
+		TopLogprobs: []dto.OpenAITopLogprobs{
+			{Token: "Yes", Logprob: -0.0123, Bytes: []int{'Y', 'e', 's'}},
+			{Token: "No", Logprob: -4.41, Bytes: []int{'N', 'o'}},
+		},
+	}}, response.Choices[0].Logprobs.Content)
+
+	c, recorder, info = newContext(true)
+	body := "data: " + chunks[0] + "\r\n\r\n" + "data: " + chunks[1] + "\r\n\r\n"
+	_, apiErr = GeminiChatStreamHandler(c, info, &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))})
+	require.Nil(t, apiErr)
+	var tokens []string
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Logprobs *dto.OpenAILogprobs `json:"logprobs"`
+			} `json:"choices"`
+		}
+		require.NoError(t, common.UnmarshalJsonStr(data, &chunk))
+		for _, choice := range chunk.Choices {
+			if choice.Logprobs == nil {
+				continue
+			}
+			for _, content := range choice.Logprobs.Content {
+				require.Len(t, content.TopLogprobs, 2)
+				tokens = append(tokens, content.Token)
+			}
+		}
+	}
+	// 每个分片携带各自的 logprobs
+	require.Equal(t, []string{"Yes", "."}, tokens)
+}
+
+func TestCovertOpenAI2GeminiAcceptsSafetyIdentifier(t *testing.T) {
+	t.Parallel()
+
+	request := dto.GeneralOpenAIRequest{
+		Model:            "gemini-2.5-flash",
+		Messages:         []dto.Message{{Role: "user", Content: "hi"}},
+		User:             json.RawMessage(`"legacy-user"`),
+		SafetyIdentifier: json.RawMessage(`"User@Example.com"`),
+	}
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.Nil(t, geminiRequest.Labels)
+	require.Equal(t, "User@Example.com", common.GetContextKeyString(c, constant.ContextKeySafetyIdentifier))
+
+	c, info = newGeminiConvertTestContext("gemini-2.5-flash")
+	info.ChannelType = constant.ChannelTypeVertexAi
+	info.ChannelOtherSettings.AllowSafetyIdentifier = true
+	geminiRequest, err = CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"safety_identifier": "user_example_com"}, geminiRequest.Labels)
+
+	request.SafetyIdentifier = nil
+	c, info = newGeminiConvertTestContext("gemini-2.5-flash")
+	_, err = CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.Equal(t, "legacy-user", common.GetContextKeyString(c, constant.ContextKeySafetyIdentifier))
+}
+
+func TestGeminiRerankRoundTripOrdersDocumentsByScore(t *testing.T) {
+	t.Parallel()
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/rerank", nil)
+	info := &relaycommon.RelayInfo{
+		RelayMode:       relayconstant.RelayModeRerank,
+		OriginModelName: "gemini-2.5-flash",
+		ChannelMeta: &relaycommon.ChannelMeta{
+			ChannelBaseUrl:    "https://generativelanguage.googleapis.com",
+			UpstreamModelName: "gemini-2.5-flash",
+		},
+	}
+	request := dto.RerankRequest{
+		Model:           "gemini-2.5-flash",
+		Query:           "capital of france",
+		Documents:       []any{"Berlin is in Germany", "Paris is the capital of France", map[string]any{"text": "France borders Spain"}},
+		TopN:            common.GetPointer(2),
+		ReturnDocuments: common.GetPointer(true),
+	}
+
+	adaptor := &Adaptor{}
+	url, err := adaptor.GetRequestURL(info)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(url, "/models/gemini-2.5-flash:generateContent"))
+	converted, err := adaptor.ConvertRerankRequest(c, relayconstant.RelayModeRerank, request)
+	require.NoError(t, err)
+	geminiRequest := converted.(*dto.GeminiChatRequest)
+	require.Equal(t, "application/json", geminiRequest.GenerationConfig.ResponseMimeType)
+	require.NotNil(t, geminiRequest.GenerationConfig.ResponseSchema)
+	prompt := geminiRequest.Contents[0].Parts[0].Text
+	require.Contains(t, prompt, "[1] Paris is the capital of France")
+	require.Contains(t, prompt, "[2] France borders Spain")
+
+	body, err := common.Marshal(dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{{
+			Content: dto.GeminiChatContent{Role: "model", Parts: []dto.GeminiPart{
+				{Text: `[{"index":0,"relevance_score":0.05},{"index":1,"relevance_score":0.97},{"index":2,"relevance_score":1.4}]`},
+			}},
+		}},
+		UsageMetadata: dto.GeminiUsageMetadata{PromptTokenCount: 80, CandidatesTokenCount: 30, TotalTokenCount: 110},
+	})
+	require.NoError(t, err)
+	usage, newAPIError := adaptor.DoResponse(c, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(body))}, info)
+	require.Nil(t, newAPIError)
+	require.Equal(t, 110, usage.(*dto.Usage).TotalTokens)
+
+	var response dto.RerankResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Len(t, response.Results, 2)
+	require.Equal(t, 2, response.Results[0].Index)
+	require.Equal(t, 1.0, response.Results[0].RelevanceScore)
+	require.Equal(t, 1, response.Results[1].Index)
+	require.Equal(t, 0.97, response.Results[1].RelevanceScore)
+	require.Equal(t, map[string]any{"text": "Paris is the capital of France"}, response.Results[1].Document)
+
+	request.TopN = common.GetPointer(4)
+	_, err = adaptor.ConvertRerankRequest(c, relayconstant.RelayModeRerank, request)
+	var apiErr *types.NewAPIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+}
+
+func TestGeminiCountTokensRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions/count_tokens", nil)
+	info := &relaycommon.RelayInfo{
+		RelayMode:       relayconstant.RelayModeChatCompletionsCountTokens,
+		OriginModelName: "gemini-2.5-flash",
+		IsStream:        true,
+		ChannelMeta: &relaycommon.ChannelMeta{
+			ChannelBaseUrl:    "https://generativelanguage.googleapis.com",
+			UpstreamModelName: "gemini-2.5-flash",
+		},
+	}
+	request := &dto.GeneralOpenAIRequest{
+		Model:  "gemini-2.5-flash",
+		Stream: common.GetPointer(true),
+		Messages: []dto.Message{
+			{Role: "system", Content: "be brief"},
+			{Role: "user", Content: "describe the image"},
+		},
+	}
+
+	adaptor := &Adaptor{}
+	converted, err := adaptor.ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+	require.False(t, info.IsStream)
+	data, err := common.Marshal(converted)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"generateContentRequest":{"model":"models/gemini-2.5-flash","contents":[`)
+	require.Contains(t, string(data), `"systemInstruction":{`)
+
+	url, err := adaptor.GetRequestURL(info)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(url, "/models/gemini-2.5-flash:countTokens"))
+
+	body := `{"totalTokens":300,"cachedContentTokenCount":20,"promptTokensDetails":[{"modality":"TEXT","tokenCount":42},{"modality":"IMAGE","tokenCount":258}]}`
+	usage, newAPIError := adaptor.DoResponse(c, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}, info)
+	require.Nil(t, newAPIError)
+	require.Zero(t, usage.(*dto.Usage).TotalTokens)
+
+	var response dto.CountTokensResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Equal(t, 300, response.TotalTokens)
+	require.Equal(t, 20, response.CachedTokens)
+	require.Equal(t, map[string]int{"text": 42, "image": 258}, response.PromptTokensDetails)
+}
+
+func TestCovertOpenAI2GeminiFilePartsAndUnknownContentTypes(t *testing.T) {
+	t.Parallel()
+
+	convert := func(content []any) (*dto.GeminiChatRequest, error) {
+		c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+		raw, err := common.Marshal(map[string]any{
+			"model":    "gemini-2.5-flash",
+			"messages": []any{map[string]any{"role": "user", "content": content}},
+		})
+		require.NoError(t, err)
+		var request dto.GeneralOpenAIRequest
+		require.NoError(t, common.Unmarshal(raw, &request))
+		return CovertOpenAI2Gemini(c, request, info)
+	}
+
+	pdf := base64.StdEncoding.EncodeToString([]byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n1 0 obj\n<<>>\nendobj\n"))
+	geminiRequest, err := convert([]any{
+		map[string]any{"type": "text", "text": "summarize"},
+		map[string]any{"type": "file", "file": map[string]any{"filename": "a.pdf", "file_data": "data:application/pdf;base64," + pdf}},
+	})
+	require.NoError(t, err)
+	require.Len(t, geminiRequest.Contents[0].Parts, 2)
+	require.Equal(t, "application/pdf", geminiRequest.Contents[0].Parts[1].InlineData.MimeType)
+	require.Equal(t, pdf, geminiRequest.Contents[0].Parts[1].InlineData.Data)
+
+	_, err = convert([]any{
+		map[string]any{"type": "text", "text": "hi"},
+		map[string]any{"type": "input_video", "input_video": map[string]any{"data": "AAAA"}},
+	})
+	var apiErr *types.NewAPIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	require.Contains(t, err.Error(), "input_video")
+
+	_, err = convert([]any{map[string]any{"type": "file", "file": map[string]any{"file_id": "file-abc"}}})
+	require.ErrorAs(t, err, &apiErr)
+	require.Contains(t, err.Error(), "file_id")
+}
+
+func TestGeminiEmbeddingUsesEmbedContentForSingleInputAndBatchOtherwise(t *testing.T) {
+	t.Parallel()
+
+	adaptor := &Adaptor{}
+	embed := func(input any, responseBody string) (string, any, dto.OpenAIEmbeddingResponse) {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/embeddings", nil)
+		info := &relaycommon.RelayInfo{
+			OriginModelName: "gemini-embedding-001",
+			ChannelMeta:     &relaycommon.ChannelMeta{ChannelBaseUrl: "https://generativelanguage.googleapis.com", UpstreamModelName: "gemini-embedding-001"},
+		}
+		converted, err := adaptor.ConvertEmbeddingRequest(c, info, dto.EmbeddingRequest{Input: input})
+		require.NoError(t, err)
+		url, err := adaptor.GetRequestURL(info)
+		require.NoError(t, err)
+		_, newAPIError := GeminiEmbeddingHandler(c, info, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(responseBody))})
+		require.Nil(t, newAPIError)
+		var response dto.OpenAIEmbeddingResponse
+		require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &response))
+		return url, converted, response
+	}
+
+	url, converted, response := embed("only one", `{"embedding":{"values":[0.1,0.2]}}`)
+	require.True(t, strings.HasSuffix(url, ":embedContent"))
+	require.NotContains(t, converted, "requests")
+	require.Equal(t, "models/gemini-embedding-001", converted.(map[string]interface{})["model"])
+	require.Len(t, response.Data, 1)
+	require.Equal(t, []float64{0.1, 0.2}, response.Data[0].Embedding)
+
+	url, converted, response = embed([]any{"a", "b", "c"}, `{"embeddings":[{"values":[1]},{"values":[2]},{"values":[3]}]}`)
+	require.True(t, strings.HasSuffix(url, ":batchEmbedContents"))
+	require.Len(t, converted.(map[string]interface{})["requests"], 3)
+	require.Len(t, response.Data, 3)
+	for i, item := range response.Data {
+		require.Equal(t, i, item.Index)
+		require.Equal(t, []float64{float64(i + 1)}, item.Embedding)
+	}
+}
+
+func TestConvertEmbeddingRequestAppliesOutputDimensionalityPerModel(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		model      string
+		dimensions int
+		expected   any
+		rejected   bool
+	}{
+		{model: "gemini-embedding-001", dimensions: 768, expected: 768},
+		{model: "gemini-embedding-exp-03-07", dimensions: 256, expected: 256},
+		{model: "text-embedding-004", dimensions: 512, expected: 512},
+		{model: "text-embedding-005", dimensions: 768, expected: 768},
+		{model: "text-multilingual-embedding-002", dimensions: 128, expected: 128},
+		{model: "gemini-embedding-001", dimensions: 0, expected: nil},
+		{model: "embedding-001", dimensions: 0, expected: nil},
+		{model: "embedding-001", dimensions: 768, rejected: true},
+	}
+	for _, tc := range cases {
+		c, info := newGeminiConvertTestContext(tc.model)
+		request := dto.EmbeddingRequest{Input: "hello"}
+		if tc.dimensions > 0 {
+			request.Dimensions = common.GetPointer(tc.dimensions)
+		}
+		converted, err := (&Adaptor{}).ConvertEmbeddingRequest(c, info, request)
+		if tc.rejected {
+			var newAPIError *types.NewAPIError
+			require.ErrorAs(t, err, &newAPIError, tc.model)
+			require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+			continue
+		}
+		require.NoError(t, err, tc.model)
+		require.Equal(t, tc.expected, converted.(map[string]interface{})["outputDimensionality"], tc.model)
+	}
+}
+
+func TestCovertOpenAI2GeminiTranslatesResponseFormatSchema(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	request := dto.GeneralOpenAIRequest{
+		Model:    "gemini-2.5-flash",
+		Messages: []dto.Message{{Role: "user", Content: "describe the order"}},
+		ResponseFormat: &dto.ResponseFormat{
+			Type: "json_schema",
+			JsonSchema: json.RawMessage(`{"name":"order","strict":true,"schema":{
+				"type":"object","additionalProperties":false,"required":["status","customer"],
+				"properties":{
+					"status":{"type":"string","enum":["pending","shipped"]},
+					"customer":{"type":"object","additionalProperties":false,"required":["name"],
+						"properties":{"name":{"type":"string"},"tier":{"type":["string","null"],"enum":["gold","silver",null]}}},
+					"items":{"type":"array","items":{"type":"object","additionalProperties":false,
+						"properties":{"sku":{"type":"string"},"quantity":{"type":"integer","minimum":1}}}}
+				}}}`),
+		},
+	}
+	geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.Equal(t, "application/json", geminiRequest.GenerationConfig.ResponseMimeType)
+
+	schemaJson, err := common.Marshal(geminiRequest.GenerationConfig.ResponseSchema)
+	require.NoError(t, err)
+	require.NotContains(t, string(schemaJson), "additionalProperties")
+	var schema map[string]any
+	require.NoError(t, common.Unmarshal(schemaJson, &schema))
+	properties := schema["properties"].(map[string]any)
+	require.Equal(t, []any{"pending", "shipped"}, properties["status"].(map[string]any)["enum"])
+	customer := properties["customer"].(map[string]any)
+	require.Equal(t, []any{"name"}, customer["required"])
+	tier := customer["properties"].(map[string]any)["tier"].(map[string]any)
+	require.Equal(t, true, tier["nullable"])
+	item := properties["items"].(map[string]any)["items"].(map[string]any)
+	require.Contains(t, item["properties"].(map[string]any), "quantity")
+
+	request.ResponseFormat = &dto.ResponseFormat{Type: "json_object"}
+	geminiRequest, err = CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.Equal(t, "application/json", geminiRequest.GenerationConfig.ResponseMimeType)
+	require.Nil(t, geminiRequest.GenerationConfig.ResponseSchema)
+}
+
+func TestCovertOpenAI2GeminiAppliesThinkingSuffixBudget(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled := settings.ThinkingAdapterEnabled
+	settings.ThinkingAdapterEnabled = true
+	t.Cleanup(func() {
+		settings.ThinkingAdapterEnabled = oldEnabled
+	})
+
+	cases := []struct {
+		model           string
+		budget          *int
+		includeThoughts bool
+	}{
+		{model: "gemini-2.5-flash-thinking-2048", budget: common.GetPointer(2048), includeThoughts: true},
+		{model: "gemini-2.5-flash-thinking-100", budget: common.GetPointer(100), includeThoughts: true},
+		{model: "gemini-2.5-flash-thinking", budget: common.GetPointer(clampThinkingBudgetByEffort("gemini-2.5-flash-thinking", "")), includeThoughts: true},
+		{model: "gemini-2.5-flash-nothinking", budget: common.GetPointer(0)},
+	}
+	for _, tc := range cases {
+		c, info := newGeminiConvertTestContext(tc.model)
+		geminiRequest, err := CovertOpenAI2Gemini(c, dto.GeneralOpenAIRequest{
+			Model:    tc.model,
+			Messages: []dto.Message{{Role: "user", Content: "hi"}},
+		}, info)
+		require.NoError(t, err, tc.model)
+		thinkingConfig := geminiRequest.GenerationConfig.ThinkingConfig
+		require.NotNil(t, thinkingConfig, tc.model)
+		require.Equal(t, tc.budget, thinkingConfig.ThinkingBudget, tc.model)
+		require.Equal(t, tc.includeThoughts, thinkingConfig.IncludeThoughts, tc.model)
+
+		url, err := (&Adaptor{}).GetRequestURL(info)
+		require.NoError(t, err)
+		require.Contains(t, url, "/models/gemini-2.5-flash:", tc.model)
+	}
+}
+
+func TestCovertOpenAI2GeminiSafetySettingsDefaultsAndOverrides(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldSafetySettings := settings.SafetySettings
+	t.Cleanup(func() {
+		settings.SafetySettings = oldSafetySettings
+	})
+
+	convert := func(extraBody string) []byte {
+		c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+		request := dto.GeneralOpenAIRequest{
+			Model:    "gemini-2.5-flash",
+			Messages: []dto.Message{{Role: "user", Content: "hi"}},
+		}
+		if extraBody != "" {
+			request.ExtraBody = []byte(extraBody)
+		}
+		geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+		require.NoError(t, err)
+		body, err := common.Marshal(geminiRequest)
+		require.NoError(t, err)
+		return body
+	}
+	safetySettingsOf := func(body []byte) any {
+		var decoded map[string]any
+		require.NoError(t, common.Unmarshal(body, &decoded))
+		return decoded["safetySettings"]
+	}
+
+	settings.SafetySettings = map[string]string{"default": "BLOCK_ONLY_HIGH", "HARM_CATEGORY_DANGEROUS_CONTENT": "BLOCK_NONE"}
+	require.Equal(t, []any{
+		map[string]any{"category": "HARM_CATEGORY_HARASSMENT", "threshold": "BLOCK_ONLY_HIGH"},
+		map[string]any{"category": "HARM_CATEGORY_HATE_SPEECH", "threshold": "BLOCK_ONLY_HIGH"},
+		map[string]any{"category": "HARM_CATEGORY_SEXUALLY_EXPLICIT", "threshold": "BLOCK_ONLY_HIGH"},
+		map[string]any{"category": "HARM_CATEGORY_DANGEROUS_CONTENT", "threshold": "BLOCK_NONE"},
+	}, safetySettingsOf(convert("")))
+
+	body := convert(`{"google":{"safety_settings":[{"category":"HARM_CATEGORY_HARASSMENT","threshold":"block_low_and_above"},{"category":"HARM_CATEGORY_CIVIC_INTEGRITY","threshold":"BLOCK_NONE"}]}}`)
+	require.Equal(t, []any{
+		map[string]any{"category": "HARM_CATEGORY_HARASSMENT", "threshold": "BLOCK_LOW_AND_ABOVE"},
+		map[string]any{"category": "HARM_CATEGORY_HATE_SPEECH", "threshold": "BLOCK_ONLY_HIGH"},
+		map[string]any{"category": "HARM_CATEGORY_SEXUALLY_EXPLICIT", "threshold": "BLOCK_ONLY_HIGH"},
+		map[string]any{"category": "HARM_CATEGORY_DANGEROUS_CONTENT", "threshold": "BLOCK_NONE"},
+		map[string]any{"category": "HARM_CATEGORY_CIVIC_INTEGRITY", "threshold": "BLOCK_NONE"},
+	}, safetySettingsOf(body))
+
+	settings.SafetySettings = map[string]string{}
+	require.Nil(t, safetySettingsOf(convert("")))
+	require.Equal(t, []any{
+		map[string]any{"category": "HARM_CATEGORY_HATE_SPEECH", "threshold": "OFF"},
+	}, safetySettingsOf(convert(`{"google":{"safety_settings":{"HARM_CATEGORY_HATE_SPEECH":"OFF"}}}`)))
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	_, err := CovertOpenAI2Gemini(c, dto.GeneralOpenAIRequest{
+		Model:     "gemini-2.5-flash",
+		Messages:  []dto.Message{{Role: "user", Content: "hi"}},
+		ExtraBody: []byte(`{"google":{"safety_settings":{"VIOLENCE":"OFF"}}}`),
+	}, info)
+	require.ErrorContains(t, err, "VIOLENCE")
+}
+
+func TestCovertOpenAI2GeminiMapsStopPenaltiesAndSeed(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	var request dto.GeneralOpenAIRequest
+	require.NoError(t, common.UnmarshalJsonStr(`{
+		"model": "gemini-2.5-flash",
+		"messages": [{"role": "user", "content": "count"}],
+		"stop": ["a", "b", "c", "d", "e", "f"],
+		"frequency_penalty": 0.5,
+		"presence_penalty": -0.25,
+		"seed": 42
+	}`, &request))
+	geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+
+	body, err := common.Marshal(geminiRequest.GenerationConfig)
+	require.NoError(t, err)
+	var config map[string]any
+	require.NoError(t, common.Unmarshal(body, &config))
+	require.Equal(t, []any{"a", "b", "c", "d", "e"}, config["stopSequences"])
+	require.Equal(t, 0.5, config["frequencyPenalty"])
+	require.Equal(t, -0.25, config["presencePenalty"])
+	require.Equal(t, float64(42), config["seed"])
+
+	request.Stop = "END"
+	request.FrequencyPenalty = nil
+	request.PresencePenalty = common.GetPointer(0.0)
+	geminiRequest, err = CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.Equal(t, []string{"END"}, geminiRequest.GenerationConfig.StopSequences)
+	require.Nil(t, geminiRequest.GenerationConfig.FrequencyPenalty)
+	require.Nil(t, geminiRequest.GenerationConfig.PresencePenalty)
+}
+
+func TestCovertOpenAI2GeminiPassesNAsCandidateCount(t *testing.T) {
+	t.Parallel()
+
+	request := dto.GeneralOpenAIRequest{
+		Model:    "gemini-2.5-flash",
+		Messages: []dto.Message{{Role: "user", Content: "name a color"}},
+		N:        common.GetPointer(2),
+	}
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{
+		RelayFormat:     types.RelayFormatOpenAI,
+		OriginModelName: "gemini-2.5-flash",
+		ChannelMeta:     &relaycommon.ChannelMeta{UpstreamModelName: "gemini-2.5-flash"},
+	}
+	geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.Equal(t, common.GetPointer(2), geminiRequest.GenerationConfig.CandidateCount)
+
+	body, err := common.Marshal(dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{
+			{Index: 0, Content: dto.GeminiChatContent{Role: "model", Parts: []dto.GeminiPart{{Text: "red"}}}},
+			{Index: 1, Content: dto.GeminiChatContent{Role: "model", Parts: []dto.GeminiPart{{Text: "blue"}}}},
+		},
+		UsageMetadata: dto.GeminiUsageMetadata{PromptTokenCount: 5, CandidatesTokenCount: 2, TotalTokenCount: 7},
+	})
+	require.NoError(t, err)
+	usage, newAPIError := GeminiChatHandler(c, info, &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body))})
+	require.Nil(t, newAPIError)
+	require.Equal(t, 2, usage.CompletionTokens)
+	var response dto.OpenAITextResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Len(t, response.Choices, 2)
+	require.Equal(t, 0, response.Choices[0].Index)
+	require.Equal(t, "red", response.Choices[0].Message.StringContent())
+	require.Equal(t, 1, response.Choices[1].Index)
+	require.Equal(t, "blue", response.Choices[1].Message.StringContent())
+
+	var apiErr *types.NewAPIError
+	c, info = newGeminiConvertTestContext("gemini-2.5-flash")
+	request.N = common.GetPointer(9)
+	_, err = CovertOpenAI2Gemini(c, request, info)
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+
+	c, info = newGeminiConvertTestContext("gemini-2.5-flash")
+	info.IsStream = true
+	request.N = common.GetPointer(2)
+	_, err = CovertOpenAI2Gemini(c, request, info)
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+}
+
+func TestCovertOpenAI2GeminiIntersectsAllowedFunctionNamesWithToolChoice(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	request := dto.GeneralOpenAIRequest{
+		Model:    "gemini-2.5-flash",
+		Messages: []dto.Message{{Role: "user", Content: "what time is it in Paris?"}},
+		Tools: []dto.ToolCallRequest{
+			{Type: "function", Function: dto.FunctionRequest{Name: "get_weather"}},
+			{Type: "function", Function: dto.FunctionRequest{Name: "get_time"}},
+		},
+		ToolChoice: map[string]any{"type": "function", "function": map[string]any{"name": "get_time"}},
+		ExtraBody:  []byte(`{"google":{"allowed_function_names":["get_time","get_weather"]}}`),
+	}
+	geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	require.Equal(t, []string{"get_time"}, geminiRequest.ToolConfig.FunctionCallingConfig.AllowedFunctionNames)
+
+	request.ExtraBody = []byte(`{"google":{"allowed_function_names":["get_weather"]}}`)
+	_, err = CovertOpenAI2Gemini(c, request, info)
+	var apiErr *types.NewAPIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	require.EqualError(t, err, "extra_body.google.allowed_function_names has no function in common with tool_choice (get_time)")
+}
+
+func TestCovertOpenAI2GeminiMapsToolChoiceAndGroupsFunctions(t *testing.T) {
+	t.Parallel()
+
+	tools := []dto.ToolCallRequest{
+		{Type: "function", Function: dto.FunctionRequest{Name: "get_weather", Parameters: map[string]any{"type": "object", "properties": map[string]any{"city": map[string]any{"type": "string"}}}}},
+		{Type: "function", Function: dto.FunctionRequest{Name: "get_time"}},
+		{Type: "function", Function: dto.FunctionRequest{Name: "googleSearch"}},
+	}
+	tests := []struct {
+		name         string
+		toolChoice   any
+		mode         dto.FunctionCallingConfigMode
+		allowedNames []string
+	}{
+		{name: "none", toolChoice: "none", mode: "NONE"},
+		{name: "auto", toolChoice: "auto", mode: "AUTO"},
+		{name: "required", toolChoice: "required", mode: "ANY"},
+		{name: "function", toolChoice: map[string]any{"type": "function", "function": map[string]any{"name": "get_time"}}, mode: "ANY", allowedNames: []string{"get_time"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+			request := dto.GeneralOpenAIRequest{
+				Model:      "gemini-2.5-flash",
+				Messages:   []dto.Message{{Role: "user", Content: "what time is it in Paris?"}},
+				Tools:      append([]dto.ToolCallRequest(nil), tools...),
+				ToolChoice: tt.toolChoice,
+			}
+
+			geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+			require.NoError(t, err)
+			require.NotNil(t, geminiRequest.ToolConfig)
+			require.NotNil(t, geminiRequest.ToolConfig.FunctionCallingConfig)
+			require.Equal(t, tt.mode, geminiRequest.ToolConfig.FunctionCallingConfig.Mode)
+			require.Equal(t, tt.allowedNames, geminiRequest.ToolConfig.FunctionCallingConfig.AllowedFunctionNames)
+
+			// tools 以 JSON 保存，解码后检查所有函数都在同一个 functionDeclarations 里
+			var geminiTools []struct {
+				FunctionDeclarations []dto.FunctionRequest `json:"functionDeclarations"`
+			}
+			require.NoError(t, common.Unmarshal(geminiRequest.Tools, &geminiTools))
+			var declarations []dto.FunctionRequest
+			functionTools := 0
+			for _, tool := range geminiTools {
+				if len(tool.FunctionDeclarations) > 0 {
+					functionTools++
+					declarations = tool.FunctionDeclarations
+				}
+			}
+			require.Len(t, geminiTools, 2)
+			require.Equal(t, 1, functionTools)
+			require.Len(t, declarations, 2)
+			require.Equal(t, "get_weather", declarations[0].Name)
+			require.Equal(t, "get_time", declarations[1].Name)
+		})
+	}
+}
+
+func TestGeminiSpeechRoundTripWritesWavAndBillsAudioTokens(t *testing.T) {
+	t.Parallel()
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/audio/speech", nil)
+	info := &relaycommon.RelayInfo{
+		RelayMode:       relayconstant.RelayModeAudioSpeech,
+		OriginModelName: "gemini-2.5-flash-preview-tts",
+		ChannelMeta: &relaycommon.ChannelMeta{
+			ChannelBaseUrl:    "https://generativelanguage.googleapis.com",
+			UpstreamModelName: "gemini-2.5-flash-preview-tts",
+		},
+	}
+	request := dto.AudioRequest{
+		Model:          "gemini-2.5-flash-preview-tts",
+		Input:          "Have a wonderful day!",
+		Voice:          "alloy",
+		Instructions:   "Say cheerfully",
+		ResponseFormat: "wav",
+	}
+
+	adaptor := &Adaptor{}
+	url, err := adaptor.GetRequestURL(info)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(url, "/models/gemini-2.5-flash-preview-tts:generateContent"))
+	reader, err := adaptor.ConvertAudioRequest(c, info, request)
+	require.NoError(t, err)
+	var geminiRequest dto.GeminiChatRequest
+	require.NoError(t, common.DecodeJson(reader, &geminiRequest))
+	require.Equal(t, []string{"AUDIO"}, geminiRequest.GenerationConfig.ResponseModalities)
+	require.JSONEq(t, `{"voiceConfig":{"prebuiltVoiceConfig":{"voiceName":"Zephyr"}}}`, string(geminiRequest.GenerationConfig.SpeechConfig))
+	require.Equal(t, "Say cheerfully: Have a wonderful day!", geminiRequest.Contents[0].Parts[0].Text)
+
+	pcm := []byte{0x01, 0x00, 0xff, 0x7f, 0x00, 0x80}
+	body, err := common.Marshal(dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{{
+			Content: dto.GeminiChatContent{Role: "model", Parts: []dto.GeminiPart{
+				{InlineData: &dto.GeminiInlineData{MimeType: "audio/L16;codec=pcm;rate=24000", Data: base64.StdEncoding.EncodeToString(pcm)}},
+			}},
+		}},
+		UsageMetadata: dto.GeminiUsageMetadata{PromptTokenCount: 9, CandidatesTokenCount: 50, TotalTokenCount: 59},
+	})
+	require.NoError(t, err)
+	usage, newAPIError := adaptor.DoResponse(c, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(body))}, info)
+	require.Nil(t, newAPIError)
+	require.Equal(t, 50, usage.(*dto.Usage).CompletionTokenDetails.AudioTokens)
+	require.Equal(t, 9, usage.(*dto.Usage).PromptTokens)
+
+	require.Equal(t, "audio/wav", recorder.Header().Get("Content-Type"))
+	wav := recorder.Body.Bytes()
+	require.Len(t, wav, 44+len(pcm))
+	require.Equal(t, "RIFF", string(wav[:4]))
+	require.Equal(t, "WAVE", string(wav[8:12]))
+	require.Equal(t, uint32(24000), binary.LittleEndian.Uint32(wav[24:28]))
+	require.Equal(t, pcm, wav[44:])
+
+	for _, tc := range []struct {
+		model  string
+		format string
+		input  string
+	}{
+		{model: "gemini-2.5-flash", format: "wav", input: "hi"},
+		{model: "gemini-2.5-flash-preview-tts", format: "mp3", input: "hi"},
+		{model: "gemini-2.5-flash-preview-tts", format: "opus", input: "hi"},
+		{model: "gemini-2.5-flash-preview-tts", format: "pcm", input: " "},
+	} {
+		info.UpstreamModelName = tc.model
+		_, err = adaptor.ConvertAudioRequest(c, info, dto.AudioRequest{Model: tc.model, Input: tc.input, ResponseFormat: tc.format})
+		var apiErr *types.NewAPIError
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	}
+}
+
+func newGeminiTranscriptionTestContext(t *testing.T, filename string, fields map[string]string) (*gin.Context, *httptest.ResponseRecorder) {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for key, value := range fields {
+		require.NoError(t, writer.WriteField(key, value))
+	}
+	part, err := writer.CreateFormFile("file", filename)
+	require.NoError(t, err)
+	_, err = part.Write([]byte("ID3 fake audio"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/audio/transcriptions", &body)
+	c.Request.Header.Set("Content-Type", writer.FormDataContentType())
+	return c, recorder
+}
+
+func TestGeminiTranscriptionRoundTripReturnsVerboseJsonSegments(t *testing.T) {
+	t.Parallel()
+
+	c, recorder := newGeminiTranscriptionTestContext(t, "clip.mp3", map[string]string{
+		"model":           "gemini-2.5-flash",
+		"response_format": "verbose_json",
+		"language":        "de",
+		"prompt":          "Kubernetes, Grafana",
+	})
+	info := &relaycommon.RelayInfo{
+		RelayMode:       relayconstant.RelayModeAudioTranscription,
+		OriginModelName: "gemini-2.5-flash",
+		ChannelMeta: &relaycommon.ChannelMeta{
+			ChannelBaseUrl:    "https://generativelanguage.googleapis.com",
+			UpstreamModelName: "gemini-2.5-flash",
+		},
+	}
+
+	adaptor := &Adaptor{}
+	url, err := adaptor.GetRequestURL(info)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(url, "/models/gemini-2.5-flash:generateContent"))
+	header := http.Header{}
+	require.NoError(t, adaptor.SetupRequestHeader(c, &header, info))
+	require.Equal(t, "application/json", header.Get("Content-Type"))
+
+	reader, err := adaptor.ConvertAudioRequest(c, info, dto.AudioRequest{Model: "gemini-2.5-flash", ResponseFormat: "json"})
+	require.NoError(t, err)
+	var geminiRequest dto.GeminiChatRequest
+	require.NoError(t, common.DecodeJson(reader, &geminiRequest))
+	parts := geminiRequest.Contents[0].Parts
+	require.Len(t, parts, 2)
+	require.Contains(t, parts[0].Text, "verbatim")
+	require.Contains(t, parts[0].Text, `"de"`)
+	require.Contains(t, parts[0].Text, "Kubernetes, Grafana")
+	require.Equal(t, "audio/mp3", parts[1].InlineData.MimeType)
+	require.Equal(t, base64.StdEncoding.EncodeToString([]byte("ID3 fake audio")), parts[1].InlineData.Data)
+	require.Equal(t, "application/json", geminiRequest.GenerationConfig.ResponseMimeType)
+	require.NotNil(t, geminiRequest.GenerationConfig.ResponseSchema)
+
+	transcript := `{"language":"de","text":"Hallo Welt. Wie geht's?","segments":[{"start":0,"end":1.2,"text":"Hallo Welt."},{"start":1.2,"end":2.5,"text":" Wie geht's?"}]}`
+	body, err := common.Marshal(dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{{
+			Content: dto.GeminiChatContent{Role: "model", Parts: []dto.GeminiPart{{Text: transcript}}},
+		}},
+		UsageMetadata: dto.GeminiUsageMetadata{
+			PromptTokenCount:     80,
+			CandidatesTokenCount: 20,
+			TotalTokenCount:      100,
+			PromptTokensDetails: []dto.GeminiPromptTokensDetails{
+				{Modality: "TEXT", TokenCount: 30},
+				{Modality: "AUDIO", TokenCount: 50},
+			},
+		},
+	})
+	require.NoError(t, err)
+	usage, newAPIError := adaptor.DoResponse(c, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(body))}, info)
+	require.Nil(t, newAPIError)
+	require.Equal(t, 50, usage.(*dto.Usage).PromptTokensDetails.AudioTokens)
+
+	var response dto.WhisperVerboseJSONResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Equal(t, "transcribe", response.Task)
+	require.Equal(t, "de", response.Language)
+	require.Equal(t, 2.5, response.Duration)
+	require.Equal(t, "Hallo Welt. Wie geht's?", response.Text)
+	require.Len(t, response.Segments, 2)
+	require.Equal(t, 1, response.Segments[1].Id)
+	require.Equal(t, "Wie geht's?", response.Segments[1].Text)
+
+	c, _ = newGeminiTranscriptionTestContext(t, "clip.m4a", map[string]string{"model": "gemini-2.5-flash"})
+	_, err = adaptor.ConvertAudioRequest(c, info, dto.AudioRequest{Model: "gemini-2.5-flash", ResponseFormat: "json"})
+	var apiErr *types.NewAPIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+}
+
+func TestGeminiFinishReasonMapsEveryGeminiReason(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newGeminiConvertTestContext("gemini-2.5-flash")
+	for _, tc := range []struct {
+		geminiReason string
+		openAIReason string
+		note         bool
+	}{
+		{geminiReason: "FINISH_REASON_UNSPECIFIED", openAIReason: constant.FinishReasonStop},
+		{geminiReason: "STOP", openAIReason: constant.FinishReasonStop},
+		{geminiReason: "MAX_TOKENS", openAIReason: constant.FinishReasonLength},
+		{geminiReason: "SAFETY", openAIReason: constant.FinishReasonContentFilter},
+		{geminiReason: "RECITATION", openAIReason: constant.FinishReasonContentFilter, note: true},
+		{geminiReason: "LANGUAGE", openAIReason: constant.FinishReasonContentFilter},
+		{geminiReason: "OTHER", openAIReason: constant.FinishReasonContentFilter},
+		{geminiReason: "BLOCKLIST", openAIReason: constant.FinishReasonContentFilter},
+		{geminiReason: "PROHIBITED_CONTENT", openAIReason: constant.FinishReasonContentFilter},
+		{geminiReason: "SPII", openAIReason: constant.FinishReasonContentFilter},
+		{geminiReason: "MALFORMED_FUNCTION_CALL", openAIReason: constant.FinishReasonContentFilter},
+		{geminiReason: "IMAGE_SAFETY", openAIReason: constant.FinishReasonContentFilter},
+		{geminiReason: "IMAGE_RECITATION", openAIReason: constant.FinishReasonContentFilter, note: true},
+	} {
+		require.Equal(t, tc.openAIReason, geminiFinishReason(tc.geminiReason), tc.geminiReason)
+
+		finishReason := tc.geminiReason
+		response := &dto.GeminiChatResponse{
+			Candidates: []dto.GeminiChatCandidate{{
+				FinishReason: &finishReason,
+				Content:      dto.GeminiChatContent{Parts: []dto.GeminiPart{{Text: "partial output"}}},
+			}},
+		}
+		choice := responseGeminiChat2OpenAI(c, response).Choices[0]
+		require.Equal(t, tc.openAIReason, choice.FinishReason, tc.geminiReason)
+		// 已有输出内容时不附加截断说明
+		if tc.note {
+			require.Nil(t, choice.Message.Refusal, tc.geminiReason)
+		}
+
+		streamResponse, _ := streamResponseGeminiChat2OpenAI(response)
+		streamChoice := streamResponse.Choices[0]
+		if tc.geminiReason != "STOP" {
+			require.Equal(t, tc.openAIReason, lo.FromPtr(streamChoice.FinishReason), tc.geminiReason)
+		} else {
+			// 流式 STOP 由结束分片统一给出
+			require.Nil(t, streamChoice.FinishReason)
+		}
+		if tc.note {
+			require.Nil(t, streamChoice.Delta.Refusal, tc.geminiReason)
+		}
+
+		if !tc.note {
+			continue
+		}
+		response.Candidates[0].Content.Parts = nil
+		choice = responseGeminiChat2OpenAI(c, response).Choices[0]
+		require.NotNil(t, choice.Message.Refusal, tc.geminiReason)
+		require.Contains(t, *choice.Message.Refusal, tc.geminiReason)
+		streamResponse, _ = streamResponseGeminiChat2OpenAI(response)
+		require.NotNil(t, streamResponse.Choices[0].Delta.Refusal, tc.geminiReason)
+	}
+}
+
+func TestGeminiChatResponsesSeparateThoughtsFromAnswer(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newGeminiConvertTestContext("gemini-2.5-flash")
+	stop := "STOP"
+	response := &dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{{
+			FinishReason: &stop,
+			Content: dto.GeminiChatContent{Role: "model", Parts: []dto.GeminiPart{
+				{Text: "**Recalling facts** The user asks for a capital.", Thought: true},
+				{Text: "**Answering** Paris is the capital of France.", Thought: true},
+				{Text: "The capital of France is Paris."},
+			}},
+		}},
+	}
+
+	message := responseGeminiChat2OpenAI(c, response).Choices[0].Message
+	require.Equal(t, "The capital of France is Paris.", message.StringContent())
+	require.NotNil(t, message.ReasoningContent)
+	require.Equal(t, "**Recalling facts** The user asks for a capital.\n**Answering** Paris is the capital of France.", *message.ReasoningContent)
+
+	streamResponse, _ := streamResponseGeminiChat2OpenAI(response)
+	delta := streamResponse.Choices[0].Delta
+	require.Equal(t, "The capital of France is Paris.", lo.FromPtr(delta.Content))
+	require.Equal(t, "**Recalling facts** The user asks for a capital.\n**Answering** Paris is the capital of France.", lo.FromPtr(delta.ReasoningContent))
+
+	thoughtOnly := &dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{{
+			Content: dto.GeminiChatContent{Role: "model", Parts: []dto.GeminiPart{{Text: "thinking...", Thought: true}}},
+		}},
+	}
+	streamResponse, _ = streamResponseGeminiChat2OpenAI(thoughtOnly)
+	require.Nil(t, streamResponse.Choices[0].Delta.Content)
+	require.Equal(t, "thinking...", lo.FromPtr(streamResponse.Choices[0].Delta.ReasoningContent))
+}
+
+func TestCovertOpenAI2GeminiMergesConsecutiveSameRoleTurns(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	geminiRequest, err := CovertOpenAI2Gemini(c, dto.GeneralOpenAIRequest{
+		Model: "gemini-2.5-flash",
+		Messages: []dto.Message{
+			{Role: "user", Content: "first part"},
+			{Role: "user", Content: "second part"},
+			{Role: "assistant", Content: "noted"},
+			{Role: "assistant", Content: "anything else?"},
+			{Role: "user", Content: "no"},
+		},
+	}, info)
+	require.NoError(t, err)
+	require.Len(t, geminiRequest.Contents, 3)
+	require.Equal(t, []string{"user", "model", "user"}, lo.Map(geminiRequest.Contents, func(content dto.GeminiChatContent, _ int) string {
+		return content.Role
+	}))
+	require.Equal(t, []string{"first part", "second part"}, lo.Map(geminiRequest.Contents[0].Parts, func(part dto.GeminiPart, _ int) string {
+		return part.Text
+	}))
+	require.Len(t, geminiRequest.Contents[1].Parts, 2)
+}
+
+func TestCovertOpenAI2GeminiGroupsToolResultsIntoOneTurn(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	toolCalls, err := common.Marshal([]dto.ToolCallRequest{
+		{ID: "call_1", Type: "function", Function: dto.FunctionRequest{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+		{ID: "call_2", Type: "function", Function: dto.FunctionRequest{Name: "get_time", Arguments: `{"city":"Paris"}`}},
+	})
+	require.NoError(t, err)
+	geminiRequest, err := CovertOpenAI2Gemini(c, dto.GeneralOpenAIRequest{
+		Model: "gemini-2.5-flash",
+		Messages: []dto.Message{
+			{Role: "system", Content: "use the tools"},
+			{Role: "assistant", Content: "", ToolCalls: toolCalls},
+			{Role: "tool", ToolCallId: "call_1", Content: `{"temp":21}`},
+			{Role: "tool", ToolCallId: "call_2", Content: "14:00"},
+			{Role: "user", Content: "and tomorrow?"},
+		},
+	}, info)
+	require.NoError(t, err)
+
+	// 首轮是函数调用时补一个占位 user 轮，工具结果与随后的 user 消息合并为一轮
+	require.Len(t, geminiRequest.Contents, 3)
+	require.Equal(t, "user", geminiRequest.Contents[0].Role)
+	require.Equal(t, geminiPlaceholderUserText, geminiRequest.Contents[0].Parts[0].Text)
+	require.Equal(t, "model", geminiRequest.Contents[1].Role)
+	require.Len(t, geminiRequest.Contents[1].Parts, 2)
+	results := geminiRequest.Contents[2]
+	require.Equal(t, "user", results.Role)
+	require.Len(t, results.Parts, 3)
+	require.Equal(t, "get_weather", results.Parts[0].FunctionResponse.Name)
+	require.Equal(t, map[string]any{"temp": float64(21)}, results.Parts[0].FunctionResponse.Response)
+	require.Equal(t, "get_time", results.Parts[1].FunctionResponse.Name)
+	require.Equal(t, map[string]any{"content": "14:00"}, results.Parts[1].FunctionResponse.Response)
+	require.Equal(t, "and tomorrow?", results.Parts[2].Text)
+}
+
+func TestConvertOpenAIRequestRoundTripsToolCallAndResult(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	toolCalls, err := common.Marshal([]dto.ToolCallRequest{
+		{ID: "call_weather", Type: "function", Function: dto.FunctionRequest{Name: "get_weather", Arguments: `{"city":"Paris","unit":"c"}`}},
+	})
+	require.NoError(t, err)
+	request := &dto.GeneralOpenAIRequest{
+		Model: "gemini-2.5-flash",
+		Messages: []dto.Message{
+			{Role: "user", Content: "weather in Paris?"},
+			{Role: "assistant", Content: "", ToolCalls: toolCalls},
+			{Role: "tool", ToolCallId: "call_weather", Content: `{"temp":21,"sky":"clear"}`},
+		},
+	}
+	converted, err := (&Adaptor{}).ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+	body, err := common.Marshal(converted)
+	require.NoError(t, err)
+	var upstream struct {
+		Contents []struct {
+			Role  string `json:"role"`
+			Parts []struct {
+				Text             string         `json:"text"`
+				FunctionCall     map[string]any `json:"functionCall"`
+				FunctionResponse map[string]any `json:"functionResponse"`
+			} `json:"parts"`
+		} `json:"contents"`
+	}
+	require.NoError(t, common.Unmarshal(body, &upstream))
+	require.Len(t, upstream.Contents, 3)
+	require.Equal(t, "model", upstream.Contents[1].Role)
+	require.Empty(t, upstream.Contents[1].Parts[0].Text)
+	require.Equal(t, map[string]any{"name": "get_weather", "args": map[string]any{"city": "Paris", "unit": "c"}}, upstream.Contents[1].Parts[0].FunctionCall)
+	require.Equal(t, "user", upstream.Contents[2].Role)
+	require.Equal(t, map[string]any{"name": "get_weather", "response": map[string]any{"temp": float64(21), "sky": "clear"}}, upstream.Contents[2].Parts[0].FunctionResponse)
+
+	// 无法对应到任何 tool_call 且未指定 name 的工具结果直接报错
+	request.Messages[2].ToolCallId = "call_unknown"
+	_, err = (&Adaptor{}).ConvertOpenAIRequest(c, info, request)
+	var apiErr *types.NewAPIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	require.Contains(t, apiErr.Error(), "call_unknown")
+}
+
+func TestConvertRejectsOperationsTheModelDoesNotSupport(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		model     string
+		relayMode int
+		convert   func(c *gin.Context, info *relaycommon.RelayInfo) error
+		operation string
+	}{
+		{
+			name:      "chat on embedding model",
+			model:     "gemini-embedding-001",
+			relayMode: relayconstant.RelayModeChatCompletions,
+			convert: func(c *gin.Context, info *relaycommon.RelayInfo) error {
+				_, err := (&Adaptor{}).ConvertOpenAIRequest(c, info, &dto.GeneralOpenAIRequest{Messages: []dto.Message{{Role: "user", Content: "hi"}}})
+				return err
+			},
+			operation: "chat completions",
+		},
+		{
+			name:      "embeddings on imagen model",
+			model:     "imagen-4.0-generate-001",
+			relayMode: relayconstant.RelayModeEmbeddings,
+			convert: func(c *gin.Context, info *relaycommon.RelayInfo) error {
+				_, err := (&Adaptor{}).ConvertEmbeddingRequest(c, info, dto.EmbeddingRequest{Input: "hi"})
+				return err
+			},
+			operation: "embeddings",
+		},
+		{
+			name:      "embeddings on chat model",
+			model:     "gemini-2.5-flash",
+			relayMode: relayconstant.RelayModeEmbeddings,
+			convert: func(c *gin.Context, info *relaycommon.RelayInfo) error {
+				_, err := (&Adaptor{}).ConvertEmbeddingRequest(c, info, dto.EmbeddingRequest{Input: "hi"})
+				return err
+			},
+			operation: "embeddings",
+		},
+		{
+			name:      "image generation on chat model",
+			model:     "gemini-2.5-flash",
+			relayMode: relayconstant.RelayModeImagesGenerations,
+			convert: func(c *gin.Context, info *relaycommon.RelayInfo) error {
+				_, err := (&Adaptor{}).ConvertImageRequest(c, info, dto.ImageRequest{Prompt: "cat"})
+				return err
+			},
+			operation: "image generation",
+		},
+		{
+			name:      "speech on embedding model",
+			model:     "text-embedding-004",
+			relayMode: relayconstant.RelayModeAudioSpeech,
+			convert: func(c *gin.Context, info *relaycommon.RelayInfo) error {
+				_, err := (&Adaptor{}).ConvertAudioRequest(c, info, dto.AudioRequest{Input: "hi"})
+				return err
+			},
+			operation: "speech",
+		},
+		{
+			name:      "upstream request for chat on imagen model",
+			model:     "imagen-4.0-generate-001",
+			relayMode: relayconstant.RelayModeChatCompletions,
+			convert: func(c *gin.Context, info *relaycommon.RelayInfo) error {
+				_, err := (&Adaptor{}).DoRequest(c, info, strings.NewReader("{}"))
+				return err
+			},
+			operation: "chat completions",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			c, info := newGeminiConvertTestContext(tt.model)
+			info.RelayMode = tt.relayMode
+			err := tt.convert(c, info)
+
+			var newAPIError *types.NewAPIError
+			require.ErrorAs(t, err, &newAPIError)
+			require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+			require.Equal(t, "Model "+tt.model+" does not support "+tt.operation, newAPIError.Error())
+		})
+	}
+}
+
+func TestSupportsOperationAllowsMatchingModelAndMode(t *testing.T) {
+	t.Parallel()
+
+	require.True(t, supportsOperation("gemini-embedding-001", relayconstant.RelayModeEmbeddings))
+	require.True(t, supportsOperation("imagen-4.0-generate-001", relayconstant.RelayModeImagesGenerations))
+	for _, mode := range []int{
+		relayconstant.RelayModeChatCompletions,
+		relayconstant.RelayModeRerank,
+		relayconstant.RelayModeAudioSpeech,
+		relayconstant.RelayModeAudioTranscription,
+		relayconstant.RelayModeChatCompletionsCountTokens,
+	} {
+		require.True(t, supportsOperation("gemini-2.5-flash", mode))
+	}
+	// 原生 Gemini 请求的操作由路径决定，不做拦截
+	require.True(t, supportsOperation("gemini-embedding-001", relayconstant.RelayModeGemini))
+	require.False(t, supportsOperation("gemini-2.5-flash-image", relayconstant.RelayModeImagesEdits))
+}
+
+func TestGeminiChatStreamHandlerEmitsUsageChunkOnlyWhenRequested(t *testing.T) {
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+	})
+
+	body := "data: " + `{"candidates":[{"index":0,"content":{"role":"model","parts":[{"text":"hel"}]}}]}` + "\n\n" +
+		"data: " + `{"candidates":[{"index":0,"content":{"role":"model","parts":[{"text":"lo"}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":7,"candidatesTokenCount":2,"totalTokenCount":9}}` + "\n\n"
+	// compatible_handler 按客户端的 stream_options 设置 ShouldIncludeUsage（未传时默认开启），
+	// 开启 ForceStreamOption 时转发给适配器的 StreamOptions 会被改写为 include_usage=true
+	cases := []struct {
+		name               string
+		shouldIncludeUsage bool
+		streamOptions      *dto.StreamOptions
+		wantUsage          bool
+	}{
+		{name: "absent", shouldIncludeUsage: true, streamOptions: &dto.StreamOptions{IncludeUsage: true}, wantUsage: true},
+		{name: "disabled", shouldIncludeUsage: false, streamOptions: &dto.StreamOptions{IncludeUsage: true}, wantUsage: false},
+		{name: "disabled not forced", shouldIncludeUsage: false, streamOptions: nil, wantUsage: false},
+		{name: "enabled", shouldIncludeUsage: true, streamOptions: &dto.StreamOptions{IncludeUsage: true}, wantUsage: true},
+	}
+	for _, tc := range cases {
+		gin.SetMode(gin.TestMode)
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		info := &relaycommon.RelayInfo{
+			IsStream:           true,
+			RelayFormat:        types.RelayFormatOpenAI,
+			ShouldIncludeUsage: tc.shouldIncludeUsage,
+			ChannelMeta: &relaycommon.ChannelMeta{
+				UpstreamModelName: "gemini-2.5-flash",
+			},
+		}
+		_, err := (&Adaptor{}).ConvertOpenAIRequest(c, info, &dto.GeneralOpenAIRequest{
+			Model:         "gemini-2.5-flash",
+			Messages:      []dto.Message{{Role: "user", Content: "hi"}},
+			Stream:        common.GetPointer(true),
+			StreamOptions: tc.streamOptions,
+		})
+		require.NoError(t, err)
+
+		resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+		_, apiErr := GeminiChatStreamHandler(c, info, resp)
+		require.Nil(t, apiErr)
+
+		lines := lo.Filter(strings.Split(recorder.Body.String(), "\n"), func(line string, _ int) bool {
+			return strings.HasPrefix(line, "data: ")
+		})
+		require.Equal(t, "data: [DONE]", lines[len(lines)-1])
+		var usageChunks []dto.ChatCompletionsStreamResponse
+		for _, line := range lines[:len(lines)-1] {
+			var chunk dto.ChatCompletionsStreamResponse
+			require.NoError(t, common.UnmarshalJsonStr(strings.TrimPrefix(line, "data: "), &chunk))
+			if chunk.Usage != nil {
+				usageChunks = append(usageChunks, chunk)
+			}
+		}
+		if !tc.wantUsage {
+			require.Empty(t, usageChunks, tc.name)
+			continue
+		}
+		require.Len(t, usageChunks, 1, tc.name)
+		require.Empty(t, usageChunks[0].Choices)
+		require.Equal(t, 7, usageChunks[0].Usage.PromptTokens)
+		require.Equal(t, 2, usageChunks[0].Usage.CompletionTokens)
+		require.Equal(t, 9, usageChunks[0].Usage.TotalTokens)
+		var last dto.ChatCompletionsStreamResponse
+		require.NoError(t, common.UnmarshalJsonStr(strings.TrimPrefix(lines[len(lines)-2], "data: "), &last))
+		require.NotNil(t, last.Usage)
+	}
+}
+
+func TestCovertOpenAI2GeminiMergesGenerationConfigPassthrough(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	request := dto.GeneralOpenAIRequest{
+		Model:       "gemini-2.5-flash",
+		Messages:    []dto.Message{{Role: "user", Content: "hi"}},
+		Temperature: common.GetPointer(0.3),
+		ExtraBody: []byte(`{"google":{"thinking_config":{"thinking_budget":128},"generation_config":{` +
+			`"temperature":1.5,"enableAffectiveDialog":true,"thinkingConfig":{"thinkingBudget":4096,"futureKnob":"on"}}}}`),
+	}
+
+	geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+	data, err := common.Marshal(geminiRequest)
+	require.NoError(t, err)
+
+	var body struct {
+		GenerationConfig map[string]any `json:"generationConfig"`
+	}
+	require.NoError(t, common.Unmarshal(data, &body))
+	require.Equal(t, 0.3, body.GenerationConfig["temperature"])
+	require.Equal(t, true, body.GenerationConfig["enableAffectiveDialog"])
+	thinkingConfig := body.GenerationConfig["thinkingConfig"].(map[string]any)
+	require.Equal(t, float64(128), thinkingConfig["thinkingBudget"])
+	require.Equal(t, "on", thinkingConfig["futureKnob"])
+
+	for _, invalid := range []string{`[{"temperature":1}]`, `"raw"`, `1`, `null`} {
+		request.ExtraBody = []byte(`{"google":{"generation_config":` + invalid + `}}`)
+		_, err = CovertOpenAI2Gemini(c, request, info)
+		require.EqualError(t, err, "extra_body.google.generation_config must be a JSON object")
+	}
+}
+
+func TestCovertOpenAI2GeminiLocalizesThinkingAndImageConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	request := dto.GeneralOpenAIRequest{
+		Model:    "gemini-2.5-flash",
+		Messages: []dto.Message{{Role: "user", Content: "hi"}},
+	}
+	for extraBody, message := range map[string]string{
+		`{"google":{"thinkingConfig":{}}}`:                          "extra_body.google.thinkingConfig is not supported, use extra_body.google.thinking_config instead",
+		`{"google":{"thinking_config":{"thinking_budget":"high"}}}`: "extra_body.google.thinking_config.thinking_budget must be an integer",
+		`{"google":{"thinking_config":{"include_thoughts":"yes"}}}`: "extra_body.google.thinking_config.include_thoughts must be a boolean",
+		`{"google":{"thinking_config":{"thinking_level":1}}}`:       "extra_body.google.thinking_config.thinking_level must be a string",
+		`{"google":{"image_config":{"aspectRatio":"16:9"}}}`:        "extra_body.google.image_config.aspectRatio is not supported, use extra_body.google.image_config.aspect_ratio instead",
+	} {
+		request.ExtraBody = []byte(extraBody)
+		_, err := CovertOpenAI2Gemini(c, request, info)
+		require.EqualError(t, err, message)
+	}
+}
+
+func TestGeminiChatHandlerMapsMixedTextAndAudioCandidateToMessageAudio(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newContext := func() (*gin.Context, *httptest.ResponseRecorder, *relaycommon.RelayInfo) {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		info := &relaycommon.RelayInfo{
+			RelayFormat: types.RelayFormatOpenAI,
+			StartTime:   time.Now(),
+			ChannelMeta: &relaycommon.ChannelMeta{
+				UpstreamModelName: "gemini-2.5-flash-native-audio",
+			},
+		}
+		return c, recorder, info
+	}
+	request := func(format string) dto.GeneralOpenAIRequest {
+		return dto.GeneralOpenAIRequest{
+			Model:      "gemini-2.5-flash-native-audio",
+			Messages:   []dto.Message{{Role: "user", Content: "say hello"}},
+			Modalities: []byte(`["text","audio"]`),
+			Audio:      []byte(`{"voice":"alloy","format":"` + format + `"}`),
+		}
+	}
+	// 1 秒 24kHz PCM，按 25 token/秒折算为 25 个音频 token
+	pcm := make([]byte, 48000)
+	body, err := common.Marshal(dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{{
+			Content: dto.GeminiChatContent{Role: "model", Parts: []dto.GeminiPart{
+				{Text: "Hello"},
+				{InlineData: &dto.GeminiInlineData{MimeType: "audio/L16;codec=pcm;rate=24000", Data: base64.StdEncoding.EncodeToString(pcm[:24000])}},
+				{Text: " there"},
+				{InlineData: &dto.GeminiInlineData{MimeType: "audio/L16;codec=pcm;rate=24000", Data: base64.StdEncoding.EncodeToString(pcm[24000:])}},
+			}},
+			FinishReason: lo.ToPtr("STOP"),
+		}},
+		UsageMetadata: dto.GeminiUsageMetadata{PromptTokenCount: 4, CandidatesTokenCount: 40, TotalTokenCount: 44},
+	})
+	require.NoError(t, err)
+
+	c, recorder, info := newContext()
+	geminiRequest, err := CovertOpenAI2Gemini(c, request("wav"), info)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AUDIO"}, geminiRequest.GenerationConfig.ResponseModalities)
+	usage, apiErr := GeminiChatHandler(c, info, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(body))})
+	require.Nil(t, apiErr)
+	require.Equal(t, 25, usage.CompletionTokenDetails.AudioTokens)
+	require.Equal(t, 15, usage.CompletionTokenDetails.TextTokens)
+
+	var response dto.OpenAITextResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &response))
+	message := response.Choices[0].Message
+	require.Equal(t, "", message.StringContent())
+	require.NotNil(t, message.Audio)
+	require.True(t, strings.HasPrefix(message.Audio.Id, "audio_"))
+	require.Equal(t, "wav", message.Audio.Format)
+	require.Equal(t, "Hello\n there", message.Audio.Transcript)
+	require.NotZero(t, message.Audio.ExpiresAt)
+	wav, err := base64.StdEncoding.DecodeString(message.Audio.Data)
+	require.NoError(t, err)
+	require.Len(t, wav, 44+len(pcm))
+	require.Equal(t, "RIFF", string(wav[:4]))
+	require.Equal(t, uint32(24000), binary.LittleEndian.Uint32(wav[24:28]))
+
+	// 无法转码的格式直接拒绝，开启透传后返回 Gemini 原始 PCM
+	c, _, info = newContext()
+	_, err = CovertOpenAI2Gemini(c, request("mp3"), info)
+	var newAPIError *types.NewAPIError
+	require.ErrorAs(t, err, &newAPIError)
+	require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+
+	settings := model_setting.GetGeminiSettings()
+	oldPassthrough := settings.AudioOutputPassthroughEnabled
+	settings.AudioOutputPassthroughEnabled = true
+	t.Cleanup(func() {
+		settings.AudioOutputPassthroughEnabled = oldPassthrough
+	})
+	c, recorder, info = newContext()
+	_, err = CovertOpenAI2Gemini(c, request("mp3"), info)
+	require.NoError(t, err)
+	_, apiErr = GeminiChatHandler(c, info, &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(body))})
+	require.Nil(t, apiErr)
+	response = dto.OpenAITextResponse{}
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Equal(t, "pcm16", response.Choices[0].Message.Audio.Format)
+	require.Equal(t, base64.StdEncoding.EncodeToString(pcm), response.Choices[0].Message.Audio.Data)
+}
+
+func TestGeminiChatStreamHandlerSendsAudioTranscript(t *testing.T) {
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+	})
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	common.SetContextKey(c, constant.ContextKeyGeminiAudioOutputFormat, "pcm16")
+	info := &relaycommon.RelayInfo{
+		IsStream:    true,
+		RelayFormat: types.RelayFormatOpenAI,
+		StartTime:   time.Now(),
+		ChannelMeta: &relaycommon.ChannelMeta{
+			UpstreamModelName: "gemini-2.5-flash-native-audio",
+		},
+	}
+	audio := base64.StdEncoding.EncodeToString(make([]byte, 4800))
+	body := "data: " + `{"candidates":[{"content":{"role":"model","parts":[{"text":"Hi"},{"inlineData":{"mimeType":"audio/L16;codec=pcm;rate=24000","data":"` + audio + `"}}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":2,"candidatesTokenCount":6,"totalTokenCount":8}}` + "\n\n"
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+
+	usage, apiErr := GeminiChatStreamHandler(c, info, resp)
+	require.Nil(t, apiErr)
+	require.Equal(t, 3, usage.CompletionTokenDetails.AudioTokens)
+	require.Equal(t, 3, usage.CompletionTokenDetails.TextTokens)
+
+	output := recorder.Body.String()
+	require.Contains(t, output, `"transcript":"Hi"`)
+	require.Contains(t, output, `"data":"`+audio+`"`)
+	require.NotContains(t, output, `"content":"Hi"`)
+}
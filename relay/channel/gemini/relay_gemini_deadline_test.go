@@ -0,0 +1,59 @@
+package gemini
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoRequestHonorsRequestDeadlineHeader(t *testing.T) {
+	service.InitHttpClient()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	gin.SetMode(gin.TestMode)
+	newContext := func(deadline string) (*gin.Context, *relaycommon.RelayInfo) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		c.Request.Header.Set("X-Request-Deadline", deadline)
+		info := &relaycommon.RelayInfo{
+			ChannelMeta: &relaycommon.ChannelMeta{
+				ChannelBaseUrl:    upstream.URL,
+				UpstreamModelName: "gemini-2.5-flash",
+			},
+		}
+		return c, info
+	}
+
+	c, info := newContext(time.Now().Add(100 * time.Millisecond).Format(time.RFC3339Nano))
+	start := time.Now()
+	_, err := (&Adaptor{}).DoRequest(c, info, strings.NewReader(`{"contents":[]}`))
+	require.Less(t, time.Since(start), time.Second)
+	var newAPIError *types.NewAPIError
+	require.ErrorAs(t, err, &newAPIError)
+	require.Equal(t, http.StatusGatewayTimeout, newAPIError.StatusCode)
+
+	// 已过期的截止时间不会请求上游
+	c, info = newContext(strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10))
+	_, err = (&Adaptor{}).DoRequest(c, info, strings.NewReader(`{"contents":[]}`))
+	require.ErrorAs(t, err, &newAPIError)
+	require.Equal(t, http.StatusGatewayTimeout, newAPIError.StatusCode)
+}
@@ -0,0 +1,54 @@
+package gemini
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoRequestEchoesUpstreamGenerationConfig(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled := settings.GenerationConfigEchoEnabled
+	settings.GenerationConfigEchoEnabled = true
+	t.Cleanup(func() {
+		settings.GenerationConfigEchoEnabled = oldEnabled
+	})
+	service.InitHttpClient()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		require.JSONEq(t, `{"contents":[],"generationConfig":{"temperature":1,"maxOutputTokens":256}}`, string(body))
+		_, _ = w.Write([]byte(`{"candidates":[]}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	gin.SetMode(gin.TestMode)
+	for _, debug := range []string{"", "generation_config"} {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		c.Request.Header.Set("X-Gemini-Debug", debug)
+		info := &relaycommon.RelayInfo{
+			ChannelMeta: &relaycommon.ChannelMeta{
+				ChannelBaseUrl:    upstream.URL,
+				UpstreamModelName: "gemini-2.5-flash",
+			},
+		}
+		_, err := (&Adaptor{}).DoRequest(c, info, strings.NewReader(`{"contents":[],"generationConfig":{"temperature":1, "maxOutputTokens":256}}`))
+		require.NoError(t, err)
+		if debug == "" {
+			require.Empty(t, recorder.Header().Get("X-Gemini-Generation-Config"))
+		} else {
+			require.Equal(t, `{"temperature":1,"maxOutputTokens":256}`, recorder.Header().Get("X-Gemini-Generation-Config"))
+		}
+	}
+}
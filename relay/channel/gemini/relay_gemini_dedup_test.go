@@ -0,0 +1,83 @@
+package gemini
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoRequestDeduplicatesInFlightRequests(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled := settings.InFlightDedupEnabled
+	settings.InFlightDedupEnabled = true
+	t.Cleanup(func() {
+		settings.InFlightDedupEnabled = oldEnabled
+	})
+	service.InitHttpClient()
+
+	var hits atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"once"}]},"finishReason":"STOP"}]}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	const callers = 3
+	gin.SetMode(gin.TestMode)
+	contexts := make([]*gin.Context, callers)
+	bodies := make([]string, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		contexts[i] = c
+		info := &relaycommon.RelayInfo{
+			UserId: 1,
+			ChannelMeta: &relaycommon.ChannelMeta{
+				ChannelBaseUrl:    upstream.URL,
+				UpstreamModelName: "gemini-2.5-flash",
+			},
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := (&Adaptor{}).DoRequest(c, info, strings.NewReader(`{"contents":[]}`))
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.(*http.Response).Body)
+			require.NoError(t, err)
+			bodies[i] = string(body)
+		}(i)
+	}
+	require.Eventually(t, func() bool { return hits.Load() == 1 }, time.Second, 5*time.Millisecond)
+	// 等待其它请求进入等待状态后再放行上游响应
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	require.EqualValues(t, 1, hits.Load())
+	dedupHits := 0
+	for i := 0; i < callers; i++ {
+		require.Contains(t, bodies[i], `"once"`)
+		if common.GetContextKeyBool(contexts[i], constant.ContextKeyGeminiInFlightDedupHit) {
+			dedupHits++
+		}
+	}
+	require.Equal(t, callers-1, dedupHits)
+}
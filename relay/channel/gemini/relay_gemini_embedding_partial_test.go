@@ -0,0 +1,172 @@
+package gemini
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+// doEmbeddingPartialTestRequest sends the inputs as a batch embedding through DoRequest and DoResponse,
+// respond answers every upstream batch
+func doEmbeddingPartialTestRequest(t *testing.T, inputs []any, respond func(w http.ResponseWriter, batch dto.GeminiBatchEmbeddingRequest)) (*httptest.ResponseRecorder, int32, *http.Response) {
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled := settings.EmbeddingPartialResultsEnabled
+	settings.EmbeddingPartialResultsEnabled = true
+	t.Cleanup(func() {
+		settings.EmbeddingPartialResultsEnabled = oldEnabled
+	})
+	service.InitHttpClient()
+
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		var batch dto.GeminiBatchEmbeddingRequest
+		body, _ := io.ReadAll(r.Body)
+		require.NoError(t, common.Unmarshal(body, &batch))
+		respond(w, batch)
+	}))
+	t.Cleanup(upstream.Close)
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/embeddings", nil)
+	info := &relaycommon.RelayInfo{
+		ChannelMeta: &relaycommon.ChannelMeta{
+			ChannelBaseUrl:    upstream.URL,
+			UpstreamModelName: "gemini-embedding-001",
+		},
+	}
+	adaptor := &Adaptor{}
+	converted, err := adaptor.ConvertEmbeddingRequest(c, info, dto.EmbeddingRequest{
+		Model: "gemini-embedding-001",
+		Input: inputs,
+	})
+	require.NoError(t, err)
+	body, err := common.Marshal(converted)
+	require.NoError(t, err)
+
+	resp, err := adaptor.DoRequest(c, info, strings.NewReader(string(body)))
+	require.NoError(t, err)
+	httpResp := resp.(*http.Response)
+	if httpResp.StatusCode == http.StatusOK {
+		_, newAPIError := adaptor.DoResponse(c, httpResp, info)
+		require.Nil(t, newAPIError)
+	}
+	return recorder, hits.Load(), httpResp
+}
+
+// respondEmbeddings embeds the batch, inputs with the text bad reject the whole batch with badBody
+func respondEmbeddings(badBody string) func(w http.ResponseWriter, batch dto.GeminiBatchEmbeddingRequest) {
+	return func(w http.ResponseWriter, batch dto.GeminiBatchEmbeddingRequest) {
+		response := dto.GeminiBatchEmbeddingResponse{}
+		for i, request := range batch.Requests {
+			if request.Content.Parts[0].Text == "bad" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(badBody))
+				return
+			}
+			response.Embeddings = append(response.Embeddings, &dto.ContentEmbedding{Values: []float64{float64(i)}})
+		}
+		data, _ := common.Marshal(response)
+		_, _ = w.Write(data)
+	}
+}
+
+func TestDoRequestIsolatesFailingBatchEmbeddingInputs(t *testing.T) {
+	recorder, hits, _ := doEmbeddingPartialTestRequest(t, []any{"a", "b", "bad", "c"},
+		respondEmbeddings(`{"error":{"code":400,"message":"invalid input"}}`))
+	// full batch, both halves, then the two inputs of the failing half
+	require.EqualValues(t, 5, hits)
+
+	var openAIResponse dto.OpenAIEmbeddingResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &openAIResponse))
+	require.Len(t, openAIResponse.Data, 4)
+	for i, item := range openAIResponse.Data {
+		require.Equal(t, i, item.Index)
+		if i == 2 {
+			require.Nil(t, item.Embedding)
+			require.NotNil(t, item.Error)
+			require.Equal(t, "invalid input", item.Error.Message)
+			continue
+		}
+		require.Nil(t, item.Error)
+		require.Len(t, item.Embedding, 1)
+	}
+}
+
+func TestDoRequestStopsEmbeddingBisectionOnRequestErrors(t *testing.T) {
+	// 无效 key 等请求级错误带有 ErrorInfo reason，不拆分重试
+	_, hits, resp := doEmbeddingPartialTestRequest(t, []any{"a", "bad"}, func(w http.ResponseWriter, _ dto.GeminiBatchEmbeddingRequest) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":{"code":400,"message":"API key not valid","status":"INVALID_ARGUMENT","details":[{"@type":"type.googleapis.com/google.rpc.ErrorInfo","reason":"API_KEY_INVALID"}]}}`))
+	})
+	require.EqualValues(t, 1, hits)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// 拆分过程中遇到配额等错误时直接返回该错误
+	var calls atomic.Int32
+	_, hits, resp = doEmbeddingPartialTestRequest(t, []any{"a", "b", "bad", "c"}, func(w http.ResponseWriter, batch dto.GeminiBatchEmbeddingRequest) {
+		if calls.Add(1) == 1 {
+			respondEmbeddings(`{"error":{"code":400,"message":"invalid input"}}`)(w, batch)
+			return
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"error":{"code":429,"message":"quota exceeded","status":"RESOURCE_EXHAUSTED"}}`))
+	})
+	require.EqualValues(t, 2, hits)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "quota exceeded")
+}
+
+func TestDoRequestCapsEmbeddingBisectionRequests(t *testing.T) {
+	inputs := make([]any, 100)
+	for i := range inputs {
+		inputs[i] = fmt.Sprintf("input %d", i)
+		if i%2 == 0 {
+			inputs[i] = "bad"
+		}
+	}
+	_, hits, resp := doEmbeddingPartialTestRequest(t, inputs, respondEmbeddings(`{"error":{"code":400,"message":"invalid input"}}`))
+	require.EqualValues(t, 1+embeddingPartialMaxRequests, hits)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "invalid input")
+}
+
+func TestGeminiEmbeddingHandlerReportsFirstRecordedFailureWhenAllInputsFail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/embeddings", nil)
+	// 第一个输入没有返回 embedding，也没有记录失败原因
+	common.SetContextKey(c, constant.ContextKeyGeminiEmbeddingFailures, map[int]string{1: "invalid input"})
+	info := &relaycommon.RelayInfo{
+		IsGeminiBatchEmbedding: true,
+		ChannelMeta:            &relaycommon.ChannelMeta{UpstreamModelName: "gemini-embedding-001"},
+	}
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(`{"embeddings":[null,null]}`)),
+	}
+	_, newAPIError := GeminiEmbeddingHandler(c, info, resp)
+	require.NotNil(t, newAPIError)
+	require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+	require.Equal(t, "All 2 embedding inputs failed: invalid input", newAPIError.Error())
+}
@@ -0,0 +1,61 @@
+package gemini
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/QuantumNous/new-api/constant"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoRequestSurfacesGeminiErrorDetails(t *testing.T) {
+	t.Parallel()
+	service.InitHttpClient()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(canonicalGeminiErrorBody))
+	}))
+	t.Cleanup(upstream.Close)
+
+	newInfo := func(format types.RelayFormat) (*gin.Context, *relaycommon.RelayInfo) {
+		gin.SetMode(gin.TestMode)
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		return c, &relaycommon.RelayInfo{RelayFormat: format, ChannelMeta: &relaycommon.ChannelMeta{
+			ChannelType:       constant.ChannelTypeGemini,
+			ChannelBaseUrl:    upstream.URL,
+			UpstreamModelName: "gemini-2.5-flash",
+		}}
+	}
+
+	c, info := newInfo(types.RelayFormatOpenAI)
+	resp, err := (&Adaptor{}).DoRequest(c, info, strings.NewReader(`{}`))
+	require.NoError(t, err)
+	newAPIError := service.RelayErrorHandler(c.Request.Context(), resp.(*http.Response), false)
+	require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+	openAIError := newAPIError.ToOpenAIError()
+	require.Equal(t, "INVALID_ARGUMENT", openAIError.Code)
+	require.Equal(t, "API_KEY_INVALID", openAIError.Type)
+	// ToOpenAIError 会把 metadata 附加在 message 后
+	require.True(t, strings.HasPrefix(openAIError.Message, "API key not valid. Please pass a valid API key."))
+	require.Contains(t, openAIError.Message, "API_KEY_INVALID")
+	require.Contains(t, string(openAIError.Metadata), "generativelanguage.googleapis.com")
+
+	// 原生 Gemini 格式保持上游错误体
+	c, info = newInfo(types.RelayFormatGemini)
+	resp, err = (&Adaptor{}).DoRequest(c, info, strings.NewReader(`{}`))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.(*http.Response).Body)
+	require.NoError(t, err)
+	require.JSONEq(t, canonicalGeminiErrorBody, string(body))
+}
@@ -0,0 +1,105 @@
+package gemini
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeminiChatFanOutStreamHandlerAssignsChoiceIndexes(t *testing.T) {
+	t.Parallel()
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{
+		IsStream:    true,
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{
+			UpstreamModelName: "gemini-2.5-flash",
+		},
+	}
+	common.SetContextKey(c, constant.ContextKeyGeminiStreamFanOutN, 2)
+	common.SetContextKey(c, constant.ContextKeyGeminiStreamFanOutBodies, [][]byte{
+		[]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"first"}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":3,"candidatesTokenCount":2,"totalTokenCount":5}}`),
+		[]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"second"}]},"finishReason":"MAX_TOKENS"}],"usageMetadata":{"promptTokenCount":3,"candidatesTokenCount":4,"totalTokenCount":7}}`),
+	})
+
+	usage, apiErr := GeminiChatFanOutStreamHandler(c, info, &http.Response{Body: http.NoBody})
+	require.Nil(t, apiErr)
+	require.Equal(t, 6, usage.PromptTokens)
+	require.Equal(t, 6, usage.CompletionTokens)
+	require.Equal(t, 12, usage.TotalTokens)
+
+	body := recorder.Body.String()
+	first := strings.Index(body, `"first"`)
+	second := strings.Index(body, `"second"`)
+	require.Greater(t, first, 0)
+	require.Greater(t, second, first)
+	require.Contains(t, body, `"finish_reason":"stop","index":0`)
+	require.Contains(t, body, `"finish_reason":"length","index":1`)
+}
+
+func TestDoRequestFansOutConcurrentNonStreamRequests(t *testing.T) {
+	service.InitHttpClient()
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled, oldMinBytes := settings.RequestCompressionEnabled, settings.RequestCompressionMinBytes
+	settings.RequestCompressionEnabled = true
+	settings.RequestCompressionMinBytes = 0
+	t.Cleanup(func() {
+		settings.RequestCompressionEnabled = oldEnabled
+		settings.RequestCompressionMinBytes = oldMinBytes
+	})
+
+	var requests, compressed atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			compressed.Add(1)
+		}
+		if !strings.HasSuffix(r.URL.Path, ":generateContent") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"hi"}]},"finishReason":"STOP"}]}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{
+		IsStream:    true,
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{
+			ChannelType:       constant.ChannelTypeGemini,
+			ChannelBaseUrl:    upstream.URL,
+			UpstreamModelName: "gemini-2.5-flash",
+		},
+	}
+	common.SetContextKey(c, constant.ContextKeyGeminiStreamFanOutN, 3)
+
+	resp, err := (&Adaptor{}).DoRequest(c, info, strings.NewReader(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.(*http.Response).StatusCode)
+	require.EqualValues(t, 3, requests.Load())
+	require.EqualValues(t, 3, compressed.Load())
+	require.True(t, info.IsStream)
+	bodies, ok := common.GetContextKeyType[[][]byte](c, constant.ContextKeyGeminiStreamFanOutBodies)
+	require.True(t, ok)
+	require.Len(t, bodies, 3)
+}
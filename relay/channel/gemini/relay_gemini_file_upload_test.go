@@ -0,0 +1,173 @@
+package gemini
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/types"
+	"github.com/stretchr/testify/require"
+)
+
+func enableGeminiFileUpload(t *testing.T, timeoutSeconds int) {
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled, oldTimeout, oldInterval := settings.FileUploadEnabled, settings.FileUploadActiveTimeoutSeconds, fileActivePollInterval
+	settings.FileUploadEnabled = true
+	settings.FileUploadActiveTimeoutSeconds = timeoutSeconds
+	fileActivePollInterval = 10 * time.Millisecond
+	t.Cleanup(func() {
+		settings.FileUploadEnabled = oldEnabled
+		settings.FileUploadActiveTimeoutSeconds = oldTimeout
+		fileActivePollInterval = oldInterval
+	})
+	service.InitHttpClient()
+}
+
+func newGeminiVideoRequest(video string, count int) dto.GeneralOpenAIRequest {
+	contents := []any{map[string]any{"type": "text", "text": "what happens in these videos?"}}
+	for i := 0; i < count; i++ {
+		contents = append(contents, map[string]any{"type": "video_url", "video_url": video})
+	}
+	return dto.GeneralOpenAIRequest{
+		Model:    "gemini-2.5-flash",
+		Messages: []dto.Message{{Role: "user", Content: contents}},
+	}
+}
+
+func TestCovertOpenAI2GeminiUploadsVideoThroughFileApi(t *testing.T) {
+	enableGeminiFileUpload(t, 5)
+
+	video := []byte("\x00\x00\x00\x18ftypmp42 video bytes")
+	var starts, uploads, polls atomic.Int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/upload/v1beta/files":
+			starts.Add(1)
+			require.Equal(t, "resumable", r.Header.Get("X-Goog-Upload-Protocol"))
+			require.Equal(t, "start", r.Header.Get("X-Goog-Upload-Command"))
+			require.Equal(t, "video/mp4", r.Header.Get("X-Goog-Upload-Header-Content-Type"))
+			require.Equal(t, "test-key", r.Header.Get("x-goog-api-key"))
+			w.Header().Set("X-Goog-Upload-URL", server.URL+"/upload-session/1")
+		case "/upload-session/1":
+			uploads.Add(1)
+			require.Equal(t, "upload, finalize", r.Header.Get("X-Goog-Upload-Command"))
+			body, _ := io.ReadAll(r.Body)
+			require.Equal(t, video, body)
+			_, _ = w.Write([]byte(`{"file":{"name":"files/abc","uri":"https://generativelanguage.googleapis.com/v1beta/files/abc","mimeType":"video/mp4","state":"PROCESSING"}}`))
+		case "/v1beta/files/abc":
+			state := "PROCESSING"
+			if polls.Add(1) > 1 {
+				state = "ACTIVE"
+			}
+			_, _ = w.Write([]byte(`{"name":"files/abc","uri":"https://generativelanguage.googleapis.com/v1beta/files/abc","state":"` + state + `"}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	info.ChannelType = constant.ChannelTypeGemini
+	info.ChannelBaseUrl = server.URL
+	info.ApiKey = "test-key"
+	request := newGeminiVideoRequest("data:video/mp4;base64,"+base64.StdEncoding.EncodeToString(video), 2)
+	geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+	require.NoError(t, err)
+
+	parts := geminiRequest.Contents[0].Parts
+	require.Len(t, parts, 3)
+	for _, part := range parts[1:] {
+		require.Nil(t, part.InlineData)
+		require.Equal(t, &dto.GeminiFileData{MimeType: "video/mp4", FileUri: "https://generativelanguage.googleapis.com/v1beta/files/abc"}, part.FileData)
+	}
+	// 同一请求中重复引用的文件只上传一次
+	require.Equal(t, int32(1), starts.Load())
+	require.Equal(t, int32(1), uploads.Load())
+	require.Equal(t, int32(2), polls.Load())
+}
+
+func TestCovertOpenAI2GeminiFileUploadFailures(t *testing.T) {
+	enableGeminiFileUpload(t, 1)
+
+	for name, tc := range map[string]struct {
+		state      string
+		uploadFail bool
+		status     int
+	}{
+		"upload rejected":  {uploadFail: true, status: http.StatusBadGateway},
+		"processing fails": {state: "FAILED", status: http.StatusBadRequest},
+		"never active":     {state: "PROCESSING", status: http.StatusGatewayTimeout},
+	} {
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/upload/v1beta/files":
+				if tc.uploadFail {
+					w.WriteHeader(http.StatusForbidden)
+					_, _ = w.Write([]byte(`{"error":{"message":"permission denied"}}`))
+					return
+				}
+				w.Header().Set("X-Goog-Upload-URL", server.URL+"/upload-session/1")
+			case "/upload-session/1":
+				_, _ = w.Write([]byte(`{"file":{"name":"files/abc","uri":"https://example.com/files/abc","state":"PROCESSING"}}`))
+			default:
+				_, _ = w.Write([]byte(`{"name":"files/abc","state":"` + tc.state + `"}`))
+			}
+		}))
+
+		c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+		info.ChannelType = constant.ChannelTypeGemini
+		info.ChannelBaseUrl = server.URL
+		request := newGeminiVideoRequest("data:video/mp4;base64,"+base64.StdEncoding.EncodeToString([]byte("video")), 1)
+		_, err := CovertOpenAI2Gemini(c, request, info)
+		server.Close()
+
+		var apiErr *types.NewAPIError
+		require.ErrorAs(t, err, &apiErr, name)
+		require.Equal(t, tc.status, apiErr.StatusCode, name)
+	}
+}
+
+func TestCovertOpenAI2GeminiReuploadsFileOnRetryWithAnotherKey(t *testing.T) {
+	enableGeminiFileUpload(t, 5)
+
+	var startKeys []string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/upload/v1beta/files":
+			startKeys = append(startKeys, r.Header.Get("x-goog-api-key"))
+			w.Header().Set("X-Goog-Upload-URL", server.URL+"/upload-session/1")
+		case "/upload-session/1":
+			_, _ = w.Write([]byte(`{"file":{"name":"files/abc","uri":"https://example.com/files/abc","state":"ACTIVE"}}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	info.ChannelType = constant.ChannelTypeGemini
+	info.ChannelBaseUrl = server.URL
+	request := newGeminiVideoRequest("data:video/mp4;base64,"+base64.StdEncoding.EncodeToString([]byte("video")), 1)
+	// 重试时同一 gin.Context 会换用其他渠道或 key，文件只属于上传它的 key
+	for _, attempt := range []struct {
+		channelId int
+		key       string
+	}{{1, "key-a"}, {2, "key-b"}, {1, "key-a"}} {
+		info.ChannelId = attempt.channelId
+		info.ApiKey = attempt.key
+		_, err := CovertOpenAI2Gemini(c, request, info)
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"key-a", "key-b"}, startKeys)
+}
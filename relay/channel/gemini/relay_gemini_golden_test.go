@@ -0,0 +1,55 @@
+package gemini
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 设置 GEMINI_UPDATE_GOLDEN=1 重新生成 testdata/convert 下的 *.gemini.json
+const updateGoldenEnv = "GEMINI_UPDATE_GOLDEN"
+
+// TestCovertOpenAI2GeminiGolden feeds every testdata/convert/<case>.request.json through
+// CovertOpenAI2Gemini and compares the result with <case>.gemini.json.
+func TestCovertOpenAI2GeminiGolden(t *testing.T) {
+	requestFiles, err := filepath.Glob(filepath.Join("testdata", "convert", "*.request.json"))
+	require.NoError(t, err)
+	require.NotEmpty(t, requestFiles)
+
+	for _, requestFile := range requestFiles {
+		name := strings.TrimSuffix(filepath.Base(requestFile), ".request.json")
+		goldenFile := filepath.Join(filepath.Dir(requestFile), name+".gemini.json")
+		t.Run(name, func(t *testing.T) {
+			requestBody, err := os.ReadFile(requestFile)
+			require.NoError(t, err)
+			var request dto.GeneralOpenAIRequest
+			require.NoError(t, common.Unmarshal(requestBody, &request))
+
+			c, info := newGeminiConvertTestContext(request.Model)
+			geminiRequest, err := CovertOpenAI2Gemini(c, request, info)
+			require.NoError(t, err)
+			actual, err := common.Marshal(geminiRequest)
+			require.NoError(t, err)
+
+			if os.Getenv(updateGoldenEnv) != "" {
+				var formatted bytes.Buffer
+				require.NoError(t, json.Indent(&formatted, actual, "", "  "))
+				formatted.WriteByte('\n')
+				require.NoError(t, os.WriteFile(goldenFile, formatted.Bytes(), 0o644))
+				return
+			}
+
+			expected, err := os.ReadFile(goldenFile)
+			require.NoError(t, err, "missing golden file, run with %s=1 to create it", updateGoldenEnv)
+			require.JSONEq(t, string(expected), string(actual))
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package gemini
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func resetImageResponseCache(t *testing.T, ttlSeconds int) {
+	settings := model_setting.GetGeminiSettings()
+	oldTTL := settings.ImageIdempotencyTTLSeconds
+	settings.ImageIdempotencyTTLSeconds = ttlSeconds
+	imageResponseCacheOnce = sync.Once{}
+	t.Cleanup(func() {
+		settings.ImageIdempotencyTTLSeconds = oldTTL
+		imageResponseCacheOnce = sync.Once{}
+	})
+}
+
+func newImageIdempotencyContext(key string) (*gin.Context, *relaycommon.RelayInfo) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/images/generations", nil)
+	c.Request.Header.Set(imageIdempotencyHeader, key)
+	return c, &relaycommon.RelayInfo{UserId: 1, OriginModelName: "imagen-4.0-generate-001"}
+}
+
+func TestImageIdempotencyReplaysOnlyTheSameRequestBody(t *testing.T) {
+	resetImageResponseCache(t, 60)
+
+	c, info := newImageIdempotencyContext("retry-1")
+	require.Nil(t, getCachedImageResponse(c, info, []byte(`{"prompt":"a cat"}`)))
+	cacheImageResponse(c, []byte(`{"predictions":[]}`))
+
+	c, info = newImageIdempotencyContext("retry-1")
+	resp := getCachedImageResponse(c, info, []byte(`{"prompt":"a cat"}`))
+	require.NotNil(t, resp)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, `{"predictions":[]}`, string(body))
+
+	// 同一个 key 换了请求参数不会回放其他请求的结果
+	c, info = newImageIdempotencyContext("retry-1")
+	require.Nil(t, getCachedImageResponse(c, info, []byte(`{"prompt":"a dog"}`)))
+}
+
+func TestImageIdempotencyDisabledWithoutTTLAndBoundedBySize(t *testing.T) {
+	resetImageResponseCache(t, 0)
+	c, info := newImageIdempotencyContext("retry-1")
+	require.Empty(t, imageIdempotencyCacheKey(c, info, []byte(`{}`)))
+
+	resetImageResponseCache(t, 60)
+	large := strings.Repeat("a", imageIdempotencyCacheMaxBytes/2+1)
+	for _, key := range []string{"first", "second"} {
+		c, info = newImageIdempotencyContext(key)
+		require.Nil(t, getCachedImageResponse(c, info, []byte(`{}`)))
+		cacheImageResponse(c, []byte(large))
+	}
+	c, info = newImageIdempotencyContext("first")
+	require.NotNil(t, getCachedImageResponse(c, info, []byte(`{}`)))
+	// 超出内存上限的响应不再缓存
+	c, info = newImageIdempotencyContext("second")
+	require.Nil(t, getCachedImageResponse(c, info, []byte(`{}`)))
+}
@@ -0,0 +1,101 @@
+package gemini
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/QuantumNous/new-api/constant"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyResponseJqSkipsOversizedNonStreamBody(t *testing.T) {
+	oldMaxBytes := responseJqMaxBytes
+	responseJqMaxBytes = 64
+	t.Cleanup(func() {
+		responseJqMaxBytes = oldMaxBytes
+	})
+
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{ChannelMeta: &relaycommon.ChannelMeta{}}
+	info.ChannelOtherSettings.GeminiResponseJq = `.candidates[0].content.parts[0].text |= ascii_upcase`
+
+	for _, text := range []string{"hello", strings.Repeat("large ", 16)} {
+		body := `{"candidates":[{"content":{"role":"model","parts":[{"text":"` + text + `"}]}}]}`
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}
+		applyResponseJq(c, info, resp)
+		transformed, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		if len(body) > int(responseJqMaxBytes) {
+			require.Equal(t, body, string(transformed))
+		} else {
+			require.JSONEq(t, strings.Replace(body, text, strings.ToUpper(text), 1), string(transformed))
+		}
+	}
+}
+
+func TestResponseJqBufferLimitFollowsSpoolThreshold(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled, oldThreshold := settings.ResponseSpoolEnabled, settings.ResponseSpoolThresholdMB
+	t.Cleanup(func() {
+		settings.ResponseSpoolEnabled, settings.ResponseSpoolThresholdMB = oldEnabled, oldThreshold
+	})
+
+	settings.ResponseSpoolEnabled, settings.ResponseSpoolThresholdMB = false, 1
+	require.Equal(t, responseJqMaxBytes, responseJqBufferLimit())
+	settings.ResponseSpoolEnabled = true
+	require.EqualValues(t, 1<<20, responseJqBufferLimit())
+}
+
+func TestAdaptorAppliesChannelJqTransformations(t *testing.T) {
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+	})
+	service.InitHttpClient()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		require.JSONEq(t, `{"contents":[],"labels":{"team":"ops"}}`, string(body))
+		_, _ = w.Write([]byte("data: " + `{"candidates":[{"content":{"role":"model","parts":[{"text":"hello"}]},"finishReason":"STOP"}]}` + "\n\n"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{
+		IsStream:    true,
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{
+			ChannelBaseUrl:    upstream.URL,
+			UpstreamModelName: "gemini-2.5-flash",
+		},
+	}
+	info.ChannelOtherSettings.GeminiRequestJq = `.labels = {team: "ops"}`
+	info.ChannelOtherSettings.GeminiResponseJq = `.candidates[0].content.parts[0].text |= ascii_upcase`
+
+	adaptor := &Adaptor{}
+	resp, err := adaptor.DoRequest(c, info, strings.NewReader(`{"contents":[]}`))
+	require.NoError(t, err)
+	_, newAPIError := adaptor.DoResponse(c, resp.(*http.Response), info)
+	require.Nil(t, newAPIError)
+	require.Contains(t, recorder.Body.String(), `"content":"HELLO"`)
+}
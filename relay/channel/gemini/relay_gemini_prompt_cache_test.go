@@ -0,0 +1,300 @@
+package gemini
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertOpenAIRequestMapsPromptCacheKeyToCachedContent(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled := settings.PromptCacheKeyEnabled
+	settings.PromptCacheKeyEnabled = true
+	t.Cleanup(func() {
+		settings.PromptCacheKeyEnabled = oldEnabled
+	})
+	service.InitHttpClient()
+
+	var creates atomic.Int32
+	var createdContents atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1beta/cachedContents", r.URL.Path)
+		require.Equal(t, "test-key", r.Header.Get("x-goog-api-key"))
+		body, _ := io.ReadAll(r.Body)
+		var payload struct {
+			Model             string                  `json:"model"`
+			Contents          []dto.GeminiChatContent `json:"contents"`
+			SystemInstruction *dto.GeminiChatContent  `json:"systemInstruction"`
+		}
+		require.NoError(t, common.Unmarshal(body, &payload))
+		require.Equal(t, "models/gemini-2.5-flash", payload.Model)
+		require.NotNil(t, payload.SystemInstruction)
+		creates.Add(1)
+		createdContents.Store(int32(len(payload.Contents)))
+		_, _ = w.Write([]byte(`{"name":"cachedContents/abc"}`))
+	}))
+	defer server.Close()
+
+	newRequest := func(turns ...string) *dto.GeneralOpenAIRequest {
+		messages := []dto.Message{{Role: "system", Content: "You are a long system prompt"}}
+		for i, turn := range turns {
+			role := "user"
+			if i%2 == 1 {
+				role = "assistant"
+			}
+			messages = append(messages, dto.Message{Role: role, Content: turn})
+		}
+		return &dto.GeneralOpenAIRequest{Model: "gemini-2.5-flash", Messages: messages, PromptCacheKey: "conversation-1"}
+	}
+	convert := func(request *dto.GeneralOpenAIRequest) *dto.GeminiChatRequest {
+		c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+		info.UserId = 1
+		info.ChannelId = 7
+		info.ChannelType = constant.ChannelTypeGemini
+		info.ChannelBaseUrl = server.URL
+		info.ApiKey = "test-key"
+		converted, err := (&Adaptor{}).ConvertOpenAIRequest(c, info, request)
+		require.NoError(t, err)
+		return converted.(*dto.GeminiChatRequest)
+	}
+
+	first := convert(newRequest("q1", "a1", "q2"))
+	require.Equal(t, "cachedContents/abc", first.CachedContent)
+	require.Nil(t, first.SystemInstructions)
+	require.Len(t, first.Contents, 1)
+	require.Equal(t, int32(1), creates.Load())
+	require.Equal(t, int32(2), createdContents.Load())
+
+	// the conversation grew, the cached prefix is still reused without a new cachedContent
+	second := convert(newRequest("q1", "a1", "q2", "a2", "q3"))
+	require.Equal(t, "cachedContents/abc", second.CachedContent)
+	require.Len(t, second.Contents, 3)
+	require.Equal(t, int32(1), creates.Load())
+
+	// an edited history no longer matches the cached prefix
+	third := convert(newRequest("other", "a1", "q2"))
+	require.Equal(t, "cachedContents/abc", third.CachedContent)
+	require.Equal(t, int32(2), creates.Load())
+
+	request := newRequest("q1", "a1", "q2")
+	request.PromptCacheKey = ""
+	uncached := convert(request)
+	require.Empty(t, uncached.CachedContent)
+	require.Len(t, uncached.Contents, 3)
+}
+
+func TestPromptCacheKeyCreationFailureFallsBackUncached(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled := settings.PromptCacheKeyEnabled
+	settings.PromptCacheKeyEnabled = true
+	t.Cleanup(func() {
+		settings.PromptCacheKeyEnabled = oldEnabled
+	})
+	service.InitHttpClient()
+
+	var creates atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		creates.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":{"message":"Cached content is too small"}}`))
+	}))
+	defer server.Close()
+
+	request := &dto.GeneralOpenAIRequest{
+		Model:          "gemini-2.5-flash",
+		Messages:       []dto.Message{{Role: "user", Content: "q1"}, {Role: "assistant", Content: "a1"}, {Role: "user", Content: "q2"}},
+		PromptCacheKey: "too-small",
+	}
+	for i := 0; i < 2; i++ {
+		c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+		info.ChannelType = constant.ChannelTypeGemini
+		info.ChannelBaseUrl = server.URL
+		info.ApiKey = "failing-key"
+		converted, err := (&Adaptor{}).ConvertOpenAIRequest(c, info, request)
+		require.NoError(t, err)
+		require.Empty(t, converted.(*dto.GeminiChatRequest).CachedContent)
+		require.Len(t, converted.(*dto.GeminiChatRequest).Contents, 3)
+	}
+	require.Equal(t, int32(1), creates.Load())
+}
+
+func TestChannelContextCacheRecreatesRejectedCachedContent(t *testing.T) {
+	service.InitHttpClient()
+
+	var creates atomic.Int32
+	var sentCachedContents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1beta/cachedContents" {
+			name := fmt.Sprintf("cachedContents/%d", creates.Add(1))
+			_, _ = w.Write([]byte(fmt.Sprintf(`{"name":%q}`, name)))
+			return
+		}
+		require.Equal(t, "/v1beta/models/gemini-2.5-flash:generateContent", r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		var request dto.GeminiChatRequest
+		require.NoError(t, common.Unmarshal(body, &request))
+		sentCachedContents = append(sentCachedContents, request.CachedContent)
+		if request.CachedContent == "cachedContents/1" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"error":{"code":403,"message":"CachedContent not found (or permission denied)"}}`))
+			return
+		}
+		require.Len(t, request.Contents, 1)
+		_, _ = w.Write([]byte(`{"candidates":[]}`))
+	}))
+	defer server.Close()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	info.ChannelType = constant.ChannelTypeGemini
+	info.ChannelBaseUrl = server.URL
+	info.ApiKey = "context-cache-key"
+	info.ChannelOtherSettings.GeminiContextCacheEnabled = true
+	request := &dto.GeneralOpenAIRequest{
+		Model: "gemini-2.5-flash",
+		Messages: []dto.Message{
+			{Role: "system", Content: "You are a long system prompt"},
+			{Role: "user", Content: "here is a long document"},
+			{Role: "user", Content: "summarize it"},
+		},
+	}
+	adaptor := &Adaptor{}
+	converted, err := adaptor.ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+	require.Equal(t, "cachedContents/1", converted.(*dto.GeminiChatRequest).CachedContent)
+	body, err := common.Marshal(converted)
+	require.NoError(t, err)
+
+	resp, err := adaptor.DoRequest(c, info, bytes.NewReader(body))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.(*http.Response).StatusCode)
+	require.Equal(t, []string{"cachedContents/1", "cachedContents/2"}, sentCachedContents)
+
+	// the recreated cache is reused by the next request
+	c, info = newGeminiConvertTestContext("gemini-2.5-flash")
+	info.ChannelType = constant.ChannelTypeGemini
+	info.ChannelBaseUrl = server.URL
+	info.ApiKey = "context-cache-key"
+	info.ChannelOtherSettings.GeminiContextCacheEnabled = true
+	converted, err = adaptor.ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+	require.Equal(t, "cachedContents/2", converted.(*dto.GeminiChatRequest).CachedContent)
+	require.Equal(t, int32(2), creates.Load())
+}
+
+func TestPromptCacheIncludesChannelSystemPromptAndBillsCreation(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled := settings.PromptCacheKeyEnabled
+	settings.PromptCacheKeyEnabled = true
+	t.Cleanup(func() {
+		settings.PromptCacheKeyEnabled = oldEnabled
+	})
+	service.InitHttpClient()
+
+	var createdSystem string
+	var createdKey string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload struct {
+			SystemInstruction *dto.GeminiChatContent `json:"systemInstruction"`
+		}
+		require.NoError(t, common.Unmarshal(body, &payload))
+		require.NotNil(t, payload.SystemInstruction)
+		createdSystem = payload.SystemInstruction.Parts[0].Text
+		createdKey = r.Header.Get("x-goog-api-key")
+		_, _ = w.Write([]byte(`{"name":"cachedContents/sys","usageMetadata":{"totalTokenCount":4096}}`))
+	}))
+	defer server.Close()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	info.ChannelType = constant.ChannelTypeGemini
+	info.ChannelBaseUrl = server.URL
+	info.ApiKey = "channel-key"
+	info.ChannelSetting.SystemPrompt = "channel rules"
+	common.SetContextKey(c, constant.ContextKeyTokenProviderKey, true)
+	c.Request.Header.Set("X-Provider-Api-Key", "client-key")
+	request := &dto.GeneralOpenAIRequest{
+		Model:          "gemini-2.5-flash",
+		Messages:       []dto.Message{{Role: "user", Content: "q1"}, {Role: "assistant", Content: "a1"}, {Role: "user", Content: "q2"}},
+		PromptCacheKey: "with-channel-prompt",
+	}
+	converted, err := (&Adaptor{}).ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+	geminiRequest := converted.(*dto.GeminiChatRequest)
+	// 渠道系统提示随缓存一起创建，请求本身不能再携带 systemInstruction
+	require.Equal(t, "cachedContents/sys", geminiRequest.CachedContent)
+	require.Nil(t, geminiRequest.SystemInstructions)
+	require.Equal(t, "channel rules", createdSystem)
+	require.Equal(t, "client-key", createdKey)
+
+	usage := &dto.Usage{PromptTokens: 4100, TotalTokens: 4110}
+	applyPromptCacheCreationUsage(c, usage)
+	require.Equal(t, 8196, usage.PromptTokens)
+	require.Equal(t, 4096, usage.PromptTokensDetails.CachedCreationTokens)
+}
+
+func TestApplyChannelSystemPromptSkipsRequestsWithCachedContent(t *testing.T) {
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	info.ChannelSetting.SystemPrompt = "channel rules"
+
+	request := &dto.GeminiChatRequest{CachedContent: "cachedContents/client"}
+	ApplyChannelSystemPrompt(c, info, request)
+	require.Nil(t, request.SystemInstructions)
+
+	request = &dto.GeminiChatRequest{}
+	ApplyChannelSystemPrompt(c, info, request)
+	require.NotNil(t, request.SystemInstructions)
+	require.Equal(t, "channel rules", request.SystemInstructions.Parts[0].Text)
+}
+
+func TestPromptCacheRequestDoesNotRecreateOnInvalidArgument(t *testing.T) {
+	service.InitHttpClient()
+
+	var creates, generates atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1beta/cachedContents" {
+			creates.Add(1)
+			_, _ = w.Write([]byte(`{"name":"cachedContents/invalid"}`))
+			return
+		}
+		generates.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":{"code":400,"message":"CachedContent can not be used with GenerateContent request setting system_instruction","status":"INVALID_ARGUMENT"}}`))
+	}))
+	defer server.Close()
+
+	c, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	info.ChannelType = constant.ChannelTypeGemini
+	info.ChannelBaseUrl = server.URL
+	info.ApiKey = "invalid-argument-key"
+	info.ChannelOtherSettings.GeminiContextCacheEnabled = true
+	request := &dto.GeneralOpenAIRequest{
+		Model: "gemini-2.5-flash",
+		Messages: []dto.Message{
+			{Role: "system", Content: "You are a long system prompt"},
+			{Role: "user", Content: "here is a long document"},
+			{Role: "user", Content: "summarize it"},
+		},
+	}
+	adaptor := &Adaptor{}
+	converted, err := adaptor.ConvertOpenAIRequest(c, info, request)
+	require.NoError(t, err)
+	body, err := common.Marshal(converted)
+	require.NoError(t, err)
+
+	resp, err := adaptor.DoRequest(c, info, bytes.NewReader(body))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.(*http.Response).StatusCode)
+	require.Equal(t, int32(1), creates.Load())
+	require.Equal(t, int32(1), generates.Load())
+}
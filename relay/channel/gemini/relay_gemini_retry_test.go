@@ -0,0 +1,144 @@
+package gemini
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoRequestRetriesRateLimitedRequests(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldAttempts, oldMaxDelay := settings.RateLimitRetryMaxAttempts, settings.RateLimitRetryMaxDelaySeconds
+	settings.RateLimitRetryMaxAttempts = 2
+	settings.RateLimitRetryMaxDelaySeconds = 1
+	t.Cleanup(func() {
+		settings.RateLimitRetryMaxAttempts, settings.RateLimitRetryMaxDelaySeconds = oldAttempts, oldMaxDelay
+	})
+	service.InitHttpClient()
+
+	const requestBody = `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	var statuses []int
+	var retryDelay string
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		require.Equal(t, requestBody, string(data))
+		index := int(calls.Add(1)) - 1
+		if index >= len(statuses) || statuses[index] == http.StatusOK {
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		w.WriteHeader(statuses[index])
+		_, _ = w.Write([]byte(`{"error":{"code":429,"message":"Resource has been exhausted","status":"RESOURCE_EXHAUSTED","details":[{"@type":"type.googleapis.com/google.rpc.RetryInfo","retryDelay":"` + retryDelay + `"}]}}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	doRequest := func(settings dto.ChannelOtherSettings) *http.Response {
+		calls.Store(0)
+		gin.SetMode(gin.TestMode)
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		info := &relaycommon.RelayInfo{ChannelMeta: &relaycommon.ChannelMeta{
+			ChannelType:          constant.ChannelTypeGemini,
+			ChannelBaseUrl:       upstream.URL,
+			UpstreamModelName:    "gemini-2.5-flash",
+			ChannelOtherSettings: settings,
+		}}
+		resp, err := (&Adaptor{}).DoRequest(c, info, strings.NewReader(requestBody))
+		require.NoError(t, err)
+		return resp.(*http.Response)
+	}
+
+	retryDelay = "0.01s"
+	statuses = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusOK}
+	require.Equal(t, http.StatusOK, doRequest(dto.ChannelOtherSettings{}).StatusCode)
+	require.EqualValues(t, 3, calls.Load())
+
+	// attempts exhausted, the last 429 is returned with its body intact
+	statuses = []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusOK}
+	resp := doRequest(dto.ChannelOtherSettings{})
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.EqualValues(t, 3, calls.Load())
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "RESOURCE_EXHAUSTED")
+
+	// channel override disables retries
+	statuses = []int{http.StatusTooManyRequests, http.StatusOK}
+	require.Equal(t, http.StatusTooManyRequests, doRequest(dto.ChannelOtherSettings{GeminiRateLimitRetryMaxAttempts: -1}).StatusCode)
+	require.EqualValues(t, 1, calls.Load())
+
+	// a suggested delay above the configured maximum is not waited for
+	retryDelay = "37s"
+	require.Equal(t, http.StatusTooManyRequests, doRequest(dto.ChannelOtherSettings{}).StatusCode)
+	require.EqualValues(t, 1, calls.Load())
+
+	// non-retryable client errors are returned immediately
+	for _, status := range []int{http.StatusBadRequest, http.StatusForbidden} {
+		statuses = []int{status, http.StatusOK}
+		require.Equal(t, status, doRequest(dto.ChannelOtherSettings{}).StatusCode)
+		require.EqualValues(t, 1, calls.Load())
+	}
+
+	// in-flight dedup sends through the same retry path
+	oldDedup := settings.InFlightDedupEnabled
+	settings.InFlightDedupEnabled = true
+	t.Cleanup(func() {
+		settings.InFlightDedupEnabled = oldDedup
+	})
+	retryDelay = "0.01s"
+	statuses = []int{http.StatusTooManyRequests, http.StatusOK}
+	require.Equal(t, http.StatusOK, doRequest(dto.ChannelOtherSettings{}).StatusCode)
+	require.EqualValues(t, 2, calls.Load())
+}
+
+func TestDoRequestStopsRateLimitRetryWhenClientCancels(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldAttempts, oldMaxDelay := settings.RateLimitRetryMaxAttempts, settings.RateLimitRetryMaxDelaySeconds
+	settings.RateLimitRetryMaxAttempts = 3
+	settings.RateLimitRetryMaxDelaySeconds = 30
+	t.Cleanup(func() {
+		settings.RateLimitRetryMaxAttempts, settings.RateLimitRetryMaxDelaySeconds = oldAttempts, oldMaxDelay
+	})
+	service.InitHttpClient()
+
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	t.Cleanup(upstream.Close)
+
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil).WithContext(ctx)
+	info := &relaycommon.RelayInfo{ChannelMeta: &relaycommon.ChannelMeta{
+		ChannelType:       constant.ChannelTypeGemini,
+		ChannelBaseUrl:    upstream.URL,
+		UpstreamModelName: "gemini-2.5-flash",
+	}}
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	resp, err := (&Adaptor{}).DoRequest(c, info, strings.NewReader(`{}`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.(*http.Response).StatusCode)
+	require.EqualValues(t, 1, calls.Load())
+	require.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,77 @@
+package gemini
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoRequestAppliesChannelTimeouts(t *testing.T) {
+	t.Parallel()
+	service.InitHttpClient()
+
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.RawQuery, "alt=sse") {
+			_, _ = w.Write([]byte("data: {\"candidates\":[]}\n\n"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	t.Cleanup(func() {
+		close(release)
+		upstream.Close()
+	})
+
+	newInfo := func(isStream bool) (*gin.Context, *relaycommon.RelayInfo) {
+		gin.SetMode(gin.TestMode)
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		return c, &relaycommon.RelayInfo{IsStream: isStream, ChannelMeta: &relaycommon.ChannelMeta{
+			ChannelType:       constant.ChannelTypeGemini,
+			ChannelBaseUrl:    upstream.URL,
+			UpstreamModelName: "gemini-2.5-flash",
+			ChannelOtherSettings: dto.ChannelOtherSettings{
+				GeminiRequestTimeoutSeconds:    1,
+				GeminiStreamIdleTimeoutSeconds: 1,
+			},
+		}}
+	}
+
+	c, info := newInfo(false)
+	start := time.Now()
+	_, err := (&Adaptor{}).DoRequest(c, info, strings.NewReader(`{}`))
+	var apiErr *types.NewAPIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusGatewayTimeout, apiErr.StatusCode)
+	require.Less(t, time.Since(start), 3*time.Second)
+
+	// 流式请求不受整体超时限制，收到首个分片后空闲超过 1 秒才断开
+	c, info = newInfo(true)
+	resp, err := (&Adaptor{}).DoRequest(c, info, strings.NewReader(`{}`))
+	require.NoError(t, err)
+	require.True(t, info.UpstreamDeadline.IsZero())
+	body := resp.(*http.Response).Body
+	t.Cleanup(func() { _ = body.Close() })
+	start = time.Now()
+	data, err := io.ReadAll(body)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "idle")
+	require.Equal(t, "data: {\"candidates\":[]}\n\n", string(data))
+	require.Less(t, time.Since(start), 3*time.Second)
+}
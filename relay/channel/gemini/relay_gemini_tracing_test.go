@@ -0,0 +1,103 @@
+package gemini
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestGeminiAdaptorRecordsTracingSpans(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled := settings.TracingEnabled
+	oldProvider := otel.GetTracerProvider()
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	settings.TracingEnabled = true
+	t.Cleanup(func() {
+		settings.TracingEnabled = oldEnabled
+		otel.SetTracerProvider(oldProvider)
+	})
+
+	oldPropagator := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTextMapPropagator(oldPropagator)
+	})
+	service.InitHttpClient()
+
+	stop := "STOP"
+	body, err := common.Marshal(dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{
+			{FinishReason: &stop, Content: dto.GeminiChatContent{Role: "model", Parts: []dto.GeminiPart{{Text: "ok"}}}},
+		},
+		UsageMetadata: dto.GeminiUsageMetadata{PromptTokenCount: 12, CandidatesTokenCount: 3, TotalTokenCount: 15},
+	})
+	require.NoError(t, err)
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(upstream.Close)
+
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	requestCtx, finishRequest := context.WithCancel(context.Background())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil).WithContext(requestCtx)
+	_, info := newGeminiConvertTestContext("gemini-2.5-flash")
+	info.ChannelBaseUrl = upstream.URL
+
+	adaptor := &Adaptor{}
+	converted, err := adaptor.ConvertOpenAIRequest(c, info, &dto.GeneralOpenAIRequest{
+		Model:    "gemini-2.5-flash",
+		Messages: []dto.Message{{Role: "user", Content: "hello"}},
+	})
+	require.NoError(t, err)
+	requestBody, err := common.Marshal(converted)
+	require.NoError(t, err)
+	resp, err := adaptor.DoRequest(c, info, bytes.NewReader(requestBody))
+	require.NoError(t, err)
+	_, newAPIError := adaptor.DoResponse(c, resp.(*http.Response), info)
+	require.Nil(t, newAPIError)
+
+	// 请求 span 在客户端请求结束（context 取消）后才结束
+	require.Len(t, recorder.Ended(), 3)
+	finishRequest()
+	require.Eventually(t, func() bool { return len(recorder.Ended()) == 4 }, time.Second, 10*time.Millisecond)
+
+	spans := recorder.Ended()
+	convertSpan, upstreamSpan, responseSpan, requestSpan := spans[0], spans[1], spans[2], spans[3]
+	require.Equal(t, "gemini.convert_request", convertSpan.Name())
+	require.Equal(t, "gemini.upstream_request", upstreamSpan.Name())
+	require.Equal(t, "gemini.handle_response", responseSpan.Name())
+	require.Equal(t, "gemini.request", requestSpan.Name())
+	for _, span := range []sdktrace.ReadOnlySpan{convertSpan, upstreamSpan, responseSpan} {
+		require.Equal(t, requestSpan.SpanContext().TraceID(), span.SpanContext().TraceID())
+		require.Equal(t, requestSpan.SpanContext().SpanID(), span.Parent().SpanID())
+	}
+	require.Contains(t, traceparent, upstreamSpan.SpanContext().SpanID().String())
+
+	attributes := make(map[attribute.Key]attribute.Value)
+	for _, kv := range responseSpan.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	require.Equal(t, "gemini-2.5-flash", attributes["gen_ai.request.model"].AsString())
+	require.Equal(t, int64(12), attributes["gen_ai.usage.input_tokens"].AsInt64())
+	require.Equal(t, int64(3), attributes["gen_ai.usage.output_tokens"].AsInt64())
+	require.Equal(t, []string{"STOP"}, attributes["gen_ai.response.finish_reasons"].AsStringSlice())
+}
@@ -2,15 +2,28 @@ package gemini
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"image"
+	"image/png"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/pkg/billingexpr"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/service"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/setting/ratio_setting"
 	"github.com/QuantumNous/new-api/types"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/require"
@@ -331,3 +344,549 @@ func TestGeminiTextGenerationHandlerUsesEstimatedPromptTokensWhenUsagePromptMiss
 	require.Equal(t, 100, usage.CompletionTokens)
 	require.Equal(t, 110, usage.TotalTokens)
 }
+
+func TestGeminiHandlersMapCachedAndThoughtsTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+	})
+
+	// usageMetadata 取自 gemini-2.5-pro 使用 cachedContent 的真实响应
+	body := `{"candidates":[{"content":{"role":"model","parts":[{"text":"ok"}]},"finishReason":"STOP","index":0}],` +
+		`"usageMetadata":{"promptTokenCount":12840,"candidatesTokenCount":356,"totalTokenCount":14217,"cachedContentTokenCount":12288,` +
+		`"promptTokensDetails":[{"modality":"TEXT","tokenCount":12840}],"cacheTokensDetails":[{"modality":"TEXT","tokenCount":12288}],` +
+		`"thoughtsTokenCount":1021},"modelVersion":"gemini-2.5-pro","responseId":"x5JXaLmSJ8GWz7IPlaKo4Q0"}`
+	check := func(usage *dto.Usage) {
+		require.NotNil(t, usage)
+		// prompt_tokens 保持 OpenAI 语义包含缓存部分，计费时按 cached_tokens 扣除后以缓存倍率计费
+		require.Equal(t, 12840, usage.PromptTokens)
+		require.Equal(t, 12288, usage.PromptTokensDetails.CachedTokens)
+		require.Equal(t, 12840, usage.PromptTokensDetails.TextTokens)
+		require.Equal(t, 356+1021, usage.CompletionTokens)
+		require.Equal(t, 1021, usage.CompletionTokenDetails.ReasoningTokens)
+		require.Equal(t, 14217, usage.TotalTokens)
+	}
+
+	newInfo := func() *relaycommon.RelayInfo {
+		return &relaycommon.RelayInfo{
+			RelayFormat:     types.RelayFormatOpenAI,
+			OriginModelName: "gemini-2.5-pro",
+			ChannelMeta:     &relaycommon.ChannelMeta{UpstreamModelName: "gemini-2.5-pro"},
+		}
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	usage, newAPIError := GeminiChatHandler(c, newInfo(), &http.Response{Body: io.NopCloser(strings.NewReader(body))})
+	require.Nil(t, newAPIError)
+	check(usage)
+
+	c, _ = gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	streamBody := "data: " + body + "\n" + "data: [DONE]\n"
+	usage, newAPIError = GeminiChatStreamHandler(c, newInfo(), &http.Response{Body: io.NopCloser(strings.NewReader(streamBody))})
+	require.Nil(t, newAPIError)
+	check(usage)
+}
+
+func TestGeminiImplicitCacheUsageUsesCacheRatio(t *testing.T) {
+	t.Parallel()
+
+	// 未使用显式缓存时 Gemini 2.5 也会返回 cachedContentTokenCount
+	usage := buildUsageFromGeminiMetadata(dto.GeminiUsageMetadata{
+		PromptTokenCount:        2000,
+		CandidatesTokenCount:    10,
+		TotalTokenCount:         2010,
+		CachedContentTokenCount: 1536,
+	}, 0)
+	require.Equal(t, 1536, usage.PromptTokensDetails.CachedTokens)
+
+	ratio_setting.InitRatioSettings()
+	for _, modelName := range []string{"gemini-2.5-flash", "gemini-2.5-flash-preview-09-2025", "gemini-2.5-pro-thinking-128", "gemini-2.5-flash-lite"} {
+		ratio, ok := ratio_setting.GetCacheRatio(modelName)
+		require.True(t, ok, modelName)
+		require.Equal(t, 0.1, ratio, modelName)
+	}
+	_, ok := ratio_setting.GetCacheRatio("gemini-1.0-pro")
+	require.False(t, ok)
+}
+
+func TestGeminiChatHandlerReturnsSafetyFallbackMessage(t *testing.T) {
+	t.Parallel()
+
+	gin.SetMode(gin.TestMode)
+	for _, body := range []string{
+		`{"promptFeedback":{"blockReason":"PROHIBITED_CONTENT"},"usageMetadata":{"promptTokenCount":5,"totalTokenCount":5}}`,
+		`{"candidates":[{"content":{"role":"model","parts":[]},"finishReason":"SAFETY"}],"usageMetadata":{"promptTokenCount":5,"totalTokenCount":5}}`,
+	} {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		info := &relaycommon.RelayInfo{
+			RelayFormat: types.RelayFormatOpenAI,
+			ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "gemini-2.5-flash"},
+		}
+		info.ChannelOtherSettings.GeminiSafetyFallbackMessage = "I can't help with that."
+
+		_, newAPIError := GeminiChatHandler(c, info, &http.Response{Body: io.NopCloser(bytes.NewReader([]byte(body)))})
+		require.Nil(t, newAPIError)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var response dto.OpenAITextResponse
+		require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &response))
+		require.Len(t, response.Choices, 1)
+		require.Equal(t, "I can't help with that.", response.Choices[0].Message.StringContent())
+		require.Equal(t, constant.FinishReasonStop, response.Choices[0].FinishReason)
+		require.Nil(t, response.Choices[0].Message.Refusal)
+	}
+}
+
+func TestGeminiChatHandlerSpoolsLargeResponseToDisk(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldEnabled, oldThreshold := settings.ResponseSpoolEnabled, settings.ResponseSpoolThresholdMB
+	settings.ResponseSpoolEnabled = true
+	settings.ResponseSpoolThresholdMB = 1
+	t.Cleanup(func() {
+		settings.ResponseSpoolEnabled, settings.ResponseSpoolThresholdMB = oldEnabled, oldThreshold
+	})
+	spoolDir := t.TempDir()
+	t.Setenv("TMPDIR", spoolDir)
+
+	text := strings.Repeat("long document ", 100_000)
+	body, err := common.Marshal(dto.GeminiChatResponse{
+		Candidates: []dto.GeminiChatCandidate{{
+			Content: dto.GeminiChatContent{Role: "model", Parts: []dto.GeminiPart{{Text: text}}},
+		}},
+		UsageMetadata: dto.GeminiUsageMetadata{PromptTokenCount: 3, CandidatesTokenCount: 5, TotalTokenCount: 8},
+	})
+	require.NoError(t, err)
+	require.Greater(t, len(body), 1<<20)
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	info := &relaycommon.RelayInfo{
+		RelayFormat: types.RelayFormatOpenAI,
+		ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "gemini-2.5-flash"},
+	}
+
+	usage, newAPIError := GeminiChatHandler(c, info, &http.Response{Body: io.NopCloser(bytes.NewReader(body))})
+	require.Nil(t, newAPIError)
+	require.Equal(t, 8, usage.TotalTokens)
+
+	var response dto.OpenAITextResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Equal(t, text, response.Choices[0].Message.StringContent())
+
+	// the spool file is removed once the response was relayed
+	entries, err := os.ReadDir(spoolDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestGeminiUsageSelectsLongContextBillingTier(t *testing.T) {
+	t.Parallel()
+
+	const expr = `len <= 200000 ? tier("standard", p * 1.25 + c * 10 + cr * 0.125) : tier("long_context", p * 2.5 + c * 15 + cr * 0.25)`
+	for _, tc := range []struct {
+		prompt, cached int
+		tier           string
+		cost           float64
+	}{
+		{prompt: 150_000, cached: 0, tier: "standard", cost: 150_000*1.25 + 1_000*10},
+		// 缓存命中不应让长上下文请求落入标准档位
+		{prompt: 250_000, cached: 100_000, tier: "long_context", cost: 150_000*2.5 + 1_000*15 + 100_000*0.25},
+	} {
+		usage := buildUsageFromGeminiMetadata(dto.GeminiUsageMetadata{
+			PromptTokenCount:        tc.prompt,
+			CachedContentTokenCount: tc.cached,
+			CandidatesTokenCount:    1_000,
+			TotalTokenCount:         tc.prompt + 1_000,
+		}, 0)
+		params := service.BuildTieredTokenParams(&usage, false, billingexpr.UsedVars(expr))
+		cost, trace, err := billingexpr.RunExpr(expr, params)
+		require.NoError(t, err)
+		require.Equal(t, tc.tier, trace.MatchedTier)
+		require.InDelta(t, tc.cost, cost, 1e-6)
+	}
+}
+
+func TestGeminiGeneratedImageTokensCountTiles(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, 258, GeminiGeneratedImageTokens(0, 0))
+	require.Equal(t, 258, GeminiGeneratedImageTokens(384, 384))
+	require.Equal(t, 258, GeminiGeneratedImageTokens(768, 768))
+	require.Equal(t, 1032, GeminiGeneratedImageTokens(1024, 1024))
+	require.Equal(t, 1032, GeminiGeneratedImageTokens(1536, 1024))
+	require.Equal(t, 2322, GeminiGeneratedImageTokens(2048, 2048))
+}
+
+func TestGeminiImageHandlerBillsGeneratedImagesByResolution(t *testing.T) {
+	t.Parallel()
+
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/images/generations", nil)
+	info := &relaycommon.RelayInfo{
+		OriginModelName: "imagen-4.0-generate-001",
+		ChannelMeta:     &relaycommon.ChannelMeta{UpstreamModelName: "imagen-4.0-generate-001"},
+	}
+
+	var encoded bytes.Buffer
+	require.NoError(t, png.Encode(&encoded, image.NewGray(image.Rect(0, 0, 1536, 1024))))
+	body, err := common.Marshal(dto.GeminiImageResponse{Predictions: []dto.GeminiImagePrediction{
+		{MimeType: "image/png", BytesBase64Encoded: base64.StdEncoding.EncodeToString(encoded.Bytes())},
+		{MimeType: "image/png", BytesBase64Encoded: "bm90IGFuIGltYWdl"},
+	}})
+	require.NoError(t, err)
+
+	usage, newAPIError := GeminiImageHandler(c, info, &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body))})
+	require.Nil(t, newAPIError)
+	require.Equal(t, 1032+258, usage.PromptTokens)
+	require.Equal(t, 0, usage.CompletionTokens)
+	require.Equal(t, 1032+258, usage.TotalTokens)
+}
+
+func TestGeminiImageHandlerReportsRaiFilteredImages(t *testing.T) {
+	t.Parallel()
+
+	newContext := func() (*gin.Context, *httptest.ResponseRecorder, *relaycommon.RelayInfo) {
+		gin.SetMode(gin.TestMode)
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/images/generations", nil)
+		info := &relaycommon.RelayInfo{
+			OriginModelName: "imagen-4.0-generate-001",
+			ChannelMeta:     &relaycommon.ChannelMeta{UpstreamModelName: "imagen-4.0-generate-001"},
+		}
+		info.PriceData.UsePrice = true
+		return c, recorder, info
+	}
+	filtered := dto.GeminiImagePrediction{RaiFilteredReason: "Unable to show generated images. Person generation was blocked."}
+	otherFiltered := dto.GeminiImagePrediction{RaiFilteredReason: "Image was filtered for violence."}
+
+	body, err := common.Marshal(dto.GeminiImageResponse{Predictions: []dto.GeminiImagePrediction{filtered, filtered, otherFiltered}})
+	require.NoError(t, err)
+	c, _, info := newContext()
+	_, newAPIError := GeminiImageHandler(c, info, &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body))})
+	require.NotNil(t, newAPIError)
+	require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+	openAIError := newAPIError.ToOpenAIError()
+	require.Equal(t, "content_filter", openAIError.Type)
+	require.Equal(t, "All 3 generated images were filtered by Gemini responsible AI: "+filtered.RaiFilteredReason+"; "+otherFiltered.RaiFilteredReason, openAIError.Message)
+
+	body, err = common.Marshal(dto.GeminiImageResponse{Predictions: []dto.GeminiImagePrediction{
+		{MimeType: "image/png", BytesBase64Encoded: "bm90IGFuIGltYWdl"},
+		filtered,
+		{MimeType: "image/png", BytesBase64Encoded: "bm90IGFuIGltYWdl"},
+		otherFiltered,
+	}})
+	require.NoError(t, err)
+	c, recorder, info := newContext()
+	usage, newAPIError := GeminiImageHandler(c, info, &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body))})
+	require.Nil(t, newAPIError)
+	require.Equal(t, 2*258, usage.PromptTokens)
+	require.Equal(t, 2.0, info.PriceData.OtherRatios["n"])
+
+	var response dto.ImageResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Len(t, response.Data, 2)
+	require.JSONEq(t, `{"filtered_count":2,"filtered_reasons":["`+filtered.RaiFilteredReason+`","`+otherFiltered.RaiFilteredReason+`"]}`, string(response.Metadata))
+}
+
+func TestGeminiDoResponseDecodesCompressedBodies(t *testing.T) {
+	t.Parallel()
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/images/generations", nil)
+	info := &relaycommon.RelayInfo{
+		OriginModelName: "imagen-4.0-generate-001",
+		ChannelMeta:     &relaycommon.ChannelMeta{UpstreamModelName: "imagen-4.0-generate-001"},
+	}
+	body, err := common.Marshal(dto.GeminiImageResponse{Predictions: []dto.GeminiImagePrediction{
+		{MimeType: "image/png", BytesBase64Encoded: "bm90IGFuIGltYWdl"},
+	}})
+	require.NoError(t, err)
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	_, err = gzipWriter.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, gzipWriter.Close())
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Encoding": []string{"gzip"}, "Content-Length": []string{"123"}},
+		Body:       io.NopCloser(bytes.NewReader(compressed.Bytes())),
+	}
+	usage, newAPIError := (&Adaptor{}).DoResponse(c, resp, info)
+	require.Nil(t, newAPIError)
+	require.Equal(t, 258, usage.(*dto.Usage).PromptTokens)
+	var response dto.ImageResponse
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Len(t, response.Data, 1)
+	require.Equal(t, "bm90IGFuIGltYWdl", response.Data[0].B64Json)
+
+	stream := []byte("data: {\"candidates\":[]}\n\n")
+	var zlibBody, rawDeflateBody bytes.Buffer
+	zlibWriter := zlib.NewWriter(&zlibBody)
+	_, err = zlibWriter.Write(stream)
+	require.NoError(t, err)
+	require.NoError(t, zlibWriter.Close())
+	flateWriter, err := flate.NewWriter(&rawDeflateBody, flate.DefaultCompression)
+	require.NoError(t, err)
+	_, err = flateWriter.Write(stream)
+	require.NoError(t, err)
+	require.NoError(t, flateWriter.Close())
+	for _, tc := range []struct {
+		encoding string
+		body     []byte
+	}{
+		{encoding: "deflate", body: zlibBody.Bytes()},
+		{encoding: "deflate", body: rawDeflateBody.Bytes()},
+		{encoding: "", body: stream},
+	} {
+		resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(tc.body))}
+		if tc.encoding != "" {
+			resp.Header.Set("Content-Encoding", tc.encoding)
+		}
+		originalBody := resp.Body
+		require.NoError(t, decodeResponseBody(resp))
+		if tc.encoding == "" {
+			require.Equal(t, originalBody, resp.Body)
+		}
+		decoded, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, stream, decoded)
+		require.Empty(t, resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestGeminiChatHandlersReturnContentFilterErrorForBlockedPrompt(t *testing.T) {
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+	})
+
+	blockReason := "PROHIBITED_CONTENT"
+	body, err := common.Marshal(dto.GeminiChatResponse{
+		PromptFeedback: &dto.GeminiChatPromptFeedback{
+			BlockReason: &blockReason,
+			SafetyRatings: []dto.GeminiChatSafetyRating{
+				{Category: "HARM_CATEGORY_HARASSMENT", Probability: "NEGLIGIBLE"},
+				{Category: "HARM_CATEGORY_DANGEROUS_CONTENT", Probability: "HIGH", Blocked: true},
+			},
+		},
+		UsageMetadata: dto.GeminiUsageMetadata{PromptTokenCount: 12, TotalTokenCount: 12},
+	})
+	require.NoError(t, err)
+	newContext := func() (*gin.Context, *httptest.ResponseRecorder, *relaycommon.RelayInfo) {
+		gin.SetMode(gin.TestMode)
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		return c, recorder, &relaycommon.RelayInfo{
+			RelayFormat:     types.RelayFormatOpenAI,
+			OriginModelName: "gemini-2.5-flash",
+			ChannelMeta:     &relaycommon.ChannelMeta{UpstreamModelName: "gemini-2.5-flash"},
+		}
+	}
+
+	c, recorder, info := newContext()
+	_, newAPIError := GeminiChatHandler(c, info, &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body))})
+	require.Nil(t, newAPIError)
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+	var errorResponse struct {
+		Error types.OpenAIError `json:"error"`
+	}
+	require.NoError(t, common.Unmarshal(recorder.Body.Bytes(), &errorResponse))
+	require.Equal(t, "content_filter", errorResponse.Error.Type)
+	require.Contains(t, errorResponse.Error.Message, blockReason)
+	require.Contains(t, errorResponse.Error.Message, "HARM_CATEGORY_DANGEROUS_CONTENT=HIGH")
+	require.NotContains(t, errorResponse.Error.Message, "HARM_CATEGORY_HARASSMENT")
+
+	c, recorder, info = newContext()
+	info.IsStream = true
+	streamBody := "data: " + string(body) + "\n\ndata: [DONE]\n"
+	_, newAPIError = GeminiChatStreamHandler(c, info, &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(streamBody))})
+	require.NotNil(t, newAPIError)
+	require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+	require.Equal(t, "content_filter", newAPIError.ToOpenAIError().Type)
+	require.Contains(t, newAPIError.Error(), "HARM_CATEGORY_DANGEROUS_CONTENT=HIGH")
+	require.Zero(t, recorder.Body.Len())
+}
+
+func TestGeminiImageStreamHandlerStreamsPartialImagesOrFallsBackToBufferedResponse(t *testing.T) {
+	oldStreamingTimeout := constant.StreamingTimeout
+	constant.StreamingTimeout = 300
+	t.Cleanup(func() {
+		constant.StreamingTimeout = oldStreamingTimeout
+	})
+
+	run := func(resp *http.Response) (*dto.Usage, []string, []map[string]any) {
+		gin.SetMode(gin.TestMode)
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/images/generations", nil)
+		info := &relaycommon.RelayInfo{
+			OriginModelName: "imagen-4.0-generate-001",
+			RelayMode:       relayconstant.RelayModeImagesGenerations,
+			IsStream:        true,
+			ChannelMeta:     &relaycommon.ChannelMeta{UpstreamModelName: "imagen-4.0-generate-001"},
+		}
+		usage, newAPIError := (&Adaptor{}).DoResponse(c, resp, info)
+		require.Nil(t, newAPIError)
+
+		var events []string
+		var payloads []map[string]any
+		for _, line := range strings.Split(recorder.Body.String(), "\n") {
+			if event, ok := strings.CutPrefix(line, "event: "); ok {
+				events = append(events, event)
+			} else if data, ok := strings.CutPrefix(line, "data: "); ok && data != "[DONE]" {
+				var payload map[string]any
+				require.NoError(t, common.UnmarshalJsonStr(data, &payload))
+				payloads = append(payloads, payload)
+			}
+		}
+		require.True(t, strings.HasSuffix(recorder.Body.String(), "data: [DONE]\n\n"))
+		return usage.(*dto.Usage), events, payloads
+	}
+	prediction := dto.GeminiImagePrediction{MimeType: "image/png", BytesBase64Encoded: "bm90IGFuIGltYWdl"}
+
+	chunk, err := common.Marshal(dto.GeminiImageResponse{Predictions: []dto.GeminiImagePrediction{prediction}})
+	require.NoError(t, err)
+	streamBody := "data: " + string(chunk) + "\n\n" + "data: " + string(chunk) + "\n\n"
+	usage, events, payloads := run(&http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader(streamBody)),
+	})
+	require.Equal(t, []string{"image_generation.partial_image", "image_generation.partial_image", "image_generation.completed", "image_generation.completed"}, events)
+	require.Equal(t, float64(0), payloads[0]["partial_image_index"])
+	require.Equal(t, float64(1), payloads[1]["partial_image_index"])
+	require.NotContains(t, payloads[2], "usage")
+	// 已通过 partial_image 下发的图片不再重复携带 base64 数据
+	require.NotContains(t, payloads[2], "b64_json")
+	require.Equal(t, float64(0), payloads[2]["partial_image_index"])
+	require.Equal(t, float64(1), payloads[3]["partial_image_index"])
+	require.Equal(t, float64(2*258), payloads[3]["usage"].(map[string]any)["prompt_tokens"])
+	require.Equal(t, 2*258, usage.PromptTokens)
+
+	// 流已开始后全部图片被过滤，以 error 事件结束而不是返回 JSON 错误
+	filteredChunk, err := common.Marshal(dto.GeminiImageResponse{Predictions: []dto.GeminiImagePrediction{{RaiFilteredReason: "blocked"}}})
+	require.NoError(t, err)
+	usage, events, payloads = run(&http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader("data: " + string(filteredChunk) + "\n\n")),
+	})
+	require.Equal(t, []string{"error"}, events)
+	require.Equal(t, "content_filter", payloads[0]["error"].(map[string]any)["type"])
+	require.Zero(t, usage.PromptTokens)
+
+	// 上游不支持流式时返回普通 JSON，缓冲后只下发 completed 事件
+	body, err := common.Marshal(dto.GeminiImageResponse{Predictions: []dto.GeminiImagePrediction{prediction}})
+	require.NoError(t, err)
+	usage, events, payloads = run(&http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	})
+	require.Equal(t, []string{"image_generation.completed"}, events)
+	require.Equal(t, prediction.BytesBase64Encoded, payloads[0]["b64_json"])
+	require.Equal(t, float64(258), payloads[0]["usage"].(map[string]any)["prompt_tokens"])
+	require.Equal(t, 258, usage.PromptTokens)
+}
+
+func TestGetRequestURLSelectsImagenStreamActionForConfiguredModels(t *testing.T) {
+	settings := model_setting.GetGeminiSettings()
+	oldStreamModels := settings.ImagenStreamModels
+	settings.ImagenStreamModels = []string{"imagen-4.0-fast"}
+	t.Cleanup(func() {
+		settings.ImagenStreamModels = oldStreamModels
+	})
+
+	newInfo := func(modelName string, stream bool) *relaycommon.RelayInfo {
+		return &relaycommon.RelayInfo{
+			RelayMode: relayconstant.RelayModeImagesGenerations,
+			IsStream:  stream,
+			ChannelMeta: &relaycommon.ChannelMeta{
+				ChannelBaseUrl:    "https://generativelanguage.googleapis.com",
+				UpstreamModelName: modelName,
+			},
+		}
+	}
+	url, err := (&Adaptor{}).GetRequestURL(newInfo("imagen-4.0-fast-generate-001", true))
+	require.NoError(t, err)
+	require.Equal(t, "https://generativelanguage.googleapis.com/v1beta/models/imagen-4.0-fast-generate-001:streamPredict?alt=sse", url)
+
+	url, err = (&Adaptor{}).GetRequestURL(newInfo("imagen-4.0-generate-001", true))
+	require.NoError(t, err)
+	require.Equal(t, "https://generativelanguage.googleapis.com/v1beta/models/imagen-4.0-generate-001:predict", url)
+
+	url, err = (&Adaptor{}).GetRequestURL(newInfo("imagen-4.0-fast-generate-001", false))
+	require.NoError(t, err)
+	require.Equal(t, "https://generativelanguage.googleapis.com/v1beta/models/imagen-4.0-fast-generate-001:predict", url)
+}
+
+const canonicalGeminiErrorBody = `{"error":{"code":400,"message":"API key not valid. Please pass a valid API key.","status":"INVALID_ARGUMENT",` +
+	`"details":[{"@type":"type.googleapis.com/google.rpc.ErrorInfo","reason":"API_KEY_INVALID","domain":"googleapis.com","metadata":{"service":"generativelanguage.googleapis.com"}}]}}`
+
+func TestParseGeminiErrorKeepsStatusReasonAndDetails(t *testing.T) {
+	t.Parallel()
+
+	mapped := parseGeminiError([]byte(canonicalGeminiErrorBody), http.StatusBadRequest)
+	require.Equal(t, http.StatusBadRequest, mapped.StatusCode)
+	require.Equal(t, "API key not valid. Please pass a valid API key.", mapped.Error.Message)
+	require.Equal(t, "INVALID_ARGUMENT", mapped.Error.Code)
+	require.Equal(t, "API_KEY_INVALID", mapped.Error.Type)
+	require.JSONEq(t, `{"details":[{"@type":"type.googleapis.com/google.rpc.ErrorInfo","reason":"API_KEY_INVALID","domain":"googleapis.com","metadata":{"service":"generativelanguage.googleapis.com"}}]}`, string(mapped.Error.Metadata))
+
+	mapped = parseGeminiError([]byte(`[`+`{"error":{"code":429,"message":"quota","status":"RESOURCE_EXHAUSTED"}}`+`]`), http.StatusOK)
+	require.Equal(t, http.StatusTooManyRequests, mapped.StatusCode)
+	require.Equal(t, "RESOURCE_EXHAUSTED", mapped.Error.Code)
+	require.Equal(t, "RESOURCE_EXHAUSTED", mapped.Error.Type)
+	require.Empty(t, mapped.Error.Metadata)
+
+	mapped = parseGeminiError([]byte("<html>502 Bad Gateway</html>\n"), http.StatusBadGateway)
+	require.Equal(t, http.StatusBadGateway, mapped.StatusCode)
+	require.Equal(t, "<html>502 Bad Gateway</html>", mapped.Error.Message)
+	require.Equal(t, string(types.ErrorCodeBadResponseStatusCode), mapped.Error.Code)
+}
+
+func TestGeminiHandlersReturnGeminiErrorEnvelopes(t *testing.T) {
+	t.Parallel()
+
+	handlers := map[string]func(c *gin.Context, info *relaycommon.RelayInfo, resp *http.Response) (*dto.Usage, *types.NewAPIError){
+		"chat":      GeminiChatHandler,
+		"image":     GeminiImageHandler,
+		"embedding": GeminiEmbeddingHandler,
+	}
+	for name, handler := range handlers {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			gin.SetMode(gin.TestMode)
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			info := &relaycommon.RelayInfo{ChannelMeta: &relaycommon.ChannelMeta{UpstreamModelName: "gemini-2.5-flash"}}
+			resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(canonicalGeminiErrorBody))}
+
+			_, newAPIError := handler(c, info, resp)
+			require.NotNil(t, newAPIError)
+			require.Equal(t, http.StatusBadRequest, newAPIError.StatusCode)
+			openAIError := newAPIError.ToOpenAIError()
+			require.Equal(t, "INVALID_ARGUMENT", openAIError.Code)
+			require.Equal(t, "API_KEY_INVALID", openAIError.Type)
+			require.True(t, strings.HasPrefix(openAIError.Message, "API key not valid. Please pass a valid API key."))
+			require.Contains(t, openAIError.Message, "API_KEY_INVALID")
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package gemini
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/dto"
+	relaycommon "github.com/QuantumNous/new-api/relay/common"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsGeminiModelAtLeast(t *testing.T) {
+	t.Parallel()
+
+	require.False(t, isGeminiModelAtLeast("gemini-1.5-pro", 2, 5))
+	require.False(t, isGeminiModelAtLeast("gemini-2.0-flash", 2, 5))
+	require.True(t, isGeminiModelAtLeast("gemini-2.5-flash-lite", 2, 5))
+	require.True(t, isGeminiModelAtLeast("gemini-3-pro-preview", 2, 5))
+	require.True(t, isGeminiModelAtLeast("gemini-flash-latest", 2, 5))
+}
+
+func TestAdaptGenerationConfigForModelVersion(t *testing.T) {
+	t.Parallel()
+
+	request := &dto.GeminiChatRequest{
+		GenerationConfig: dto.GeminiChatGenerationConfig{
+			ThinkingConfig:     &dto.GeminiThinkingConfig{IncludeThoughts: true, ThinkingBudget: common.GetPointer(1024)},
+			ResponseModalities: []string{"TEXT", "IMAGE"},
+		},
+	}
+	adaptGenerationConfigForModelVersion(request, "gemini-1.5-pro")
+	require.Nil(t, request.GenerationConfig.ThinkingConfig)
+	require.Nil(t, request.GenerationConfig.ResponseModalities)
+
+	// 2.0 flash thinking 预览模型早于 2.5，但能力列表标记为支持 thinkingConfig
+	request = &dto.GeminiChatRequest{
+		GenerationConfig: dto.GeminiChatGenerationConfig{
+			ThinkingConfig: &dto.GeminiThinkingConfig{IncludeThoughts: true},
+		},
+	}
+	adaptGenerationConfigForModelVersion(request, "gemini-2.0-flash-thinking-exp-01-21")
+	require.NotNil(t, request.GenerationConfig.ThinkingConfig)
+	adaptGenerationConfigForModelVersion(request, "gemini-2.0-flash")
+	require.Nil(t, request.GenerationConfig.ThinkingConfig)
+
+	request = &dto.GeminiChatRequest{
+		GenerationConfig: dto.GeminiChatGenerationConfig{
+			ThinkingConfig: &dto.GeminiThinkingConfig{IncludeThoughts: true, ThinkingLevel: "high"},
+		},
+	}
+	adaptGenerationConfigForModelVersion(request, "gemini-2.5-flash")
+	require.NotNil(t, request.GenerationConfig.ThinkingConfig)
+	require.Empty(t, request.GenerationConfig.ThinkingConfig.ThinkingLevel)
+	require.NotNil(t, request.GenerationConfig.ThinkingConfig.ThinkingBudget)
+
+	request = &dto.GeminiChatRequest{
+		GenerationConfig: dto.GeminiChatGenerationConfig{
+			ThinkingConfig: &dto.GeminiThinkingConfig{IncludeThoughts: true, ThinkingLevel: "high"},
+		},
+	}
+	adaptGenerationConfigForModelVersion(request, "gemini-3-pro-preview")
+	require.Equal(t, "high", request.GenerationConfig.ThinkingConfig.ThinkingLevel)
+	require.Nil(t, request.GenerationConfig.ThinkingConfig.ThinkingBudget)
+}
+
+func TestApplyChannelThinkingPolicy(t *testing.T) {
+	t.Parallel()
+
+	newInfo := func(modelName string, policy dto.GeminiThinkingPolicy) *relaycommon.RelayInfo {
+		return &relaycommon.RelayInfo{
+			ChannelMeta: &relaycommon.ChannelMeta{
+				UpstreamModelName:    modelName,
+				ChannelOtherSettings: dto.ChannelOtherSettings{GeminiThinkingPolicy: policy},
+			},
+		}
+	}
+
+	request := &dto.GeminiChatRequest{
+		GenerationConfig: dto.GeminiChatGenerationConfig{
+			ThinkingConfig: &dto.GeminiThinkingConfig{ThinkingBudget: common.GetPointer(0)},
+		},
+	}
+	applyChannelThinkingPolicy(request, newInfo("gemini-2.5-flash", dto.GeminiThinkingPolicyForceOn))
+	require.True(t, request.GenerationConfig.ThinkingConfig.IncludeThoughts)
+	require.Nil(t, request.GenerationConfig.ThinkingConfig.ThinkingBudget)
+
+	request = &dto.GeminiChatRequest{
+		GenerationConfig: dto.GeminiChatGenerationConfig{
+			ThinkingConfig: &dto.GeminiThinkingConfig{IncludeThoughts: true, ThinkingBudget: common.GetPointer(4096)},
+		},
+	}
+	applyChannelThinkingPolicy(request, newInfo("gemini-2.5-flash", dto.GeminiThinkingPolicyForceOff))
+	require.False(t, request.GenerationConfig.ThinkingConfig.IncludeThoughts)
+	require.Equal(t, 0, *request.GenerationConfig.ThinkingConfig.ThinkingBudget)
+
+	applyChannelThinkingPolicy(request, newInfo("gemini-2.5-pro", dto.GeminiThinkingPolicyForceOff))
+	require.Equal(t, pro25MinBudget, *request.GenerationConfig.ThinkingConfig.ThinkingBudget)
+
+	applyChannelThinkingPolicy(request, newInfo("gemini-3-pro-preview", dto.GeminiThinkingPolicyForceOff))
+	require.Equal(t, "low", request.GenerationConfig.ThinkingConfig.ThinkingLevel)
+
+	request = &dto.GeminiChatRequest{}
+	applyChannelThinkingPolicy(request, newInfo("gemini-2.5-flash", dto.GeminiThinkingPolicyClient))
+	require.Nil(t, request.GenerationConfig.ThinkingConfig)
+}
+
+func TestApplyChannelThinkingBudgetCap(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newGeminiConvertTestContext("gemini-2.5-flash")
+	newInfo := func(modelName string, limit int) *relaycommon.RelayInfo {
+		return &relaycommon.RelayInfo{
+			ChannelMeta: &relaycommon.ChannelMeta{
+				UpstreamModelName:    modelName,
+				ChannelOtherSettings: dto.ChannelOtherSettings{GeminiMaxThinkingBudget: limit},
+			},
+		}
+	}
+	newRequest := func(thinkingConfig *dto.GeminiThinkingConfig) *dto.GeminiChatRequest {
+		return &dto.GeminiChatRequest{GenerationConfig: dto.GeminiChatGenerationConfig{ThinkingConfig: thinkingConfig}}
+	}
+
+	request := newRequest(&dto.GeminiThinkingConfig{IncludeThoughts: true, ThinkingBudget: common.GetPointer(20000)})
+	applyChannelThinkingBudgetCap(c, request, newInfo("gemini-2.5-flash", 2048))
+	require.Equal(t, 2048, *request.GenerationConfig.ThinkingConfig.ThinkingBudget)
+	require.True(t, request.GenerationConfig.ThinkingConfig.IncludeThoughts)
+
+	request = newRequest(&dto.GeminiThinkingConfig{ThinkingBudget: common.GetPointer(1024)})
+	applyChannelThinkingBudgetCap(c, request, newInfo("gemini-2.5-flash", 2048))
+	require.Equal(t, 1024, *request.GenerationConfig.ThinkingConfig.ThinkingBudget)
+
+	request = newRequest(&dto.GeminiThinkingConfig{ThinkingBudget: common.GetPointer(-1)})
+	applyChannelThinkingBudgetCap(c, request, newInfo("gemini-2.5-flash", 2048))
+	require.Equal(t, 2048, *request.GenerationConfig.ThinkingConfig.ThinkingBudget)
+
+	// 未指定时默认动态思考，同样需要截断；flash-lite 默认不思考
+	request = newRequest(nil)
+	applyChannelThinkingBudgetCap(c, request, newInfo("gemini-2.5-pro", 64))
+	require.Equal(t, pro25MinBudget, *request.GenerationConfig.ThinkingConfig.ThinkingBudget)
+	request = newRequest(nil)
+	applyChannelThinkingBudgetCap(c, request, newInfo("gemini-2.5-flash-lite", 2048))
+	require.Nil(t, request.GenerationConfig.ThinkingConfig)
+
+	request = newRequest(&dto.GeminiThinkingConfig{ThinkingLevel: "high"})
+	applyChannelThinkingBudgetCap(c, request, newInfo("gemini-3-pro-preview", 4096))
+	require.Equal(t, 4096, *request.GenerationConfig.ThinkingConfig.ThinkingBudget)
+	require.Empty(t, request.GenerationConfig.ThinkingConfig.ThinkingLevel)
+
+	request = newRequest(&dto.GeminiThinkingConfig{ThinkingBudget: common.GetPointer(20000)})
+	applyChannelThinkingBudgetCap(c, request, newInfo("gemini-2.5-flash", 0))
+	require.Equal(t, 20000, *request.GenerationConfig.ThinkingConfig.ThinkingBudget)
+}
+
+func TestReserveThinkingOutputTokens(t *testing.T) {
+	t.Parallel()
+
+	newRequest := func(maxTokens uint, thinkingConfig *dto.GeminiThinkingConfig) *dto.GeminiChatRequest {
+		return &dto.GeminiChatRequest{
+			GenerationConfig: dto.GeminiChatGenerationConfig{
+				MaxOutputTokens: common.GetPointer(maxTokens),
+				ThinkingConfig:  thinkingConfig,
+			},
+		}
+	}
+
+	request := newRequest(100, &dto.GeminiThinkingConfig{ThinkingBudget: common.GetPointer(1024)})
+	reserveThinkingOutputTokens(request, "gemini-2.5-flash")
+	require.EqualValues(t, 1124, *request.GenerationConfig.MaxOutputTokens)
+
+	// 默认动态思考
+	request = newRequest(100, nil)
+	reserveThinkingOutputTokens(request, "gemini-2.5-pro")
+	require.EqualValues(t, 100+pro25MaxBudget*50/100, *request.GenerationConfig.MaxOutputTokens)
+
+	// 关闭思考或不支持思考的模型保持原值
+	request = newRequest(100, &dto.GeminiThinkingConfig{ThinkingBudget: common.GetPointer(0)})
+	reserveThinkingOutputTokens(request, "gemini-2.5-flash")
+	require.EqualValues(t, 100, *request.GenerationConfig.MaxOutputTokens)
+	request = newRequest(100, nil)
+	reserveThinkingOutputTokens(request, "gemini-2.5-flash-lite")
+	require.EqualValues(t, 100, *request.GenerationConfig.MaxOutputTokens)
+	request = newRequest(100, nil)
+	reserveThinkingOutputTokens(request, "gemini-2.0-flash")
+	require.EqualValues(t, 100, *request.GenerationConfig.MaxOutputTokens)
+
+	request = newRequest(60000, &dto.GeminiThinkingConfig{ThinkingLevel: "high"})
+	reserveThinkingOutputTokens(request, "gemini-3-pro-preview")
+	require.EqualValues(t, geminiMaxOutputTokens, *request.GenerationConfig.MaxOutputTokens)
+}
+
+func TestNormalizeGeminiModelNameKeepsNameWithSuffixPassThrough(t *testing.T) {
+	settings := model_setting.GetGlobalSettings()
+	oldPassThrough := settings.ModelSuffixPassThroughEnabled
+	settings.ModelSuffixPassThroughEnabled = true
+	t.Cleanup(func() {
+		settings.ModelSuffixPassThroughEnabled = oldPassThrough
+	})
+
+	require.Equal(t, "google/gemini-2.5-flash-lite:free", normalizeGeminiModelName("google/gemini-2.5-flash-lite:free"))
+}
+
+func TestNormalizeGeminiModelNameStripsProviderPrefixAndTag(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "gemini-2.5-pro", normalizeGeminiModelName("google/gemini-2.5-pro"))
+	require.Equal(t, "gemini-2.5-flash", normalizeGeminiModelName("gemini-2.5-flash:free"))
+	require.Equal(t, "gemini-2.5-flash-lite", normalizeGeminiModelName("google/gemini-2.5-flash-lite:free"))
+	require.Equal(t, "gemini-2.5-pro", normalizeGeminiModelName("gemini-2.5-pro"))
+	require.Equal(t, "anthropic/claude-sonnet-4", normalizeGeminiModelName("anthropic/claude-sonnet-4"))
+
+	for _, modelName := range []string{"google/gemini-2.5-pro", "gemini-2.5-pro:free", "gemini-2.5-pro"} {
+		info := &relaycommon.RelayInfo{
+			OriginModelName: modelName,
+			ChannelMeta: &relaycommon.ChannelMeta{
+				ChannelBaseUrl:    "https://generativelanguage.googleapis.com",
+				UpstreamModelName: modelName,
+			},
+		}
+		adaptor := &Adaptor{}
+		adaptor.Init(info)
+		url, err := adaptor.GetRequestURL(info)
+		require.NoError(t, err)
+		require.Equal(t, "https://generativelanguage.googleapis.com/v1beta/models/gemini-2.5-pro:generateContent", url)
+		require.Equal(t, "gemini-2.5-pro", info.UpstreamModelName)
+		require.Equal(t, modelName, info.OriginModelName)
+	}
+}
@@ -54,16 +54,19 @@ func applySystemPromptIfNeeded(c *gin.Context, info *relaycommon.RelayInfo, requ
 			continue
 		}
 		if message.IsStringContent() {
-			request.Messages[i].SetStringContent(info.ChannelSetting.SystemPrompt + "\n" + message.StringContent())
+			request.Messages[i].SetStringContent(info.ChannelSetting.MergeSystemPrompt(message.StringContent()))
 			return
 		}
+		systemContent := dto.MediaContent{
+			Type: dto.ContentTypeText,
+			Text: info.ChannelSetting.SystemPrompt,
+		}
 		contents := message.ParseContent()
-		contents = append([]dto.MediaContent{
-			{
-				Type: dto.ContentTypeText,
-				Text: info.ChannelSetting.SystemPrompt,
-			},
-		}, contents...)
+		if info.ChannelSetting.SystemPromptAppend {
+			contents = append(contents, systemContent)
+		} else {
+			contents = append([]dto.MediaContent{systemContent}, contents...)
+		}
 		request.Messages[i].Content = contents
 		return
 	}
@@ -117,7 +117,7 @@ func ClaudeHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *typ
 				if existing == "" {
 					request.SetStringSystem(info.ChannelSetting.SystemPrompt)
 				} else {
-					request.SetStringSystem(info.ChannelSetting.SystemPrompt + "\n" + existing)
+					request.SetStringSystem(info.ChannelSetting.MergeSystemPrompt(existing))
 				}
 			} else {
 				systemContents := request.ParseSystem()
@@ -125,6 +125,8 @@ func ClaudeHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *typ
 				newSystem.SetText(info.ChannelSetting.SystemPrompt)
 				if len(systemContents) == 0 {
 					request.System = []dto.ClaudeMediaMessage{newSystem}
+				} else if info.ChannelSetting.SystemPromptAppend {
+					request.System = append(systemContents, newSystem)
 				} else {
 					request.System = append([]dto.ClaudeMediaMessage{newSystem}, systemContents...)
 				}
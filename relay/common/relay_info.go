@@ -106,7 +106,8 @@ type RelayInfo struct {
 	RequestURLPath         string
 	RequestHeaders         map[string]string
 	ShouldIncludeUsage     bool
-	DisablePing            bool // 是否禁止向下游发送自定义 Ping
+	DisablePing            bool      // 是否禁止向下游发送自定义 Ping
+	UpstreamDeadline       time.Time // 上游请求的截止时间，零值表示不限制，超过时取消上游请求
 	ClientWs               *websocket.Conn
 	TargetWs               *websocket.Conn
 	InputAudioFormat       string
@@ -13,7 +13,7 @@ func GuessRelayFormatFromRequest(req any) (types.RelayFormat, bool) {
 		return types.RelayFormatOpenAIResponses, true
 	case *dto.ClaudeRequest, dto.ClaudeRequest:
 		return types.RelayFormatClaude, true
-	case *dto.GeminiChatRequest, dto.GeminiChatRequest:
+	case *dto.GeminiChatRequest, dto.GeminiChatRequest, *dto.GeminiCountTokensRequest:
 		return types.RelayFormatGemini, true
 	case *dto.EmbeddingRequest, dto.EmbeddingRequest:
 		return types.RelayFormatEmbedding, true
@@ -1,6 +1,7 @@
 package relay
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"github.com/QuantumNous/new-api/common"
 	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/i18n"
 	"github.com/QuantumNous/new-api/logger"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
 	relayconstant "github.com/QuantumNous/new-api/relay/constant"
@@ -70,7 +72,13 @@ func TextHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *types
 	}
 	adaptor.Init(info)
 
-	passThroughGlobal := model_setting.GetGlobalSettings().PassThroughRequestEnabled
+	// count_tokens 只由 Gemini 渠道的 :countTokens 支持，分组内混有其他类型渠道时返回可重试的 501，由重试换到 Gemini 渠道
+	isCountTokens := info.RelayMode == relayconstant.RelayModeChatCompletionsCountTokens
+	if isCountTokens && info.ApiType != constant.APITypeGemini {
+		return types.NewErrorWithStatusCode(errors.New(i18n.T(c, i18n.MsgGeminiCountTokensUnsupported, map[string]any{"ChannelType": info.ChannelType})), types.ErrorCodeInvalidRequest, http.StatusNotImplemented)
+	}
+
+	passThroughGlobal := model_setting.GetGlobalSettings().PassThroughRequestEnabled && !isCountTokens
 	if info.RelayMode == relayconstant.RelayModeChatCompletions &&
 		!passThroughGlobal &&
 		!info.ChannelSetting.PassThroughBodyEnabled &&
@@ -94,7 +102,7 @@ func TextHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *types
 
 	var requestBody io.Reader
 
-	if passThroughGlobal || info.ChannelSetting.PassThroughBodyEnabled {
+	if passThroughGlobal || (info.ChannelSetting.PassThroughBodyEnabled && !isCountTokens) {
 		storage, err := common.GetBodyStorage(c)
 		if err != nil {
 			return types.NewErrorWithStatusCode(err, types.ErrorCodeReadRequestBodyFailed, http.StatusBadRequest, types.ErrOptionWithSkipRetry())
@@ -113,6 +121,7 @@ func TextHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *types
 		relaycommon.AppendRequestConversionFromRequest(info, convertedRequest)
 
 		if info.ChannelSetting.SystemPrompt != "" {
+			// Gemini 请求由适配器在转换时写入 systemInstruction
 			// 如果有系统提示，则将其添加到请求中
 			request, ok := convertedRequest.(*dto.GeneralOpenAIRequest)
 			if ok {
@@ -136,15 +145,18 @@ func TextHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *types
 					for i, message := range request.Messages {
 						if message.Role == request.GetSystemRoleName() {
 							if message.IsStringContent() {
-								request.Messages[i].SetStringContent(info.ChannelSetting.SystemPrompt + "\n" + message.StringContent())
+								request.Messages[i].SetStringContent(info.ChannelSetting.MergeSystemPrompt(message.StringContent()))
 							} else {
+								systemContent := dto.MediaContent{
+									Type: dto.ContentTypeText,
+									Text: info.ChannelSetting.SystemPrompt,
+								}
 								contents := message.ParseContent()
-								contents = append([]dto.MediaContent{
-									{
-										Type: dto.ContentTypeText,
-										Text: info.ChannelSetting.SystemPrompt,
-									},
-								}, contents...)
+								if info.ChannelSetting.SystemPromptAppend {
+									contents = append(contents, systemContent)
+								} else {
+									contents = append([]dto.MediaContent{systemContent}, contents...)
+								}
 								request.Messages[i].Content = contents
 							}
 							break
@@ -211,6 +223,14 @@ func TextHelper(c *gin.Context, info *relaycommon.RelayInfo) (newAPIError *types
 		return newApiErr
 	}
 
+	if isCountTokens {
+		// 计数请求不产生生成费用，结算为 0 以退还预扣费
+		if err := service.SettleBilling(c, info, 0); err != nil {
+			logger.LogError(c, "error settling count_tokens billing: "+err.Error())
+		}
+		return nil
+	}
+
 	var containAudioTokens = usage.(*dto.Usage).CompletionTokenDetails.AudioTokens > 0 || usage.(*dto.Usage).PromptTokensDetails.AudioTokens > 0
 	var containsAudioRatios = ratio_setting.ContainsAudioRatio(info.OriginModelName) || ratio_setting.ContainsAudioCompletionRatio(info.OriginModelName)
 
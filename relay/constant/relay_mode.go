@@ -52,11 +52,15 @@ const (
 	RelayModeGemini
 
 	RelayModeResponsesCompact
+
+	RelayModeChatCompletionsCountTokens
 )
 
 func Path2RelayMode(path string) int {
 	relayMode := RelayModeUnknown
-	if strings.HasPrefix(path, "/v1/chat/completions") || strings.HasPrefix(path, "/pg/chat/completions") {
+	if strings.HasPrefix(path, "/v1/chat/completions/count_tokens") {
+		relayMode = RelayModeChatCompletionsCountTokens
+	} else if strings.HasPrefix(path, "/v1/chat/completions") || strings.HasPrefix(path, "/pg/chat/completions") {
 		relayMode = RelayModeChatCompletions
 	} else if strings.HasPrefix(path, "/v1/completions") {
 		relayMode = RelayModeCompletions
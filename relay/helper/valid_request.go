@@ -4,14 +4,18 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 
 	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
 	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/i18n"
 	"github.com/QuantumNous/new-api/logger"
 	relayconstant "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/setting/model_setting"
 	"github.com/QuantumNous/new-api/types"
 	"github.com/samber/lo"
 
@@ -21,6 +25,10 @@ import (
 func GetAndValidateRequest(c *gin.Context, format types.RelayFormat) (request dto.Request, err error) {
 	relayMode := relayconstant.Path2RelayMode(c.Request.URL.Path)
 
+	if err = checkGeminiRequestBodySize(c); err != nil {
+		return nil, err
+	}
+
 	switch format {
 	case types.RelayFormatOpenAI:
 		request, err = GetAndValidateTextRequest(c, relayMode)
@@ -55,6 +63,39 @@ func GetAndValidateRequest(c *gin.Context, format types.RelayFormat) (request dt
 	return request, err
 }
 
+// checkGeminiRequestBodySize 在解析请求前按 Gemini 渠道的请求体上限拒绝超大请求，适用于所有 relay 模式
+func checkGeminiRequestBodySize(c *gin.Context) error {
+	channelType := common.GetContextKeyInt(c, constant.ContextKeyChannelType)
+	if channelType != constant.ChannelTypeGemini && channelType != constant.ChannelTypeVertexAi {
+		return nil
+	}
+	otherSettings, _ := common.GetContextKeyType[dto.ChannelOtherSettings](c, constant.ContextKeyChannelOtherSetting)
+	return CheckGeminiRequestBodySize(c, otherSettings.GeminiMaxRequestBodyMB)
+}
+
+// CheckGeminiRequestBodySize 按渠道配置（为 0 时使用全局配置）的 Gemini 请求体上限检查请求体大小，超过时返回 413
+func CheckGeminiRequestBodySize(c *gin.Context, channelLimitMB int) error {
+	limitMB := model_setting.GetGeminiMaxRequestBodyMB(channelLimitMB)
+	if limitMB <= 0 {
+		return nil
+	}
+	size := c.Request.ContentLength
+	if storage, exists := c.Get(common.KeyBodyStorage); exists && storage != nil {
+		if bs, ok := storage.(common.BodyStorage); ok {
+			size = bs.Size()
+		}
+	}
+	if size <= int64(limitMB)<<20 {
+		return nil
+	}
+	return types.NewErrorWithStatusCode(
+		errors.New(i18n.T(c, i18n.MsgGeminiRequestBodyTooLarge, map[string]any{"Limit": limitMB})),
+		types.ErrorCodeReadRequestBodyFailed,
+		http.StatusRequestEntityTooLarge,
+		types.ErrOptionWithSkipRetry(),
+	)
+}
+
 func GetAndValidAudioRequest(c *gin.Context, relayMode int) (*dto.AudioRequest, error) {
 	audioRequest := &dto.AudioRequest{}
 	err := common.UnmarshalBodyReusable(c, audioRequest)
@@ -296,6 +337,10 @@ func GetAndValidateTextRequest(c *gin.Context, relayMode int) (*dto.GeneralOpenA
 		if textRequest.Prompt == "" {
 			return nil, errors.New("field prompt is required")
 		}
+	case relayconstant.RelayModeChatCompletionsCountTokens:
+		if len(textRequest.Messages) == 0 {
+			return nil, errors.New("field messages is required")
+		}
 	case relayconstant.RelayModeChatCompletions:
 		// For FIM (Fill-in-the-middle) requests with prefix/suffix, messages is optional
 		// It will be filled by provider-specific adaptors if needed (e.g., SiliconFlow)。Or it is allowed by model vendor(s) (e.g., DeepSeek)
@@ -0,0 +1,67 @@
+package helper
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/QuantumNous/new-api/common"
+	"github.com/QuantumNous/new-api/constant"
+	"github.com/QuantumNous/new-api/dto"
+	"github.com/QuantumNous/new-api/i18n"
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/types"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+// TestGetAndValidateRequestRejectsOversizedGeminiBody verifies the Gemini body limit is enforced before parsing.
+func TestGetAndValidateRequestRejectsOversizedGeminiBody(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	require.NoError(t, i18n.Init())
+
+	settings := model_setting.GetGeminiSettings()
+	oldLimit := settings.MaxRequestBodyMB
+	settings.MaxRequestBodyMB = 1
+	t.Cleanup(func() {
+		settings.MaxRequestBodyMB = oldLimit
+	})
+
+	// 超过上限的 body 不是合法 JSON，若先解析则会返回解析错误而不是 413
+	body := append([]byte(`{"model":"text-embedding-004","input":"`), bytes.Repeat([]byte("a"), 2<<20)...)
+	newContext := func(channelType int, otherSettings dto.ChannelOtherSettings) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/embeddings", bytes.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		common.SetContextKey(c, constant.ContextKeyChannelType, channelType)
+		common.SetContextKey(c, constant.ContextKeyChannelOtherSetting, otherSettings)
+		return c
+	}
+	requireTooLarge := func(err error) {
+		var apiErr *types.NewAPIError
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, http.StatusRequestEntityTooLarge, apiErr.StatusCode)
+	}
+	requireNotTooLarge := func(err error) {
+		require.Error(t, err)
+		var apiErr *types.NewAPIError
+		if errors.As(err, &apiErr) {
+			require.NotEqual(t, http.StatusRequestEntityTooLarge, apiErr.StatusCode)
+		}
+	}
+
+	_, err := GetAndValidateRequest(newContext(constant.ChannelTypeGemini, dto.ChannelOtherSettings{}), types.RelayFormatEmbedding)
+	requireTooLarge(err)
+
+	_, err = GetAndValidateRequest(newContext(constant.ChannelTypeVertexAi, dto.ChannelOtherSettings{}), types.RelayFormatEmbedding)
+	requireTooLarge(err)
+
+	// 渠道配置优先于全局配置，非 Gemini 渠道不受影响
+	_, err = GetAndValidateRequest(newContext(constant.ChannelTypeGemini, dto.ChannelOtherSettings{GeminiMaxRequestBodyMB: 4}), types.RelayFormatEmbedding)
+	requireNotTooLarge(err)
+
+	_, err = GetAndValidateRequest(newContext(constant.ChannelTypeOpenAI, dto.ChannelOtherSettings{}), types.RelayFormatEmbedding)
+	requireNotTooLarge(err)
+}
@@ -96,6 +96,9 @@ func SetRelayRouter(router *gin.Engine) {
 		httpRouter.POST("/chat/completions", func(c *gin.Context) {
 			controller.Relay(c, types.RelayFormatOpenAI)
 		})
+		httpRouter.POST("/chat/completions/count_tokens", func(c *gin.Context) {
+			controller.Relay(c, types.RelayFormatOpenAI)
+		})
 
 		// response related routes
 		httpRouter.POST("/responses", func(c *gin.Context) {
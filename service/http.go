@@ -42,12 +42,15 @@ func ShouldCopyUpstreamHeader(c *gin.Context, k string, v []string) bool {
 }
 
 func IOCopyBytesGracefully(c *gin.Context, src *http.Response, data []byte) {
+	IOCopyReaderGracefully(c, src, bytes.NewBuffer(data), int64(len(data)))
+}
+
+// IOCopyReaderGracefully is IOCopyBytesGracefully for a body of known size that is not held in memory
+func IOCopyReaderGracefully(c *gin.Context, src *http.Response, body io.Reader, size int64) {
 	if c.Writer == nil {
 		return
 	}
 
-	body := io.NopCloser(bytes.NewBuffer(data))
-
 	// We shouldn't set the header before we parse the response body, because the parse part may fail.
 	// And then we will have to send an error response, but in this case, the header has already been set.
 	// So the httpClient will be confused by the response.
@@ -62,7 +65,7 @@ func IOCopyBytesGracefully(c *gin.Context, src *http.Response, data []byte) {
 	}
 
 	// set Content-Length header manually BEFORE calling WriteHeader
-	c.Writer.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	c.Writer.Header().Set("Content-Length", fmt.Sprintf("%d", size))
 
 	// Write header with status code (this sends the headers)
 	if src != nil {
@@ -51,6 +51,9 @@ func GenerateTextOtherInfo(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, m
 		other["is_model_mapped"] = true
 		other["upstream_model_name"] = relayInfo.UpstreamModelName
 	}
+	if upgradedFrom := common.GetContextKeyString(ctx, constant.ContextKeyGeminiContextOverflowFrom); upgradedFrom != "" {
+		other["context_overflow_upgraded_from"] = upgradedFrom
+	}
 
 	isSystemPromptOverwritten := common.GetContextKeyBool(ctx, constant.ContextKeySystemPromptOverride)
 	if isSystemPromptOverwritten {
@@ -70,6 +73,10 @@ func GenerateTextOtherInfo(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, m
 		adminInfo["local_count_tokens"] = isLocalCountTokens
 	}
 
+	if safetyIdentifier := common.GetContextKeyString(ctx, constant.ContextKeySafetyIdentifier); safetyIdentifier != "" {
+		adminInfo["safety_identifier"] = safetyIdentifier
+	}
+
 	AppendChannelAffinityAdminInfo(ctx, adminInfo)
 
 	other["admin_info"] = adminInfo
@@ -79,9 +86,24 @@ func GenerateTextOtherInfo(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, m
 	appendBillingInfo(relayInfo, other)
 	appendParamOverrideInfo(relayInfo, other)
 	appendStreamStatus(relayInfo, other)
+	appendGeminiStreamTiming(ctx, other)
 	return other
 }
 
+func appendGeminiStreamTiming(ctx *gin.Context, other map[string]interface{}) {
+	if ctx == nil || other == nil {
+		return
+	}
+	durationMs, ok := common.GetContextKeyType[int64](ctx, constant.ContextKeyGeminiStreamDurationMs)
+	if !ok {
+		return
+	}
+	other["stream_duration_ms"] = durationMs
+	if firstTokenMs, ok := common.GetContextKeyType[int64](ctx, constant.ContextKeyGeminiStreamFirstTokenMs); ok {
+		other["ttft_ms"] = firstTokenMs
+	}
+}
+
 func appendParamOverrideInfo(relayInfo *relaycommon.RelayInfo, other map[string]interface{}) {
 	if relayInfo == nil || other == nil || len(relayInfo.ParamOverrideAudit) == 0 {
 		return
@@ -14,6 +14,7 @@ import (
 	"github.com/QuantumNous/new-api/logger"
 	relaycommon "github.com/QuantumNous/new-api/relay/common"
 	constant2 "github.com/QuantumNous/new-api/relay/constant"
+	"github.com/QuantumNous/new-api/setting/model_setting"
 	"github.com/QuantumNous/new-api/types"
 
 	"github.com/gin-gonic/gin"
@@ -176,6 +177,52 @@ func getImageToken(c *gin.Context, fileMeta *types.FileMeta, model string, strea
 	return tiles*tileTokens + baseTokens, nil
 }
 
+// getGeminiImageToken estimates Gemini input image tokens from the configured cost table
+func getGeminiImageToken(c *gin.Context, fileMeta *types.FileMeta, cost model_setting.GeminiImageTokenCost, stream bool) (int, error) {
+	if fileMeta == nil || fileMeta.Source == nil {
+		return 0, fmt.Errorf("image_url_is_nil")
+	}
+	if len(cost.MediaResolutionTokens) > 0 {
+		resolution := cost.DefaultMediaResolution
+		if fileMeta.Detail == "low" || fileMeta.Detail == "high" {
+			resolution = fileMeta.Detail
+		}
+		if tokens, ok := cost.MediaResolutionTokens[resolution]; ok {
+			return tokens, nil
+		}
+	}
+	// detail=low 时按单个低分辨率 tile 计费，与转换时的降采样保持一致
+	if cost.TileSize <= 0 || fileMeta.Detail == "low" {
+		return cost.TileTokens, nil
+	}
+	if !constant.GetMediaToken || (!constant.GetMediaTokenNotStream && !stream) {
+		return cost.TileTokens, nil
+	}
+
+	config, format, err := GetImageConfig(c, fileMeta.Source)
+	if err != nil {
+		return 0, err
+	}
+	if config.Width == 0 || config.Height == 0 {
+		if format != "" {
+			return cost.TileTokens, nil
+		}
+		return 0, fmt.Errorf("fail to decode image config: %s", fileMeta.GetIdentifier())
+	}
+	logger.LogDebug(c, "gemini image token input: format=%s, width=%d, height=%d", format, config.Width, config.Height)
+	return GeminiImageTiles(config.Width, config.Height, cost) * cost.TileTokens, nil
+}
+
+// GeminiImageTiles 计算图片按 TileSize 切分后的切片数量
+func GeminiImageTiles(width int, height int, cost model_setting.GeminiImageTokenCost) int {
+	if width <= cost.SmallImageMaxSide && height <= cost.SmallImageMaxSide {
+		return 1
+	}
+	tilesW := (width + cost.TileSize - 1) / cost.TileSize
+	tilesH := (height + cost.TileSize - 1) / cost.TileSize
+	return tilesW * tilesH
+}
+
 func EstimateRequestToken(c *gin.Context, meta *types.TokenCountMeta, info *relaycommon.RelayInfo) (int, error) {
 	// 是否统计token
 	if !constant.CountToken {
@@ -277,6 +324,12 @@ func EstimateRequestToken(c *gin.Context, meta *types.TokenCountMeta, info *rela
 					return 0, fmt.Errorf("error counting image token, media index[%d], identifier[%s], err: %v", i, file.GetIdentifier(), err)
 				}
 				tkm += token
+			} else if cost, ok := model_setting.GetGeminiImageTokenCost(model); ok {
+				token, err := getGeminiImageToken(c, file, cost, info.IsStream)
+				if err != nil {
+					return 0, fmt.Errorf("error counting image token, media index[%d], identifier[%s], err: %v", i, file.GetIdentifier(), err)
+				}
+				tkm += token
 			} else {
 				tkm += 520
 			}
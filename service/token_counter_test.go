@@ -0,0 +1,49 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/QuantumNous/new-api/setting/model_setting"
+	"github.com/QuantumNous/new-api/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeminiImageTiles(t *testing.T) {
+	cost, ok := model_setting.GetGeminiImageTokenCost("gemini-2.5-flash")
+	require.True(t, ok)
+	require.Equal(t, 258, cost.TileTokens)
+
+	require.Equal(t, 1, GeminiImageTiles(384, 256, cost))
+	require.Equal(t, 1, GeminiImageTiles(768, 768, cost))
+	require.Equal(t, 4, GeminiImageTiles(1024, 1024, cost))
+	require.Equal(t, 6, GeminiImageTiles(1920, 1080, cost))
+
+	cost, ok = model_setting.GetGeminiImageTokenCost("gemini-3-pro-preview")
+	require.True(t, ok)
+	require.Equal(t, 1120, cost.MediaResolutionTokens[cost.DefaultMediaResolution])
+
+	_, ok = model_setting.GetGeminiImageTokenCost("claude-sonnet-4")
+	require.False(t, ok)
+}
+
+func TestGetGeminiImageTokenUsesDetail(t *testing.T) {
+	file := types.NewFileMeta(types.FileTypeImage, types.NewURLFileSource("https://example.com/a.png"))
+	file.Detail = "low"
+
+	cost, ok := model_setting.GetGeminiImageTokenCost("gemini-2.5-flash")
+	require.True(t, ok)
+	tokens, err := getGeminiImageToken(nil, file, cost, true)
+	require.NoError(t, err)
+	require.Equal(t, cost.TileTokens, tokens)
+
+	cost, ok = model_setting.GetGeminiImageTokenCost("gemini-3-pro-preview")
+	require.True(t, ok)
+	tokens, err = getGeminiImageToken(nil, file, cost, true)
+	require.NoError(t, err)
+	require.Equal(t, 280, tokens)
+
+	file.Detail = "auto"
+	tokens, err = getGeminiImageToken(nil, file, cost, true)
+	require.NoError(t, err)
+	require.Equal(t, 1120, tokens)
+}
@@ -1,9 +1,40 @@
 package model_setting
 
 import (
+	"strings"
+	"sync"
+
 	"github.com/QuantumNous/new-api/setting/config"
 )
 
+// GeminiModelCapabilities describes the features of a Gemini model exposed in the model list
+type GeminiModelCapabilities struct {
+	Vision        bool `json:"vision"`
+	Tools         bool `json:"tools"`
+	Json          bool `json:"json"`
+	Thinking      bool `json:"thinking"`
+	ContextLength int  `json:"context_length,omitempty"`
+	// MaxOutputTokens 单次请求允许的最大输出 token（包含思考 token）
+	MaxOutputTokens int `json:"max_output_tokens,omitempty"`
+}
+
+// GeminiModelLimits describes the context window and output limit of a Gemini model
+type GeminiModelLimits struct {
+	ContextLength   int `json:"context_length"`
+	MaxOutputTokens int `json:"max_output_tokens"`
+}
+
+// GeminiImageTokenCost describes how Gemini bills input images.
+// Tile based models charge TileTokens per TileSize tile, images no larger than SmallImageMaxSide count as one tile.
+// Models with media resolution levels (gemini 3) charge a fixed amount per image.
+type GeminiImageTokenCost struct {
+	TileTokens             int            `json:"tile_tokens"`
+	TileSize               int            `json:"tile_size,omitempty"`
+	SmallImageMaxSide      int            `json:"small_image_max_side,omitempty"`
+	MediaResolutionTokens  map[string]int `json:"media_resolution_tokens,omitempty"`
+	DefaultMediaResolution string         `json:"default_media_resolution,omitempty"`
+}
+
 // GeminiSettings defines Gemini model configuration. 注意bool要以enabled结尾才可以生效编辑
 type GeminiSettings struct {
 	SafetySettings                        map[string]string `json:"safety_settings"`
@@ -13,6 +44,64 @@ type GeminiSettings struct {
 	ThinkingAdapterBudgetTokensPercentage float64           `json:"thinking_adapter_budget_tokens_percentage"`
 	FunctionCallThoughtSignatureEnabled   bool              `json:"function_call_thought_signature_enabled"`
 	RemoveFunctionResponseIdEnabled       bool              `json:"remove_function_response_id_enabled"`
+	ForceJsonModeModels                   []string          `json:"force_json_mode_models"`
+	AudioOutputFallbackEnabled            bool              `json:"audio_output_fallback_enabled"`
+	AudioOutputPassthroughEnabled         bool              `json:"audio_output_passthrough_enabled"`
+	ImageIdempotencyTTLSeconds            int               `json:"image_idempotency_ttl_seconds"`
+	StreamFanOutEnabled                   bool              `json:"stream_fan_out_enabled"`
+	StreamFanOutMaxN                      int               `json:"stream_fan_out_max_n"`
+	InFlightDedupEnabled                  bool              `json:"in_flight_dedup_enabled"`
+	ImageFormatConversionEnabled          bool              `json:"image_format_conversion_enabled"`
+	ThinkingOutputReserveEnabled          bool              `json:"thinking_output_reserve_enabled"`
+	OutputTrimEnabled                     bool              `json:"output_trim_enabled"`
+	StreamSchemaValidationEnabled         bool              `json:"stream_schema_validation_enabled"`
+	ContextOverflowUpgradeEnabled         bool              `json:"context_overflow_upgrade_enabled"`
+	EmbeddingMatryoshkaNormalizeEnabled   bool              `json:"embedding_matryoshka_normalize_enabled"`
+	TracingEnabled                        bool              `json:"tracing_enabled"`
+	ImagenPromptTrimEnabled               bool              `json:"imagen_prompt_trim_enabled"`
+	PromptCacheKeyEnabled                 bool              `json:"prompt_cache_key_enabled"`
+	EmbeddingPartialResultsEnabled        bool              `json:"embedding_partial_results_enabled"`
+	GenerationConfigEchoEnabled           bool              `json:"generation_config_echo_enabled"`
+	RequestCompressionEnabled             bool              `json:"request_compression_enabled"`
+	ResponseSpoolEnabled                  bool              `json:"response_spool_enabled"`
+	FileUploadEnabled                     bool              `json:"file_upload_enabled"`
+	LowDetailImageDownscaleEnabled        bool              `json:"low_detail_image_downscale_enabled"`
+	// EmptyContentsFallbackText 请求没有任何有效消息时注入的用户消息，为空时直接返回 400
+	EmptyContentsFallbackText string `json:"empty_contents_fallback_text"`
+	// ImageTokenCosts 按模型名或模型名前缀配置输入图片的 token 计费，最长前缀优先
+	ImageTokenCosts map[string]GeminiImageTokenCost `json:"image_token_costs"`
+	// ModelCapabilities 按模型名或模型名前缀配置能力信息，最长前缀优先
+	ModelCapabilities map[string]GeminiModelCapabilities `json:"model_capabilities"`
+	// MaxRequestBodyMB 转换前的请求体大小上限（MB），超过时直接返回 413，0 表示不限制
+	MaxRequestBodyMB int `json:"max_request_body_mb"`
+	// StreamCoalesceWindowMs 流式响应中在该时间窗口内到达的文本分片合并为一个 delta 下发，0 表示不合并
+	StreamCoalesceWindowMs int `json:"stream_coalesce_window_ms"`
+	// ContextOverflowUpgradeModels 预估输入超过模型上下文窗口时改用的更大上下文模型，key 为原模型名
+	ContextOverflowUpgradeModels map[string]string `json:"context_overflow_upgrade_models"`
+	// ImagenPromptMaxChars 按模型名或模型名前缀配置 Imagen 提示词的最大字符数，最长前缀优先，超过时报错或按 ImagenPromptTrimEnabled 截断；默认为空即不校验，需要按模型自行开启
+	ImagenPromptMaxChars map[string]int `json:"imagen_prompt_max_chars"`
+	// PromptCacheTTLSeconds 按 prompt_cache_key 创建的 cachedContent 的有效期（秒）
+	PromptCacheTTLSeconds int `json:"prompt_cache_ttl_seconds"`
+	// ReasoningEffortBudgets OpenAI reasoning_effort 各档位对应的 thinkingBudget，会再按模型允许的范围截断
+	ReasoningEffortBudgets map[string]int `json:"reasoning_effort_budgets"`
+	// RequestCompressionMinBytes 开启请求压缩时，请求体达到该大小（字节）才使用 gzip 压缩
+	RequestCompressionMinBytes int `json:"request_compression_min_bytes"`
+	// ResponseSpoolThresholdMB 开启响应落盘时，非流式响应超过该大小（MB）后写入临时文件；仅原生格式透传时全程不占用内存，OpenAI 格式转换仍会在内存中解码响应
+	ResponseSpoolThresholdMB int `json:"response_spool_threshold_mb"`
+	// LowDetailImageMaxSide detail=low 的图片在未配置按块计费的模型上缩放到的最长边（像素）
+	LowDetailImageMaxSide int `json:"low_detail_image_max_side"`
+	// FileUploadThresholdMB 开启文件上传时，超过该大小（MB）的媒体改为通过 File API 上传，视频总是上传
+	FileUploadThresholdMB int `json:"file_upload_threshold_mb"`
+	// FileUploadActiveTimeoutSeconds 等待上传的文件变为 ACTIVE 的最长时间（秒）
+	FileUploadActiveTimeoutSeconds int `json:"file_upload_active_timeout_seconds"`
+	// RateLimitRetryMaxAttempts 上游返回 429/503 时在同一渠道内重试的最大次数，0 表示不重试
+	RateLimitRetryMaxAttempts int `json:"rate_limit_retry_max_attempts"`
+	// RateLimitRetryMaxDelaySeconds 单次重试的最长等待时间（秒），上游建议的 retryDelay 超过该值时不再重试
+	RateLimitRetryMaxDelaySeconds int `json:"rate_limit_retry_max_delay_seconds"`
+	// ModelProviderPrefixes 发往上游前从模型名去掉的提供商前缀，兼容 OpenRouter 风格的 google/gemini-2.5-pro
+	ModelProviderPrefixes []string `json:"model_provider_prefixes"`
+	// ImagenStreamModels 按模型名前缀配置上游支持 streamPredict 的 Imagen 模型，其余模型的流式请求缓冲上游响应后以事件下发
+	ImagenStreamModels []string `json:"imagen_stream_models"`
 }
 
 // 默认配置
@@ -35,11 +124,72 @@ var defaultGeminiSettings = GeminiSettings{
 	ThinkingAdapterBudgetTokensPercentage: 0.6,
 	FunctionCallThoughtSignatureEnabled:   true,
 	RemoveFunctionResponseIdEnabled:       true,
+	ForceJsonModeModels:                   []string{},
+	AudioOutputFallbackEnabled:            false,
+	AudioOutputPassthroughEnabled:         false,
+	ImageIdempotencyTTLSeconds:            0,
+	StreamFanOutEnabled:                   false,
+	StreamFanOutMaxN:                      4,
+	InFlightDedupEnabled:                  false,
+	ImageFormatConversionEnabled:          false,
+	ThinkingOutputReserveEnabled:          false,
+	OutputTrimEnabled:                     false,
+	StreamSchemaValidationEnabled:         false,
+	ContextOverflowUpgradeEnabled:         false,
+	EmbeddingMatryoshkaNormalizeEnabled:   false,
+	TracingEnabled:                        false,
+	ImagenPromptTrimEnabled:               false,
+	PromptCacheKeyEnabled:                 false,
+	EmbeddingPartialResultsEnabled:        false,
+	GenerationConfigEchoEnabled:           false,
+	RequestCompressionEnabled:             false,
+	RequestCompressionMinBytes:            1 << 20,
+	ResponseSpoolEnabled:                  false,
+	ResponseSpoolThresholdMB:              16,
+	FileUploadEnabled:                     false,
+	LowDetailImageDownscaleEnabled:        true,
+	LowDetailImageMaxSide:                 512,
+	FileUploadThresholdMB:                 15,
+	FileUploadActiveTimeoutSeconds:        120,
+	RateLimitRetryMaxAttempts:             0,
+	RateLimitRetryMaxDelaySeconds:         10,
+	PromptCacheTTLSeconds:                 3600,
+	EmptyContentsFallbackText:             "",
+	MaxRequestBodyMB:                      0,
+	StreamCoalesceWindowMs:                0,
+	ContextOverflowUpgradeModels:          map[string]string{},
+	ModelProviderPrefixes:                 []string{"google/"},
+	ImagenStreamModels:                    []string{},
+	ImagenPromptMaxChars:                  map[string]int{},
+	ReasoningEffortBudgets: map[string]int{
+		"minimal": 512,
+		"low":     1024,
+		"medium":  8192,
+		"high":    24576,
+	},
+	ImageTokenCosts: map[string]GeminiImageTokenCost{
+		"gemini-1.5": {TileTokens: 258, TileSize: 768, SmallImageMaxSide: 384},
+		"gemini-2":   {TileTokens: 258, TileSize: 768, SmallImageMaxSide: 384},
+		"gemini-3": {
+			MediaResolutionTokens:  map[string]int{"low": 280, "medium": 560, "high": 1120},
+			DefaultMediaResolution: "high",
+		},
+	},
+	ModelCapabilities: map[string]GeminiModelCapabilities{
+		"gemini-1.5":                {Vision: true, Tools: true, Json: true, ContextLength: 1048576, MaxOutputTokens: 8192},
+		"gemini-2.0":                {Vision: true, Tools: true, Json: true, ContextLength: 1048576, MaxOutputTokens: 8192},
+		"gemini-2.0-flash-thinking": {Vision: true, Json: true, Thinking: true, ContextLength: 1048576, MaxOutputTokens: 65536},
+		"gemini-2.5":                {Vision: true, Tools: true, Json: true, Thinking: true, ContextLength: 1048576, MaxOutputTokens: 65536},
+		"gemini-3":                  {Vision: true, Tools: true, Json: true, Thinking: true, ContextLength: 1048576, MaxOutputTokens: 65536},
+	},
 }
 
 // 全局实例
 var geminiSettings = defaultGeminiSettings
 
+// geminiLiveModelLimits 记录上游模型列表返回的 inputTokenLimit/outputTokenLimit
+var geminiLiveModelLimits sync.Map
+
 func init() {
 	// 注册到全局配置管理器
 	config.GlobalConfig.Register("gemini", &geminiSettings)
@@ -50,6 +200,14 @@ func GetGeminiSettings() *GeminiSettings {
 	return &geminiSettings
 }
 
+// GetGeminiMaxRequestBodyMB 返回生效的请求体大小上限（MB），渠道配置优先于全局配置，0 表示不限制
+func GetGeminiMaxRequestBodyMB(channelLimitMB int) int {
+	if channelLimitMB > 0 {
+		return channelLimitMB
+	}
+	return geminiSettings.MaxRequestBodyMB
+}
+
 // GetGeminiSafetySetting 获取安全设置
 func GetGeminiSafetySetting(key string) string {
 	if value, ok := geminiSettings.SafetySettings[key]; ok {
@@ -58,19 +216,110 @@ func GetGeminiSafetySetting(key string) string {
 	return geminiSettings.SafetySettings["default"]
 }
 
-// GetGeminiVersionSetting 获取版本设置
+// GetGeminiVersionSetting 获取版本设置：优先精确匹配模型名，其次最长的前缀通配（如 gemini-2.5-*），最后使用 default
 func GetGeminiVersionSetting(key string) string {
 	if value, ok := geminiSettings.VersionSettings[key]; ok {
 		return value
 	}
+	matched := ""
+	for pattern := range geminiSettings.VersionSettings {
+		prefix, isPrefix := strings.CutSuffix(pattern, "*")
+		if isPrefix && len(pattern) > len(matched) && strings.HasPrefix(key, prefix) {
+			matched = pattern
+		}
+	}
+	if matched != "" {
+		return geminiSettings.VersionSettings[matched]
+	}
 	return geminiSettings.VersionSettings["default"]
 }
 
+// IsGeminiModelSupportImagine 判断模型是否能在对话中输出图片：配置的模型名及其后续版本（如 -preview、-001 后缀），
+// 以及名称中带 -image 段的模型（如 gemini-2.5-flash-image、gemini-2.0-flash-exp-image-generation）
 func IsGeminiModelSupportImagine(model string) bool {
 	for _, v := range geminiSettings.SupportedImagineModels {
+		if v == model || strings.HasPrefix(model, v+"-") {
+			return true
+		}
+	}
+	return strings.HasPrefix(model, "gemini-") && strings.Contains(model+"-", "-image-")
+}
+
+// IsGeminiModelForceJsonMode 判断请求的模型名是否强制返回 JSON
+func IsGeminiModelForceJsonMode(model string) bool {
+	for _, v := range geminiSettings.ForceJsonModeModels {
 		if v == model {
 			return true
 		}
 	}
 	return false
 }
+
+// GetGeminiModelCapabilities 返回模型的能力配置，优先精确匹配，其次最长前缀匹配
+func GetGeminiModelCapabilities(model string) (GeminiModelCapabilities, bool) {
+	return matchModelPrefix(geminiSettings.ModelCapabilities, model)
+}
+
+// GetImagenPromptMaxChars 返回 Imagen 模型提示词的最大字符数，优先精确匹配，其次最长前缀匹配
+func GetImagenPromptMaxChars(model string) (int, bool) {
+	maxChars, ok := matchModelPrefix(geminiSettings.ImagenPromptMaxChars, model)
+	return maxChars, ok && maxChars > 0
+}
+
+// GetReasoningEffortBudget 返回 reasoning_effort 档位对应的 thinkingBudget
+func GetReasoningEffortBudget(effort string) (int, bool) {
+	budget, ok := geminiSettings.ReasoningEffortBudgets[strings.ToLower(strings.TrimSpace(effort))]
+	return budget, ok
+}
+
+// SetGeminiLiveModelLimits 记录上游模型列表上报的模型限制，全部为 0 时忽略
+func SetGeminiLiveModelLimits(model string, limits GeminiModelLimits) {
+	if limits.ContextLength <= 0 && limits.MaxOutputTokens <= 0 {
+		return
+	}
+	geminiLiveModelLimits.Store(model, limits)
+}
+
+// GetGeminiModelLimits 返回模型的上下文窗口与最大输出 token：
+// 精确匹配的配置优先，其次是上游模型列表上报的值，最后是最长前缀匹配的配置
+func GetGeminiModelLimits(model string) (GeminiModelLimits, bool) {
+	var limits GeminiModelLimits
+	if capabilities, ok := matchModelPrefix(geminiSettings.ModelCapabilities, model); ok {
+		limits.ContextLength = capabilities.ContextLength
+		limits.MaxOutputTokens = capabilities.MaxOutputTokens
+	}
+	if _, exact := geminiSettings.ModelCapabilities[model]; !exact {
+		if value, ok := geminiLiveModelLimits.Load(model); ok {
+			live := value.(GeminiModelLimits)
+			if live.ContextLength > 0 {
+				limits.ContextLength = live.ContextLength
+			}
+			if live.MaxOutputTokens > 0 {
+				limits.MaxOutputTokens = live.MaxOutputTokens
+			}
+		}
+	}
+	return limits, limits.ContextLength > 0 || limits.MaxOutputTokens > 0
+}
+
+// GetGeminiImageTokenCost 返回模型输入图片的 token 计费配置，优先精确匹配，其次最长前缀匹配
+func GetGeminiImageTokenCost(model string) (GeminiImageTokenCost, bool) {
+	return matchModelPrefix(geminiSettings.ImageTokenCosts, model)
+}
+
+func matchModelPrefix[T any](values map[string]T, model string) (T, bool) {
+	if value, ok := values[model]; ok {
+		return value, true
+	}
+	matched := ""
+	for prefix := range values {
+		if len(prefix) > len(matched) && strings.HasPrefix(model, prefix) {
+			matched = prefix
+		}
+	}
+	if matched == "" {
+		var zero T
+		return zero, false
+	}
+	return values[matched], true
+}
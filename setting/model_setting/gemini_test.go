@@ -0,0 +1,71 @@
+package model_setting
+
+import "testing"
+
+func TestGetGeminiModelLimitsPrefersExactConfigThenLiveMetadata(t *testing.T) {
+	SetGeminiLiveModelLimits("gemini-2.5-flash-live-test", GeminiModelLimits{ContextLength: 131072})
+	limits, ok := GetGeminiModelLimits("gemini-2.5-flash-live-test")
+	if !ok {
+		t.Fatal("expected limits for a live reported model")
+	}
+	if limits.ContextLength != 131072 || limits.MaxOutputTokens != 65536 {
+		t.Fatalf("expected live context length with prefix output limit, got %+v", limits)
+	}
+
+	geminiSettings.ModelCapabilities["gemini-2.5-flash-live-test"] = GeminiModelCapabilities{ContextLength: 32768, MaxOutputTokens: 1024}
+	t.Cleanup(func() {
+		delete(geminiSettings.ModelCapabilities, "gemini-2.5-flash-live-test")
+	})
+	limits, _ = GetGeminiModelLimits("gemini-2.5-flash-live-test")
+	if limits.ContextLength != 32768 || limits.MaxOutputTokens != 1024 {
+		t.Fatalf("expected exact config to win over live metadata, got %+v", limits)
+	}
+
+	if _, ok := GetGeminiModelLimits("unknown-model"); ok {
+		t.Fatal("expected no limits for an unknown model")
+	}
+}
+
+func TestIsGeminiModelSupportImagineMatchesVariants(t *testing.T) {
+	for _, model := range []string{
+		"gemini-2.0-flash-exp-image-generation",
+		"gemini-2.0-flash-preview-image-generation",
+		"gemini-2.5-flash-image",
+		"gemini-2.5-flash-image-preview",
+		"gemini-3-pro-image-preview-11-2025",
+	} {
+		if !IsGeminiModelSupportImagine(model) {
+			t.Fatalf("expected %s to support image output", model)
+		}
+	}
+	for _, model := range []string{"gemini-2.5-flash", "gemini-2.5-pro", "imagen-4.0-generate-001", "gemini-embedding-001"} {
+		if IsGeminiModelSupportImagine(model) {
+			t.Fatalf("expected %s not to support image output", model)
+		}
+	}
+}
+
+func TestGetGeminiVersionSettingMatchesPrefixPatterns(t *testing.T) {
+	original := geminiSettings.VersionSettings
+	geminiSettings.VersionSettings = map[string]string{
+		"default":                 "v1beta",
+		"gemini-1.0-pro":          "v1",
+		"gemini-2.5-*":            "v1beta",
+		"gemini-2.5-flash-think*": "v1alpha",
+	}
+	t.Cleanup(func() {
+		geminiSettings.VersionSettings = original
+	})
+
+	for model, expected := range map[string]string{
+		"gemini-1.0-pro":                "v1",
+		"gemini-1.0-pro-vision":         "v1beta",
+		"gemini-2.5-pro":                "v1beta",
+		"gemini-2.5-flash-thinking-exp": "v1alpha",
+		"gemini-3-pro-preview":          "v1beta",
+	} {
+		if version := GetGeminiVersionSetting(model); version != expected {
+			t.Fatalf("expected %s for %s, got %s", expected, model, version)
+		}
+	}
+}
@@ -35,6 +35,7 @@ func (p ChatCompletionsToResponsesPolicy) IsChannelEnabled(channelID int, channe
 type GlobalSettings struct {
 	PassThroughRequestEnabled        bool                             `json:"pass_through_request_enabled"`
 	ThinkingModelBlacklist           []string                         `json:"thinking_model_blacklist"`
+	ModelSuffixPassThroughEnabled    bool                             `json:"model_suffix_pass_through_enabled"` // 关闭所有模型名后缀转换，原样透传给上游（用于 new-api 级联部署）
 	ChatCompletionsToResponsesPolicy ChatCompletionsToResponsesPolicy `json:"chat_completions_to_responses_policy"`
 }
 
@@ -65,6 +66,9 @@ func GetGlobalSettings() *GlobalSettings {
 
 // ShouldPreserveThinkingSuffix 判断模型是否配置为保留 thinking/-nothinking/-low/-high/-medium 后缀
 func ShouldPreserveThinkingSuffix(modelName string) bool {
+	if globalSettings.ModelSuffixPassThroughEnabled {
+		return true
+	}
 	target := strings.TrimSpace(modelName)
 	if target == "" {
 		return false
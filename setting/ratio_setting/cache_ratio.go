@@ -1,10 +1,20 @@
 package ratio_setting
 
 import (
+	"strings"
+
 	"github.com/QuantumNous/new-api/types"
 )
 
 var defaultCacheRatio = map[string]float64{
+	"gemini-2.0-flash":                    0.25,
+	"gemini-2.0-flash-lite":               0.25,
+	"gemini-2.5-pro":                      0.1,
+	"gemini-2.5-pro-thinking-*":           0.1,
+	"gemini-2.5-flash":                    0.1,
+	"gemini-2.5-flash-thinking-*":         0.1,
+	"gemini-2.5-flash-lite":               0.1,
+	"gemini-2.5-flash-lite-thinking-*":    0.1,
 	"gemini-3-flash-preview":              0.1,
 	"gemini-3-pro-preview":                0.1,
 	"gemini-3.1-pro-preview":              0.1,
@@ -155,10 +165,35 @@ func UpdateCreateCacheRatioByJSONString(jsonStr string) error {
 // GetCacheRatio returns the cache ratio for a model
 func GetCacheRatio(name string) (float64, bool) {
 	ratio, ok := cacheRatioMap.Get(name)
-	if !ok {
-		return 1, false // Default to 1 if not found
+	if ok {
+		return ratio, true
 	}
-	return ratio, true
+	if strings.HasPrefix(name, "gemini-") {
+		// Gemini 2.5+ 会自动进行隐式缓存，预览版/思考预算等变体需要回落到基础模型的缓存倍率
+		if ratio, ok = cacheRatioMap.Get(FormatMatchingModelName(name)); ok {
+			return ratio, true
+		}
+		if ratio, ok = getGeminiFamilyCacheRatio(name); ok {
+			return ratio, true
+		}
+	}
+	return 1, false // Default to 1 if not found
+}
+
+// getGeminiFamilyCacheRatio returns the cache ratio of the longest configured gemini model name that prefixes name
+func getGeminiFamilyCacheRatio(name string) (float64, bool) {
+	matched := ""
+	ratio := 1.0
+	for model, modelRatio := range cacheRatioMap.ReadAll() {
+		if strings.HasSuffix(model, "*") || !strings.HasPrefix(name, model+"-") {
+			continue
+		}
+		if len(model) > len(matched) {
+			matched = model
+			ratio = modelRatio
+		}
+	}
+	return ratio, matched != ""
 }
 
 func GetCreateCacheRatio(name string) (float64, bool) {
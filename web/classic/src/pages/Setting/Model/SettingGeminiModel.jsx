@@ -36,6 +36,8 @@ const GEMINI_SETTING_EXAMPLE = {
 
 const GEMINI_VERSION_EXAMPLE = {
   default: 'v1beta',
+  'gemini-2.5-*': 'v1beta',
+  'gemini-1.0-pro': 'v1',
 };
 
 const DEFAULT_GEMINI_INPUTS = {
@@ -155,6 +155,11 @@ const PRESET_GROUPS: PresetGroup[] = [
         label: 'Claude Sonnet 4.5',
         expr: 'len <= 200000 ? tier("standard", p * 3 + c * 15 + cr * 0.3 + cc * 3.75 + cc1h * 6) : tier("long_context", p * 6 + c * 22.5 + cr * 0.6 + cc * 7.5 + cc1h * 12)',
       },
+      {
+        key: 'gemini-2.5-pro',
+        label: 'Gemini 2.5 Pro',
+        expr: 'len <= 200000 ? tier("standard", p * 1.25 + c * 10 + cr * 0.125) : tier("long_context", p * 2.5 + c * 15 + cr * 0.25)',
+      },
       {
         key: 'qwen3-max',
         label: 'Qwen3 Max',